@@ -27,20 +27,140 @@ func main() {
 		os.Exit(1)
 	}
 
-	flag.StringVar(&cfg.StratumPort, "stratum", cfg.StratumPort, "stratum port to listen on, default `:5555`")
+	flag.StringVar(&cfg.StratumPort, "stratum", cfg.StratumPort, "stratum port to listen on, unix:///path for a unix socket, default `:5555`")
 	flag.BoolVar(&cfg.PrintStats, "stats", cfg.PrintStats, "true to show periodic stats to console, default `true`")
 	flag.StringVar(&cfg.RPCServer, "pyrin", cfg.RPCServer, "address of the pyrin node, default `localhost:13110`")
+	flag.StringVar(&cfg.StatsRPCServer, "statsnode", cfg.StatsRPCServer, `optional separate node network stats are queried from, default ""`)
+	flag.StringVar(&cfg.NodeAuthToken, "nodeauthtoken", cfg.NodeAuthToken, `bearer token sent to the pyrin node(s), e.g. for an authenticating proxy in front of them, default ""`)
+	flag.BoolVar(&cfg.NodeTLS, "nodetls", cfg.NodeTLS, "connect to the pyrin node(s) over TLS, default `false`")
+	flag.StringVar(&cfg.NodeTLSCAFile, "nodetlsca", cfg.NodeTLSCAFile, `CA bundle the pyrin node certificates are verified against, default "" (system roots)`)
+	flag.StringVar(&cfg.NodeTLSCertFile, "nodetlscert", cfg.NodeTLSCertFile, `client certificate for pyrin nodes requiring mutual TLS, default ""`)
+	flag.StringVar(&cfg.NodeTLSKeyFile, "nodetlskey", cfg.NodeTLSKeyFile, `key for -nodetlscert, default ""`)
+	flag.StringVar(&cfg.NodeTLSServerName, "nodetlsservername", cfg.NodeTLSServerName, `name the pyrin node certificates are verified for, default "" (the node address' host)`)
+	flag.BoolVar(&cfg.NodeTLSInsecure, "nodetlsinsecure", cfg.NodeTLSInsecure, "skip verifying the pyrin node certificates, default `false`")
+	flag.StringVar(&cfg.Network, "network", cfg.Network, `network the pyrin node(s) must be on, e.g. "pyrin-mainnet", default "" (not checked)`)
+	flag.StringVar(&cfg.NetworkMismatch, "networkmismatch", cfg.NetworkMismatch, `what to do if a node is on another network, "strict" (refuse to start) or "warn", default "strict"`)
 	flag.DurationVar(&cfg.BlockWaitTime, "blockwait", cfg.BlockWaitTime, "time in ms to wait before manually requesting new block, default `500`")
 	flag.UintVar(&cfg.MinShareDiff, "mindiff", cfg.MinShareDiff, "minimum share difficulty to accept from miner(s), default `4`")
+	flag.UintVar(&cfg.MaxShareDiff, "maxdiff", cfg.MaxShareDiff, "maximum difficulty vardiff will raise miner(s) to, 0 for no limit, default `0`")
+	flag.UintVar(&cfg.DiffHardCap, "diffcap", cfg.DiffHardCap, "hard difficulty cap vardiff never exceeds regardless of -maxdiff, 0 for none, default `0`")
+	flag.Float64Var(&cfg.MinDiffFraction, "mindifffraction", cfg.MinDiffFraction, "minimum (and starting) share difficulty as a fraction of the network difficulty, replacing -mindiff once it's known, 0 for absolute, default `0`")
+	flag.Float64Var(&cfg.MaxDiffFraction, "maxdifffraction", cfg.MaxDiffFraction, "maximum vardiff difficulty as a fraction of the network difficulty, replacing -maxdiff once it's known, 0 for absolute, default `0`")
+	flag.BoolVar(&cfg.BlockWaitAuto, "blockwaitauto", cfg.BlockWaitAuto, "tune -blockwait to the node's notification cadence, between -blockwaitmin and -blockwaitmax, default `false`")
+	flag.DurationVar(&cfg.BlockWaitMin, "blockwaitmin", cfg.BlockWaitMin, "with -blockwaitauto, the shortest fallback wait, default -blockwait")
+	flag.DurationVar(&cfg.BlockWaitMax, "blockwaitmax", cfg.BlockWaitMax, "with -blockwaitauto, the longest fallback wait, default `5s`")
+	flag.BoolVar(&cfg.DisablePolling, "nopoll", cfg.DisablePolling, "if true only fetches templates on notifications from pyrin, never after -blockwait, default `false`")
+	flag.BoolVar(&cfg.DisableHandshakeJob, "nohandshakejob", cfg.DisableHandshakeJob, "if true miners get their first job with the next new block rather than right after subscribing and authorizing, default `false`")
+	flag.BoolVar(&cfg.Vardiff, "vardiff", cfg.Vardiff, "if true adjusts each miner's difficulty to hit -sharespermin, default `false`")
+	flag.Float64Var(&cfg.SharesPerMin, "sharespermin", cfg.SharesPerMin, "shares per minute vardiff targets per miner, default `15`")
+	flag.StringVar(&cfg.VardiffMode, "vardiffmode", cfg.VardiffMode, `vardiff controller, "variance" (target -vardiffcv) or "pid", default "" (simple retargeting)`)
+	flag.DurationVar(&cfg.VardiffMinInterval, "vardiffinterval", cfg.VardiffMinInterval, "minimum time between vardiff difficulty changes per miner, 0 for none, default `0`")
+	flag.Float64Var(&cfg.VardiffMinChange, "vardiffminchange", cfg.VardiffMinChange, "vardiff changes smaller than this fraction of the current difficulty aren't sent, default `0`")
+	flag.Float64Var(&cfg.VardiffTargetCV, "vardiffcv", cfg.VardiffTargetCV, "with -vardiffmode=variance, target coefficient of variation of shares per 5m window, default `0`")
 	flag.UintVar(&cfg.ExtranonceSize, "extranonce", cfg.ExtranonceSize, "size in bytes of extranonce, default `0`")
+	flag.UintVar(&cfg.Extranonce2Size, "extranonce2", cfg.Extranonce2Size, "size in bytes of the miner controlled extranonce2, sent with the extranonce, 0 for the rest of the nonce (not sent), default `0`")
+	flag.BoolVar(&cfg.UniqueExtranonce, "uniqueextranonce", cfg.UniqueExtranonce, "never give two connected clients the same extranonce (nonce range), requires extranonce, default `false`")
+	flag.DurationVar(&cfg.ExtranonceReuse, "extranoncereuse", cfg.ExtranonceReuse, "how long an extranonce released by a disconnected client is held back before it's leased again, with uniqueextranonce, default `1m`")
 	flag.StringVar(&cfg.PromPort, "prom", cfg.PromPort, "address to serve prom stats, default `:2112`")
+	flag.Int64Var(&cfg.WorkerMetricShares, "workermetricshares", cfg.WorkerMetricShares, "only publish per worker metrics for workers with this many accepted shares, default `0` (every worker)")
+	flag.DurationVar(&cfg.WorkerMetricTTL, "workermetricttl", cfg.WorkerMetricTTL, "drop per worker metrics of workers gone for this long, default `0` (never)")
+	flag.DurationVar(&cfg.HashrateWindow, "hashratewindow", cfg.HashrateWindow, "how long accepted shares are averaged over for each worker's estimated hashrate, default `5m`")
 	flag.BoolVar(&cfg.UseLogFile, "log", cfg.UseLogFile, "if true will output errors to log file, default `true`")
-	flag.StringVar(&cfg.HealthCheckPort, "hcp", cfg.HealthCheckPort, `(rarely used) if defined will expose a health check on /readyz, default ""`)
+	flag.IntVar(&cfg.LogMaxSize, "logmaxsize", cfg.LogMaxSize, "rotate the log file once it reaches this many megabytes, 0 to not rotate by size, default `0`")
+	flag.IntVar(&cfg.LogMaxBackups, "logbackups", cfg.LogMaxBackups, "number of rotated log files to keep, 0 keeps all, default `0`")
+	flag.DurationVar(&cfg.LogRotateInterval, "logrotate", cfg.LogRotateInterval, "rotate the log file this often, 0 to not rotate by time, default `0`")
+	flag.BoolVar(&cfg.LogCompress, "logcompress", cfg.LogCompress, "gzip rotated log files, default `false`")
+	flag.StringVar(&cfg.LogLevel, "loglevel", cfg.LogLevel, `log level, "debug", "info", "warn" or "error", default "info"`)
+	flag.StringVar(&cfg.LogFileLevel, "logfilelevel", cfg.LogFileLevel, `log level for the log file only, default "" (-loglevel)`)
+	flag.StringVar(&cfg.LogStdoutLevel, "logstdoutlevel", cfg.LogStdoutLevel, `log level for stdout only, default "" (-loglevel)`)
+	flag.DurationVar(&cfg.MaxTemplateAge, "maxtemplateage", cfg.MaxTemplateAge, "max age of a block template before it's considered stale and refetched, 0 to disable, default `0`")
+	flag.BoolVar(&cfg.CoinbaseWorkerName, "coinbaseworker", cfg.CoinbaseWorkerName, "tag the coinbase of each miner's templates with its worker name, so found blocks can be told apart on chain, default `false`")
+	flag.DurationVar(&cfg.DuplicateRefresh, "duprefresh", cfg.DuplicateRefresh, "skip pushing a template identical to the previous one unless it's been this long, 0 pushes every template, default `0`")
+	flag.Float64Var(&cfg.MaxJobsPerSecond, "maxjobrate", cfg.MaxJobsPerSecond, "max jobs pushed to a single miner per second, faster updates are coalesced into the latest one, 0 for no limit, default `0`")
+	flag.DurationVar(&cfg.JobKeepalive, "jobkeepalive", cfg.JobKeepalive, "resend the current job to miners not sent one for this long, 0 to disable, default `0`")
+	flag.DurationVar(&cfg.RPCTimeout, "rpctimeout", cfg.RPCTimeout, "max time to wait for a response from the pyrin node, default `10s`")
+	flag.IntVar(&cfg.QuarantineAfter, "quarantineafter", cfg.QuarantineAfter, "quarantine a pyrin node from templates after other nodes rejected this many blocks in a row built on its templates, -1 to disable, default `3`")
+	flag.DurationVar(&cfg.QuarantineCooldown, "quarantine", cfg.QuarantineCooldown, "how long a quarantined pyrin node isn't used for templates, default `10m`")
+	flag.DurationVar(&cfg.NodeStabilizeWindow, "nodestabilize", cfg.NodeStabilizeWindow, "keep a reconnected pyrin node out of template rotation for this long, and until it has reported synced and its block count advanced, 0 to disable, default `0`")
+	flag.Float64Var(&cfg.NodeErrorRate, "nodeerrorrate", cfg.NodeErrorRate, "fail over from a pyrin node failing more than this share of its rpc calls over -nodeerrorwindow, 1 to disable, default `0.5`")
+	flag.DurationVar(&cfg.NodeErrorWindow, "nodeerrorwindow", cfg.NodeErrorWindow, "window a pyrin node's rpc error rate is measured over, default `1m`")
+	flag.BoolVar(&cfg.ShareTemplates, "sharetemplates", cfg.ShareTemplates, "fetch one template per new block for all miners mining to the same address instead of one per miner, default `false`")
+	flag.BoolVar(&cfg.SkipUnchangedTips, "skipunchangedtips", cfg.SkipUnchangedTips, "skip block template notifications for the same tips as the last one, -blockwait still refreshes, default `false`")
+	flag.BoolVar(&cfg.PauseWhenIdle, "pausewhenidle", cfg.PauseWhenIdle, "pause template refreshes while no miners are connected, resuming on the first connect, default `false`")
+	flag.StringVar(&cfg.InstabilityPolicy, "instabilitypolicy", cfg.InstabilityPolicy, `what to do while difficulty swings or block count regressions make the network look unstable, "pause" serving templates or "widen" the stale window, default "" (only report it)`)
+	flag.Float64Var(&cfg.InstabilitySwing, "instabilityswing", cfg.InstabilitySwing, "difficulty change between stats refreshes (as a fraction) that counts as unstable, default `0.5`")
+	flag.DurationVar(&cfg.InstabilityHold, "instabilityhold", cfg.InstabilityHold, "how long the network is held unstable after the last swing or regression, default `5m`")
+	flag.DurationVar(&cfg.NodeRefreshInterval, "noderefresh", cfg.NodeRefreshInterval, "replace the connection to each pyrin node with a fresh one this often, 0 to disable, default `0`")
+	flag.StringVar(&cfg.DesyncPolicy, "desyncpolicy", cfg.DesyncPolicy, `what to do with shares for a job from a node that lost sync, "failover", "reject" or "buffer", default "failover" with several nodes, otherwise "reject"`)
+	flag.DurationVar(&cfg.DesyncBuffer, "desyncbuffer", cfg.DesyncBuffer, "with desync policy buffer, how long a block candidate is held waiting for a node to sync, default `10s`")
+	flag.DurationVar(&cfg.NodeIdleTimeout, "nodeidle", cfg.NodeIdleTimeout, "fail over from a pyrin node whose block count hasn't advanced for this long, 0 to disable, default `0`")
+	flag.IntVar(&cfg.ConnectRetries, "connectretries", cfg.ConnectRetries, "times to retry connecting at startup while no pyrin node is reachable, -1 to disable, default `5`")
+	flag.DurationVar(&cfg.ConnectBackoff, "connectbackoff", cfg.ConnectBackoff, "wait before the first startup connect retry, doubling up to 30s, default `2s`")
+	flag.DurationVar(&cfg.ReconnectBackoff, "reconnectbackoff", cfg.ReconnectBackoff, "wait before retrying to reconnect a node that went down, growing by -reconnectmultiplier after each failed attempt, default `1s`")
+	flag.DurationVar(&cfg.ReconnectMaxBackoff, "reconnectmaxbackoff", cfg.ReconnectMaxBackoff, "longest wait between attempts to reconnect a node, default `1m`")
+	flag.Float64Var(&cfg.ReconnectMultiplier, "reconnectmultiplier", cfg.ReconnectMultiplier, "factor the wait between attempts to reconnect a node grows by, default `2`")
+	flag.IntVar(&cfg.TemplateRetries, "templateretries", cfg.TemplateRetries, "times to ask a just (re)connected pyrin node for a template again while it reports not being synced, -1 to disable, default `3`")
+	flag.DurationVar(&cfg.TemplateRetryDelay, "templateretrydelay", cfg.TemplateRetryDelay, "wait between -templateretries, default `500ms`")
+	flag.DurationVar(&cfg.SyncCheckInterval, "synccheck", cfg.SyncCheckInterval, "how often every node is asked whether it's synced, unsynced nodes aren't used for templates, default `10s`")
+	flag.IntVar(&cfg.MinNodePeers, "minpeers", cfg.MinNodePeers, "treat a pyrin node connected to fewer peers than this as isolated and fail over from it, -1 to disable, default `1`")
+	flag.DurationVar(&cfg.WarmupTimeout, "warmup", cfg.WarmupTimeout, "max time to wait for an initial block template before accepting miners, default `30s`")
+	flag.UintVar(&cfg.MaxSubmits, "maxsubmits", cfg.MaxSubmits, "max number of concurrent block submits to the pyrin node, default `4`")
+	flag.IntVar(&cfg.ValidationWorkers, "validationworkers", cfg.ValidationWorkers, "number of workers hashing shares, -1 to hash on each connection, default GOMAXPROCS")
+	flag.DurationVar(&cfg.JobGrace, "jobgrace", cfg.JobGrace, "how long the previous job is still accepted after a new job is pushed, 0 accepts any retained job, default `0`")
+	flag.StringVar(&cfg.ShareLogFile, "sharelog", cfg.ShareLogFile, `if defined every accepted/rejected share is appended to this file as json lines, default ""`)
+	flag.StringVar(&cfg.ShareNatsURL, "sharenats", cfg.ShareNatsURL, `if defined every accepted/rejected share is published as json to this nats server, e.g. nats://localhost:4222, default ""`)
+	flag.StringVar(&cfg.TraceEndpoint, "otlp", cfg.TraceEndpoint, `if defined share and template lifecycle traces are exported to this OpenTelemetry collector over OTLP/HTTP, e.g. http://localhost:4318, default ""`)
+	flag.Float64Var(&cfg.TraceSampleRate, "otlpsample", cfg.TraceSampleRate, "fraction of shares and template broadcasts traced with -otlp, default `1`")
+	flag.StringVar(&cfg.ShareNatsSubject, "sharesubject", cfg.ShareNatsSubject, "nats subject shares are published to, default `pyrin.shares`")
+	flag.DurationVar(&cfg.MinShareInterval, "minshareinterval", cfg.MinShareInterval, "throttle workers submitting shares more often than this on average, 0 to disable, default `0`")
+	flag.Float64Var(&cfg.InvalidShareRatio, "invalidratio", cfg.InvalidShareRatio, "disconnect workers whose invalid share ratio over -invalidwindow exceeds this, 1 to disable, default `0.9`")
+	flag.DurationVar(&cfg.InvalidShareWindow, "invalidwindow", cfg.InvalidShareWindow, "window the invalid share ratio is measured over, default `10m`")
+	flag.Float64Var(&cfg.StaleShareTolerance, "staletolerance", cfg.StaleShareTolerance, "log a tuning hint when more than this fraction of shares over 5m are stale, 0 to disable, default `0`")
+	flag.IntVar(&cfg.StuckJobLag, "stucklag", cfg.StuckJobLag, "flag workers whose shares are consistently this many jobs behind, -1 to disable, default `8`")
+	flag.IntVar(&cfg.StuckJobDisconnect, "stuckdisconnect", cfg.StuckJobDisconnect, "disconnect workers after this many consecutive shares -stucklag jobs behind, 0 to never disconnect, default `0`")
+	flag.DurationVar(&cfg.DiffMemoryTTL, "diffmemory", cfg.DiffMemoryTTL, "how long a disconnected worker's difficulty is remembered and restored on reconnect, 0 to disable, default `0`")
+	flag.StringVar(&cfg.HandshakeOrder, "handshakeorder", cfg.HandshakeOrder, `enforce handshake order, "subscribe_first" or "authorize_first", default "" (either order)`)
+	flag.StringVar(&cfg.SubscribeFormat, "subscribeformat", cfg.SubscribeFormat, `mining.subscribe response format, "nicehash" for [["mining.notify", session id, "EthereumStratum/1.0.0"], extranonce1], default "" ([true, "EthereumStratum/1.0.0"])`)
+	flag.BoolVar(&cfg.UppercaseHex, "uppercasehex", cfg.UppercaseHex, "send the extranonce and session id as upper case hex, default `false`")
+	flag.BoolVar(&cfg.NetworkDiffNotice, "networkdiffmessage", cfg.NetworkDiffNotice, "tell miners the network difficulty in a client.show_message when it changes, default `false`")
+	flag.StringVar(&cfg.UnknownMethodPolicy, "unknownmethods", cfg.UnknownMethodPolicy, `how to answer unknown stratum methods, "ignore" or "disconnect", default "" (reply with an error)`)
+	flag.IntVar(&cfg.UnknownMethodLimit, "unknownlimit", cfg.UnknownMethodLimit, "with -unknownmethods=disconnect, number of unknown methods before disconnecting, default `10`")
+	flag.StringVar(&cfg.LostRacePolicy, "lostracepolicy", cfg.LostRacePolicy, `how shares whose block reached the node too late are answered, "credit" or "stale", default "credit"`)
+	flag.StringVar(&cfg.JobIds, "jobids", cfg.JobIds, `ids jobs are sent to miners under, "sequential" per connection or "deterministic" (derived from the template), default "sequential"`)
+	flag.StringVar(&cfg.UnknownJobPolicy, "unknownjobs", cfg.UnknownJobPolicy, `how to answer submits for a job the client was never sent, "reject" or "disconnect", default "reject"`)
+	flag.BoolVar(&cfg.AcceptAnyAddress, "acceptanyaddress", cfg.AcceptAnyAddress, "accept miner addresses the bridge can't validate, only stripped to letters, digits and ':', see the README for the risks, default `false`")
+	flag.BoolVar(&cfg.StrictSubmit, "strictsubmit", cfg.StrictSubmit, "reject submits whose nonce isn't exactly the negotiated extranonce2 (or a full nonce with the client's extranonce) or with extra params, default `false`")
+	flag.DurationVar(&cfg.FlapWindow, "flapwindow", cfg.FlapWindow, "window reconnects are counted per worker over, default `10m`")
+	flag.IntVar(&cfg.FlapLimit, "flaplimit", cfg.FlapLimit, "turn away workers reconnecting more often than this within -flapwindow for -flapbackoff, 0 to disable, default `0`")
+	flag.DurationVar(&cfg.FlapBackoff, "flapbackoff", cfg.FlapBackoff, "how long a worker over -flaplimit is turned away, default `5m`")
+	flag.IntVar(&cfg.MaxTrackedWorkers, "maxtrackedworkers", cfg.MaxTrackedWorkers, "most workers kept in the share stats, difficulty memory and reconnect tracking each, least recently seen evicted first, 0 for the built in limits, default `0`")
+	flag.IntVar(&cfg.MaxWalletConnections, "walletlimit", cfg.MaxWalletConnections, "max connections per wallet address, -1 for no limit, default `1000`")
+	flag.IntVar(&cfg.ShareLogSample, "logshares", cfg.ShareLogSample, "log every Nth accepted share at info level, 0 logs none, default `0`")
+	flag.IntVar(&cfg.AcceptBacklog, "acceptbacklog", cfg.AcceptBacklog, "listen backlog of the stratum ports, connections the OS queues before they're accepted, 0 for the OS maximum, default `0`")
+	flag.IntVar(&cfg.AcceptWorkers, "acceptworkers", cfg.AcceptWorkers, "number of workers setting up accepted connections off the accept loop, 0 sets them up in the accept loop, default `0`")
+	flag.IntVar(&cfg.AcceptQueue, "acceptqueue", cfg.AcceptQueue, "with -acceptworkers, accepted connections waiting for a worker before new ones are dropped, default `128`")
+	flag.IntVar(&cfg.MaxMessageSize, "maxmessage", cfg.MaxMessageSize, "max size in bytes of a stratum message, clients sending larger ones are disconnected, default `16384`")
+	flag.DurationVar(&cfg.LatencyProbe, "latencyprobe", cfg.LatencyProbe, "ping every miner this often to measure its round trip time, 0 to disable, default `0`")
+	flag.DurationVar(&cfg.WriteTimeout, "writetimeout", cfg.WriteTimeout, "how long a write to a client may block before it's disconnected, default `5s`")
+	flag.BoolVar(&cfg.KeepMappedIPv4, "keepmappedipv4", cfg.KeepMappedIPv4, "keep the IPv4-mapped IPv6 address (::ffff:1.2.3.4) of IPv4 clients on a dual stack listener instead of the plain IPv4 address, default `false`")
+	flag.StringVar(&cfg.TLSPort, "stratumtls", cfg.TLSPort, `if defined will also serve stratum over tls on this port, requires tls_cert_file/tls_key_file, default ""`)
+	flag.DurationVar(&cfg.ShutdownDrain, "drain", cfg.ShutdownDrain, "on SIGTERM/interrupt stop accepting connections and keep serving connected miners this long before exiting, 0 exits right away, default `0`")
+	flag.DurationVar(&cfg.MaintenanceDrain, "maintenancedrain", cfg.MaintenanceDrain, "in maintenance mode disconnect the connected miners evenly over this long, default `5m`")
+	flag.StringVar(&cfg.MaintenanceMessage, "maintenancemsg", cfg.MaintenanceMessage, `message miners are shown in maintenance mode, default "pool in maintenance, switch to a backup pool"`)
+	flag.BoolVar(&cfg.WorkerNameLowercase, "workerlower", cfg.WorkerNameLowercase, "lower case worker names, default `false`")
+	flag.BoolVar(&cfg.WorkerNameTrim, "workertrim", cfg.WorkerNameTrim, "trim whitespace around worker names, default `false`")
+	flag.StringVar(&cfg.WorkerNameSeparators, "workerseps", cfg.WorkerNameSeparators, `characters in worker names replaced with -workersep (e.g. "_-"), default ""`)
+	flag.StringVar(&cfg.WorkerNameReplace, "workersep", cfg.WorkerNameReplace, `what -workerseps characters are replaced with, default "" (removed)`)
+	flag.StringVar(&cfg.AdminPort, "admin", cfg.AdminPort, `if defined will expose admin actions (node draining, maintenance mode) on /admin, default ""`)
+	flag.StringVar(&cfg.HealthCheckPort, "hcp", cfg.HealthCheckPort, `(rarely used) if defined will expose health checks on /healthz and /readyz, default ""`)
 	flag.Parse()
 
 	if cfg.MinShareDiff == 0 {
 		cfg.MinShareDiff = 4
 	}
+	if cfg.MaxSubmits == 0 {
+		cfg.MaxSubmits = 4
+	}
 	if cfg.BlockWaitTime == 0 {
 		cfg.BlockWaitTime = 5 * time.Second // this should never happen due to pyi 1s block times
 	}
@@ -48,13 +168,89 @@ func main() {
 	log.Println("----------------------------------")
 	log.Printf("initializing bridge")
 	log.Printf("\tpyrin:          %s", cfg.RPCServer)
+	log.Printf("\tpyrin extra:     %s", cfg.RPCServers)
+	log.Printf("\tstats node:      %s", cfg.StatsRPCServer)
+	log.Printf("\tsubmit nodes:    %s", cfg.SubmitRPCServers)
+	log.Printf("\tnode rpc:        tls %t, auth token %t, %d headers", cfg.NodeTLS, cfg.NodeAuthToken != "", len(cfg.NodeHeaders))
+	log.Printf("\tnetwork:         %s (mismatch %s)", cfg.Network, cfg.NetworkMismatch)
+	log.Printf("\tpayouts:         %s", cfg.PayoutAddresses)
+	log.Printf("\tcoinbase worker: %t", cfg.CoinbaseWorkerName)
+	log.Printf("\twallet access:   %d allowed, %d denied", len(cfg.AllowedWallets), len(cfg.DeniedWallets))
 	log.Printf("\tstratum:         %s", cfg.StratumPort)
+	log.Printf("\tstratum tls:     %s", cfg.TLSPort)
 	log.Printf("\tprom:            %s", cfg.PromPort)
+	log.Printf("\tworker metrics:  min shares %d (ttl %s)", cfg.WorkerMetricShares, cfg.WorkerMetricTTL)
+	log.Printf("\thashrate window: %s", cfg.HashrateWindow)
 	log.Printf("\tstats:           %t", cfg.PrintStats)
 	log.Printf("\tlog:             %t", cfg.UseLogFile)
+	log.Printf("\tlog level:       %s (file %q, stdout %q)", cfg.LogLevel, cfg.LogFileLevel, cfg.LogStdoutLevel)
+	log.Printf("\tlog rotation:    %dMB / %s, %d backups (compress %t)", cfg.LogMaxSize, cfg.LogRotateInterval, cfg.LogMaxBackups, cfg.LogCompress)
 	log.Printf("\tmin diff:        %d", cfg.MinShareDiff)
-	log.Printf("\tblock wait:      %s", cfg.BlockWaitTime)
+	log.Printf("\tmax diff:        %d (hard cap %d)", cfg.MaxShareDiff, cfg.DiffHardCap)
+	log.Printf("\tnetwork diff:    min %g max %g", cfg.MinDiffFraction, cfg.MaxDiffFraction)
+	log.Printf("\tvardiff:         %t (mode %q, %.1f shares/min, cv %.2f)", cfg.Vardiff, cfg.VardiffMode, cfg.SharesPerMin, cfg.VardiffTargetCV)
+	log.Printf("\tdiff coalesce:   %s, min change %.2f", cfg.VardiffMinInterval, cfg.VardiffMinChange)
+	log.Printf("\tblock wait:      %s (auto %t, %s-%s)", cfg.BlockWaitTime, cfg.BlockWaitAuto, cfg.BlockWaitMin, cfg.BlockWaitMax)
+	log.Printf("\tno polling:      %t", cfg.DisablePolling)
+	log.Printf("\thandshake job:   %t", !cfg.DisableHandshakeJob)
 	log.Printf("\textranonce size: %d", cfg.ExtranonceSize)
+	log.Printf("\textranonce2:     %d", cfg.Extranonce2Size)
+	log.Printf("\tunique nonces:   %t", cfg.UniqueExtranonce)
+	log.Printf("\tnonce reuse:     %s", cfg.ExtranonceReuse)
+	log.Printf("\tmax tmpl age:    %s", cfg.MaxTemplateAge)
+	log.Printf("\tdup refresh:     %s", cfg.DuplicateRefresh)
+	log.Printf("\tmax job rate:    %.2f/s", cfg.MaxJobsPerSecond)
+	log.Printf("\tjob keepalive:   %s", cfg.JobKeepalive)
+	log.Printf("\trpc timeout:     %s", cfg.RPCTimeout)
+	log.Printf("\tnode idle:       %s", cfg.NodeIdleTimeout)
+	log.Printf("\tconnect retries: %d (backoff %s)", cfg.ConnectRetries, cfg.ConnectBackoff)
+	log.Printf("\treconnect:       %s up to %s (x%g)", cfg.ReconnectBackoff, cfg.ReconnectMaxBackoff, cfg.ReconnectMultiplier)
+	log.Printf("\tunsynced retry:  %d (delay %s)", cfg.TemplateRetries, cfg.TemplateRetryDelay)
+	log.Printf("\tsync check:      %s", cfg.SyncCheckInterval)
+	log.Printf("\tmin node peers:  %d", cfg.MinNodePeers)
+	log.Printf("\tquarantine:      after %d (cooldown %s)", cfg.QuarantineAfter, cfg.QuarantineCooldown)
+	log.Printf("\tnode stabilize:  %s", cfg.NodeStabilizeWindow)
+	log.Printf("\tnode refresh:    %s", cfg.NodeRefreshInterval)
+	log.Printf("\tnode errors:     %.2f over %s", cfg.NodeErrorRate, cfg.NodeErrorWindow)
+	log.Printf("\tshare templates: %t", cfg.ShareTemplates)
+	log.Printf("\tskip same tips:  %t", cfg.SkipUnchangedTips)
+	log.Printf("\tpause when idle: %t", cfg.PauseWhenIdle)
+	log.Printf("\tinstability:     '%s' (swing %.2f, hold %s)", cfg.InstabilityPolicy, cfg.InstabilitySwing, cfg.InstabilityHold)
+	log.Printf("\tdesync policy:   %s (buffer %s)", cfg.DesyncPolicy, cfg.DesyncBuffer)
+	log.Printf("\twarmup timeout:  %s", cfg.WarmupTimeout)
+	log.Printf("\tmax submits:     %d", cfg.MaxSubmits)
+	log.Printf("\tvalidators:      %d", cfg.ValidationWorkers)
+	log.Printf("\tjob grace:       %s", cfg.JobGrace)
+	log.Printf("\tshare log:       %s", cfg.ShareLogFile)
+	log.Printf("\tshare nats:      %s %s", cfg.ShareNatsURL, cfg.ShareNatsSubject)
+	log.Printf("\totlp traces:     %s (sample %g)", cfg.TraceEndpoint, cfg.TraceSampleRate)
+	log.Printf("\tmin share ivl:   %s", cfg.MinShareInterval)
+	log.Printf("\tinvalid shares:  %.2f over %s", cfg.InvalidShareRatio, cfg.InvalidShareWindow)
+	log.Printf("\tstale tolerance: %.2f", cfg.StaleShareTolerance)
+	log.Printf("\tstuck jobs:      lag %d (disconnect after %d)", cfg.StuckJobLag, cfg.StuckJobDisconnect)
+	log.Printf("\tdiff memory:     %s", cfg.DiffMemoryTTL)
+	log.Printf("\thandshake order: %s", cfg.HandshakeOrder)
+	log.Printf("\tsubscribe fmt:   %s (upper hex %t)", cfg.SubscribeFormat, cfg.UppercaseHex)
+	log.Printf("\tnet diff notice: %t", cfg.NetworkDiffNotice)
+	log.Printf("\tunknown methods: %s (limit %d)", cfg.UnknownMethodPolicy, cfg.UnknownMethodLimit)
+	log.Printf("\tunknown jobs:    %s", cfg.UnknownJobPolicy)
+	log.Printf("\tjob ids:         %s", cfg.JobIds)
+	log.Printf("\tlost races:      %s", cfg.LostRacePolicy)
+	log.Printf("\tstrict submit:   %t", cfg.StrictSubmit)
+	log.Printf("\tany address:     %t", cfg.AcceptAnyAddress)
+	log.Printf("\tmax message:     %d", cfg.MaxMessageSize)
+	log.Printf("\twrite timeout:   %s", cfg.WriteTimeout)
+	log.Printf("\tlatency probe:   %s", cfg.LatencyProbe)
+	log.Printf("\tkeep mapped ip:  %t", cfg.KeepMappedIPv4)
+	log.Printf("\taccept backlog:  %d (workers %d, queue %d)", cfg.AcceptBacklog, cfg.AcceptWorkers, cfg.AcceptQueue)
+	log.Printf("\twallet limit:    %d", cfg.MaxWalletConnections)
+	log.Printf("\tflap limit:      %d per %s (backoff %s)", cfg.FlapLimit, cfg.FlapWindow, cfg.FlapBackoff)
+	log.Printf("\ttracked workers: %d", cfg.MaxTrackedWorkers)
+	log.Printf("\tlog shares:      every %d", cfg.ShareLogSample)
+	log.Printf("\tshutdown drain:  %s", cfg.ShutdownDrain)
+	log.Printf("\tmaintenance:     drain %s, %q", cfg.MaintenanceDrain, cfg.MaintenanceMessage)
+	log.Printf("\tworker names:    lower %t, trim %t, %q -> %q", cfg.WorkerNameLowercase, cfg.WorkerNameTrim, cfg.WorkerNameSeparators, cfg.WorkerNameReplace)
+	log.Printf("\tadmin:           %s", cfg.AdminPort)
 	log.Printf("\thealth check:    %s", cfg.HealthCheckPort)
 	log.Println("----------------------------------")
 
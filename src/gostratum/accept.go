@@ -0,0 +1,90 @@
+package gostratum
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// DefaultAcceptQueue is how many accepted connections wait for an accept
+// worker when AcceptWorkers is set without AcceptQueue
+const DefaultAcceptQueue = 128
+
+// setBacklog applies the configured listen backlog to the socket. Go listens
+// with the OS maximum (net.core.somaxconn on linux), listening again on the
+// bound socket replaces it. A backlog above that maximum is capped by the OS,
+// raise the sysctl to go beyond it
+func setBacklog(server net.Listener, backlog int) error {
+	if backlog <= 0 {
+		return nil
+	}
+	conn, ok := server.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("listener %T has no socket to set the backlog on", server)
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var listenErr error
+	if err := raw.Control(func(fd uintptr) { listenErr = relisten(fd, backlog) }); err != nil {
+		return err
+	}
+	return listenErr
+}
+
+// acceptConnection hands an accepted connection to the accept workers,
+// dropping it if they're backed up a full queue rather than stalling the
+// accept loop (and with it every connection behind this one). Without accept
+// workers the connection is set up right on the accept loop
+func (s *StratumListener) acceptConnection(ctx context.Context, connection net.Conn) {
+	if s.acceptQueue == nil {
+		s.onAccept(true)
+		s.newClient(ctx, connection)
+		return
+	}
+	select {
+	case s.acceptQueue <- connection:
+		s.onAccept(true)
+	default:
+		s.Logger.Warn("accept queue full, dropping connection",
+			zap.String("remote", connection.RemoteAddr().String()), zap.Int("queue", cap(s.acceptQueue)))
+		s.onAccept(false)
+		connection.Close()
+	}
+}
+
+func (s *StratumListener) onAccept(accepted bool) {
+	if s.OnAccept != nil {
+		s.OnAccept(accepted)
+	}
+}
+
+// closeQueued closes the connections still waiting for a worker on shutdown
+func (s *StratumListener) closeQueued() {
+	for {
+		select {
+		case connection := <-s.acceptQueue:
+			connection.Close()
+		default:
+			return
+		}
+	}
+}
+
+// acceptWorker sets up queued connections until the listener stops
+func (s *StratumListener) acceptWorker(ctx context.Context) {
+	defer s.workerGroup.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			s.closeQueued()
+			return
+		case connection := <-s.acceptQueue:
+			s.newClient(ctx, connection)
+		}
+	}
+}
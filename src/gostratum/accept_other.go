@@ -0,0 +1,9 @@
+//go:build !windows
+
+package gostratum
+
+import "syscall"
+
+func relisten(fd uintptr, backlog int) error {
+	return syscall.Listen(int(fd), backlog)
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package gostratum
+
+import "fmt"
+
+// windows ignores listen on a socket that's already listening, the backlog
+// can't be changed after net.Listen
+func relisten(uintptr, int) error {
+	return fmt.Errorf("setting the listen backlog isn't supported on windows")
+}
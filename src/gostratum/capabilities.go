@@ -0,0 +1,56 @@
+package gostratum
+
+import "strings"
+
+// Capabilities are the protocol nuances detected for a connection during the
+// handshake. Keeping them per connection lets job and difficulty messages
+// follow what the miner's firmware expects instead of a bridge wide toggle.
+// Pyrin headers have no version bits, so there's no version rolling to
+// negotiate
+type Capabilities struct {
+	// Protocol is the stratum protocol the miner named in mining.subscribe,
+	// e.g. EthereumStratum/1.0.0
+	Protocol string `json:"protocol,omitempty"`
+	// ExtranonceSubscribe is set once the miner sent
+	// mining.extranonce.subscribe, it handles extranonce changes mid session
+	ExtranonceSubscribe bool `json:"extranonce_subscribe"`
+	// SuggestTarget is set once the miner sent mining.suggest_target, it
+	// thinks in targets. Difficulty is still sent with set_difficulty
+	SuggestTarget bool `json:"suggest_target"`
+	// BigJob is set for miners taking the job header as a single hex string
+	// rather than four uint64s, detected by the caller from the miner app
+	BigJob bool `json:"big_job"`
+}
+
+// String lists the detected capabilities, for logs and status pages
+func (c Capabilities) String() string {
+	var detected []string
+	if c.Protocol != "" {
+		detected = append(detected, c.Protocol)
+	}
+	if c.BigJob {
+		detected = append(detected, "big jobs")
+	}
+	if c.ExtranonceSubscribe {
+		detected = append(detected, "extranonce.subscribe")
+	}
+	if c.SuggestTarget {
+		detected = append(detected, "suggest_target")
+	}
+	return strings.Join(detected, ", ")
+}
+
+// Capabilities returns the protocol capabilities detected so far
+func (sc *StratumContext) Capabilities() Capabilities {
+	caps, _ := sc.capabilities.Load().(Capabilities)
+	return caps
+}
+
+// UpdateCapabilities records a detected capability. Capabilities are only
+// detected from the client's read loop, so updates never race each other,
+// only with whatever reads them to send the client work
+func (sc *StratumContext) UpdateCapabilities(update func(*Capabilities)) {
+	caps := sc.Capabilities()
+	update(&caps)
+	sc.capabilities.Store(caps)
+}
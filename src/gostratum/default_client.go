@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"sync/atomic"
 
 	"github.com/pyrin-network/pyipad/util"
 	"github.com/mattn/go-colorable"
@@ -18,8 +19,34 @@ const (
 	StratumMethodSubscribe StratumMethod = "mining.subscribe"
 	StratumMethodAuthorize StratumMethod = "mining.authorize"
 	StratumMethodSubmit    StratumMethod = "mining.submit"
+
+	// NiceHash/extension control methods, acknowledged so clients relying on
+	// them don't disconnect
+	StratumMethodExtranonceSubscribe StratumMethod = "mining.extranonce.subscribe"
+	StratumMethodSuggestDifficulty   StratumMethod = "mining.suggest_difficulty"
+	StratumMethodSuggestTarget       StratumMethod = "mining.suggest_target"
+	StratumMethodSetGoal             StratumMethod = "mining.set_goal"
+	StratumMethodConfigure           StratumMethod = "mining.configure"
+)
+
+// SubscribeFormat controls the shape of the mining.subscribe result. Miner
+// firmwares are picky about it, some only work with one of these
+type SubscribeFormat string
+
+const (
+	// SubscribeFormatDefault replies [true, "EthereumStratum/1.0.0"], the
+	// extranonce follows in a set_extranonce notification
+	SubscribeFormatDefault SubscribeFormat = ""
+	// SubscribeFormatNiceHash replies per the EthereumStratum/1.0.0 spec:
+	// [["mining.notify", <session id>, "EthereumStratum/1.0.0"], <extranonce1>].
+	// set_extranonce is still sent for miners that rely on it
+	SubscribeFormatNiceHash SubscribeFormat = "nicehash"
 )
 
+func (f SubscribeFormat) Valid() bool {
+	return f == SubscribeFormatDefault || f == SubscribeFormatNiceHash
+}
+
 func DefaultLogger() *zap.Logger {
 	cfg := zap.NewDevelopmentEncoderConfig()
 	cfg.EncodeLevel = zapcore.CapitalColorLevelEncoder
@@ -44,16 +71,89 @@ func DefaultHandlers() StratumHandlerMap {
 		string(StratumMethodSubscribe): HandleSubscribe,
 		string(StratumMethodAuthorize): HandleAuthorize,
 		string(StratumMethodSubmit):    HandleSubmit,
+
+		string(StratumMethodExtranonceSubscribe): HandleExtranonceSubscribe,
+		string(StratumMethodSuggestDifficulty):   HandleAck,
+		string(StratumMethodSuggestTarget):       HandleSuggestTarget,
+		string(StratumMethodSetGoal):             HandleAck,
+		string(StratumMethodConfigure):           HandleConfigure,
 	}
 }
 
-func HandleAuthorize(ctx *StratumContext, event JsonRpcEvent) error {
+// HandleAck replies `true` to the event without acting on it, used for
+// control methods that we accept but don't (or can't) honor
+func HandleAck(ctx *StratumContext, event JsonRpcEvent) error {
+	if err := ctx.Reply(NewResponse(event, true, nil)); err != nil {
+		return errors.Wrapf(err, "failed to send response to %s", event.Method)
+	}
+	return nil
+}
+
+// HandleExtranonceSubscribe acknowledges mining.extranonce.subscribe,
+// recording that the miner supports extranonce changes
+func HandleExtranonceSubscribe(ctx *StratumContext, event JsonRpcEvent) error {
+	ctx.UpdateCapabilities(func(c *Capabilities) { c.ExtranonceSubscribe = true })
+	return HandleAck(ctx, event)
+}
+
+// HandleSuggestTarget acknowledges mining.suggest_target without honoring
+// it, recording that the miner prefers targets
+func HandleSuggestTarget(ctx *StratumContext, event JsonRpcEvent) error {
+	ctx.UpdateCapabilities(func(c *Capabilities) { c.SuggestTarget = true })
+	return HandleAck(ctx, event)
+}
+
+// HandleConfigure answers mining.configure (BIP 310) declining every
+// extension the miner asked for. Pyrin jobs are the header's pre-pow hash,
+// the version is hashed into it, so there's nothing for version rolling (or
+// the other extensions) to roll. Miners that send it get an answer instead
+// of an unknown method error, and mine rolling only the nonce
+func HandleConfigure(ctx *StratumContext, event JsonRpcEvent) error {
+	result := map[string]any{}
+	if len(event.Params) > 0 {
+		if extensions, ok := event.Params[0].([]any); ok {
+			for _, extension := range extensions {
+				if name, ok := extension.(string); ok {
+					result[name] = false
+				}
+			}
+		}
+	}
+	if err := ctx.Reply(NewResponse(event, result, nil)); err != nil {
+		return errors.Wrapf(err, "failed to send response to %s", event.Method)
+	}
+	return nil
+}
+
+// authorize failures, see ReplyAuthorizeFailed for what the miner is told
+var (
+	ErrMalformedAuthorize = fmt.Errorf("malformed authorize")
+	ErrInvalidWallet      = fmt.Errorf("invalid wallet address")
+)
+
+// WalletCleaner turns the address a miner authorized with into the one it's
+// mined for, or rejects it. CleanWallet and SanitizeWallet are the two the
+// bridge uses
+type WalletCleaner func(string) (string, error)
+
+// ParseAuthorize returns the cleaned up wallet address and worker name of an
+// authorize event (`address.worker`)
+func ParseAuthorize(event JsonRpcEvent) (string, string, error) {
+	return ParseAuthorizeWith(event, CleanWallet)
+}
+
+// ParseAuthorizeWith is ParseAuthorize with the address cleaned up by clean,
+// nil for CleanWallet
+func ParseAuthorizeWith(event JsonRpcEvent, clean WalletCleaner) (string, string, error) {
+	if clean == nil {
+		clean = CleanWallet
+	}
 	if len(event.Params) < 1 {
-		return fmt.Errorf("malformed event from miner, expected param[1] to be address")
+		return "", "", fmt.Errorf("%w, expected param[1] to be address", ErrMalformedAuthorize)
 	}
 	address, ok := event.Params[0].(string)
 	if !ok {
-		return fmt.Errorf("malformed event from miner, expected param[1] to be address string")
+		return "", "", fmt.Errorf("%w, expected param[1] to be address string", ErrMalformedAuthorize)
 	}
 	parts := strings.Split(address, ".")
 	var workerName string
@@ -61,19 +161,85 @@ func HandleAuthorize(ctx *StratumContext, event JsonRpcEvent) error {
 		address = parts[0]
 		workerName = parts[1]
 	}
-	var err error
-	address, err = CleanWallet(address)
+	cleaned, err := clean(address)
+	if err != nil {
+		return "", "", fmt.Errorf("%w %s: %s", ErrInvalidWallet, address, err)
+	}
+	return cleaned, workerName, nil
+}
+
+// WorkerNameRules normalize the worker names miners authorize with, so the
+// same rig reported differently by different firmwares (`Rig1`, `rig_1`) ends
+// up under one name for metrics and per worker settings. The zero value
+// leaves names untouched
+type WorkerNameRules struct {
+	Lowercase bool
+	// trims surrounding whitespace
+	Trim bool
+	// every run of characters in Separators is replaced with Replacement,
+	// or removed if Replacement is empty. Leading and trailing ones are
+	// dropped
+	Separators  string
+	Replacement string
+}
+
+// Apply returns the normalized worker name. A name made up only of
+// separators is kept as is rather than normalized to nothing
+func (r WorkerNameRules) Apply(name string) string {
+	normalized := name
+	if r.Trim {
+		normalized = strings.TrimSpace(normalized)
+	}
+	if r.Lowercase {
+		normalized = strings.ToLower(normalized)
+	}
+	if r.Separators != "" {
+		normalized = strings.Join(strings.FieldsFunc(normalized, func(c rune) bool {
+			return strings.ContainsRune(r.Separators, c)
+		}), r.Replacement)
+	}
+	if normalized == "" {
+		return name
+	}
+	return normalized
+}
+
+func HandleAuthorize(ctx *StratumContext, event JsonRpcEvent) error {
+	return HandleAuthorizeWithRules(ctx, event, WorkerNameRules{})
+}
+
+// HandleAuthorizeWithRules authorizes the client under its worker name
+// normalized by rules. The name as sent is kept in RawWorkerName and logged
+// alongside when it differs
+func HandleAuthorizeWithRules(ctx *StratumContext, event JsonRpcEvent, rules WorkerNameRules) error {
+	return HandleAuthorizeWith(ctx, event, rules, CleanWallet)
+}
+
+// HandleAuthorizeWith is HandleAuthorizeWithRules with the address cleaned up
+// by clean, see ParseAuthorizeWith
+func HandleAuthorizeWith(ctx *StratumContext, event JsonRpcEvent, rules WorkerNameRules, clean WalletCleaner) error {
+	address, workerName, err := ParseAuthorizeWith(event, clean)
 	if err != nil {
-		return fmt.Errorf("invalid wallet format %s: %w", address, err)
+		ctx.Logger.Warn("rejecting authorize", zap.Error(err))
+		if replyErr := ctx.ReplyAuthorizeFailed(event.Id, err); replyErr != nil {
+			return replyErr
+		}
+		// returning an error ends the client's read loop which disconnects it
+		return err
 	}
 
 	ctx.WalletAddr = address
-	ctx.WorkerName = workerName
+	ctx.RawWorkerName = workerName
+	ctx.WorkerName = rules.Apply(workerName)
 	ctx.Logger = ctx.Logger.With(zap.String("worker", ctx.WorkerName), zap.String("addr", ctx.WalletAddr))
+	if ctx.RawWorkerName != ctx.WorkerName {
+		ctx.Logger = ctx.Logger.With(zap.String("raw_worker", ctx.RawWorkerName))
+	}
 
 	if err := ctx.Reply(NewResponse(event, true, nil)); err != nil {
 		return errors.Wrap(err, "failed to send response to authorize")
 	}
+	atomic.StoreInt32(&ctx.authorized, 1)
 	if ctx.Extranonce != "" {
 		SendExtranonce(ctx)
 	}
@@ -82,9 +248,57 @@ func HandleAuthorize(ctx *StratumContext, event JsonRpcEvent) error {
 	return nil
 }
 
+// PasswordOptions parses key=value options miners pass in the authorize
+// password (param[1]), e.g. `d=4096` or `x,d=4096;m=solo`. Keys are lower
+// cased, anything that isn't a key=value pair is ignored
+func PasswordOptions(event JsonRpcEvent) map[string]string {
+	options := map[string]string{}
+	if len(event.Params) < 2 {
+		return options
+	}
+	password, ok := event.Params[1].(string)
+	if !ok {
+		return options
+	}
+	for _, field := range strings.FieldsFunc(password, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' '
+	}) {
+		key, value, found := strings.Cut(field, "=")
+		if !found || key == "" {
+			continue
+		}
+		options[strings.ToLower(key)] = value
+	}
+	return options
+}
+
 func HandleSubscribe(ctx *StratumContext, event JsonRpcEvent) error {
-	if err := ctx.Reply(NewResponse(event,
-		[]any{true, "EthereumStratum/1.0.0"}, nil)); err != nil {
+	return handleSubscribe(ctx, event, SubscribeFormatDefault)
+}
+
+// NewSubscribeHandler returns a mining.subscribe handler replying in the
+// given format
+func NewSubscribeHandler(format SubscribeFormat) EventHandler {
+	return func(ctx *StratumContext, event JsonRpcEvent) error {
+		return handleSubscribe(ctx, event, format)
+	}
+}
+
+// SubscribeResult returns the mining.subscribe result sent to the client in
+// the given format
+func SubscribeResult(ctx *StratumContext, format SubscribeFormat) []any {
+	if format == SubscribeFormatNiceHash {
+		sessionId := ctx.SessionId
+		if sessionId == "" {
+			sessionId = fmt.Sprintf("%08x", ctx.Id)
+		}
+		return []any{[]any{"mining.notify", sessionId, "EthereumStratum/1.0.0"}, ctx.Extranonce}
+	}
+	return []any{true, "EthereumStratum/1.0.0"}
+}
+
+func handleSubscribe(ctx *StratumContext, event JsonRpcEvent, format SubscribeFormat) error {
+	if err := ctx.Reply(NewResponse(event, SubscribeResult(ctx, format), nil)); err != nil {
 		return errors.Wrap(err, "failed to send response to subscribe")
 	}
 	if len(event.Params) > 0 {
@@ -93,6 +307,17 @@ func HandleSubscribe(ctx *StratumContext, event JsonRpcEvent) error {
 			ctx.RemoteApp = app
 		}
 	}
+	if len(event.Params) > 1 {
+		if protocol, ok := event.Params[1].(string); ok {
+			ctx.UpdateCapabilities(func(c *Capabilities) { c.Protocol = protocol })
+		}
+	}
+	atomic.StoreInt32(&ctx.subscribed, 1)
+	if ctx.Authorized() && ctx.Extranonce != "" {
+		// authorized before subscribing, some miners drop the extranonce if
+		// it arrives before the subscribe response so send it again
+		SendExtranonce(ctx)
+	}
 
 	ctx.Logger.Info("client subscribed ", zap.Any("context", ctx))
 	return nil
@@ -105,7 +330,11 @@ func HandleSubmit(ctx *StratumContext, event JsonRpcEvent) error {
 }
 
 func SendExtranonce(ctx *StratumContext) {
-	if err := ctx.Send(NewEvent("", "set_extranonce", []any{ctx.Extranonce})); err != nil {
+	params := []any{ctx.Extranonce}
+	if ctx.Extranonce2Size > 0 {
+		params = append(params, ctx.Extranonce2Size)
+	}
+	if err := ctx.Send(NewEvent("", "set_extranonce", params)); err != nil {
 		// should we doing anything further on failure
 		ctx.Logger.Error(errors.Wrap(err, "failed to set extranonce").Error(), zap.Any("context", ctx))
 	}
@@ -130,14 +359,44 @@ func CleanWallet(in string) (string, error) {
 		return CleanWallet("pyrin:" + in)
 	}
 
-	// has pyrin: prefix but other weirdness somewhere
-	if walletRegex.MatchString(in) {
+	// has pyrin: prefix but other weirdness somewhere, anything shorter than
+	// an address can't be trimmed down to one
+	if walletRegex.MatchString(in) && len(in) >= 67 {
 		return in[0:67], nil
 	}
 
-	if testnetWalletRegex.MatchString(in) {
+	if testnetWalletRegex.MatchString(in) && len(in) >= 71 {
 		return in[0:71], nil
 	}
 
 	return "", errors.New("unable to coerce wallet to valid pyrin address")
 }
+
+// addresses accepted without validation are cut to this many characters,
+// well past the longest (p2sh testnet) pyrin address
+const maxSanitizedWalletLength = 100
+
+// SanitizeWallet accepts any address, for setups where the node takes
+// addresses the bridge can't validate. Addresses CleanWallet can make sense
+// of come out the same, of anything else only letters, digits and ':' are
+// kept, cut to maxSanitizedWalletLength, so whatever the miner sent can't
+// inject anything into template requests, logs or metric labels. An address
+// with nothing left is still rejected
+func SanitizeWallet(in string) (string, error) {
+	if cleaned, err := CleanWallet(in); err == nil {
+		return cleaned, nil
+	}
+	sanitized := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == ':' {
+			return r
+		}
+		return -1
+	}, in)
+	if len(sanitized) > maxSanitizedWalletLength {
+		sanitized = sanitized[:maxSanitizedWalletLength]
+	}
+	if strings.Trim(sanitized, ":") == "" {
+		return "", errors.New("no address left after sanitizing")
+	}
+	return sanitized, nil
+}
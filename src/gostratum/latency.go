@@ -0,0 +1,46 @@
+package gostratum
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// StratumMethodPing is sent to time the round trip to a client, see
+// SendLatencyProbe
+const StratumMethodPing StratumMethod = "mining.ping"
+
+const latencyProbePrefix = "ping."
+
+// pendingProbe is the ping sent to a client that hasn't been answered yet
+type pendingProbe struct {
+	id   string
+	sent time.Time
+}
+
+// SendLatencyProbe sends the client a mining.ping request. Few miners
+// implement it, but any response carrying the request's id times the round
+// trip, a method not found error as well as a pong, and is reported to the
+// listener's OnLatency instead of being handled as a message. Only the
+// latest probe is timed, one the client never answered is forgotten
+func (sc *StratumContext) SendLatencyProbe() error {
+	id := fmt.Sprintf("%s%d", latencyProbePrefix, atomic.AddInt32(&sc.probeSeq, 1))
+	sc.probe.Store(pendingProbe{id: id, sent: time.Now()})
+	return sc.Send(NewEvent(id, string(StratumMethodPing), []any{}))
+}
+
+// probeResponse returns true if the event is a response to a latency probe,
+// with the round trip time if it's the pending one. Responses to earlier
+// probes are just dropped
+func (sc *StratumContext) probeResponse(event JsonRpcEvent, now time.Time) (rtt time.Duration, timed bool, isProbe bool) {
+	id, ok := event.Id.(string)
+	if event.Method != "" || !ok || !strings.HasPrefix(id, latencyProbePrefix) {
+		return 0, false, false
+	}
+	pending, _ := sc.probe.Load().(pendingProbe)
+	if id != pending.id || !sc.probe.CompareAndSwap(pending, pendingProbe{}) {
+		return 0, false, true
+	}
+	return now.Sub(pending.sent), true, true
+}
@@ -0,0 +1,26 @@
+package gostratum
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// meteredConn tallies the bytes read from and written to a client
+// connection. Counts are kept on the context with plain atomic adds so the
+// hot path stays cheap, consumers sample them via BytesRead/BytesWritten
+type meteredConn struct {
+	net.Conn
+	ctx *StratumContext
+}
+
+func (mc *meteredConn) Read(b []byte) (int, error) {
+	n, err := mc.Conn.Read(b)
+	atomic.AddInt64(&mc.ctx.bytesRead, int64(n))
+	return n, err
+}
+
+func (mc *meteredConn) Write(b []byte) (int, error) {
+	n, err := mc.Conn.Write(b)
+	atomic.AddInt64(&mc.ctx.bytesWritten, int64(n))
+	return n, err
+}
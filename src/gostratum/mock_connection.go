@@ -14,6 +14,8 @@ type MockConnection struct {
 	lock    sync.Mutex // to prevent double closing of channel
 	inChan  chan []byte
 	outChan chan []byte
+	unread  []byte // data written to the read buffer that didn't fit in the last read
+	closed  bool   // deadlines passing after Close leave the channels be
 }
 
 var channelCounter int32
@@ -46,21 +48,31 @@ func (mc *MockConnection) AsyncReadTestDataFromBuffer(handler func([]byte)) {
 }
 
 func (mc *MockConnection) Read(b []byte) (int, error) {
-	data, ok := <-mc.inChan
-	if !ok {
-		return 0, context.DeadlineExceeded
+	if len(mc.unread) == 0 {
+		data, ok := <-mc.inChan
+		if !ok {
+			return 0, context.DeadlineExceeded
+		}
+		mc.unread = data
 	}
-	return copy(b, data), nil
+	n := copy(b, mc.unread)
+	mc.unread = mc.unread[n:]
+	return n, nil
 }
 
 func (mc *MockConnection) Write(b []byte) (int, error) {
-	mc.outChan <- b
+	// callers are free to reuse b once Write returns, same as a real conn
+	mc.outChan <- append([]byte(nil), b...)
 	return len(b), nil
 }
 
 func (mc *MockConnection) Close() error {
 	mc.lock.Lock()
 	defer mc.lock.Unlock()
+	if mc.closed {
+		return nil
+	}
+	mc.closed = true
 	close(mc.inChan)
 	close(mc.outChan)
 	return nil
@@ -92,6 +104,9 @@ func (mc *MockConnection) SetReadDeadline(t time.Time) error {
 		mc.lock.Lock()
 		defer mc.lock.Unlock()
 		time.Sleep(time.Until(t))
+		if mc.closed {
+			return
+		}
 		close(mc.inChan)
 		mc.inChan = make(chan []byte)
 	}()
@@ -104,6 +119,9 @@ func (mc *MockConnection) SetWriteDeadline(t time.Time) error {
 		mc.lock.Lock()
 		defer mc.lock.Unlock()
 		time.Sleep(time.Until(t))
+		if mc.closed {
+			return
+		}
 		close(mc.outChan)
 		mc.outChan = make(chan []byte)
 	}()
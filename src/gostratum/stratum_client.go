@@ -1,11 +1,11 @@
 package gostratum
 
 import (
-	"bufio"
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"net"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -15,8 +15,9 @@ import (
 func spawnClientListener(ctx *StratumContext, connection net.Conn, s *StratumListener) error {
 	defer ctx.Disconnect()
 
+	reader := newLineReader(s.MaxMessageSize)
 	for {
-		err := readFromConnection(connection, func(line string) error {
+		err := readFromConnection(connection, reader, func(line string) error {
 			event, err := UnmarshalEvent(line)
 			if err != nil {
 				ctx.Logger.Error("error unmarshalling event", zap.String("raw", line))
@@ -33,6 +34,14 @@ func spawnClientListener(ctx *StratumContext, connection net.Conn, s *StratumLis
 		if ctx.parentContext.Err() != nil {
 			return ctx.parentContext.Err() // parent context cancelled
 		}
+		if errors.Is(err, ErrMessageTooLarge) {
+			ctx.Logger.Warn("disconnecting client, message too large",
+				zap.String("remote", ctx.RemoteAddr), zap.Int("limit", s.MaxMessageSize))
+			if s.OnOversizedMessage != nil {
+				s.OnOversizedMessage(ctx)
+			}
+			return err
+		}
 		if err != nil { // actual error
 			ctx.Logger.Error("error reading from socket", zap.Error(err))
 			return err
@@ -42,23 +51,78 @@ func spawnClientListener(ctx *StratumContext, connection net.Conn, s *StratumLis
 
 type LineCallback func(line string) error
 
-func readFromConnection(connection net.Conn, cb LineCallback) error {
+var ErrMessageTooLarge = fmt.Errorf("stratum message exceeds max size")
+
+// lineReader frames the incoming byte stream into newline delimited messages.
+// A single read may contain several messages, and a message may be split
+// across reads, so anything after the last newline is kept until the rest of
+// the message arrives. Messages longer than maxSize are an error rather than
+// being buffered indefinitely
+type lineReader struct {
+	buffer  []byte
+	pending []byte
+	maxSize int
+}
+
+func newLineReader(maxSize int) *lineReader {
+	return &lineReader{
+		buffer:  make([]byte, 4096),
+		maxSize: maxSize,
+	}
+}
+
+func readFromConnection(connection net.Conn, reader *lineReader, cb LineCallback) error {
 	deadline := time.Now().Add(5 * time.Second).UTC()
 	if err := connection.SetReadDeadline(deadline); err != nil {
 		return err
 	}
 
-	buffer := make([]byte, 1024)
-	_, err := connection.Read(buffer)
+	n, err := connection.Read(reader.buffer)
+	if n > 0 {
+		reader.pending = append(reader.pending, reader.buffer[:n]...)
+		if cbErr := reader.drain(cb); cbErr != nil {
+			return cbErr
+		}
+	}
 	if err != nil {
 		return errors.Wrapf(err, "error reading from connection")
 	}
-	buffer = bytes.ReplaceAll(buffer, []byte("\x00"), nil)
-	scanner := bufio.NewScanner(strings.NewReader(string(buffer)))
-	for scanner.Scan() {
-		if err := cb(scanner.Text()); err != nil {
+	return nil
+}
+
+// drain calls cb for every complete line that has been read so far
+func (lr *lineReader) drain(cb LineCallback) error {
+	for {
+		idx := bytes.IndexByte(lr.pending, '\n')
+		if idx < 0 {
+			break
+		}
+		if lr.maxSize > 0 && idx > lr.maxSize {
+			return errors.Wrapf(ErrMessageTooLarge, "%d byte message", idx)
+		}
+		line := cleanLine(lr.pending[:idx])
+		lr.pending = lr.pending[idx+1:]
+		if len(line) == 0 {
+			continue
+		}
+		if err := cb(string(line)); err != nil {
 			return err
 		}
 	}
+
+	// some clients don't terminate their messages with a newline, if what's
+	// left is a complete json message on its own treat it as a line. A partial
+	// json object is never valid json so this can't cut a split message short
+	if line := cleanLine(lr.pending); len(line) > 0 && json.Valid(line) {
+		lr.pending = lr.pending[:0]
+		return cb(string(line))
+	}
+	if lr.maxSize > 0 && len(lr.pending) > lr.maxSize {
+		return errors.Wrapf(ErrMessageTooLarge, "%d bytes without a message delimiter", len(lr.pending))
+	}
 	return nil
 }
+
+func cleanLine(line []byte) []byte {
+	return bytes.TrimSpace(bytes.ReplaceAll(line, []byte("\x00"), nil))
+}
@@ -1,10 +1,13 @@
 package gostratum
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"net"
+	"os"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -18,15 +21,43 @@ type StratumContext struct {
 	RemoteAddr    string
 	WalletAddr    string
 	WorkerName    string
+	// RawWorkerName is the worker name as the miner sent it, WorkerName is
+	// normalized per the authorize handler's WorkerNameRules
+	RawWorkerName string
 	RemoteApp     string
 	Id            int32
 	Logger        *zap.Logger
 	connection    net.Conn
-	disconnecting bool
+	disconnecting int32
 	onDisconnect  chan *StratumContext
 	State         any // gross, but go generics aren't mature enough this can be typed 😭
 	writeLock     int32
 	Extranonce    string
+	// Extranonce2Size is the number of nonce bytes the miner controls, sent
+	// along with the extranonce when non-zero
+	Extranonce2Size int
+	subscribed      int32
+	authorized      int32
+	unknownMethods  int32
+	bytesRead       int64
+	bytesWritten    int64
+
+	// SessionId is the subscription id sent in the nicehash subscribe
+	// format, defaults to the client id as 8 hex digits when unset
+	SessionId string
+	// ListenPort is the configured port of the listener the client
+	// connected through
+	ListenPort string
+	// protocol nuances detected during the handshake, see Capabilities
+	capabilities atomic.Value
+	// deadline for every write, DefaultWriteTimeout when unset, and called
+	// when a write misses it
+	writeTimeout   time.Duration
+	onWriteTimeout func(ctx *StratumContext)
+	// the pending latency probe and the last probe's sequence number, see
+	// SendLatencyProbe
+	probe    atomic.Value
+	probeSeq int32
 }
 
 type ContextSummary struct {
@@ -39,7 +70,27 @@ type ContextSummary struct {
 var ErrorDisconnected = fmt.Errorf("disconnecting")
 
 func (sc *StratumContext) Connected() bool {
-	return !sc.disconnecting
+	return atomic.LoadInt32(&sc.disconnecting) == 0
+}
+
+// Subscribed returns true once the client has completed mining.subscribe
+func (sc *StratumContext) Subscribed() bool {
+	return atomic.LoadInt32(&sc.subscribed) == 1
+}
+
+// Authorized returns true once the client has completed mining.authorize
+func (sc *StratumContext) Authorized() bool {
+	return atomic.LoadInt32(&sc.authorized) == 1
+}
+
+// BytesRead returns the total bytes read from the client connection
+func (sc *StratumContext) BytesRead() int64 {
+	return atomic.LoadInt64(&sc.bytesRead)
+}
+
+// BytesWritten returns the total bytes written to the client connection
+func (sc *StratumContext) BytesWritten() int64 {
+	return atomic.LoadInt64(&sc.bytesWritten)
 }
 
 func (sc *StratumContext) Summary() ContextSummary {
@@ -62,6 +113,8 @@ func NewMockContext(ctx context.Context, logger *zap.Logger, state any) (*Stratu
 		RemoteApp:     "mock.context",
 		Logger:        logger,
 		connection:    mc,
+		// nothing listens for it, buffered so Disconnect doesn't block
+		onDisconnect: make(chan *StratumContext, 1),
 	}, mc
 }
 
@@ -71,39 +124,79 @@ func (sc *StratumContext) String() string {
 }
 
 func (sc *StratumContext) Reply(response JsonRpcResponse) error {
-	if sc.disconnecting {
+	if !sc.Connected() {
 		return ErrorDisconnected
 	}
-	encoded, err := json.Marshal(response)
-	if err != nil {
+	buf := encodeBufferPool.Get().(*bytes.Buffer)
+	defer releaseEncodeBuffer(buf)
+	// Encode appends the newline delimiter
+	if err := json.NewEncoder(buf).Encode(response); err != nil {
 		return errors.Wrap(err, "failed encoding jsonrpc response")
 	}
-	encoded = append(encoded, '\n')
-	return sc.writeWithBackoff(encoded)
+	return sc.writeWithBackoff(buf.Bytes())
 }
 
 func (sc *StratumContext) Send(event JsonRpcEvent) error {
-	if sc.disconnecting {
+	if !sc.Connected() {
 		return ErrorDisconnected
 	}
-	encoded, err := json.Marshal(event)
-	if err != nil {
+	buf := encodeBufferPool.Get().(*bytes.Buffer)
+	defer releaseEncodeBuffer(buf)
+	if err := json.NewEncoder(buf).Encode(event); err != nil {
 		return errors.Wrap(err, "failed encoding jsonrpc event")
 	}
-	encoded = append(encoded, '\n')
+	return sc.writeWithBackoff(buf.Bytes())
+}
+
+// SendRaw writes an already encoded message, which must include the trailing
+// newline. Used by callers that serialize a message once and send it to many
+// clients. The data isn't retained after returning
+func (sc *StratumContext) SendRaw(encoded []byte) error {
+	if !sc.Connected() {
+		return ErrorDisconnected
+	}
 	return sc.writeWithBackoff(encoded)
 }
 
+// encoding buffers are reused across messages, the connection doesn't retain
+// written data so a buffer is free again as soon as the write returns
+var encodeBufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// buffers grown past this by an unusually large message are dropped rather
+// than pinned in the pool
+const maxPooledBufferSize = 64 * 1024
+
+func releaseEncodeBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	buf.Reset()
+	encodeBufferPool.Put(buf)
+}
+
 var errWriteBlocked = fmt.Errorf("error writing to socket, previous write pending")
 
 func (sc *StratumContext) write(data []byte) error {
 	if atomic.CompareAndSwapInt32(&sc.writeLock, 0, 1) {
 		defer atomic.StoreInt32(&sc.writeLock, 0)
-		deadline := time.Now().Add(5 * time.Second)
-		if err := sc.connection.SetWriteDeadline(deadline); err != nil {
+		timeout := sc.writeTimeout
+		if timeout <= 0 {
+			timeout = DefaultWriteTimeout
+		}
+		if err := sc.connection.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
 			return errors.Wrap(err, "failed setting write deadline for connection")
 		}
 		_, err := sc.connection.Write(data)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// the client isn't reading, a partial write also leaves the
+			// stream unusable so there's no point retrying
+			sc.Logger.Warn("disconnecting client, write timed out", zap.Duration("timeout", timeout))
+			if sc.onWriteTimeout != nil {
+				sc.onWriteTimeout(sc)
+			}
+		}
 		sc.checkDisconnect(err)
 		return err
 	}
@@ -136,6 +229,26 @@ func (sc *StratumContext) ReplyStaleShare(id any) error {
 		Error:  []any{21, "Job not found", nil},
 	})
 }
+
+// ReplyMalformedSubmit rejects a submit whose params don't parse or don't
+// match what was negotiated
+func (sc *StratumContext) ReplyMalformedSubmit(id any) error {
+	return sc.Reply(JsonRpcResponse{
+		Id:     id,
+		Result: nil,
+		Error:  []any{20, "Malformed submit", nil},
+	})
+}
+
+// ReplyUnknownJob rejects a share for a job id the client was never sent
+func (sc *StratumContext) ReplyUnknownJob(id any) error {
+	return sc.Reply(JsonRpcResponse{
+		Id:     id,
+		Result: nil,
+		Error:  []any{21, "Unknown job", nil},
+	})
+}
+
 func (sc *StratumContext) ReplyDupeShare(id any) error {
 	return sc.Reply(JsonRpcResponse{
 		Id:     id,
@@ -160,10 +273,115 @@ func (sc *StratumContext) ReplyLowDiffShare(id any) error {
 	})
 }
 
+func (sc *StratumContext) ReplyThrottledShare(id any) error {
+	return sc.Reply(JsonRpcResponse{
+		Id:     id,
+		Result: nil,
+		Error:  []any{20, "Share rate limit exceeded", nil},
+	})
+}
+
+// ReplyNodeSyncing rejects a share the node can't currently take, the miner
+// is expected to carry on and have later shares accepted once it's synced
+func (sc *StratumContext) ReplyNodeSyncing(id any) error {
+	return sc.Reply(JsonRpcResponse{
+		Id:     id,
+		Result: nil,
+		Error:  []any{20, "Node syncing, retry shortly", nil},
+	})
+}
+
+func (sc *StratumContext) ReplyUnauthorized(id any) error {
+	return sc.Reply(JsonRpcResponse{
+		Id:     id,
+		Result: nil,
+		Error:  []any{24, "Unauthorized worker", nil},
+	})
+}
+
+// ReplyAuthorizeFailed answers a failed mining.authorize with a message
+// naming the reason, shown by miner dashboards. Every authorize failure uses
+// code 24 (unauthorized worker):
+//
+//	ErrMalformedAuthorize  "Malformed authorize, expected [\"address.worker\", \"password\"]"
+//	ErrInvalidWallet       "Invalid wallet address, expected pyrin:<address>.<worker>"
+//	connection limit       "Too many connections for this address", see ReplyConnectionLimit
+//	wallet not allowed     "Address not allowed on this bridge", see ReplyWalletNotAllowed
+//	reconnect backoff      "Reconnecting too often, retry in <backoff>", see ReplyReconnectBackoff
+//	maintenance            the operator's message, see ReplyMaintenance
+//	anything else          "Unauthorized worker"
+func (sc *StratumContext) ReplyAuthorizeFailed(id any, err error) error {
+	message := "Unauthorized worker"
+	switch {
+	case errors.Is(err, ErrMalformedAuthorize):
+		message = `Malformed authorize, expected ["address.worker", "password"]`
+	case errors.Is(err, ErrInvalidWallet):
+		message = "Invalid wallet address, expected pyrin:<address>.<worker>"
+	}
+	return sc.Reply(JsonRpcResponse{
+		Id:     id,
+		Result: nil,
+		Error:  []any{24, message, nil},
+	})
+}
+
+func (sc *StratumContext) ReplyConnectionLimit(id any) error {
+	return sc.Reply(JsonRpcResponse{
+		Id:     id,
+		Result: nil,
+		Error:  []any{24, "Too many connections for this address", nil},
+	})
+}
+
+func (sc *StratumContext) ReplyWalletNotAllowed(id any) error {
+	return sc.Reply(JsonRpcResponse{
+		Id:     id,
+		Result: nil,
+		Error:  []any{24, "Address not allowed on this bridge", nil},
+	})
+}
+
+// ReplyReconnectBackoff rejects a worker that reconnected too often, telling
+// it when it's let in again
+func (sc *StratumContext) ReplyReconnectBackoff(id any, backoff time.Duration) error {
+	return sc.Reply(JsonRpcResponse{
+		Id:     id,
+		Result: nil,
+		Error:  []any{24, fmt.Sprintf("Reconnecting too often, retry in %s", backoff.Round(time.Second)), nil},
+	})
+}
+
+// ReplyMaintenance rejects a client while the pool is down for maintenance,
+// with the message shown to the operator. Code 24 like the other temporary
+// refusals, miners retry the authorize later rather than treating it as a
+// broken pool
+func (sc *StratumContext) ReplyMaintenance(id any, message string) error {
+	return sc.Reply(JsonRpcResponse{
+		Id:     id,
+		Result: nil,
+		Error:  []any{24, message, nil},
+	})
+}
+
+func (sc *StratumContext) ReplyNotSubscribed(id any) error {
+	return sc.Reply(JsonRpcResponse{
+		Id:     id,
+		Result: nil,
+		Error:  []any{25, "Not subscribed", nil},
+	})
+}
+
+func (sc *StratumContext) ReplyMethodNotFound(id any) error {
+	return sc.Reply(JsonRpcResponse{
+		Id:     id,
+		Result: nil,
+		Error:  []any{-32601, "Method not found", nil},
+	})
+}
+
 func (sc *StratumContext) Disconnect() {
-	if !sc.disconnecting {
+	if atomic.CompareAndSwapInt32(&sc.disconnecting, 0, 1) {
 		sc.Logger.Info("disconnecting")
-		sc.disconnecting = true
 		if sc.connection != nil {
 			sc.connection.Close()
 		}
@@ -2,10 +2,15 @@ package gostratum
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"net/netip"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
@@ -26,20 +31,111 @@ type StratumStats struct {
 	Disconnects int64
 }
 
+// HandshakeOrder controls whether mining.subscribe and mining.authorize
+// must arrive in a particular order. Miner firmwares differ here, so by
+// default either order is accepted
+type HandshakeOrder string
+
+const (
+	HandshakeAnyOrder       HandshakeOrder = ""
+	HandshakeSubscribeFirst HandshakeOrder = "subscribe_first"
+	HandshakeAuthorizeFirst HandshakeOrder = "authorize_first"
+)
+
+func (o HandshakeOrder) Valid() bool {
+	return o == HandshakeAnyOrder || o == HandshakeSubscribeFirst || o == HandshakeAuthorizeFirst
+}
+
+// UnknownMethodPolicy controls how methods without a handler are answered
+type UnknownMethodPolicy string
+
+const (
+	// UnknownMethodError replies with a method not found error (default)
+	UnknownMethodError UnknownMethodPolicy = ""
+	// UnknownMethodIgnore silently drops the message
+	UnknownMethodIgnore UnknownMethodPolicy = "ignore"
+	// UnknownMethodDisconnect replies with an error and disconnects the
+	// client once it has sent UnknownMethodLimit unknown methods
+	UnknownMethodDisconnect UnknownMethodPolicy = "disconnect"
+)
+
+func (p UnknownMethodPolicy) Valid() bool {
+	return p == UnknownMethodError || p == UnknownMethodIgnore || p == UnknownMethodDisconnect
+}
+
+const defaultUnknownMethodLimit = 10
+
+// DefaultMaxMessageSize is well above any legitimate stratum message (a
+// submit is ~200 bytes) while bounding what a client can make us buffer
+const DefaultMaxMessageSize = 16 * 1024
+
+// DefaultWriteTimeout is how long a write to a client may block, a write
+// only blocks once the client stopped reading long enough to fill the
+// socket's send buffer
+const DefaultWriteTimeout = 5 * time.Second
+
+var ErrTooManyUnknownMethods = fmt.Errorf("too many unknown methods")
+
 type StratumListenerConfig struct {
 	Logger         *zap.Logger
 	HandlerMap     StratumHandlerMap
 	ClientListener StratumClientListener
 	StateGenerator StateGenerator
 	Port           string
+	HandshakeOrder HandshakeOrder
+	// TLSConfig if set serves stratum over tls on Port
+	TLSConfig *tls.Config
+
+	UnknownMethodPolicy UnknownMethodPolicy
+	UnknownMethodLimit  int
+	// OnUnknownMethod is called for every message without a handler, used
+	// for metrics
+	OnUnknownMethod func(ctx *StratumContext, method string)
+	// MaxMessageSize is the longest message (in bytes) a client may send,
+	// clients exceeding it are disconnected. Defaults to
+	// DefaultMaxMessageSize
+	MaxMessageSize int
+	// OnOversizedMessage is called before a client is disconnected for
+	// exceeding MaxMessageSize, used for metrics
+	OnOversizedMessage func(ctx *StratumContext)
+	// WriteTimeout is the deadline for every write to a client, clients
+	// that miss it are disconnected. Defaults to DefaultWriteTimeout
+	WriteTimeout time.Duration
+	// OnWriteTimeout is called when a client is disconnected for missing
+	// WriteTimeout, used for metrics
+	OnWriteTimeout func(ctx *StratumContext)
+	// OnLatency is called with the round trip time of every answered
+	// latency probe, see SendLatencyProbe
+	OnLatency func(ctx *StratumContext, rtt time.Duration)
+	// AcceptBacklog is the listen backlog, connections the OS queues for
+	// the accept loop. 0 keeps the OS maximum, see setBacklog
+	AcceptBacklog int
+	// AcceptWorkers when non-zero sets up accepted connections off the
+	// accept loop, with up to AcceptQueue (default DefaultAcceptQueue)
+	// connections waiting for a worker before new ones are dropped
+	AcceptWorkers int
+	AcceptQueue   int
+	// OnAccept is called for every accepted connection, with false for
+	// those dropped on a full accept queue, used for metrics
+	OnAccept func(accepted bool)
+	// KeepMappedIPv4 leaves IPv4 clients on a dual stack listener with their
+	// IPv4-mapped IPv6 address (::ffff:1.2.3.4) instead of the plain IPv4
+	// one, see remoteHost
+	KeepMappedIPv4 bool
 }
 
 type StratumListener struct {
 	StratumListenerConfig
-	shuttingDown      bool
+	shuttingDown      int32
 	disconnectChannel DisconnectChannel
 	stats             StratumStats
 	workerGroup       sync.WaitGroup
+
+	// the listening socket while Listen runs, guarded for StopAccepting
+	acceptLock sync.Mutex
+	server     net.Listener
+	// accepted connections waiting for an accept worker, nil without them
+	acceptQueue chan net.Conn
 }
 
 func NewListener(cfg StratumListenerConfig) *StratumListener {
@@ -54,6 +150,21 @@ func NewListener(cfg StratumListenerConfig) *StratumListener {
 		zap.String("address", listener.Port),
 	)
 
+	if listener.UnknownMethodLimit <= 0 {
+		listener.UnknownMethodLimit = defaultUnknownMethodLimit
+	}
+	if listener.MaxMessageSize <= 0 {
+		listener.MaxMessageSize = DefaultMaxMessageSize
+	}
+	if listener.AcceptWorkers > 0 {
+		if listener.AcceptQueue <= 0 {
+			listener.AcceptQueue = DefaultAcceptQueue
+		}
+		listener.acceptQueue = make(chan net.Conn, listener.AcceptQueue)
+	} else {
+		listener.AcceptWorkers = 0
+	}
+
 	if listener.StateGenerator == nil {
 		listener.Logger.Warn("no state generator provided, using default")
 		listener.StateGenerator = func() any { return nil }
@@ -63,43 +174,129 @@ func NewListener(cfg StratumListenerConfig) *StratumListener {
 }
 
 func (s *StratumListener) Listen(ctx context.Context) error {
-	s.shuttingDown = false
+	atomic.StoreInt32(&s.shuttingDown, 0)
 
 	serverContext, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	network, address := listenAddress(s.Port)
+	if network == "unix" {
+		if err := removeStaleSocket(address); err != nil {
+			return err
+		}
+	}
 	lc := net.ListenConfig{}
-	server, err := lc.Listen(ctx, "tcp", s.Port)
+	server, err := lc.Listen(ctx, network, address)
 	if err != nil {
 		return errors.Wrapf(err, "failed listening to socket %s", s.Port)
 	}
+	if err := setBacklog(server, s.AcceptBacklog); err != nil {
+		server.Close()
+		return errors.Wrapf(err, "failed setting the listen backlog on %s", s.Port)
+	}
+	if s.TLSConfig != nil {
+		server = tls.NewListener(server, s.TLSConfig)
+	}
 	defer server.Close()
+	s.acceptLock.Lock()
+	s.server = server
+	s.acceptLock.Unlock()
 
+	// added here rather than in the goroutines so Wait can't miss them
+	s.workerGroup.Add(2 + s.AcceptWorkers)
 	go s.disconnectListener(serverContext)
 	go s.tcpListener(serverContext, server)
+	for i := 0; i < s.AcceptWorkers; i++ {
+		go s.acceptWorker(serverContext)
+	}
 
 	// block here until the context is killed
 	<-ctx.Done() // context cancelled, so kill the server
-	s.shuttingDown = true
+	atomic.StoreInt32(&s.shuttingDown, 1)
 	server.Close()
 	s.workerGroup.Wait()
 	return context.Canceled
 }
 
+// StopAccepting closes the listening socket so no new clients can connect,
+// clients already connected are served until Listen's context is cancelled.
+// Used to drain the listener before shutting down
+func (s *StratumListener) StopAccepting() {
+	s.acceptLock.Lock()
+	defer s.acceptLock.Unlock()
+	if s.server != nil {
+		atomic.StoreInt32(&s.shuttingDown, 1)
+		s.server.Close()
+	}
+}
+
+const unixScheme = "unix://"
+
+// listenAddress splits the configured port into network and address, a
+// unix:///path/to/socket address listens on a unix domain socket, anything
+// else is tcp
+func listenAddress(port string) (string, string) {
+	if strings.HasPrefix(port, unixScheme) {
+		return "unix", strings.TrimPrefix(port, unixScheme)
+	}
+	return "tcp", port
+}
+
+// removeStaleSocket removes a socket file left behind by a previous run that
+// didn't shut down cleanly, refusing to touch anything that isn't a socket
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed checking unix socket %s", path)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a unix socket", path)
+	}
+	return os.Remove(path)
+}
+
+// remoteHost returns the canonical form of a client's address without the
+// port, which every per ip limit, metric and log uses as the client's ip. On a
+// dual stack listener IPv4 clients show up with IPv4-mapped IPv6 addresses,
+// those are unmapped to plain IPv4 unless keepMapped is set so the same
+// client is keyed the same on either stack
+func remoteHost(addr string, keepMapped bool) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr // no port
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return host
+	}
+	if !keepMapped {
+		ip = ip.Unmap()
+	}
+	return ip.String()
+}
+
 func (s *StratumListener) newClient(ctx context.Context, connection net.Conn) {
-	addr := connection.RemoteAddr().String()
-	parts := strings.Split(addr, ":")
-	if len(parts) > 0 {
-		addr = parts[0] // trim off the port
+	addr := remoteHost(connection.RemoteAddr().String(), s.KeepMappedIPv4)
+	if _, isUnix := connection.LocalAddr().(*net.UnixAddr); isUnix {
+		// peers on a unix socket have no address of their own
+		addr = "unix"
 	}
 	clientContext := &StratumContext{
 		parentContext: ctx,
 		RemoteAddr:    addr,
 		Logger:        s.Logger.With(zap.String("client", addr)),
-		connection:    connection,
 		State:         s.StateGenerator(),
 		onDisconnect:  s.disconnectChannel,
+		ListenPort:    s.Port,
+
+		writeTimeout:   s.WriteTimeout,
+		onWriteTimeout: s.OnWriteTimeout,
 	}
+	connection = &meteredConn{Conn: connection, ctx: clientContext}
+	clientContext.connection = connection
 
 	s.Logger.Info(fmt.Sprintf("new client connecting - %s", addr))
 
@@ -112,15 +309,60 @@ func (s *StratumListener) newClient(ctx context.Context, connection net.Conn) {
 }
 
 func (s *StratumListener) HandleEvent(ctx *StratumContext, event JsonRpcEvent) error {
+	if rtt, timed, isProbe := ctx.probeResponse(event, time.Now()); isProbe {
+		if timed && s.OnLatency != nil {
+			s.OnLatency(ctx, rtt)
+		}
+		return nil
+	}
+	if !s.inHandshakeOrder(ctx, event.Method) {
+		// reply with an explicit error rather than leaving the miner hanging
+		ctx.Logger.Warn(fmt.Sprintf("rejecting %s, out of order for %s handshake", event.Method, s.HandshakeOrder))
+		if event.Method == StratumMethodAuthorize {
+			return ctx.ReplyNotSubscribed(event.Id)
+		}
+		return ctx.ReplyUnauthorized(event.Id)
+	}
 	if handler, exists := s.HandlerMap[string(event.Method)]; exists {
 		return handler(ctx, event)
 	}
-	//s.Logger.Warn(fmt.Sprintf("unhandled event '%+v'", event))
+	return s.handleUnknownMethod(ctx, event)
+}
+
+func (s *StratumListener) handleUnknownMethod(ctx *StratumContext, event JsonRpcEvent) error {
+	if s.OnUnknownMethod != nil {
+		s.OnUnknownMethod(ctx, string(event.Method))
+	}
+	if s.UnknownMethodPolicy == UnknownMethodIgnore {
+		return nil
+	}
+	count := atomic.AddInt32(&ctx.unknownMethods, 1)
+	if count == 1 {
+		ctx.Logger.Warn(fmt.Sprintf("unhandled method '%s'", event.Method))
+	}
+	if event.Id != nil { // notifications don't get a response
+		if err := ctx.ReplyMethodNotFound(event.Id); err != nil {
+			return err
+		}
+	}
+	if s.UnknownMethodPolicy == UnknownMethodDisconnect && int(count) >= s.UnknownMethodLimit {
+		// returning an error ends the client's read loop which disconnects it
+		return errors.Wrapf(ErrTooManyUnknownMethods, "%d unknown methods", count)
+	}
 	return nil
 }
 
+func (s *StratumListener) inHandshakeOrder(ctx *StratumContext, method StratumMethod) bool {
+	switch {
+	case s.HandshakeOrder == HandshakeSubscribeFirst && method == StratumMethodAuthorize:
+		return ctx.Subscribed()
+	case s.HandshakeOrder == HandshakeAuthorizeFirst && method == StratumMethodSubscribe:
+		return ctx.Authorized()
+	}
+	return true
+}
+
 func (s *StratumListener) disconnectListener(ctx context.Context) {
-	s.workerGroup.Add(1)
 	defer s.workerGroup.Done()
 	for {
 		select {
@@ -137,18 +379,17 @@ func (s *StratumListener) disconnectListener(ctx context.Context) {
 }
 
 func (s *StratumListener) tcpListener(ctx context.Context, server net.Listener) {
-	s.workerGroup.Add(1)
 	defer s.workerGroup.Done()
 	for { // listen and spin forever
 		connection, err := server.Accept()
 		if err != nil {
-			if s.shuttingDown {
+			if atomic.LoadInt32(&s.shuttingDown) == 1 {
 				s.Logger.Error("stopping listening due to server shutdown")
 				return
 			}
 			s.Logger.Error("failed to accept incoming connection", zap.Error(err))
 			continue
 		}
-		s.newClient(ctx, connection)
+		s.acceptConnection(ctx, connection)
 	}
 }
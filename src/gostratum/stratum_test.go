@@ -3,11 +3,19 @@ package gostratum
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/mattn/go-colorable"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -42,7 +50,7 @@ func TestNewClient(t *testing.T) {
 	listener.newClient(ctx, mc)
 	// send in the authorize event
 	event, _ := json.Marshal(NewEvent("1", "mining.authorize", []any{
-		"", "test",
+		"pyrin:qqkrl0er5ka5snd55gr9rcf6rlpx8nln8gf3jxf83w4dc0khfqmauy6qs83zm.test", "x",
 	}))
 	mc.AsyncWriteTestDataToReadBuffer(string(event))
 
@@ -69,6 +77,129 @@ func TestNewClient(t *testing.T) {
 	}
 }
 
+func TestMessageFraming(t *testing.T) {
+	msg := func(id int) string {
+		event, _ := json.Marshal(NewEvent(fmt.Sprintf("%d", id), "mining.submit", []any{"worker", "1", "0x1"}))
+		return string(event)
+	}
+	tests := []struct {
+		name     string
+		reads    []string
+		expected []string
+	}{
+		{
+			name:     "single",
+			reads:    []string{msg(1) + "\n"},
+			expected: []string{msg(1)},
+		},
+		{
+			name:     "concatenated",
+			reads:    []string{msg(1) + "\n" + msg(2) + "\n" + msg(3) + "\n"},
+			expected: []string{msg(1), msg(2), msg(3)},
+		},
+		{
+			name:     "split",
+			reads:    []string{msg(1)[:10], msg(1)[10:20], msg(1)[20:] + "\n"},
+			expected: []string{msg(1)},
+		},
+		{
+			name:     "concatenated and split",
+			reads:    []string{msg(1) + "\n" + msg(2)[:7], msg(2)[7:] + "\r\n" + msg(3) + "\n"},
+			expected: []string{msg(1), msg(2), msg(3)},
+		},
+		{
+			name:     "unterminated",
+			reads:    []string{msg(1)},
+			expected: []string{msg(1)},
+		},
+		{
+			name:     "null padded",
+			reads:    []string{msg(1) + "\n\x00\x00\x00"},
+			expected: []string{msg(1)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mc := NewMockConnection()
+			reader := newLineReader(DefaultMaxMessageSize)
+			var lines []string
+			for _, read := range test.reads {
+				mc.AsyncWriteTestDataToReadBuffer(read)
+				if err := readFromConnection(mc, reader, func(line string) error {
+					lines = append(lines, line)
+					return nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if d := cmp.Diff(test.expected, lines); d != "" {
+				t.Fatalf("messages framed incorrectly: %s", d)
+			}
+		})
+	}
+}
+
+func TestOversizedMessage(t *testing.T) {
+	noop := func(string) error { return nil }
+	tests := []struct {
+		name  string
+		reads []string
+	}{
+		{"single line", []string{strings.Repeat("a", 100) + "\n"}},
+		{"unterminated", []string{strings.Repeat("a", 60), strings.Repeat("a", 60)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mc := NewMockConnection()
+			reader := newLineReader(64)
+			var err error
+			for _, read := range test.reads {
+				mc.AsyncWriteTestDataToReadBuffer(read)
+				if err = readFromConnection(mc, reader, noop); err != nil {
+					break
+				}
+			}
+			if !errors.Is(err, ErrMessageTooLarge) {
+				t.Fatalf("expected message too large, got %v", err)
+			}
+		})
+	}
+
+	mc := NewMockConnection()
+	mc.AsyncWriteTestDataToReadBuffer(strings.Repeat("a", 64) + "\n")
+	if err := readFromConnection(mc, newLineReader(64), noop); err != nil {
+		t.Fatalf("expected message at the limit to be accepted, got %s", err)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	timedOut := make(chan struct{}, 1)
+	ctx := &StratumContext{
+		parentContext:  context.Background(),
+		Logger:         zap.NewNop(),
+		connection:     server,
+		onDisconnect:   make(chan *StratumContext, 1),
+		writeTimeout:   50 * time.Millisecond,
+		onWriteTimeout: func(*StratumContext) { timedOut <- struct{}{} },
+	}
+
+	// nothing reads from the other end of the pipe, like a stalled client
+	start := time.Now()
+	if err := ctx.Send(NewEvent("", "mining.notify", []any{"1"})); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the write to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the write to fail at the timeout, took %s", elapsed)
+	}
+	<-timedOut
+	if disconnected := <-ctx.onDisconnect; disconnected != ctx {
+		t.Fatalf("expected the client disconnected")
+	}
+}
+
 func TestWalletValidation(t *testing.T) {
 	tests := []struct {
 		in        string
@@ -99,3 +230,616 @@ func TestWalletValidation(t *testing.T) {
 		}
 	}
 }
+
+func TestSanitizeWallet(t *testing.T) {
+	const wallet = "pyrin:qqkrl0er5ka5snd55gr9rcf6rlpx8nln8gf3jxf83w4dc0khfqmauy6qs83zm"
+	tests := []struct {
+		in        string
+		expected  string
+		shouldErr bool
+	}{
+		{in: wallet, expected: wallet},
+		{in: wallet[len("pyrin:"):], expected: wallet},
+		{in: "pyrin:notanaddress", expected: "pyrin:notanaddress"},
+		{in: "custom:Addr'\"; DROP\n<x>", expected: "custom:AddrDROPx"},
+		{in: strings.Repeat("A", 200), expected: strings.Repeat("A", maxSanitizedWalletLength)},
+		{in: "'@!:", shouldErr: true},
+	}
+	for _, v := range tests {
+		sanitized, err := SanitizeWallet(v.in)
+		if (err != nil) != v.shouldErr {
+			t.Fatalf("unexpected error %v for wallet %q", err, v.in)
+		}
+		if sanitized != v.expected {
+			t.Fatalf("expected %q, got %q", v.expected, sanitized)
+		}
+	}
+
+	ctx, mc := NewMockContext(context.Background(), zap.NewNop(), nil)
+	mc.AsyncReadTestDataFromBuffer(func([]byte) {})
+	event := NewEvent("1", string(StratumMethodAuthorize), []any{"custom:addr.rig", "x"})
+	if _, _, err := ParseAuthorize(event); err == nil {
+		t.Fatalf("expected the address rejected when validated")
+	}
+	if err := HandleAuthorizeWith(ctx, event, WorkerNameRules{}, SanitizeWallet); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.WalletAddr != "custom:addr" || ctx.WorkerName != "rig" {
+		t.Fatalf("expected custom:addr.rig authorized, got %q.%q", ctx.WalletAddr, ctx.WorkerName)
+	}
+}
+
+func TestPasswordOptions(t *testing.T) {
+	tests := []struct {
+		params   []any
+		expected map[string]string
+	}{
+		{[]any{"wallet.worker"}, map[string]string{}},
+		{[]any{"wallet.worker", "x"}, map[string]string{}},
+		{[]any{"wallet.worker", "d=4096"}, map[string]string{"d": "4096"}},
+		{[]any{"wallet.worker", "x,D=512;m=solo =bad"}, map[string]string{"d": "512", "m": "solo"}},
+		{[]any{"wallet.worker", 1234}, map[string]string{}},
+	}
+	for _, tt := range tests {
+		options := PasswordOptions(JsonRpcEvent{Params: tt.params})
+		if d := cmp.Diff(tt.expected, options); d != "" {
+			t.Fatalf("unexpected options for %v: %s", tt.params, d)
+		}
+	}
+}
+
+func TestWorkerNameRules(t *testing.T) {
+	rules := WorkerNameRules{Lowercase: true, Trim: true, Separators: "_-"}
+	for _, name := range []string{"rig1", "Rig1", "rig_1", " RIG-1 ", "rig__1_"} {
+		if normalized := rules.Apply(name); normalized != "rig1" {
+			t.Fatalf("expected %q normalized to rig1, got %q", name, normalized)
+		}
+	}
+	rules.Replacement = "-"
+	if normalized := rules.Apply("Rig_East_1"); normalized != "rig-east-1" {
+		t.Fatalf("expected separators replaced, got %q", normalized)
+	}
+	if normalized := rules.Apply("__"); normalized != "__" {
+		t.Fatalf("expected a name of only separators kept, got %q", normalized)
+	}
+	if normalized := (WorkerNameRules{}).Apply(" Rig_1"); normalized != " Rig_1" {
+		t.Fatalf("expected no rules to leave the name untouched, got %q", normalized)
+	}
+
+	const wallet = "pyrin:qqkrl0er5ka5snd55gr9rcf6rlpx8nln8gf3jxf83w4dc0khfqmauy6qs83zm"
+	ctx, mc := NewMockContext(context.Background(), zap.NewNop(), nil)
+	mc.AsyncReadTestDataFromBuffer(func([]byte) {})
+	event := NewEvent("1", string(StratumMethodAuthorize), []any{wallet + ".Rig_1", "x"})
+	if err := HandleAuthorizeWithRules(ctx, event, WorkerNameRules{Lowercase: true, Separators: "_"}); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.WorkerName != "rig1" || ctx.RawWorkerName != "Rig_1" {
+		t.Fatalf("expected worker rig1 authorized as Rig_1, got %q (raw %q)", ctx.WorkerName, ctx.RawWorkerName)
+	}
+}
+
+func TestHandshakeOrder(t *testing.T) {
+	const wallet = "pyrin:qqkrl0er5ka5snd55gr9rcf6rlpx8nln8gf3jxf83w4dc0khfqmauy6qs83zm.test"
+	subscribe := NewEvent("1", string(StratumMethodSubscribe), []any{"test.miner/1.0"})
+	authorize := NewEvent("2", string(StratumMethodAuthorize), []any{wallet, "x"})
+
+	tests := []struct {
+		name   string
+		order  HandshakeOrder
+		events []JsonRpcEvent
+		errors [][]any // expected error per reply, nil for success
+	}{
+		{"any order, subscribe first", HandshakeAnyOrder, []JsonRpcEvent{subscribe, authorize}, [][]any{nil, nil}},
+		{"any order, authorize first", HandshakeAnyOrder, []JsonRpcEvent{authorize, subscribe}, [][]any{nil, nil}},
+		{"strict subscribe first", HandshakeSubscribeFirst, []JsonRpcEvent{subscribe, authorize}, [][]any{nil, nil}},
+		{"strict subscribe first, violated", HandshakeSubscribeFirst, []JsonRpcEvent{authorize}, [][]any{{25.0, "Not subscribed", nil}}},
+		{"strict authorize first", HandshakeAuthorizeFirst, []JsonRpcEvent{authorize, subscribe}, [][]any{nil, nil}},
+		{"strict authorize first, violated", HandshakeAuthorizeFirst, []JsonRpcEvent{subscribe}, [][]any{{24.0, "Unauthorized worker", nil}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig(zap.NewNop())
+			cfg.HandshakeOrder = tt.order
+			listener := NewListener(cfg)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			mc := NewMockConnection()
+			listener.newClient(ctx, mc)
+
+			for i, event := range tt.events {
+				encoded, _ := json.Marshal(event)
+				mc.AsyncWriteTestDataToReadBuffer(string(encoded))
+				mc.ReadTestDataFromBuffer(func(b []byte) {
+					decoded := JsonRpcResponse{}
+					if err := json.Unmarshal(b, &decoded); err != nil {
+						t.Fatal(err)
+					}
+					if decoded.Id != event.Id {
+						t.Fatalf("expected reply to %v, got %v", event.Id, decoded.Id)
+					}
+					if d := cmp.Diff(tt.errors[i], decoded.Error); d != "" {
+						t.Fatalf("unexpected reply to %s: %s", event.Method, d)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestLatencyProbe(t *testing.T) {
+	cfg := DefaultConfig(zap.NewNop())
+	cfg.UnknownMethodPolicy = UnknownMethodDisconnect
+	cfg.UnknownMethodLimit = 1
+	var measured []time.Duration
+	cfg.OnLatency = func(_ *StratumContext, rtt time.Duration) { measured = append(measured, rtt) }
+	listener := NewListener(cfg)
+	ctx, mc := NewMockContext(context.Background(), zap.NewNop(), nil)
+
+	probe := func() string {
+		sent := make(chan []byte, 1)
+		mc.AsyncReadTestDataFromBuffer(func(data []byte) { sent <- data })
+		if err := ctx.SendLatencyProbe(); err != nil {
+			t.Fatal(err)
+		}
+		event, err := UnmarshalEvent(string(<-sent))
+		if err != nil || event.Method != StratumMethodPing {
+			t.Fatalf("expected a mining.ping request, got %+v (%v)", event, err)
+		}
+		return event.Id.(string)
+	}
+	// the miner doesn't know the method, the error still times the round trip
+	answer := func(id string) error {
+		return listener.HandleEvent(ctx, JsonRpcEvent{Id: id, Params: nil})
+	}
+
+	first := probe()
+	second := probe()
+	if err := answer(first); err != nil || len(measured) != 0 {
+		t.Fatalf("expected a response to a superseded probe dropped, got %v (%d measured)", err, len(measured))
+	}
+	if err := answer(second); err != nil || len(measured) != 1 {
+		t.Fatalf("expected the pending probe timed, got %v (%d measured)", err, len(measured))
+	}
+	if err := answer(second); err != nil || len(measured) != 1 {
+		t.Fatalf("expected a probe only timed once, got %v (%d measured)", err, len(measured))
+	}
+	if atomic.LoadInt32(&ctx.unknownMethods) != 0 {
+		t.Fatalf("expected probe responses not handled as unknown methods")
+	}
+}
+
+func TestUnknownMethod(t *testing.T) {
+	unknown := NewEvent("7", "mining.something_new", nil)
+	newListener := func(policy UnknownMethodPolicy, counted *int) *StratumListener {
+		cfg := DefaultConfig(zap.NewNop())
+		cfg.UnknownMethodPolicy = policy
+		cfg.UnknownMethodLimit = 2
+		cfg.OnUnknownMethod = func(_ *StratumContext, method string) {
+			if method != string(unknown.Method) {
+				t.Errorf("unexpected method counted: %s", method)
+			}
+			*counted++
+		}
+		return NewListener(cfg)
+	}
+	// handles the event, returning the reply sent (if any) and the handler error
+	handle := func(listener *StratumListener, ctx *StratumContext, mc *MockConnection) (*JsonRpcResponse, error) {
+		result := make(chan error, 1)
+		go func() { result <- listener.HandleEvent(ctx, unknown) }()
+		var reply *JsonRpcResponse
+		select {
+		case err := <-result:
+			return nil, err
+		case b := <-mc.outChan:
+			reply = &JsonRpcResponse{}
+			if err := json.Unmarshal(b, reply); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return reply, <-result
+	}
+
+	t.Run("error", func(t *testing.T) {
+		counted := 0
+		listener := newListener(UnknownMethodError, &counted)
+		ctx, mc := NewMockContext(context.Background(), zap.NewNop(), nil)
+		for i := 0; i < 3; i++ {
+			reply, err := handle(listener, ctx, mc)
+			if err != nil {
+				t.Fatalf("expected client to stay connected, got %s", err)
+			}
+			if reply == nil || cmp.Diff([]any{-32601.0, "Method not found", nil}, reply.Error) != "" {
+				t.Fatalf("expected method not found reply, got %+v", reply)
+			}
+		}
+		if counted != 3 {
+			t.Fatalf("expected 3 unknown methods counted, got %d", counted)
+		}
+	})
+
+	t.Run("ignore", func(t *testing.T) {
+		counted := 0
+		listener := newListener(UnknownMethodIgnore, &counted)
+		ctx, mc := NewMockContext(context.Background(), zap.NewNop(), nil)
+		reply, err := handle(listener, ctx, mc)
+		if err != nil || reply != nil {
+			t.Fatalf("expected unknown method to be ignored, got %+v, %v", reply, err)
+		}
+		if counted != 1 {
+			t.Fatalf("expected ignored method to still be counted")
+		}
+	})
+
+	t.Run("disconnect after limit", func(t *testing.T) {
+		counted := 0
+		listener := newListener(UnknownMethodDisconnect, &counted)
+		ctx, mc := NewMockContext(context.Background(), zap.NewNop(), nil)
+		if _, err := handle(listener, ctx, mc); err != nil {
+			t.Fatalf("expected client to stay connected below the limit, got %s", err)
+		}
+		reply, err := handle(listener, ctx, mc)
+		if reply == nil {
+			t.Fatalf("expected an error reply before disconnecting")
+		}
+		if !errors.Is(err, ErrTooManyUnknownMethods) {
+			t.Fatalf("expected too many unknown methods error, got %v", err)
+		}
+	})
+}
+
+func TestDisconnectOnce(t *testing.T) {
+	ctx := &StratumContext{Logger: zap.NewNop(), onDisconnect: make(chan *StratumContext, 8)}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx.Disconnect()
+		}()
+	}
+	wg.Wait()
+	if ctx.Connected() || len(ctx.onDisconnect) != 1 {
+		t.Fatalf("expected a single disconnect, got %d", len(ctx.onDisconnect))
+	}
+	if err := ctx.Send(JsonRpcEvent{Method: "mining.notify"}); !errors.Is(err, ErrorDisconnected) {
+		t.Fatalf("expected sends refused once disconnecting, got %v", err)
+	}
+}
+
+type captureClientListener struct {
+	connected chan *StratumContext
+}
+
+func (c captureClientListener) OnConnect(ctx *StratumContext) { c.connected <- ctx }
+func (captureClientListener) OnDisconnect(*StratumContext)    {}
+
+func TestBandwidthAccounting(t *testing.T) {
+	cfg := DefaultConfig(zap.NewNop())
+	capture := captureClientListener{connected: make(chan *StratumContext, 1)}
+	cfg.ClientListener = capture
+	listener := NewListener(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	mc := NewMockConnection()
+	listener.newClient(ctx, mc)
+	client := <-capture.connected
+
+	event, _ := json.Marshal(NewEvent("1", "mining.subscribe", []any{"test.miner/1.0"}))
+	mc.AsyncWriteTestDataToReadBuffer(string(event))
+	written := 0
+	mc.ReadTestDataFromBuffer(func(b []byte) { written = len(b) })
+
+	// the write is tallied once it returns, which can be just after the
+	// data is handed to the mock
+	for i := 0; i < 100 && client.BytesWritten() != int64(written); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if client.BytesRead() != int64(len(event)) {
+		t.Fatalf("expected %d bytes read, got %d", len(event), client.BytesRead())
+	}
+	if client.BytesWritten() != int64(written) {
+		t.Fatalf("expected %d bytes written, got %d", written, client.BytesWritten())
+	}
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "stratum.sock")
+	cfg := DefaultConfig(zap.NewNop())
+	cfg.Port = "unix://" + socket
+	capture := captureClientListener{connected: make(chan *StratumContext, 1)}
+	cfg.ClientListener = capture
+	listener := NewListener(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- listener.Listen(ctx) }()
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("unix", socket); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if client := <-capture.connected; client.RemoteAddr != "unix" {
+		t.Fatalf("expected unix remote address, got %s", client.RemoteAddr)
+	}
+
+	cancel()
+	<-done
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Fatalf("expected socket file to be removed on shutdown, got %v", err)
+	}
+}
+
+// blockingClientListener holds every connect until released
+type blockingClientListener struct {
+	entered chan *StratumContext
+	release chan struct{}
+}
+
+func (b blockingClientListener) OnConnect(ctx *StratumContext) {
+	b.entered <- ctx
+	<-b.release
+}
+func (blockingClientListener) OnDisconnect(*StratumContext) {}
+
+func TestAcceptQueue(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "stratum.sock")
+	cfg := DefaultConfig(zap.NewNop())
+	cfg.Port = "unix://" + socket
+	cfg.AcceptBacklog = 16
+	cfg.AcceptWorkers, cfg.AcceptQueue = 1, 1
+	clients := blockingClientListener{entered: make(chan *StratumContext, 2), release: make(chan struct{})}
+	cfg.ClientListener = clients
+	accepts := make(chan bool, 3)
+	cfg.OnAccept = func(accepted bool) { accepts <- accepted }
+	listener := NewListener(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- listener.Listen(ctx) }()
+	dial := func() net.Conn {
+		var conn net.Conn
+		var err error
+		for i := 0; i < 100; i++ {
+			if conn, err = net.Dial("unix", socket); err == nil {
+				return conn
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal(err)
+		return nil
+	}
+
+	// the only worker is stuck setting up the first connection, the second
+	// waits in the queue and the third has nowhere to go
+	first := dial()
+	defer first.Close()
+	<-clients.entered
+	second := dial()
+	defer second.Close()
+	third := dial()
+	defer third.Close()
+	for _, expected := range []bool{true, true, false} {
+		if accepted := <-accepts; accepted != expected {
+			t.Fatalf("expected accepted %t, got %t", expected, accepted)
+		}
+	}
+	third.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := third.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected the dropped connection closed")
+	}
+
+	close(clients.release)
+	<-clients.entered
+	cancel()
+	<-done
+}
+
+func TestSubscribeResponse(t *testing.T) {
+	subscribe := NewEvent("1", string(StratumMethodSubscribe), []any{"test.miner/1.0"})
+	tests := []struct {
+		name       string
+		format     SubscribeFormat
+		sessionId  string
+		extranonce string
+		expect     string
+	}{
+		{"default", SubscribeFormatDefault, "", "0a0b",
+			`{"id":"1","result":[true,"EthereumStratum/1.0.0"],"error":null}` + "\n"},
+		{"nicehash", SubscribeFormatNiceHash, "0000002a", "0a0b",
+			`{"id":"1","result":[["mining.notify","0000002a","EthereumStratum/1.0.0"],"0a0b"],"error":null}` + "\n"},
+		{"nicehash upper case", SubscribeFormatNiceHash, "0000002A", "0A0B",
+			`{"id":"1","result":[["mining.notify","0000002A","EthereumStratum/1.0.0"],"0A0B"],"error":null}` + "\n"},
+		{"nicehash without extranonce", SubscribeFormatNiceHash, "", "",
+			`{"id":"1","result":[["mining.notify","0000002a","EthereumStratum/1.0.0"],""],"error":null}` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, mc := NewMockContext(context.Background(), zap.NewNop(), nil)
+			ctx.Id, ctx.SessionId, ctx.Extranonce = 42, tt.sessionId, tt.extranonce
+
+			reply := make(chan string, 1)
+			mc.AsyncReadTestDataFromBuffer(func(b []byte) { reply <- string(b) })
+			if err := NewSubscribeHandler(tt.format)(ctx, subscribe); err != nil {
+				t.Fatal(err)
+			}
+			if got := <-reply; got != tt.expect {
+				t.Fatalf("unexpected subscribe response\nexpected: %s\ngot:      %s", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	ctx, mc := NewMockContext(context.Background(), zap.NewNop(), nil)
+	if caps := ctx.Capabilities(); caps != (Capabilities{}) || caps.String() != "" {
+		t.Fatalf("expected nothing detected before the handshake, got %+v", caps)
+	}
+	handlers := DefaultHandlers()
+	for _, event := range []JsonRpcEvent{
+		NewEvent("1", string(StratumMethodSubscribe), []any{"test.miner/1.0", "EthereumStratum/1.0.0"}),
+		NewEvent("2", string(StratumMethodExtranonceSubscribe), nil),
+		NewEvent("3", string(StratumMethodSuggestTarget), []any{"00ff"}),
+	} {
+		mc.AsyncReadTestDataFromBuffer(func([]byte) {})
+		if err := handlers[string(event.Method)](ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := Capabilities{Protocol: "EthereumStratum/1.0.0", ExtranonceSubscribe: true, SuggestTarget: true}
+	if caps := ctx.Capabilities(); caps != expected {
+		t.Fatalf("expected %+v detected, got %+v", expected, caps)
+	}
+	if caps := ctx.Capabilities().String(); caps != "EthereumStratum/1.0.0, extranonce.subscribe, suggest_target" {
+		t.Fatalf("unexpected capabilities summary %q", caps)
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	ctx, mc := NewMockContext(context.Background(), zap.NewNop(), nil)
+	replies := make(chan []byte, 1)
+	mc.AsyncReadTestDataFromBuffer(func(data []byte) { replies <- data })
+	event := NewEvent("1", string(StratumMethodConfigure), []any{
+		[]any{"version-rolling", "minimum-difficulty"},
+		map[string]any{"version-rolling.mask": "1fffe000", "version-rolling.min-bit-count": 2},
+	})
+	if err := DefaultHandlers()[string(StratumMethodConfigure)](ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	var reply struct {
+		Result map[string]any `json:"result"`
+		Error  any            `json:"error"`
+	}
+	if err := json.Unmarshal(<-replies, &reply); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]any{"version-rolling": false, "minimum-difficulty": false}
+	if reply.Error != nil || !cmp.Equal(reply.Result, expected) {
+		t.Fatalf("expected every extension declined, got %+v", reply)
+	}
+	if ctx.Capabilities() != (Capabilities{}) {
+		t.Fatalf("expected nothing negotiated")
+	}
+}
+
+func TestRemoteHost(t *testing.T) {
+	tests := []struct {
+		addr       string
+		keepMapped bool
+		expected   string
+	}{
+		{"1.2.3.4:5555", false, "1.2.3.4"},
+		{"[::ffff:1.2.3.4]:5555", false, "1.2.3.4"},
+		{"[::ffff:1.2.3.4]:5555", true, "::ffff:1.2.3.4"},
+		{"1.2.3.4:5555", true, "1.2.3.4"},
+		{"[2001:DB8:0::1]:5555", false, "2001:db8::1"},
+		{"[fe80::1%eth0]:5555", false, "fe80::1%eth0"},
+		{"::ffff:1.2.3.4", false, "1.2.3.4"},
+		{"@", false, "@"},
+	}
+	for _, tt := range tests {
+		if host := remoteHost(tt.addr, tt.keepMapped); host != tt.expected {
+			t.Fatalf("expected %s for %s (keep mapped %t), got %s", tt.expected, tt.addr, tt.keepMapped, host)
+		}
+	}
+}
+
+func TestStopAccepting(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "stratum.sock")
+	cfg := DefaultConfig(zap.NewNop())
+	cfg.Port = "unix://" + socket
+	capture := captureClientListener{connected: make(chan *StratumContext, 1)}
+	cfg.ClientListener = capture
+	listener := NewListener(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- listener.Listen(ctx) }()
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("unix", socket); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-capture.connected
+
+	listener.StopAccepting()
+	if late, err := net.Dial("unix", socket); err == nil {
+		late.Close()
+		t.Fatalf("expected new connections to be refused after StopAccepting")
+	}
+
+	// the connected client is still served
+	subscribe, _ := json.Marshal(NewEvent("1", string(StratumMethodSubscribe), []any{"test.miner/1.0"}))
+	if _, err := conn.Write(append(subscribe, '\n')); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reply := make([]byte, 256)
+	n, err := conn.Read(reply)
+	if err != nil {
+		t.Fatalf("expected the connected client to get a reply, got %s", err)
+	}
+	if !strings.Contains(string(reply[:n]), "EthereumStratum/1.0.0") {
+		t.Fatalf("unexpected reply %s", reply[:n])
+	}
+
+	cancel()
+	<-done
+}
+
+func TestAuthorizeErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		params []any
+		err    error
+		reply  []any
+	}{
+		{"no params", nil, ErrMalformedAuthorize,
+			[]any{24.0, `Malformed authorize, expected ["address.worker", "password"]`, nil}},
+		{"address not a string", []any{42.0, "x"}, ErrMalformedAuthorize,
+			[]any{24.0, `Malformed authorize, expected ["address.worker", "password"]`, nil}},
+		{"bad address", []any{"pyrin:nope.rig1", "x"}, ErrInvalidWallet,
+			[]any{24.0, "Invalid wallet address, expected pyrin:<address>.<worker>", nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, mc := NewMockContext(context.Background(), zap.NewNop(), nil)
+			replies := make(chan []byte, 1)
+			mc.AsyncReadTestDataFromBuffer(func(b []byte) { replies <- b })
+
+			err := HandleAuthorize(ctx, NewEvent("1", string(StratumMethodAuthorize), tt.params))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			decoded := JsonRpcResponse{}
+			if err := json.Unmarshal(<-replies, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tt.reply, decoded.Error); d != "" {
+				t.Fatalf("unexpected authorize error reply: %s", d)
+			}
+			if ctx.Authorized() {
+				t.Fatalf("expected the client not to be authorized")
+			}
+		})
+	}
+}
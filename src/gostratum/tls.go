@@ -0,0 +1,99 @@
+package gostratum
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// CertReloader serves the tls certificate from disk, picking up renewals
+// (e.g. from certbot) for new connections without a restart. The files are
+// only stat'd per handshake, the certificate itself is cached until either
+// file changes. Established connections keep their negotiated session
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	logger   *zap.Logger
+
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+	certMod  time.Time
+	keyMod   time.Time
+	certSize int64
+	keySize  int64
+}
+
+func NewCertReloader(certFile, keyFile string, logger *zap.Logger) (*CertReloader, error) {
+	cr := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+	}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// TLSConfig returns a server config using the reloader for certificates
+func (cr *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.GetCertificate,
+	}
+}
+
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cr.changed() {
+		if err := cr.reload(); err != nil {
+			// likely caught mid-renewal, keep serving the previous cert
+			cr.logger.Warn("failed reloading tls certificate, using previous", zap.Error(err))
+		}
+	}
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	return cr.cert, nil
+}
+
+func (cr *CertReloader) changed() bool {
+	certInfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return false
+	}
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	return !certInfo.ModTime().Equal(cr.certMod) || certInfo.Size() != cr.certSize ||
+		!keyInfo.ModTime().Equal(cr.keyMod) || keyInfo.Size() != cr.keySize
+}
+
+func (cr *CertReloader) reload() error {
+	// stat before reading so a change during the read is picked up next time
+	certInfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return errors.Wrap(err, "failed reading tls certificate")
+	}
+	keyInfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "failed reading tls key")
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "failed loading tls certificate")
+	}
+
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	cr.cert = &cert
+	cr.certMod, cr.certSize = certInfo.ModTime(), certInfo.Size()
+	cr.keyMod, cr.keySize = keyInfo.ModTime(), keyInfo.Size()
+	cr.logger.Info("loaded tls certificate", zap.String("cert", cr.certFile))
+	return nil
+}
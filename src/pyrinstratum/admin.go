@@ -0,0 +1,175 @@
+package pyrinstratum
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// adminServer exposes operational actions over http. It runs on its own port
+// and mux, separate from prom/health check, since it can change bridge state
+type adminServer struct {
+	logger  *zap.SugaredLogger
+	pyApi   *PyrinApi
+	clients *clientListener
+	token   string
+}
+
+func newAdminServer(logger *zap.SugaredLogger, pyApi *PyrinApi, clients *clientListener, token string) *adminServer {
+	return &adminServer{
+		logger:  logger.With(zap.String("server", "admin")),
+		pyApi:   pyApi,
+		clients: clients,
+		token:   token,
+	}
+}
+
+func (as *adminServer) mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/nodes", as.authorized(http.MethodGet, as.handleNodes))
+	mux.HandleFunc("/admin/nodes/drain", as.authorized(http.MethodPost, as.handleDrain(true)))
+	mux.HandleFunc("/admin/nodes/undrain", as.authorized(http.MethodPost, as.handleDrain(false)))
+	mux.HandleFunc("/admin/workers", as.authorized(http.MethodGet, as.handleWorkers))
+	mux.HandleFunc("/admin/workers/kick", as.authorized(http.MethodPost, as.handleKick))
+	mux.HandleFunc("/admin/workers/difficulty", as.authorized(http.MethodGet, as.handleDifficulty))
+	mux.HandleFunc("/admin/blocks/rejected", as.authorized(http.MethodGet, as.handleRejectedBlocks))
+	mux.HandleFunc("/admin/maintenance", as.authorized(http.MethodGet, as.handleMaintenanceStatus))
+	mux.HandleFunc("/admin/maintenance/enable", as.authorized(http.MethodPost, as.handleMaintenance(true)))
+	mux.HandleFunc("/admin/maintenance/disable", as.authorized(http.MethodPost, as.handleMaintenance(false)))
+	mux.HandleFunc("/status", as.authorized(http.MethodGet, as.handleStatus))
+	return mux
+}
+
+func (as *adminServer) start(port string) {
+	if as.token == "" {
+		as.logger.Warn("admin_token not set, admin endpoint is unauthenticated and refuses every action (POST)")
+	}
+	as.logger.Info("hosting admin endpoint on ", port, "/admin")
+	go func() {
+		if err := http.ListenAndServe(port, as.mux()); err != nil {
+			as.logger.Error("error serving admin endpoint", zap.Error(err))
+		}
+	}()
+}
+
+// authorized serves the handler for requests with the admin token. Without a
+// token configured the read only (GET) requests are served to anyone
+// reaching the port, the ones changing bridge state are refused
+func (as *adminServer) authorized(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if as.token == "" && method != http.MethodGet {
+			http.Error(w, "admin_token not set, admin actions are disabled", http.StatusForbidden)
+			return
+		}
+		if as.token != "" {
+			expected := "Bearer " + as.token
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+func (as *adminServer) handleNodes(w http.ResponseWriter, _ *http.Request) {
+	writeJson(w, as.pyApi.NodeStatuses())
+}
+
+func (as *adminServer) handleDrain(draining bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		address := r.URL.Query().Get("address")
+		if address == "" {
+			http.Error(w, "missing node address", http.StatusBadRequest)
+			return
+		}
+		if err := as.pyApi.SetDraining(address, draining); err != nil {
+			if errors.Is(err, ErrUnknownNode) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		as.logger.Info("admin request updated node drain state",
+			zap.String("node", address), zap.Bool("draining", draining))
+		writeJson(w, as.pyApi.NodeStatuses())
+	}
+}
+
+// handleKick disconnects a misbehaving worker, matched by worker name (or
+// wallet.worker) or every connection from an ip
+func (as *adminServer) handleKick(w http.ResponseWriter, r *http.Request) {
+	worker, ip := r.URL.Query().Get("worker"), r.URL.Query().Get("ip")
+	if worker == "" && ip == "" {
+		http.Error(w, "missing worker or ip", http.StatusBadRequest)
+		return
+	}
+	kicked := as.clients.kickClients(worker, ip)
+	if len(kicked) == 0 {
+		http.Error(w, "no matching clients connected", http.StatusNotFound)
+		return
+	}
+	as.logger.Info("admin request disconnected clients",
+		zap.String("worker", worker), zap.String("ip", ip), zap.Int("count", len(kicked)))
+	writeJson(w, kicked)
+}
+
+// handleDifficulty reports the difficulty matching workers (by worker name,
+// wallet.worker or ip) are mining at and what set it
+func (as *adminServer) handleDifficulty(w http.ResponseWriter, r *http.Request) {
+	worker, ip := r.URL.Query().Get("worker"), r.URL.Query().Get("ip")
+	if worker == "" && ip == "" {
+		http.Error(w, "missing worker or ip", http.StatusBadRequest)
+		return
+	}
+	difficulties := as.clients.workerDifficulties(worker, ip)
+	if len(difficulties) == 0 {
+		http.Error(w, "no matching clients mining", http.StatusNotFound)
+		return
+	}
+	writeJson(w, difficulties)
+}
+
+// handleRejectedBlocks lists the most recent blocks no node took, newest
+// first
+func (as *adminServer) handleRejectedBlocks(w http.ResponseWriter, _ *http.Request) {
+	rejected := []RejectedBlock{}
+	if as.clients.shareHandler != nil {
+		rejected = as.clients.shareHandler.rejections.recent()
+	}
+	writeJson(w, rejected)
+}
+
+func (as *adminServer) handleMaintenanceStatus(w http.ResponseWriter, _ *http.Request) {
+	writeJson(w, as.clients.maintenanceStatus())
+}
+
+// handleMaintenance enters or leaves maintenance mode, entering takes an
+// optional message shown to miners instead of the configured one
+func (as *adminServer) handleMaintenance(enable bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var changed bool
+		if enable {
+			changed = as.clients.enterMaintenance(r.URL.Query().Get("message"))
+		} else {
+			changed = as.clients.exitMaintenance()
+		}
+		if changed {
+			as.logger.Info("admin request updated maintenance mode", zap.Bool("enabled", enable))
+		}
+		writeJson(w, as.clients.maintenanceStatus())
+	}
+}
+
+func writeJson(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,84 @@
+package pyrinstratum
+
+import (
+	"math"
+	"time"
+)
+
+const defaultBlockWaitMax = 5 * time.Second
+
+// the fallback fires once a notification is this many typical intervals
+// overdue
+const blockWaitIntervals = 3
+
+// weight of the latest interval in the running average
+const blockWaitSmoothing = 0.1
+
+// adjustments smaller than this fraction of the last logged wait aren't
+// logged
+const blockWaitLogChange = 0.25
+
+// adaptiveBlockWait tunes the template polling fallback to the node's
+// notification cadence, within [min, max]. While notifications keep arriving
+// on cadence the fallback waits blockWaitIntervals typical intervals, so it
+// rarely fires against a reliable node. Each time it does fire a notification
+// was missed, and the wait is halved so gaps in sparse or unreliable
+// notifications are covered quickly, growing back as notifications arrive
+// on time again
+type adaptiveBlockWait struct {
+	min, max time.Duration
+	current  time.Duration
+	logged   time.Duration
+	// average seconds between notifications, 0 until the first interval
+	interval float64
+	last     time.Time
+	missed   bool
+}
+
+func newAdaptiveBlockWait(initial, min, max time.Duration) *adaptiveBlockWait {
+	initial = time.Duration(math.Max(float64(min), math.Min(float64(max), float64(initial))))
+	return &adaptiveBlockWait{min: min, max: max, current: initial, logged: initial}
+}
+
+// notified records a notification at now and returns the wait until the
+// next fallback poll
+func (a *adaptiveBlockWait) notified(now time.Time) time.Duration {
+	// gaps the fallback had to cover are misses, not the cadence
+	if !a.last.IsZero() && !a.missed {
+		sample := now.Sub(a.last).Seconds()
+		if a.interval == 0 {
+			a.interval = sample
+		} else {
+			a.interval += blockWaitSmoothing * (sample - a.interval)
+		}
+	}
+	a.last, a.missed = now, false
+	if a.interval == 0 {
+		return a.current
+	}
+	target := time.Duration(blockWaitIntervals * a.interval * float64(time.Second))
+	target = time.Duration(math.Max(float64(a.min), math.Min(float64(a.max), float64(target))))
+	if target < a.current {
+		a.current = target
+	} else {
+		a.current = time.Duration(math.Min(float64(target), float64(a.current+a.current/4)))
+	}
+	return a.current
+}
+
+// polled records the fallback firing and returns the wait until the next one
+func (a *adaptiveBlockWait) polled() time.Duration {
+	a.missed = true
+	a.current = time.Duration(math.Max(float64(a.min), float64(a.current/2)))
+	return a.current
+}
+
+// adjusted reports whether the wait moved far enough from the last reported
+// one to be worth logging, and marks it reported
+func (a *adaptiveBlockWait) adjusted() bool {
+	if math.Abs(float64(a.current-a.logged)) < blockWaitLogChange*float64(a.logged) {
+		return false
+	}
+	a.logged = a.current
+	return true
+}
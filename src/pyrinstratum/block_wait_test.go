@@ -0,0 +1,51 @@
+package pyrinstratum
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveBlockWait(t *testing.T) {
+	wait := newAdaptiveBlockWait(500*time.Millisecond, 500*time.Millisecond, 5*time.Second)
+	now := time.Now()
+	if got := wait.notified(now); got != 500*time.Millisecond {
+		t.Fatalf("expected the initial wait before any interval is known, got %s", got)
+	}
+
+	// reliable once a second notifications grow the wait gradually up to 3s
+	var got time.Duration
+	for i := 0; i < 20; i++ {
+		now = now.Add(time.Second)
+		got = wait.notified(now)
+	}
+	if got != 3*time.Second {
+		t.Fatalf("expected the wait to settle at 3 intervals, got %s", got)
+	}
+	if !wait.adjusted() || wait.adjusted() {
+		t.Fatalf("expected the adjustment reported once")
+	}
+
+	// a missed notification halves it, and the gap isn't taken as cadence
+	if got := wait.polled(); got != 1500*time.Millisecond {
+		t.Fatalf("expected the wait halved after polling, got %s", got)
+	}
+	wait.polled()
+	wait.polled()
+	if got := wait.polled(); got != 500*time.Millisecond {
+		t.Fatalf("expected the wait held at the min, got %s", got)
+	}
+	now = now.Add(10 * time.Second)
+	wait.notified(now)
+	if wait.interval < 0.99 || wait.interval > 1.01 {
+		t.Fatalf("expected the missed gap left out of the cadence, got %f", wait.interval)
+	}
+
+	// sparse notifications are capped at the max
+	for i := 0; i < 100; i++ {
+		now = now.Add(4 * time.Second)
+		got = wait.notified(now)
+	}
+	if got != 5*time.Second {
+		t.Fatalf("expected the wait capped at the max, got %s", got)
+	}
+}
@@ -1,16 +1,19 @@
 package pyrinstratum
 
 import (
+	"bytes"
 	"fmt"
 	"math"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
 	"github.com/pkg/errors"
+	"github.com/pyrin-network/pyipad/app/appmessage"
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
 	"go.uber.org/zap"
 )
 
@@ -18,29 +21,98 @@ var bigJobRegex = regexp.MustCompile(".*BzMiner.*")
 
 const balanceDelay = time.Minute
 
+// how long an authorized client that hasn't subscribed yet is held before
+// being sent work anyway, a late subscribe still tells us the miner software
+// (and so the job format to use)
+const subscribeGrace = 5 * time.Second
+
+// how long a disconnected worker's per-worker series are kept around before
+// being dropped, gives rigs that briefly drop a chance to reconnect
+const workerMetricRetention = 15 * time.Minute
+
 type clientListener struct {
-	logger           *zap.SugaredLogger
-	shareHandler     *shareHandler
-	clientLock       sync.RWMutex
-	clients          map[int32]*gostratum.StratumContext
-	lastBalanceCheck time.Time
-	clientCounter    int32
-	minShareDiff     float64
-	extranonceSize   int8
-	maxExtranonce    int32
-	nextExtranonce   int32
-}
-
-func newClientListener(logger *zap.SugaredLogger, shareHandler *shareHandler, minShareDiff float64, extranonceSize int8) *clientListener {
+	logger            *zap.SugaredLogger
+	shareHandler      *shareHandler
+	clientLock        sync.RWMutex
+	clients           map[int32]*gostratum.StratumContext
+	lastBalanceCheck  time.Time
+	clientCounter     int32
+	minShareDiff      float64
+	extranonceSize    int8
+	extranonce2Size   int
+	maxExtranonce     int32
+	nextExtranonce    int32
+	connectionLabeler ConnectionLabeler
+	diffMemory        *diffMemory
+	// nil if vardiff is disabled
+	vardiff *vardiffConfig
+	// when non-zero a template identical to the last one pushed to a client
+	// is skipped, unless it's been this long since that push
+	templateRefresh time.Duration
+	// max connections authorized per wallet address, 0 for no limit
+	maxWalletConnections int
+	// hex sent to clients (extranonce, session id) is upper case
+	uppercaseHex bool
+	// share difficulty bounds set relative to the network difficulty
+	relativeDiff relativeDiff
+	// clients are told the network difficulty, see noticeNetworkDiff
+	networkDiffNotice bool
+	// nil unless extranonces are leased to connections, see extranoncePool
+	extranonces *extranoncePool
+	// when non-zero a client is sent at most one job per interval, new
+	// templates in between are coalesced into one push at the end of it
+	minJobInterval time.Duration
+	// when non-zero clients not sent a job for this long are sent their
+	// current one again, see startJobKeepalive
+	jobKeepalive time.Duration
+	// templates for a client's first job are fetched from as soon as its
+	// handshake completes, nil leaves it to the next new block
+	handshakeJobs *PyrinApi
+	// payout addresses allowed to authorize
+	walletAccess walletAccess
+	// counts reconnects per worker, nil doesn't
+	flaps *flapDetector
+	// traces each new block broadcast when set
+	tracer *tracer
+	// planned downtime, see enterMaintenance
+	maintenance maintenanceMode
+	// how long disconnecting every client takes when entering maintenance,
+	// and the message miners are shown unless the request names one
+	maintenanceDrain   time.Duration
+	maintenanceMessage string
+	// applied to worker names at authorize, and to worker names in admin
+	// requests
+	workerNames gostratum.WorkerNameRules
+	// cleans up the address miners authorize with, nil validates it, see
+	// gostratum.SanitizeWallet for accept_any_address
+	cleanWallet gostratum.WalletCleaner
+	// ids jobs are sent under, sequential unless JobIdsDeterministic
+	jobIds JobIdMode
+	// when set called with false as the first client connects and with true
+	// as the last one disconnects, see pause_when_idle
+	onIdle func(idle bool)
+}
+
+func newClientListener(logger *zap.SugaredLogger, shareHandler *shareHandler, minShareDiff float64, extranonceSize int8, extranonce2Size int, diffMemoryTTL, templateRefresh time.Duration, maxWalletConnections int, vardiff *vardiffConfig, labeler ConnectionLabeler) *clientListener {
+	if labeler == nil {
+		labeler = noopConnectionLabeler{}
+	}
 	return &clientListener{
-		logger:         logger,
-		minShareDiff:   minShareDiff,
-		extranonceSize: extranonceSize,
-		maxExtranonce:  int32(math.Pow(2, (8*math.Min(float64(extranonceSize), 3))) - 1),
-		nextExtranonce: 0,
-		clientLock:     sync.RWMutex{},
-		shareHandler:   shareHandler,
-		clients:        make(map[int32]*gostratum.StratumContext),
+		logger:            logger,
+		minShareDiff:      minShareDiff,
+		extranonceSize:    extranonceSize,
+		extranonce2Size:   extranonce2Size,
+		maxExtranonce:     int32(math.Pow(2, (8*math.Min(float64(extranonceSize), 3))) - 1),
+		nextExtranonce:    0,
+		clientLock:        sync.RWMutex{},
+		shareHandler:      shareHandler,
+		clients:           make(map[int32]*gostratum.StratumContext),
+		connectionLabeler: labeler,
+		diffMemory:        newDiffMemory(diffMemoryTTL, maxDiffMemoryEntries),
+		vardiff:           vardiff,
+		templateRefresh:   templateRefresh,
+
+		maxWalletConnections: maxWalletConnections,
 	}
 }
 
@@ -49,23 +121,34 @@ func (c *clientListener) OnConnect(ctx *gostratum.StratumContext) {
 
 	idx := atomic.AddInt32(&c.clientCounter, 1)
 	ctx.Id = idx
+	state := GetMiningState(ctx)
 	c.clientLock.Lock()
 	if c.extranonceSize > 0 {
-		extranonce = c.nextExtranonce
-		if c.nextExtranonce < c.maxExtranonce {
-			c.nextExtranonce++
-		} else {
-			c.nextExtranonce = 0
-			c.logger.Warn("wrapped extranonce! new clients may be duplicating work...")
-		}
+		extranonce, state.extranonceLeased = c.assignExtranonce()
+		state.extranonce = extranonce
 	}
 	c.clients[idx] = ctx
+	if c.onIdle != nil && len(c.clients) == 1 {
+		c.onIdle(false)
+	}
 	c.clientLock.Unlock()
 	ctx.Logger = ctx.Logger.With(zap.Int("client_id", int(ctx.Id)))
 
+	hexFormat := "%0*x"
+	if c.uppercaseHex {
+		hexFormat = "%0*X"
+	}
+	ctx.SessionId = fmt.Sprintf(hexFormat, 8, idx)
 	if c.extranonceSize > 0 {
-		ctx.Extranonce = fmt.Sprintf("%0*x", c.extranonceSize*2, extranonce)
+		ctx.Extranonce = fmt.Sprintf(hexFormat, c.extranonceSize*2, extranonce)
+		ctx.Extranonce2Size = c.extranonce2Size
 	}
+
+	state.deterministicJobs = c.jobIds == JobIdsDeterministic
+	state.origin = labelConnection(c.connectionLabeler, ctx.RemoteAddr)
+	RecordConnectionOrigin(state.origin, 1)
+	RecordPortConnection(ctx.ListenPort, 1)
+
 	go func() {
 		// hacky, but give time for the authorize to go through so we can use the worker name
 		time.Sleep(5 * time.Second)
@@ -77,92 +160,426 @@ func (c *clientListener) OnDisconnect(ctx *gostratum.StratumContext) {
 	ctx.Done()
 	c.clientLock.Lock()
 	c.logger.Info("removing client ", ctx.Id)
+	reportBandwidth(ctx)
 	delete(c.clients, ctx.Id)
+	state := GetMiningState(ctx)
+	if state.extranonceLeased {
+		c.extranonces.release(state.extranonce, time.Now())
+	}
 	c.logger.Info("removed client ", ctx.Id)
+	if c.onIdle != nil && len(c.clients) == 0 {
+		c.onIdle(true)
+	}
 	c.clientLock.Unlock()
 	RecordDisconnect(ctx)
+	RecordConnectionOrigin(state.origin, -1)
+	RecordPortConnection(ctx.ListenPort, -1)
+	if state.minerApp != "" {
+		RecordMinerApp(state.minerApp, -1)
+	}
+	state.ReleaseJobs()
+	state.pushLock.Lock()
+	if state.initialized && ctx.WalletAddr != "" {
+		c.diffMemory.remember(diffMemoryKey(ctx), state.stratumDiff.diffValue)
+	}
+	state.pushLock.Unlock()
+
+	// a hashrate is only meaningful while connected, the last share is kept
+	// around for the retention period
+	if !c.workerConnected(ctx) {
+		RemoveWorkerHashrate(ctx)
+	}
+	time.AfterFunc(workerMetricRetention, func() {
+		if !c.workerConnected(ctx) {
+			RemoveWorkerLastShare(ctx)
+		}
+	})
 }
 
-func (c *clientListener) NewBlockAvailable(kapi *PyrinApi) {
-	c.clientLock.Lock()
-	addresses := make([]string, 0, len(c.clients))
+// workerConnected returns true if a client with the same identity (and thus
+// the same prom labels) as the provided context is currently connected
+func (c *clientListener) workerConnected(ctx *gostratum.StratumContext) bool {
+	c.clientLock.RLock()
+	defer c.clientLock.RUnlock()
 	for _, cl := range c.clients {
-		if !cl.Connected() {
+		if cl.WorkerName == ctx.WorkerName && cl.WalletAddr == ctx.WalletAddr &&
+			cl.RemoteAddr == ctx.RemoteAddr && cl.RemoteApp == ctx.RemoteApp {
+			return true
+		}
+	}
+	return false
+}
+
+// KickedClient describes a connection closed through the admin endpoint
+type KickedClient struct {
+	Id         int32  `json:"id"`
+	Wallet     string `json:"wallet"`
+	Worker     string `json:"worker"`
+	RemoteAddr string `json:"remote_addr"`
+}
+
+// kickClients disconnects every client matching the worker (either the
+// worker name or wallet.worker) or the ip, whichever is set
+func (c *clientListener) kickClients(worker, ip string) []KickedClient {
+	// disconnecting removes the client through OnDisconnect, which needs the
+	// client lock, so only hold it while matching
+	matched := c.matchClients(worker, ip)
+	kicked := make([]KickedClient, 0, len(matched))
+	for _, cl := range matched {
+		cl.Logger.Warn("disconnecting client on admin request")
+		cl.Disconnect()
+		kicked = append(kicked, KickedClient{
+			Id:         cl.Id,
+			Wallet:     cl.WalletAddr,
+			Worker:     cl.WorkerName,
+			RemoteAddr: cl.RemoteAddr,
+		})
+	}
+	return kicked
+}
+
+// matchClients returns every client matching the worker or ip, see
+// kickClients. The worker is normalized the same way names are at authorize
+func (c *clientListener) matchClients(worker, ip string) []*gostratum.StratumContext {
+	if wallet, name, found := strings.Cut(worker, "."); found {
+		worker = wallet + "." + c.workerNames.Apply(name)
+	} else if worker != "" {
+		worker = c.workerNames.Apply(worker)
+	}
+	c.clientLock.RLock()
+	defer c.clientLock.RUnlock()
+	var matched []*gostratum.StratumContext
+	for _, cl := range c.clients {
+		if (worker != "" && (cl.WorkerName == worker || cl.WalletAddr+"."+cl.WorkerName == worker)) ||
+			(ip != "" && cl.RemoteAddr == ip) {
+			matched = append(matched, cl)
+		}
+	}
+	return matched
+}
+
+// WorkerDifficulty describes the difficulty a connected client is mining at
+// and what set it, returned by the admin endpoint
+type WorkerDifficulty struct {
+	Id         int32      `json:"id"`
+	Wallet     string     `json:"wallet"`
+	Worker     string     `json:"worker"`
+	RemoteAddr string     `json:"remote_addr"`
+	Difficulty float64    `json:"difficulty"`
+	Source     DiffSource `json:"source"`
+	// difficulty the miner asked for, through mining.suggest_difficulty or
+	// the password, 0 if it didn't
+	Requested float64 `json:"requested,omitempty"`
+	Vardiff   bool    `json:"vardiff"`
+}
+
+// workerDifficulties returns the difficulty of every client matching the
+// worker or ip, clients that haven't been sent a difficulty yet are skipped
+func (c *clientListener) workerDifficulties(worker, ip string) []WorkerDifficulty {
+	matched := c.matchClients(worker, ip)
+	difficulties := make([]WorkerDifficulty, 0, len(matched))
+	for _, cl := range matched {
+		diff := GetMiningState(cl).diffStatus()
+		if diff.diff.diffValue <= 0 {
 			continue
 		}
-		go func(client *gostratum.StratumContext) {
-			state := GetMiningState(client)
-			if client.WalletAddr == "" {
-				if time.Since(state.connectTime) > time.Second*20 { // timeout passed
-					// this happens pretty frequently in gcp/aws land since script-kiddies scrape ports
-					client.Logger.Warn("client misconfigured, no miner address specified - disconnecting", zap.String("client", client.String()))
-					RecordWorkerError(client.WalletAddr, ErrNoMinerAddress)
-					client.Disconnect() // invalid configuration, boot the worker
-				}
-				return
-			}
-			template, err := kapi.GetBlockTemplate(client)
-			if err != nil {
-				if strings.Contains(err.Error(), "Could not decode address") {
-					RecordWorkerError(client.WalletAddr, ErrInvalidAddressFmt)
-					client.Logger.Error(fmt.Sprintf("failed fetching new block template from pyrin, malformed address: %s", err))
-					client.Disconnect() // unrecoverable
-				} else {
-					RecordWorkerError(client.WalletAddr, ErrFailedBlockFetch)
-					client.Logger.Error(fmt.Sprintf("failed fetching new block template from pyrin: %s", err))
-				}
-				return
+		difficulties = append(difficulties, WorkerDifficulty{
+			Id:         cl.Id,
+			Wallet:     cl.WalletAddr,
+			Worker:     cl.WorkerName,
+			RemoteAddr: cl.RemoteAddr,
+			Difficulty: diff.diff.diffValue,
+			Source:     diff.source,
+			Requested:  diff.requested,
+			Vardiff:    diff.vardiff,
+		})
+	}
+	return difficulties
+}
+
+// startingDiffSource returns what the difficulty picked by startingDiff is
+// based on
+func (c *clientListener) startingDiffSource(state *MiningState) DiffSource {
+	if state.suggestedDiff > 0 {
+		return state.suggestedSource
+	}
+	return DiffSourceMinDiff
+}
+
+// startingDiff returns the difficulty a client starts mining at, the miner's
+// suggested difficulty if it sent one (within bounds), otherwise the min diff
+func (c *clientListener) startingDiff(state *MiningState) float64 {
+	if state.suggestedDiff > 0 {
+		if c.vardiff != nil {
+			return c.vardiff.clamp(state.suggestedDiff)
+		}
+		return math.Max(state.suggestedDiff, c.minDiff())
+	}
+	return c.minDiff()
+}
+
+var ErrWalletConnectionLimit = fmt.Errorf("too many connections for wallet")
+
+// walletConnections returns the number of connected clients other than ctx
+// authorized for the wallet
+func (c *clientListener) walletConnections(ctx *gostratum.StratumContext, wallet string) int {
+	c.clientLock.RLock()
+	defer c.clientLock.RUnlock()
+	count := 0
+	for _, cl := range c.clients {
+		if cl != ctx && cl.Connected() && cl.WalletAddr == wallet {
+			count++
+		}
+	}
+	return count
+}
+
+// HandleAuthorize wraps the default authorize handler, rejecting clients
+// while in maintenance or beyond the per wallet connection limit and
+// applying options the miner passed in the password field:
+//
+//	d=<difficulty>  a starting difficulty hint, handled like mining.suggest_difficulty
+//	                and clamped the same way
+//	hr=<hashrate>   the miner's own hashrate, e.g. `hr=120G` (H/s if no unit),
+//	                published next to the bridge's estimate
+//
+// Unknown options are ignored
+func (c *clientListener) HandleAuthorize(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent) error {
+	if message, maintenance := c.inMaintenance(); maintenance {
+		ctx.Logger.Info("rejecting client, bridge in maintenance")
+		RecordRejectedConnection("maintenance")
+		showMessage(ctx, message)
+		if err := ctx.ReplyMaintenance(event.Id, message); err != nil {
+			return err
+		}
+		return ErrMaintenance
+	}
+	if c.walletAccess.enabled() {
+		wallet, _, err := gostratum.ParseAuthorizeWith(event, c.cleanWallet)
+		if list := c.walletAccess.rejects(wallet); err == nil && list != "" {
+			ctx.Logger.Warn("rejecting client, wallet not allowed",
+				zap.String("wallet", wallet), zap.String("list", list))
+			RecordRejectedConnection("wallet_denied")
+			if err := ctx.ReplyWalletNotAllowed(event.Id); err != nil {
+				return err
 			}
-			state.bigDiff = CalculateTarget(uint64(template.Block.Header.Bits))
-			header, err := SerializeBlockHeader(template.Block)
-			if err != nil {
-				RecordWorkerError(client.WalletAddr, ErrBadDataFromMiner)
-				client.Logger.Error(fmt.Sprintf("failed to serialize block header: %s", err))
-				return
+			return errors.Wrapf(ErrWalletNotAllowed, "%s by %s", wallet, list)
+		}
+	}
+	if c.maxWalletConnections > 0 {
+		wallet, _, err := gostratum.ParseAuthorizeWith(event, c.cleanWallet)
+		if err == nil && c.walletConnections(ctx, wallet) >= c.maxWalletConnections {
+			ctx.Logger.Warn("rejecting client, too many connections for wallet",
+				zap.String("wallet", wallet), zap.Int("limit", c.maxWalletConnections))
+			RecordRejectedConnection("wallet_limit")
+			if err := ctx.ReplyConnectionLimit(event.Id); err != nil {
+				return err
 			}
-
-			jobId := state.AddJob(template.Block)
-			if !state.initialized {
-				state.initialized = true
-				state.useBigJob = bigJobRegex.MatchString(client.RemoteApp)
-				// first pass through send the difficulty since it's fixed
-				state.stratumDiff = newPyrinDiff()
-				state.stratumDiff.setDiffValue(c.minShareDiff)
-				if err := client.Send(gostratum.JsonRpcEvent{
-					Version: "2.0",
-					Method:  "mining.set_difficulty",
-					Params:  []any{state.stratumDiff.diffValue},
-				}); err != nil {
-					RecordWorkerError(client.WalletAddr, ErrFailedSetDiff)
-					client.Logger.Error(errors.Wrap(err, "failed sending difficulty").Error(), zap.Any("context", client))
-					return
+			// returning an error ends the client's read loop which disconnects it
+			return errors.Wrapf(ErrWalletConnectionLimit, "%d connections for %s", c.maxWalletConnections, wallet)
+		}
+	}
+	reconnects := 0
+	if c.flaps != nil {
+		if wallet, worker, err := gostratum.ParseAuthorizeWith(event, c.cleanWallet); err == nil {
+			var backoff time.Duration
+			reconnects, backoff = c.flaps.connect(wallet + "." + c.workerNames.Apply(worker))
+			if backoff > 0 {
+				ctx.Logger.Warn("rejecting client, worker reconnecting too often",
+					zap.String("wallet", wallet), zap.String("worker", worker),
+					zap.Int("reconnects", reconnects), zap.Duration("backoff", backoff))
+				RecordRejectedConnection("flapping")
+				if err := ctx.ReplyReconnectBackoff(event.Id, backoff); err != nil {
+					return err
 				}
+				return errors.Wrapf(ErrWorkerFlapping, "%d reconnects, backing off %s", reconnects, backoff)
 			}
+		}
+	}
+	if err := gostratum.HandleAuthorizeWith(ctx, event, c.workerNames, c.cleanWallet); err != nil {
+		return err
+	}
+	if c.flaps != nil {
+		RecordWorkerReconnects(ctx, reconnects)
+	}
+	// after the password options, the first job uses a difficulty hint
+	defer c.handshakeComplete(ctx)
+	state := GetMiningState(ctx)
+	state.authorizeTime = time.Now()
+	options := gostratum.PasswordOptions(event)
+	if raw, exists := options["hr"]; exists {
+		if rate, err := parseHashrate(raw); err != nil {
+			ctx.Logger.Warn(fmt.Sprintf("ignoring invalid hashrate '%s' in password", raw))
+		} else {
+			RecordReportedHashrate(ctx, rate)
+		}
+	}
+	raw, exists := options["d"]
+	if !exists {
+		return nil
+	}
+	diff, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(diff) || math.IsInf(diff, 0) || diff <= 0 {
+		ctx.Logger.Warn(fmt.Sprintf("ignoring invalid difficulty '%s' in password", raw))
+		return nil
+	}
+	state.pushLock.Lock()
+	defer state.pushLock.Unlock()
+	if state.suggestedDiff > 0 {
+		// an explicit mining.suggest_difficulty takes precedence
+		return nil
+	}
+	state.suggestedDiff = diff
+	state.suggestedSource = DiffSourcePassword
+	ctx.Logger.Info(fmt.Sprintf("client requested difficulty %f in password, using %f", diff, c.startingDiff(state)))
+	return nil
+}
 
-			jobParams := []any{fmt.Sprintf("%d", jobId)}
-			if state.useBigJob {
-				jobParams = append(jobParams, GenerateLargeJobParams(header, uint64(template.Block.Header.Timestamp)))
-			} else {
-				jobParams = append(jobParams, GenerateJobHeader(header))
-				jobParams = append(jobParams, template.Block.Header.Timestamp)
-			}
+var hashrateUnits = map[string]float64{"": 1e-9, "k": 1e-6, "m": 1e-3, "g": 1, "t": 1e3, "p": 1e6}
 
-			// // normal notify flow
-			if err := client.Send(gostratum.JsonRpcEvent{
-				Version: "2.0",
-				Method:  "mining.notify",
-				Id:      jobId,
-				Params:  jobParams,
-			}); err != nil {
-				if errors.Is(err, gostratum.ErrorDisconnected) {
-					RecordWorkerError(client.WalletAddr, ErrDisconnected)
-					return
-				}
-				RecordWorkerError(client.WalletAddr, ErrFailedSendWork)
-				client.Logger.Error(errors.Wrapf(err, "failed sending work packet %d", jobId).Error())
-			}
+// parseHashrate parses a hashrate like `120G`, `1.5TH/s` or `950000` (H/s)
+// into GH/s
+func parseHashrate(raw string) (float64, error) {
+	value := strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(raw), "/s"), "h")
+	unit := ""
+	if len(value) > 0 {
+		if _, known := hashrateUnits[value[len(value)-1:]]; known {
+			value, unit = value[:len(value)-1], value[len(value)-1:]
+		}
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if rate <= 0 || math.IsInf(rate, 0) {
+		return 0, fmt.Errorf("hashrate must be positive")
+	}
+	return rate * hashrateUnits[unit], nil
+}
+
+// initialDiff returns the difficulty a newly initialized client is sent. A
+// reconnecting worker resumes at its last difficulty unless the miner asked
+// for one explicitly
+func (c *clientListener) initialDiff(client *gostratum.StratumContext, state *MiningState) (float64, DiffSource) {
+	remembered, ok := c.diffMemory.recall(diffMemoryKey(client))
+	if !ok || state.suggestedDiff > 0 {
+		return c.startingDiff(state), c.startingDiffSource(state)
+	}
+	client.Logger.Info(fmt.Sprintf("restoring difficulty %f from previous connection", remembered))
+	return math.Max(remembered, c.minDiff()), DiffSourceRemembered
+}
+
+// HandleSuggestDifficulty honors mining.suggest_difficulty (NiceHash and
+// others), clamped so a miner can never go below the configured min diff
+func (c *clientListener) HandleSuggestDifficulty(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent) error {
+	if len(event.Params) < 1 {
+		return fmt.Errorf("malformed event from miner, expected param[0] to be difficulty")
+	}
+	diff, ok := event.Params[0].(float64)
+	if !ok || diff <= 0 {
+		return fmt.Errorf("malformed event from miner, expected param[0] to be a positive difficulty")
+	}
+	if err := ctx.Reply(gostratum.NewResponse(event, true, nil)); err != nil {
+		return errors.Wrap(err, "failed to send response to suggest_difficulty")
+	}
+
+	state := GetMiningState(ctx)
+	state.pushLock.Lock()
+	defer state.pushLock.Unlock()
+	state.suggestedDiff = diff
+	state.suggestedSource = DiffSourceSuggested
+	if state.initialized {
+		// already mining, apply the new difficulty right away
+		state.setDiff(c.startingDiff(state), DiffSourceSuggested)
+		if err := sendClientDiff(ctx, state); err != nil {
+			return err
+		}
+	}
+	ctx.Logger.Info(fmt.Sprintf("client suggested difficulty %f, using %f", diff, c.startingDiff(state)))
+	return nil
+}
+
+// reportBandwidth records the bytes transferred since the last report,
+// sampled once per new block rather than on every read/write
+func reportBandwidth(client *gostratum.StratumContext) {
+	state := GetMiningState(client)
+	read, written := client.BytesRead(), client.BytesWritten()
+	prevRead, prevWritten := state.reportedBytesRead.Swap(read), state.reportedBytesWritten.Swap(written)
+	RecordBandwidth(client, read-prevRead, written-prevWritten)
+}
+
+func sendClientDiff(client *gostratum.StratumContext, state *MiningState) error {
+	if err := client.Send(gostratum.JsonRpcEvent{
+		Version: "2.0",
+		Method:  "mining.set_difficulty",
+		Params:  []any{state.stratumDiff.diffValue},
+	}); err != nil {
+		RecordWorkerError(client.WalletAddr, ErrFailedSetDiff)
+		client.Logger.Error(errors.Wrap(err, "failed sending difficulty").Error(), zap.Any("context", client))
+		return err
+	}
+	RecordWorkerDifficulty(client, state.stratumDiff.diffValue)
+	return nil
+}
 
-			RecordNewJob(client)
+// retargetClientDiff lets vardiff adjust the client's difficulty, sent ahead
+// of the next job so the job is worked at the new difficulty
+func retargetClientDiff(client *gostratum.StratumContext, state *MiningState) error {
+	decision := state.vardiff.retarget(time.Now(), state.stratumDiff.diffValue)
+	if !decision.evaluated {
+		return nil
+	}
+	client.Logger.Debug("vardiff retarget",
+		zap.String("mode", string(state.vardiff.cfg.mode)),
+		zap.Float64("observed_spm", decision.observedSPM),
+		zap.Float64("target_spm", decision.targetSPM),
+		zap.Float64("old_diff", decision.oldDiff),
+		zap.Float64("new_diff", decision.newDiff),
+		zap.Bool("changed", decision.changed),
+		zap.Bool("suppressed", decision.suppressed))
+	if decision.suppressed {
+		RecordVardiffSuppressed()
+	}
+	if drift, ok := decision.drift(); ok {
+		RecordDifficultyDrift(client, drift)
+	}
+	if decision.capAnomaly() {
+		client.Logger.Warn("vardiff repeatedly held back by the hard difficulty cap, possible hashrate anomaly",
+			zap.Float64("cap", state.vardiff.cfg.hardCap),
+			zap.Float64("observed_spm", decision.observedSPM),
+			zap.Int("evaluations", decision.capHits))
+	}
+	if !decision.changed {
+		return nil
+	}
+	state.setDiff(decision.newDiff, DiffSourceVardiff)
+	if err := sendClientDiff(client, state); err != nil {
+		return err
+	}
+	RecordVardiffRetarget(decision.oldDiff, decision.newDiff)
+	return nil
+}
+
+func (c *clientListener) NewBlockAvailable(kapi *PyrinApi) {
+	broadcastStart := time.Now()
+	trace := c.tracer.start("template.broadcast")
+	broadcast := sync.WaitGroup{}
+	notifies := newNotifyCache()
+	c.clientLock.Lock()
+	addresses := make([]string, 0, len(c.clients))
+	connected := 0
+	for _, cl := range c.clients {
+		if !cl.Connected() {
+			continue
+		}
+		reportBandwidth(cl)
+		connected++
+		broadcast.Add(1)
+		RecordJobBroadcastQueue(1)
+		go func(client *gostratum.StratumContext) {
+			defer broadcast.Done()
+			defer RecordJobBroadcastQueue(-1)
+			c.pushTracedJob(kapi, client, notifies, trace)
 		}(cl)
 
 		if cl.WalletAddr != "" {
@@ -170,12 +587,26 @@ func (c *clientListener) NewBlockAvailable(kapi *PyrinApi) {
 		}
 	}
 	c.clientLock.Unlock()
+	if connected == 0 {
+		// templates are fetched per client, so with no miners connected
+		// nothing is fetched from the node until the first one connects
+		return
+	}
+	trace.setAttr("clients", connected)
+
+	go func() {
+		// time from the new block notification until every client has been
+		// sent the new job, slow clients show up here
+		broadcast.Wait()
+		RecordJobBroadcast(time.Since(broadcastStart))
+		trace.finish()
+	}()
 
 	if time.Since(c.lastBalanceCheck) > balanceDelay {
 		c.lastBalanceCheck = time.Now()
 		if len(addresses) > 0 {
 			go func() {
-				balances, err := kapi.pyrin.GetBalancesByAddresses(addresses)
+				balances, err := kapi.GetBalancesByAddresses(addresses)
 				if err != nil {
 					c.logger.Warn("failed to get balances from pyrin, prom stats will be out of date", zap.Error(err))
 					return
@@ -185,3 +616,194 @@ func (c *clientListener) NewBlockAvailable(kapi *PyrinApi) {
 		}
 	}
 }
+
+// coalesceJob returns true if the client was sent a job too recently to get
+// another one now. A single push is then scheduled for when the interval is
+// up, it fetches the template current at that point so every update in
+// between collapses into the latest one
+func (c *clientListener) coalesceJob(kapi *PyrinApi, client *gostratum.StratumContext, state *MiningState) bool {
+	if c.minJobInterval <= 0 || !state.initialized {
+		return false
+	}
+	wait := c.minJobInterval - time.Since(state.lastPush)
+	if wait <= 0 {
+		return false
+	}
+	RecordCoalescedJob(client)
+	if state.jobPending.CAS(false, true) {
+		time.AfterFunc(wait, func() {
+			state.jobPending.Store(false)
+			if client.Connected() {
+				c.pushJob(kapi, client, newNotifyCache())
+			}
+		})
+	}
+	return true
+}
+
+// pushJob fetches a template for the client and sends it the new job
+func (c *clientListener) pushJob(kapi *PyrinApi, client *gostratum.StratumContext, notifies *notifyCache) {
+	c.pushTracedJob(kapi, client, notifies, nil)
+}
+
+// pushTracedJob is pushJob as part of the broadcast traced by broadcast
+func (c *clientListener) pushTracedJob(kapi *PyrinApi, client *gostratum.StratumContext, notifies *notifyCache, broadcast *span) {
+	c.pushClientJob(kapi, client, notifies, broadcast, false)
+}
+
+// pushClientJob fetches a template for the client and sends it the job,
+// with firstOnly only if the client has had no job yet. The client's
+// pushLock is taken to decide whether a job is due and again to update the
+// client and send it, not over the template fetch: shares and the admin api
+// read the client's difficulty under the same lock and would otherwise wait
+// on a slow node
+func (c *clientListener) pushClientJob(kapi *PyrinApi, client *gostratum.StratumContext, notifies *notifyCache, broadcast *span, firstOnly bool) {
+	state := GetMiningState(client)
+	state.pushLock.Lock()
+	if (firstOnly && state.initialized) || !c.jobDue(kapi, client, state) {
+		state.pushLock.Unlock()
+		return
+	}
+	state.pushStarted++
+	seq := state.pushStarted
+	state.pushLock.Unlock()
+	trace := broadcast.child("template.push", workerAttrs(client)...)
+	defer trace.finish()
+	fetch := trace.child("template.fetch")
+	template, sourceNode, err := kapi.GetBlockTemplate(client)
+	fetch.setAttr("node", sourceNode)
+	fetch.fail(err)
+	fetch.finish()
+
+	state.pushLock.Lock()
+	defer state.pushLock.Unlock()
+	if firstOnly && state.initialized {
+		// a broadcast got the client its first job during the fetch
+		return
+	}
+	if seq < state.pushSent {
+		// a push that started after this one already sent its job, this
+		// template is no newer than that one
+		return
+	}
+	state.pushSent = seq
+	c.sendJob(kapi, client, state, notifies, trace, template, sourceNode, err)
+}
+
+// jobDue returns whether the client is to be sent a job now, the caller
+// holds its pushLock
+func (c *clientListener) jobDue(kapi *PyrinApi, client *gostratum.StratumContext, state *MiningState) bool {
+	if client.WalletAddr == "" {
+		if time.Since(state.connectTime) > time.Second*20 { // timeout passed
+			// this happens pretty frequently in gcp/aws land since script-kiddies scrape ports
+			client.Logger.Warn("client misconfigured, no miner address specified - disconnecting", zap.String("client", client.String()))
+			RecordWorkerError(client.WalletAddr, ErrNoMinerAddress)
+			client.Disconnect() // invalid configuration, boot the worker
+		}
+		return false
+	}
+	if !state.initialized && !client.Subscribed() && time.Since(state.connectTime) < subscribeGrace {
+		return false
+	}
+	return !c.coalesceJob(kapi, client, state)
+}
+
+// sendJob sends the client the job for the template fetched for it (or
+// handles the fetch failing), the caller holds its pushLock
+func (c *clientListener) sendJob(kapi *PyrinApi, client *gostratum.StratumContext, state *MiningState, notifies *notifyCache,
+	trace *span, template *appmessage.GetBlockTemplateResponseMessage, sourceNode string, err error) {
+	if errors.Is(err, ErrNetworkUnstable) {
+		if state.initialized {
+			// the miner keeps its current job until the network settles
+			client.Logger.Debug("network unstable, not pushing a new job")
+			return
+		}
+		// a new miner has no job to keep, it gets the last good one
+		last, node, ok := kapi.LastTemplate(client)
+		if !ok {
+			client.Logger.Debug("network unstable, no template to start a new miner on")
+			return
+		}
+		template, sourceNode, err = last, node, nil
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "Could not decode address") {
+			RecordWorkerError(client.WalletAddr, ErrInvalidAddressFmt)
+			client.Logger.Error(fmt.Sprintf("failed fetching new block template from pyrin, malformed address: %s", err))
+			client.Disconnect() // unrecoverable
+		} else {
+			RecordWorkerError(client.WalletAddr, ErrFailedBlockFetch)
+			client.Logger.Error(fmt.Sprintf("failed fetching new block template from pyrin: %s", err))
+		}
+		return
+	}
+	fingerprint := templateFingerprint(template.Block)
+	if c.templateRefresh > 0 && state.initialized && fingerprint == state.lastFingerprint &&
+		time.Since(state.lastPush) < c.templateRefresh {
+		// nothing changed, don't make the miner throw away its work
+		RecordDuplicateTemplate()
+		return
+	}
+	RecordTemplateTransactions(len(template.Block.Transactions))
+	reward := RecordTemplateReward(template.Block)
+	client.Logger.Debug("block template fetched", zap.Int("transactions", len(template.Block.Transactions)),
+		zap.Uint64("coinbase_reward_sompi", reward), zap.String("node", sourceNode))
+	state.bigDiff = CalculateTarget(uint64(template.Block.Header.Bits))
+	header, err := SerializeBlockHeader(template.Block)
+	if err != nil {
+		RecordWorkerError(client.WalletAddr, ErrBadDataFromMiner)
+		client.Logger.Error(fmt.Sprintf("failed to serialize block header: %s", err))
+		return
+	}
+
+	jobId := state.WireJobId(state.AddJob(template.Block, sourceNode))
+	trace.setAttr("job_id", jobId)
+	trace.setAttr("node", sourceNode)
+	if !state.initialized {
+		state.initialized = true
+		state.minerApp = minerAppLabel(client.RemoteApp)
+		RecordMinerApp(state.minerApp, 1)
+		// first pass through send the difficulty since it's fixed
+		state.stratumDiff = newPyrinDiff()
+		state.setDiff(c.initialDiff(client, state))
+		if err := sendClientDiff(client, state); err != nil {
+			return
+		}
+		if c.vardiff != nil {
+			state.vardiff = newVardiff(*c.vardiff, time.Now())
+		}
+	} else if state.vardiff != nil {
+		if err := retargetClientDiff(client, state); err != nil {
+			return
+		}
+	} else if err := c.followNetworkDiff(client, state); err != nil {
+		return
+	}
+	c.noticeNetworkDiff(client, state)
+
+	jobParams, err := notifies.jobParams(header, template.Block.Header.Timestamp, client.Capabilities().BigJob)
+	if err != nil {
+		client.Logger.Error(err.Error())
+		return
+	}
+	buf := notifyBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	encodeNotify(buf, jobId, jobParams)
+	err = state.lastNotify.send(client, buf.Bytes())
+	notifyBufferPool.Put(buf)
+	trace.fail(err)
+
+	// // normal notify flow
+	if err != nil {
+		if errors.Is(err, gostratum.ErrorDisconnected) {
+			RecordWorkerError(client.WalletAddr, ErrDisconnected)
+			return
+		}
+		RecordWorkerError(client.WalletAddr, ErrFailedSendWork)
+		client.Logger.Error(errors.Wrapf(err, "failed sending work packet %d", jobId).Error())
+	} else {
+		state.lastFingerprint, state.lastPush = fingerprint, time.Now()
+	}
+
+	RecordNewJob(client)
+}
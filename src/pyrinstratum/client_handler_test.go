@@ -0,0 +1,667 @@
+package pyrinstratum
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/pyrin-network/pyipad/app/appmessage"
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+	"go.uber.org/zap"
+)
+
+func TestWalletConnectionLimit(t *testing.T) {
+	const wallet = "pyrin:qqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqgxrehfpw"
+	listener := newClientListener(zap.NewNop().Sugar(), nil, 1, 0, 0, 0, 0, 2, nil, nil)
+	for i := int32(0); i < 2; i++ {
+		ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+		ctx.WalletAddr = wallet
+		listener.clients[i] = ctx
+	}
+	other, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	listener.clients[2] = other
+
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	ctx.WalletAddr = ""
+	if count := listener.walletConnections(ctx, wallet); count != 2 {
+		t.Fatalf("expected 2 connections for the wallet, got %d", count)
+	}
+
+	replies := make(chan string, 1)
+	mc.AsyncReadTestDataFromBuffer(func(b []byte) { replies <- string(b) })
+	event := gostratum.JsonRpcEvent{Id: 1, Method: "mining.authorize", Params: []any{wallet + ".rig3", "x"}}
+	if err := listener.HandleAuthorize(ctx, event); !errors.Is(err, ErrWalletConnectionLimit) {
+		t.Fatalf("expected the wallet connection limit error, got %v", err)
+	}
+	if reply := <-replies; !strings.Contains(reply, "Too many connections") {
+		t.Fatalf("expected a connection limit error, got %s", reply)
+	}
+	if ctx.WalletAddr != "" {
+		t.Fatalf("expected the client not to be authorized")
+	}
+}
+
+func TestWalletAccess(t *testing.T) {
+	const stranger = "pyrin:qqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqgxrehfpw"
+	listener := newClientListener(zap.NewNop().Sugar(), nil, 1, 0, 0, 0, 0, 0, nil, nil)
+	listener.walletAccess = newWalletAccess([]string{warmupAddress}, nil)
+
+	authorize := func(wallet string) (error, string) {
+		ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+		ctx.WalletAddr = ""
+		replies := readAll(mc)
+		err := listener.HandleAuthorize(ctx, gostratum.JsonRpcEvent{Id: 1, Method: "mining.authorize", Params: []any{wallet + ".rig", "x"}})
+		return err, <-replies
+	}
+	if err, reply := authorize(stranger); !errors.Is(err, ErrWalletNotAllowed) || !strings.Contains(reply, "not allowed") {
+		t.Fatalf("expected an address outside the allowlist rejected, got %v: %s", err, reply)
+	}
+	if err, reply := authorize(warmupAddress); err != nil || !strings.Contains(reply, "true") {
+		t.Fatalf("expected the allowed address authorized, got %v: %s", err, reply)
+	}
+
+	denied := newWalletAccess(nil, []string{stranger})
+	if denied.rejects(stranger) != "denylist" || denied.rejects(warmupAddress) != "" {
+		t.Fatalf("expected only the denied address rejected without an allowlist")
+	}
+	if (walletAccess{}).enabled() {
+		t.Fatalf("expected no restriction without lists")
+	}
+}
+
+// readAll forwards everything written to the mock connection until it's
+// closed
+func readAll(mc *gostratum.MockConnection) <-chan string {
+	messages := make(chan string, 8)
+	go func() {
+		defer close(messages)
+		for {
+			var read []byte
+			mc.ReadTestDataFromBuffer(func(b []byte) { read = b })
+			if read == nil {
+				return
+			}
+			messages <- string(read)
+		}
+	}()
+	return messages
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	listener := newClientListener(zap.NewNop().Sugar(), nil, 1, 0, 0, 0, 0, 0, nil, nil)
+	listener.maintenanceDrain = 10 * time.Millisecond
+	existing, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	listener.clients[1] = existing
+	messages := readAll(mc)
+
+	if !listener.enterMaintenance("back at 14:00") || listener.enterMaintenance("") {
+		t.Fatalf("expected only the first request to enter maintenance")
+	}
+	if msg := <-messages; !strings.Contains(msg, "client.show_message") || !strings.Contains(msg, "back at 14:00") {
+		t.Fatalf("expected connected clients to be shown the maintenance message, got %s", msg)
+	}
+	deadline := time.Now().Add(time.Second)
+	for existing.Connected() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if existing.Connected() {
+		t.Fatalf("expected the connected client to be disconnected over the drain")
+	}
+
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	messages = readAll(mc)
+	event := gostratum.JsonRpcEvent{Id: 1, Method: "mining.authorize", Params: []any{"pyrin:qqtypo.rig1", "x"}}
+	if err := listener.HandleAuthorize(ctx, event); !errors.Is(err, ErrMaintenance) {
+		t.Fatalf("expected new clients rejected in maintenance, got %v", err)
+	}
+	<-messages
+	if reply := <-messages; !strings.Contains(reply, `"error":[24,"back at 14:00",null]`) {
+		t.Fatalf("expected a maintenance error reply, got %s", reply)
+	}
+
+	unauthenticated := newAdminServer(zap.NewNop().Sugar(), nil, listener, "")
+	recorder := httptest.NewRecorder()
+	unauthenticated.mux().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/admin/maintenance/disable", nil))
+	if _, maintenance := listener.inMaintenance(); recorder.Code != http.StatusForbidden || !maintenance {
+		t.Fatalf("expected admin actions refused without an admin token, got %d", recorder.Code)
+	}
+
+	admin := newAdminServer(zap.NewNop().Sugar(), nil, listener, "secret")
+	recorder = httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/admin/maintenance/disable", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	admin.mux().ServeHTTP(recorder, request)
+	var status MaintenanceStatus
+	if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+		t.Fatalf("failed decoding response %q: %s", recorder.Body.String(), err)
+	}
+	if _, maintenance := listener.inMaintenance(); maintenance || status.Enabled {
+		t.Fatalf("expected maintenance mode left through the admin endpoint, got %+v", status)
+	}
+}
+
+func TestParseHashrate(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected float64
+	}{
+		{"120G", 120},
+		{"120gh/s", 120},
+		{"1.5TH/s", 1500},
+		{"500M", 0.5},
+		{"2000000000", 2},
+	}
+	for _, tt := range tests {
+		if rate, err := parseHashrate(tt.raw); err != nil || math.Abs(rate-tt.expected) > 1e-9 {
+			t.Fatalf("expected %s to be %f GH/s, got %f (%v)", tt.raw, tt.expected, rate, err)
+		}
+	}
+	for _, raw := range []string{"", "fast", "-5G", "G"} {
+		if _, err := parseHashrate(raw); err == nil {
+			t.Fatalf("expected %q to be rejected", raw)
+		}
+	}
+}
+
+func TestPasswordDifficulty(t *testing.T) {
+	const wallet = "pyrin:qqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqgxrehfpw"
+	listener := newClientListener(zap.NewNop().Sugar(), nil, 4, 0, 0, 0, 0, 0,
+		&vardiffConfig{minDiff: 4, maxDiff: 1024}, nil)
+	tests := []struct {
+		password string
+		expected float64
+		ignored  bool
+	}{
+		{"d=64", 64, false},
+		{"d=1", 4, false},
+		{"d=1e9", 1024, false},
+		{"d=NaN", 4, true},
+		{"d=+Inf", 4, true},
+		{"d=-8", 4, true},
+	}
+	for _, tt := range tests {
+		ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+		ctx.WalletAddr = ""
+		readAll(mc)
+		event := gostratum.JsonRpcEvent{Id: 1, Method: "mining.authorize", Params: []any{wallet + ".rig1", tt.password}}
+		if err := listener.HandleAuthorize(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+		state := GetMiningState(ctx)
+		if diff := listener.startingDiff(state); diff != tt.expected || tt.ignored != (state.suggestedDiff == 0) {
+			t.Fatalf("expected %s to start at difficulty %f (ignored %t), got %f requested %f",
+				tt.password, tt.expected, tt.ignored, diff, state.suggestedDiff)
+		}
+	}
+}
+
+func TestNoTemplatesWithoutClients(t *testing.T) {
+	mock := &mockRpcClient{}
+	listener := newClientListener(zap.NewNop().Sugar(), nil, 1, 0, 0, 0, 0, 0, nil, nil)
+	listener.NewBlockAvailable(testApi(mock, 0))
+	if mock.templateCalls != 0 {
+		t.Fatalf("expected no template fetches without connected clients, got %d", mock.templateCalls)
+	}
+}
+
+func TestUppercaseHex(t *testing.T) {
+	shareHandler := newShareHandler(nil, 1, 0, nil, 0, invalidSharePolicy{}, 0)
+	listener := newClientListener(zap.NewNop().Sugar(), shareHandler, 1, 2, 0, 0, 0, 0, nil, nil)
+	listener.uppercaseHex = true
+	listener.nextExtranonce = 0xab
+
+	ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	listener.OnConnect(ctx)
+	if ctx.Extranonce != "00AB" || ctx.SessionId != "00000001" {
+		t.Fatalf("expected upper case extranonce and session id, got %s and %s", ctx.Extranonce, ctx.SessionId)
+	}
+}
+
+func TestUniqueExtranonce(t *testing.T) {
+	shareHandler := newShareHandler(nil, 1, 0, nil, 0, invalidSharePolicy{}, 0)
+	listener := newClientListener(zap.NewNop().Sugar(), shareHandler, 1, 1, 0, 0, 0, 0, nil, nil)
+	listener.extranonces = newExtranoncePool(2, 0)
+	connect := func() *gostratum.StratumContext {
+		ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+		listener.OnConnect(ctx)
+		return ctx
+	}
+	first, second, third := connect(), connect(), connect()
+	if first.Extranonce != "00" || second.Extranonce != "01" || third.Extranonce != "02" {
+		t.Fatalf("expected extranonces handed out in order, got %s %s %s", first.Extranonce, second.Extranonce, third.Extranonce)
+	}
+	listener.OnDisconnect(second)
+	if reused := connect(); reused.Extranonce != "01" {
+		t.Fatalf("expected the released extranonce reused rather than wrapping onto a connected client, got %s", reused.Extranonce)
+	}
+	exhausted := testutil.ToFloat64(extranonceExhaustedCounter)
+	connect()
+	if testutil.ToFloat64(extranonceExhaustedCounter) != exhausted+1 {
+		t.Fatalf("expected running out of extranonces counted")
+	}
+}
+
+func TestConcurrentExtranonces(t *testing.T) {
+	shareHandler := newShareHandler(nil, 1, 0, nil, 0, invalidSharePolicy{}, 0)
+	listener := newClientListener(zap.NewNop().Sugar(), shareHandler, 1, 1, 0, 0, 0, 0, nil, nil)
+	listener.extranonces = newExtranoncePool(255, 0)
+	clients := make([]*gostratum.StratumContext, 64)
+	var connects sync.WaitGroup
+	for i := range clients {
+		clients[i], _ = gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+		connects.Add(1)
+		go func(ctx *gostratum.StratumContext) {
+			defer connects.Done()
+			listener.OnConnect(ctx)
+		}(clients[i])
+	}
+	connects.Wait()
+
+	seen := map[string]bool{}
+	for _, ctx := range clients {
+		if seen[ctx.Extranonce] {
+			t.Fatalf("expected clients connecting at once to get distinct extranonces, %s handed out twice", ctx.Extranonce)
+		}
+		seen[ctx.Extranonce] = true
+	}
+
+	var disconnects sync.WaitGroup
+	for _, ctx := range clients {
+		disconnects.Add(1)
+		go func(ctx *gostratum.StratumContext) {
+			defer disconnects.Done()
+			listener.OnDisconnect(ctx)
+		}(ctx)
+	}
+	disconnects.Wait()
+	if len(listener.extranonces.leased) != 0 {
+		t.Fatalf("expected every extranonce released on disconnect, %d still leased", len(listener.extranonces.leased))
+	}
+}
+
+func TestExtranonceRecycling(t *testing.T) {
+	pool := newExtranoncePool(2, time.Minute)
+	start := time.Now()
+	for i := int32(0); i <= 2; i++ {
+		if extranonce, ok := pool.lease(start); !ok || extranonce != i {
+			t.Fatalf("expected never leased extranonce %d first, got %d %t", i, extranonce, ok)
+		}
+	}
+	pool.release(1, start)
+	pool.release(0, start.Add(time.Second))
+	pool.release(0, start.Add(2*time.Second)) // not leased
+	if _, ok := pool.lease(start.Add(30 * time.Second)); ok {
+		t.Fatalf("expected a released extranonce held back until it cooled down")
+	}
+	if extranonce, ok := pool.lease(start.Add(time.Minute)); !ok || extranonce != 1 {
+		t.Fatalf("expected the first released extranonce recycled once cooled down, got %d %t", extranonce, ok)
+	}
+	if extranonce, ok := pool.lease(start.Add(2 * time.Minute)); !ok || extranonce != 0 {
+		t.Fatalf("expected the next released extranonce recycled, got %d %t", extranonce, ok)
+	}
+	if _, ok := pool.lease(start.Add(time.Hour)); ok {
+		t.Fatalf("expected the pool exhausted with every extranonce leased")
+	}
+}
+
+func TestNotifyShutdown(t *testing.T) {
+	listener := newClientListener(zap.NewNop().Sugar(), nil, 1, 0, 0, 0, 0, 0, nil, nil)
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	listener.clients[1] = ctx
+
+	notices := make(chan string, 1)
+	mc.AsyncReadTestDataFromBuffer(func(b []byte) { notices <- string(b) })
+	if notified := listener.notifyShutdown(30 * time.Second); notified != 1 {
+		t.Fatalf("expected 1 client notified, got %d", notified)
+	}
+	if notice := <-notices; !strings.Contains(notice, "client.show_message") || !strings.Contains(notice, "restarting in 30s") {
+		t.Fatalf("unexpected shutdown notice %s", notice)
+	}
+}
+
+func TestDrainConnections(t *testing.T) {
+	sh := newShareHandler(&mockSubmitter{}, 1, 0, nil, 0, invalidSharePolicy{}, 0)
+	listener := newClientListener(zap.NewNop().Sugar(), sh, 1, 0, 0, 0, 0, 0, nil, nil)
+	drainConnections(zap.NewNop().Sugar(), nil, listener, time.Millisecond, nil)
+
+	// shares still arriving once the drain is over are dropped
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	replies := readAll(mc)
+	if err := sh.HandleSubmit(ctx, gostratum.JsonRpcEvent{Id: 1, Method: gostratum.StratumMethodSubmit, Params: []any{"w", "1", "aabbccdd"}}); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-replies; !strings.Contains(r, "Bridge shutting down") {
+		t.Fatalf("expected the share dropped after the drain, got %s", r)
+	}
+}
+
+func TestWorkerDifficultyEndpoint(t *testing.T) {
+	listener := newClientListener(zap.NewNop().Sugar(), nil, 4, 0, 0, 0, 0, 0, nil, nil)
+	ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	ctx.WorkerName = "rig1"
+	state := GetMiningState(ctx)
+	state.suggestedDiff, state.suggestedSource = 64, DiffSourcePassword
+	state.stratumDiff = newPyrinDiff()
+	state.setDiff(listener.initialDiff(ctx, state))
+	listener.clients[1] = ctx
+
+	admin := newAdminServer(zap.NewNop().Sugar(), nil, listener, "")
+	recorder := httptest.NewRecorder()
+	admin.mux().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/workers/difficulty?worker=rig1", nil))
+	var difficulties []WorkerDifficulty
+	if err := json.Unmarshal(recorder.Body.Bytes(), &difficulties); err != nil {
+		t.Fatalf("failed decoding response %q: %s", recorder.Body.String(), err)
+	}
+	if len(difficulties) != 1 || difficulties[0].Difficulty != 64 || difficulties[0].Source != DiffSourcePassword {
+		t.Fatalf("expected rig1 at the difficulty from its password, got %+v", difficulties)
+	}
+
+	recorder = httptest.NewRecorder()
+	admin.mux().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/workers/difficulty?worker=rig2", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected not found for an unknown worker, got %d", recorder.Code)
+	}
+
+	// worker names in requests are normalized like the ones miners send
+	listener.workerNames = gostratum.WorkerNameRules{Lowercase: true, Separators: "_"}
+	recorder = httptest.NewRecorder()
+	admin.mux().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/workers/difficulty?worker=Rig_1", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected Rig_1 to match rig1, got %d", recorder.Code)
+	}
+}
+
+func TestStatusPage(t *testing.T) {
+	listener := newClientListener(zap.NewNop().Sugar(), nil, 4, 0, 0, 0, 0, 0, nil, nil)
+	ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	ctx.WalletAddr, ctx.WorkerName = "pyrin:qqtest", "<rig1>"
+	state := GetMiningState(ctx)
+	state.stratumDiff = newPyrinDiff()
+	state.setDiff(64, DiffSourcePassword)
+	listener.clients[1] = ctx
+	pending, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	pending.WalletAddr, pending.WorkerName = "", "unauthorized"
+	listener.clients[2] = pending
+
+	admin := newAdminServer(zap.NewNop().Sugar(), nil, listener, "secret")
+	recorder := httptest.NewRecorder()
+	admin.mux().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("expected the status page to need the admin token, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/status", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	admin.mux().ServeHTTP(recorder, request)
+	body := recorder.Body.String()
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected the status page, got %d: %s", recorder.Code, body)
+	}
+	// worker names come from miners, they must be escaped
+	if !strings.Contains(body, "&lt;rig1&gt;") || strings.Contains(body, "<rig1>") {
+		t.Fatalf("expected rig1 escaped on the status page, got %s", body)
+	}
+	if !strings.Contains(body, "pyrin:qqtest") || !strings.Contains(body, "<td>64</td>") {
+		t.Fatalf("expected rig1's wallet and difficulty on the status page, got %s", body)
+	}
+	if strings.Contains(body, "unauthorized") {
+		t.Fatalf("expected clients that haven't authorized left off the status page, got %s", body)
+	}
+
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest(http.MethodGet, "/admin/workers", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	admin.mux().ServeHTTP(recorder, request)
+	var workers []map[string]any
+	if err := json.Unmarshal(recorder.Body.Bytes(), &workers); err != nil || len(workers) != 1 {
+		t.Fatalf("expected rig1 alone in the workers listing, got %s: %v", recorder.Body, err)
+	}
+	if workers[0]["difficulty"] != 64.0 || workers[0]["difficulty_source"] != string(DiffSourcePassword) || workers[0]["worker"] != "<rig1>" {
+		t.Fatalf("unexpected workers listing %v", workers[0])
+	}
+}
+
+func TestJobKeepalive(t *testing.T) {
+	listener := newClientListener(zap.NewNop().Sugar(), nil, 1, 0, 0, 0, 0, 0, nil, nil)
+	listener.jobKeepalive = time.Minute
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	listener.clients[1] = ctx
+	state := GetMiningState(ctx)
+
+	sent := make(chan string, 1)
+	mc.AsyncReadTestDataFromBuffer(func(b []byte) { sent <- string(b) })
+	job := `{"id":1,"jsonrpc":"2.0","method":"mining.notify","params":["1",[1,2,3,4],1700000000000]}` + "\n"
+	if err := state.lastNotify.send(ctx, []byte(job)); err != nil {
+		t.Fatal(err)
+	}
+	<-sent
+
+	if resent, err := state.lastNotify.resend(ctx, listener.jobKeepalive, time.Now()); resent || err != nil {
+		t.Fatalf("expected no keepalive right after a job, got %t (%v)", resent, err)
+	}
+	keepalives := testutil.ToFloat64(keepaliveJobCounter)
+	mc.AsyncReadTestDataFromBuffer(func(b []byte) { sent <- string(b) })
+	listener.resendJobs(time.Now().Add(time.Minute))
+	if resent := <-sent; resent != job {
+		t.Fatalf("expected the current job resent unchanged, got %s", resent)
+	}
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(keepaliveJobCounter) != keepalives+1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if testutil.ToFloat64(keepaliveJobCounter) != keepalives+1 {
+		t.Fatalf("expected the keepalive counted")
+	}
+}
+
+func TestHandshakeJob(t *testing.T) {
+	const wallet = "pyrin:qqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqgxrehfpw"
+	handshake := func(t *testing.T, api *PyrinApi, subscribeFirst bool) (*gostratum.StratumContext, <-chan string) {
+		listener := newClientListener(zap.NewNop().Sugar(), nil, 1, 0, 0, 0, 0, 0, nil, nil)
+		listener.handshakeJobs = api
+		ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+		ctx.WalletAddr = ""
+		listener.clients[1] = ctx
+		messages := readAll(mc)
+		subscribe := func() {
+			event := gostratum.JsonRpcEvent{Id: 1, Method: "mining.subscribe", Params: []any{"BzMiner/v15"}}
+			if err := listener.subscribeHandler(gostratum.HandleSubscribe)(ctx, event); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if subscribeFirst {
+			subscribe()
+		}
+		event := gostratum.JsonRpcEvent{Id: 2, Method: "mining.authorize", Params: []any{wallet + ".rig1", "d=64"}}
+		if err := listener.HandleAuthorize(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+		if !subscribeFirst {
+			subscribe()
+		}
+		return ctx, messages
+	}
+	// awaitJob returns the messages up to and including the first job
+	awaitJob := func(t *testing.T, messages <-chan string) []string {
+		var sent []string
+		for {
+			select {
+			case msg := <-messages:
+				if sent = append(sent, msg); strings.Contains(msg, "mining.notify") {
+					return sent
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("expected a job pushed on completing the handshake, got %v", sent)
+			}
+		}
+	}
+
+	for _, subscribeFirst := range []bool{true, false} {
+		mock := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{templateWithTimestamp(time.Now())}}
+		ctx, messages := handshake(t, testApi(mock, 0), subscribeFirst)
+		sent := awaitJob(t, messages)
+		if diff := sent[len(sent)-2]; !strings.Contains(diff, "mining.set_difficulty") || !strings.Contains(diff, "64") {
+			t.Fatalf("expected the password difficulty sent ahead of the first job, got %s", diff)
+		}
+		if diff := testutil.ToFloat64(workerDifficultyGauge.With(commonLabels(ctx))); diff != 64 {
+			t.Fatalf("expected the worker's difficulty published, got %f", diff)
+		}
+		if mock.templateCalls != 1 || !GetMiningState(ctx).initialized {
+			t.Fatalf("expected the first job fetched on demand, got %d fetches", mock.templateCalls)
+		}
+		// BzMiner takes the header as one hex string
+		var job gostratum.JsonRpcEvent
+		if err := json.Unmarshal([]byte(sent[len(sent)-1]), &job); err != nil || !ctx.Capabilities().BigJob || len(job.Params) != 2 {
+			t.Fatalf("expected a big job for the detected miner, got %s (%v)", sent[len(sent)-1], err)
+		}
+	}
+
+	// disabled, the first job waits for a new block
+	ctx, messages := handshake(t, nil, true)
+	select {
+	case msg := <-messages:
+		if strings.Contains(msg, "mining.notify") {
+			t.Fatalf("expected no job without handshake jobs, got %s", msg)
+		}
+	case <-time.After(50 * time.Millisecond):
+	}
+	if GetMiningState(ctx).initialized {
+		t.Fatalf("expected the client left for the next new block")
+	}
+}
+
+func TestHandshakeJobOnce(t *testing.T) {
+	mock := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{templateWithTimestamp(time.Now())}}
+	listener := newClientListener(zap.NewNop().Sugar(), nil, 1, 0, 0, 0, 0, 0, nil, nil)
+	listener.handshakeJobs = testApi(mock, 0)
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	listener.clients[1] = ctx
+	messages := readAll(mc)
+	event := gostratum.JsonRpcEvent{Id: 1, Method: "mining.subscribe", Params: []any{"BzMiner/v15"}}
+	if err := gostratum.HandleSubscribe(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	// subscribe and authorize completing together each try the first job
+	for i := 0; i < 4; i++ {
+		listener.handshakeComplete(ctx)
+	}
+	jobs := 0
+	for done := false; !done; {
+		select {
+		case msg := <-messages:
+			if strings.Contains(msg, "mining.notify") {
+				jobs++
+			}
+		case <-time.After(200 * time.Millisecond):
+			done = true
+		}
+	}
+	if jobs != 1 {
+		t.Fatalf("expected a single first job, got %d", jobs)
+	}
+}
+
+func TestJobCoalescing(t *testing.T) {
+	mock := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{templateWithTimestamp(time.Now())}}
+	api := testApi(mock, 0)
+	listener := newClientListener(zap.NewNop().Sugar(), nil, 1, 0, 0, 0, 0, 0, nil, nil)
+	listener.minJobInterval = 100 * time.Millisecond
+
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	state := GetMiningState(ctx)
+	state.initialized = true
+	state.stratumDiff = newPyrinDiff()
+	state.setDiff(1, DiffSourceMinDiff)
+	state.lastPush = time.Now()
+	listener.clients[1] = ctx
+	jobs := make(chan string, 4)
+	mc.AsyncReadTestDataFromBuffer(func(b []byte) { jobs <- string(b) })
+
+	listener.pushJob(api, ctx, newNotifyCache())
+	listener.pushJob(api, ctx, newNotifyCache())
+	if coalesced := testutil.ToFloat64(coalescedJobCounter.With(commonLabels(ctx))); coalesced != 2 {
+		t.Fatalf("expected both jobs within the interval coalesced, got %f", coalesced)
+	}
+	select {
+	case job := <-jobs:
+		if !strings.Contains(job, "mining.notify") {
+			t.Fatalf("expected the coalesced job pushed, got %s", job)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a single job pushed once the interval was up")
+	}
+	select {
+	case job := <-jobs:
+		t.Fatalf("expected the updates collapsed into one push, got another %s", job)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// slowTemplateClient holds template fetches until released
+type slowTemplateClient struct {
+	*mockRpcClient
+	fetching chan struct{}
+	release  chan struct{}
+}
+
+func (s *slowTemplateClient) GetBlockTemplate(miningAddress, extraData string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+	s.fetching <- struct{}{}
+	<-s.release
+	return s.mockRpcClient.GetBlockTemplate(miningAddress, extraData)
+}
+
+func TestPushUnlockedDuringFetch(t *testing.T) {
+	slow := &slowTemplateClient{
+		mockRpcClient: &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{templateWithTimestamp(time.Now())}},
+		fetching:      make(chan struct{}),
+		release:       make(chan struct{}),
+	}
+	listener := newClientListener(zap.NewNop().Sugar(), nil, 1, 0, 0, 0, 0, 0, nil, nil)
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	state := GetMiningState(ctx)
+	state.initialized = true
+	state.stratumDiff = newPyrinDiff()
+	state.setDiff(4, DiffSourceMinDiff)
+	listener.clients[1] = ctx
+	jobs := readAll(mc)
+
+	pushed := make(chan struct{})
+	go func() {
+		listener.pushJob(testApi(slow, 0), ctx, newNotifyCache())
+		close(pushed)
+	}()
+	<-slow.fetching
+	read := make(chan float64)
+	go func() {
+		diff, _ := state.difficulty()
+		read <- diff.diffValue
+	}()
+	select {
+	case diff := <-read:
+		if diff != 4 {
+			t.Fatalf("expected the current difficulty read during the fetch, got %f", diff)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the difficulty readable while the template is fetched")
+	}
+	close(slow.release)
+	<-pushed
+	select {
+	case job := <-jobs:
+		if !strings.Contains(job, "mining.notify") {
+			t.Fatalf("expected the job sent once fetched, got %s", job)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the job sent once fetched")
+	}
+}
@@ -0,0 +1,49 @@
+package pyrinstratum
+
+import (
+	"context"
+	"time"
+
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+	"go.uber.org/zap"
+)
+
+// startLatencyProbes pings every authorized client each interval, timing the
+// round trip to it (see gostratum.SendLatencyProbe) into
+// py_client_latency_seconds_histogram by the connection's origin label. It's
+// a tiny request per client per interval, opt-in as strict clients may log
+// the unknown method
+func (c *clientListener) startLatencyProbes(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.probeLatency()
+		}
+	}
+}
+
+func (c *clientListener) probeLatency() {
+	for _, cl := range c.connectedClients() {
+		if !cl.Connected() || !cl.Authorized() {
+			continue
+		}
+		go func(client *gostratum.StratumContext) {
+			if err := client.SendLatencyProbe(); err != nil {
+				client.Logger.Debug("failed sending latency probe: " + err.Error())
+			}
+		}(cl)
+	}
+}
+
+// recordLatency is the listener's OnLatency
+func recordLatency(client *gostratum.StratumContext, rtt time.Duration) {
+	client.Logger.Debug("client round trip", zap.Duration("rtt", rtt))
+	RecordClientLatency(GetMiningState(client).origin, rtt)
+}
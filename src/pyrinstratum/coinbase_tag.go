@@ -0,0 +1,60 @@
+package pyrinstratum
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+)
+
+// the node caps the coinbase payload at 204 bytes, its own fields and the
+// longest payout script take up 54 of them
+const maxExtraDataLength = 150
+
+// worker names tagged into the coinbase are cut to this many bytes
+const maxTagWorkerLength = 32
+
+// coinbaseTag returns the extra data a client's templates are fetched with,
+// the miner software and bridge version and with withWorker the client's
+// worker name, so a solo farm can tell from the chain which rig found a
+// block. The worker name is reduced to characters safe to put on chain, and
+// the miner software (whatever the miner claimed at subscribe) is shortened
+// if needed to keep the tag within what the node accepts
+func coinbaseTag(client *gostratum.StratumContext, withWorker bool) string {
+	suffix := " via pyrin-network/pyrin-stratum-bridge_" + version
+	if worker := tagWorkerName(client.WorkerName); withWorker && worker != "" {
+		suffix += fmt.Sprintf(" worker '%s'", worker)
+	}
+	app := truncateUtf8(client.RemoteApp, maxExtraDataLength-len(suffix)-len("''"))
+	return "'" + app + "'" + suffix
+}
+
+// tagWorkerName keeps the letters, digits, '.', '-' and '_' of a worker name,
+// cut to maxTagWorkerLength
+func tagWorkerName(name string) string {
+	cleaned := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return -1
+	}, name)
+	if len(cleaned) > maxTagWorkerLength {
+		cleaned = cleaned[:maxTagWorkerLength]
+	}
+	return cleaned
+}
+
+// truncateUtf8 cuts s to at most max bytes without splitting a character
+func truncateUtf8(s string, max int) string {
+	if max <= 0 {
+		return ""
+	}
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
@@ -0,0 +1,710 @@
+package pyrinstratum
+
+import (
+	"fmt"
+	"net/url"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const redacted = "<redacted>"
+
+// lenient enough that only a rig that's almost exclusively sending garbage
+// gets disconnected
+const defaultInvalidShareRatio = 0.9
+const defaultInvalidShareWindow = 10 * time.Minute
+const defaultStuckJobLag = 8
+
+// far above any legitimate farm behind a single address
+const defaultMaxWalletConnections = 1000
+
+// nodeAddresses returns the primary node followed by any additional nodes,
+// without duplicates
+func (cfg BridgeConfig) nodeAddresses() []string {
+	seen := map[string]struct{}{}
+	addresses := []string{}
+	for _, address := range append([]string{cfg.RPCServer}, cfg.RPCServers...) {
+		if _, exists := seen[address]; exists || address == "" {
+			continue
+		}
+		seen[address] = struct{}{}
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
+func (cfg BridgeConfig) nodeRPCOptions() NodeRPCOptions {
+	return NodeRPCOptions{
+		AuthToken:     cfg.NodeAuthToken,
+		Headers:       cfg.NodeHeaders,
+		TLS:           cfg.NodeTLS,
+		TLSCAFile:     cfg.NodeTLSCAFile,
+		TLSCertFile:   cfg.NodeTLSCertFile,
+		TLSKeyFile:    cfg.NodeTLSKeyFile,
+		TLSServerName: cfg.NodeTLSServerName,
+		TLSInsecure:   cfg.NodeTLSInsecure,
+	}
+}
+
+// withDefaults returns the effective config the bridge runs with, unset
+// values replaced with their defaults and out of range values clamped
+func (cfg BridgeConfig) withDefaults() BridgeConfig {
+	if cfg.BlockWaitTime < minBlockWaitTime {
+		cfg.BlockWaitTime = minBlockWaitTime
+	}
+	if cfg.BlockWaitAuto {
+		if cfg.BlockWaitMin == 0 {
+			cfg.BlockWaitMin = cfg.BlockWaitTime
+		} else if cfg.BlockWaitMin < minBlockWaitTime {
+			cfg.BlockWaitMin = minBlockWaitTime
+		}
+		if cfg.BlockWaitMax == 0 {
+			cfg.BlockWaitMax = defaultBlockWaitMax
+		}
+	}
+	if cfg.RPCTimeout == 0 {
+		cfg.RPCTimeout = defaultRpcTimeout
+	}
+	if cfg.ShareNatsURL != "" && cfg.ShareNatsSubject == "" {
+		cfg.ShareNatsSubject = defaultNatsSubject
+	}
+	if cfg.TraceEndpoint != "" && cfg.TraceSampleRate == 0 {
+		cfg.TraceSampleRate = 1
+	}
+	if cfg.SyncCheckInterval == 0 {
+		cfg.SyncCheckInterval = defaultSyncCheckInterval
+	}
+	if cfg.WarmupTimeout == 0 {
+		cfg.WarmupTimeout = defaultWarmupTimeout
+	}
+	if cfg.MaxSubmits == 0 {
+		cfg.MaxSubmits = defaultMaxSubmits
+	}
+	if cfg.ValidationWorkers == 0 {
+		cfg.ValidationWorkers = runtime.GOMAXPROCS(0)
+	}
+	if cfg.MinShareDiff < 1 {
+		cfg.MinShareDiff = 1
+	}
+	if cfg.InvalidShareRatio == 0 {
+		cfg.InvalidShareRatio = defaultInvalidShareRatio
+	}
+	if cfg.NodeErrorRate == 0 {
+		cfg.NodeErrorRate = defaultNodeErrorRate
+	}
+	if cfg.NodeErrorWindow == 0 {
+		cfg.NodeErrorWindow = defaultNodeErrorWindow
+	}
+	if cfg.InstabilitySwing == 0 {
+		cfg.InstabilitySwing = defaultInstabilitySwing
+	}
+	if cfg.InstabilityHold == 0 {
+		cfg.InstabilityHold = defaultInstabilityHold
+	}
+	if cfg.InvalidShareWindow == 0 {
+		cfg.InvalidShareWindow = defaultInvalidShareWindow
+	}
+	if cfg.StuckJobLag == 0 {
+		cfg.StuckJobLag = defaultStuckJobLag
+	}
+	if cfg.MaxWalletConnections == 0 {
+		cfg.MaxWalletConnections = defaultMaxWalletConnections
+	}
+	if cfg.MaxMessageSize == 0 {
+		cfg.MaxMessageSize = gostratum.DefaultMaxMessageSize
+	}
+	if cfg.WriteTimeout == 0 {
+		cfg.WriteTimeout = gostratum.DefaultWriteTimeout
+	}
+	if cfg.FlapWindow == 0 {
+		cfg.FlapWindow = defaultFlapWindow
+	}
+	if cfg.FlapBackoff == 0 {
+		cfg.FlapBackoff = defaultFlapBackoff
+	}
+	if cfg.SharesPerMin == 0 {
+		cfg.SharesPerMin = defaultSharesPerMin
+	}
+	if cfg.NetworkMismatch == "" {
+		cfg.NetworkMismatch = string(NetworkMismatchStrict)
+	}
+	if cfg.MaintenanceDrain == 0 {
+		cfg.MaintenanceDrain = defaultMaintenanceDrain
+	}
+	if cfg.MaintenanceMessage == "" {
+		cfg.MaintenanceMessage = defaultMaintenanceMessage
+	}
+	if cfg.UnknownJobPolicy == "" {
+		cfg.UnknownJobPolicy = string(UnknownJobReject)
+	}
+	if cfg.LostRacePolicy == "" {
+		cfg.LostRacePolicy = string(LostRaceCredit)
+	}
+	if cfg.JobIds == "" {
+		cfg.JobIds = string(JobIdsSequential)
+	}
+	if cfg.DesyncPolicy == "" {
+		cfg.DesyncPolicy = string(DesyncReject)
+		if len(cfg.nodeAddresses()) > 1 {
+			cfg.DesyncPolicy = string(DesyncFailover)
+		}
+	}
+	if cfg.ConnectRetries == 0 {
+		cfg.ConnectRetries = defaultConnectRetries
+	}
+	if cfg.ConnectBackoff == 0 {
+		cfg.ConnectBackoff = defaultConnectBackoff
+	}
+	if cfg.ReconnectBackoff == 0 {
+		cfg.ReconnectBackoff = defaultReconnectBackoff
+	}
+	if cfg.ReconnectMaxBackoff == 0 {
+		cfg.ReconnectMaxBackoff = defaultReconnectMaxBackoff
+	}
+	if cfg.HashrateWindow == 0 {
+		cfg.HashrateWindow = defaultHashrateWindow
+	}
+	if cfg.ReconnectMultiplier == 0 {
+		cfg.ReconnectMultiplier = defaultReconnectMultiplier
+	}
+	if cfg.TemplateRetries == 0 {
+		cfg.TemplateRetries = defaultTemplateRetries
+	}
+	if cfg.TemplateRetryDelay == 0 {
+		cfg.TemplateRetryDelay = defaultTemplateRetryDelay
+	}
+	if cfg.ExtranonceReuse == 0 {
+		cfg.ExtranonceReuse = defaultExtranonceReuseDelay
+	}
+	if cfg.MinNodePeers == 0 {
+		cfg.MinNodePeers = defaultMinNodePeers
+	}
+	if cfg.QuarantineAfter == 0 {
+		cfg.QuarantineAfter = defaultQuarantineAfter
+	}
+	if cfg.QuarantineCooldown == 0 {
+		cfg.QuarantineCooldown = defaultQuarantineCooldown
+	}
+	if cfg.DesyncBuffer == 0 {
+		cfg.DesyncBuffer = defaultDesyncBuffer
+	}
+	if cfg.ExtranonceSize > 3 {
+		cfg.ExtranonceSize = 3
+	}
+	return cfg
+}
+
+// walletConnectionLimit returns the per wallet connection limit, 0 for none
+func (cfg BridgeConfig) walletConnectionLimit() int {
+	if cfg.MaxWalletConnections < 0 {
+		return 0
+	}
+	return cfg.MaxWalletConnections
+}
+
+// minJobInterval converts max_jobs_per_second to the minimum time between
+// jobs pushed to a client, 0 for no limit
+func (cfg BridgeConfig) minJobInterval() time.Duration {
+	if cfg.MaxJobsPerSecond <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / cfg.MaxJobsPerSecond)
+}
+
+// workerNameRules returns the normalization applied to worker names
+func (cfg BridgeConfig) workerNameRules() gostratum.WorkerNameRules {
+	return gostratum.WorkerNameRules{
+		Lowercase:   cfg.WorkerNameLowercase,
+		Trim:        cfg.WorkerNameTrim,
+		Separators:  cfg.WorkerNameSeparators,
+		Replacement: cfg.WorkerNameReplace,
+	}
+}
+
+// vardiffSettings returns the vardiff controller config, nil if vardiff is
+// disabled
+func (cfg BridgeConfig) vardiffSettings() *vardiffConfig {
+	if !cfg.Vardiff {
+		return nil
+	}
+	return &vardiffConfig{
+		mode:         VardiffMode(cfg.VardiffMode),
+		sharesPerMin: cfg.SharesPerMin,
+		targetCV:     cfg.VardiffTargetCV,
+		minDiff:      float64(cfg.MinShareDiff),
+		maxDiff:      float64(cfg.MaxShareDiff),
+		hardCap:      float64(cfg.DiffHardCap),
+
+		minChangeInterval: cfg.VardiffMinInterval,
+		minChangeRatio:    cfg.VardiffMinChange,
+		relative:          cfg.relativeDiff(),
+	}
+}
+
+func (cfg BridgeConfig) relativeDiff() relativeDiff {
+	return relativeDiff{minFraction: cfg.MinDiffFraction, maxFraction: cfg.MaxDiffFraction}
+}
+
+// validate fails on settings that are invalid or contradict each other, the
+// bridge would otherwise run in a way the operator didn't intend
+func (cfg BridgeConfig) validate() error {
+	var problems []string
+	fail := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if len(cfg.nodeAddresses()) == 0 {
+		fail("no pyrin node configured, set pyrin_address")
+	}
+	for _, address := range cfg.PayoutAddresses {
+		if err := validatePayoutAddress(address); err != nil {
+			fail("%s", err)
+		}
+	}
+	for _, address := range cfg.AllowedWallets {
+		if err := validateListedWallet("allowed_wallets", address); err != nil {
+			fail("%s", err)
+		}
+	}
+	for _, address := range cfg.DeniedWallets {
+		if err := validateListedWallet("denied_wallets", address); err != nil {
+			fail("%s", err)
+		}
+	}
+	if cfg.StratumPort == "" {
+		fail("stratum_port is required")
+	}
+	if !gostratum.HandshakeOrder(cfg.HandshakeOrder).Valid() {
+		fail("invalid handshake_order '%s', expected %s or %s", cfg.HandshakeOrder,
+			gostratum.HandshakeSubscribeFirst, gostratum.HandshakeAuthorizeFirst)
+	}
+	if !gostratum.SubscribeFormat(cfg.SubscribeFormat).Valid() {
+		fail("invalid subscribe_format '%s', expected %s", cfg.SubscribeFormat, gostratum.SubscribeFormatNiceHash)
+	}
+	if !gostratum.UnknownMethodPolicy(cfg.UnknownMethodPolicy).Valid() {
+		fail("invalid unknown_method_policy '%s', expected %s or %s", cfg.UnknownMethodPolicy,
+			gostratum.UnknownMethodIgnore, gostratum.UnknownMethodDisconnect)
+	}
+	if !UnknownJobPolicy(cfg.UnknownJobPolicy).Valid() {
+		fail("invalid unknown_job_policy '%s', expected %s or %s", cfg.UnknownJobPolicy,
+			UnknownJobReject, UnknownJobDisconnect)
+	}
+	if !LostRacePolicy(cfg.LostRacePolicy).Valid() {
+		fail("invalid lost_race_policy '%s', expected %s or %s", cfg.LostRacePolicy, LostRaceCredit, LostRaceStale)
+	}
+	if !JobIdMode(cfg.JobIds).Valid() {
+		fail("invalid job_ids '%s', expected %s or %s", cfg.JobIds, JobIdsSequential, JobIdsDeterministic)
+	}
+	if !NetworkMismatchPolicy(cfg.NetworkMismatch).Valid() {
+		fail("invalid network_mismatch '%s', expected %s or %s", cfg.NetworkMismatch,
+			NetworkMismatchStrict, NetworkMismatchWarn)
+	}
+	if !InstabilityPolicy(cfg.InstabilityPolicy).Valid() {
+		fail("invalid instability_policy '%s', expected %s or %s", cfg.InstabilityPolicy,
+			InstabilityPause, InstabilityWiden)
+	}
+	if !DesyncPolicy(cfg.DesyncPolicy).Valid() {
+		fail("invalid desync_policy '%s', expected %s, %s or %s", cfg.DesyncPolicy,
+			DesyncFailover, DesyncReject, DesyncBuffer)
+	}
+	if cfg.Extranonce2Size > 0 && cfg.ExtranonceSize == 0 {
+		fail("extranonce2_size requires extranonce_size")
+	}
+	if cfg.UniqueExtranonce && cfg.ExtranonceSize == 0 {
+		fail("unique_extranonce requires extranonce_size")
+	}
+	if cfg.ShareTemplates && cfg.ExtranonceSize == 0 {
+		fail("share_templates requires extranonce_size")
+	}
+	if cfg.ExtranonceSize+cfg.Extranonce2Size > 8 {
+		fail("extranonce_size + extranonce2_size can't exceed the 8 byte nonce")
+	}
+	for _, setting := range []struct {
+		name  string
+		value string
+	}{
+		{"log_level", cfg.LogLevel},
+		{"log_file_level", cfg.LogFileLevel},
+		{"log_stdout_level", cfg.LogStdoutLevel},
+	} {
+		if setting.value == "" {
+			continue
+		}
+		var level zapcore.Level
+		if err := level.UnmarshalText([]byte(setting.value)); err != nil {
+			fail("invalid %s '%s', expected debug, info, warn or error", setting.name, setting.value)
+		}
+	}
+	if !VardiffMode(cfg.VardiffMode).Valid() {
+		fail("invalid vardiff_mode '%s', expected %s or %s", cfg.VardiffMode, VardiffVariance, VardiffPID)
+	}
+	if cfg.VardiffMode == string(VardiffVariance) && cfg.VardiffTargetCV <= 0 {
+		fail("vardiff_mode %s requires a positive vardiff_target_cv", VardiffVariance)
+	}
+	if cfg.SharesPerMin < 0 {
+		fail("shares_per_min can't be negative")
+	}
+	if cfg.MaxShareDiff > 0 && cfg.MaxShareDiff < cfg.MinShareDiff {
+		fail("max_share_diff %d is below min_share_diff %d", cfg.MaxShareDiff, cfg.MinShareDiff)
+	}
+	for _, f := range []struct {
+		name     string
+		fraction float64
+	}{
+		{"min_share_diff_fraction", cfg.MinDiffFraction},
+		{"max_share_diff_fraction", cfg.MaxDiffFraction},
+	} {
+		if f.fraction < 0 || f.fraction > 1 {
+			fail("%s must be between 0 and 1 (0 for an absolute difficulty)", f.name)
+		}
+	}
+	if cfg.MaxDiffFraction > 0 && cfg.MaxDiffFraction < cfg.MinDiffFraction {
+		fail("max_share_diff_fraction %g is below min_share_diff_fraction %g", cfg.MaxDiffFraction, cfg.MinDiffFraction)
+	}
+	if cfg.DiffHardCap > 0 && cfg.DiffHardCap < cfg.MinShareDiff {
+		fail("diff_hard_cap %d is below min_share_diff %d", cfg.DiffHardCap, cfg.MinShareDiff)
+	}
+	if cfg.VardiffMinChange < 0 || cfg.VardiffMinChange >= 1 {
+		fail("vardiff_min_change must be between 0 and 1")
+	}
+	if cfg.MaxJobsPerSecond < 0 {
+		fail("max_jobs_per_second can't be negative")
+	}
+	if cfg.UnknownMethodLimit < 0 {
+		fail("unknown_method_limit can't be negative")
+	}
+	if cfg.InvalidShareRatio < 0 || cfg.InvalidShareRatio > 1 {
+		fail("invalid_share_ratio must be between 0 and 1, 1 disables the policy")
+	}
+	if cfg.NodeErrorRate < 0 || cfg.NodeErrorRate > 1 {
+		fail("node_error_rate must be between 0 and 1, 1 disables the check")
+	}
+	if cfg.InstabilitySwing < 0 {
+		fail("instability_difficulty_swing can't be negative")
+	}
+	if cfg.StaleShareTolerance < 0 || cfg.StaleShareTolerance > 1 {
+		fail("stale_share_tolerance must be between 0 and 1, 0 disables the hint")
+	}
+	if cfg.TraceSampleRate < 0 || cfg.TraceSampleRate > 1 {
+		fail("otlp_sample_rate must be between 0 and 1")
+	}
+	if cfg.StuckJobLag < -1 || cfg.StuckJobLag >= maxjobs {
+		fail("stuck_job_lag must be below %d (the retained jobs), or -1 to disable", maxjobs)
+	}
+	if cfg.WorkerMetricShares < 0 {
+		fail("worker_metrics_min_shares can't be negative")
+	}
+	if cfg.ConnectRetries < -1 {
+		fail("connect_retries must be positive, or -1 to disable")
+	}
+	if cfg.ReconnectMultiplier < 1 {
+		fail("reconnect_backoff_multiplier must be at least 1")
+	}
+	if cfg.ReconnectMaxBackoff < cfg.ReconnectBackoff {
+		fail("reconnect_max_backoff can't be below reconnect_backoff")
+	}
+	if cfg.TemplateRetries < -1 {
+		fail("template_unsynced_retries must be positive, or -1 to disable")
+	}
+	if cfg.ValidationWorkers < -1 {
+		fail("validation_workers must be positive, or -1 to validate shares inline")
+	}
+	if cfg.MinNodePeers < -1 {
+		fail("min_node_peers must be positive, or -1 to disable")
+	}
+	if cfg.QuarantineAfter < -1 {
+		fail("quarantine_after must be positive, or -1 to disable")
+	}
+	if cfg.StuckJobDisconnect < 0 {
+		fail("stuck_job_disconnect can't be negative")
+	}
+	if cfg.MaxWalletConnections < -1 {
+		fail("max_connections_per_wallet must be positive, or -1 for no limit")
+	}
+	if cfg.ShareLogSample < 0 {
+		fail("log_every_nth_share can't be negative")
+	}
+	if cfg.LogMaxSize < 0 || cfg.LogMaxBackups < 0 {
+		fail("log_max_size_mb and log_max_backups can't be negative")
+	}
+	if cfg.MaxMessageSize < 0 {
+		fail("max_message_size can't be negative")
+	}
+	if cfg.FlapLimit < 0 {
+		fail("flap_reconnect_limit can't be negative")
+	}
+	if cfg.MaxTrackedWorkers < 0 {
+		fail("max_tracked_workers can't be negative")
+	}
+	if cfg.AcceptBacklog < 0 || cfg.AcceptWorkers < 0 || cfg.AcceptQueue < 0 {
+		fail("accept_backlog, accept_workers and accept_queue can't be negative")
+	}
+	if cfg.AcceptQueue > 0 && cfg.AcceptWorkers == 0 {
+		fail("accept_queue requires accept_workers")
+	}
+	if cfg.TLSPort != "" && (cfg.TLSCertFile == "" || cfg.TLSKeyFile == "") {
+		fail("stratum_tls_port requires tls_cert_file and tls_key_file")
+	}
+	if cfg.WorkerNameReplace != "" && cfg.WorkerNameSeparators == "" {
+		fail("worker_name_separator_replacement is set but worker_name_separators isn't, nothing would be replaced")
+	}
+	if cfg.BlockWaitAuto && cfg.DisablePolling {
+		fail("block_wait_auto has nothing to tune with disable_template_polling")
+	}
+	if cfg.BlockWaitAuto && cfg.BlockWaitMax < cfg.BlockWaitMin {
+		fail("block_wait_max %s is below block_wait_min %s", cfg.BlockWaitMax, cfg.BlockWaitMin)
+	}
+	if err := cfg.nodeRPCOptions().Validate(); err != nil {
+		fail("%s", err)
+	}
+	if cfg.AdminToken != "" && cfg.AdminPort == "" {
+		fail("admin_token is set but admin_port isn't, the admin endpoint is disabled")
+	}
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"max_template_age", cfg.MaxTemplateAge},
+		{"duplicate_template_refresh", cfg.DuplicateRefresh},
+		{"job_keepalive", cfg.JobKeepalive},
+		{"rpc_timeout", cfg.RPCTimeout},
+		{"node_idle_timeout", cfg.NodeIdleTimeout},
+		{"connect_backoff", cfg.ConnectBackoff},
+		{"reconnect_backoff", cfg.ReconnectBackoff},
+		{"reconnect_max_backoff", cfg.ReconnectMaxBackoff},
+		{"template_unsynced_delay", cfg.TemplateRetryDelay},
+		{"flap_window", cfg.FlapWindow},
+		{"flap_backoff", cfg.FlapBackoff},
+		{"sync_check_interval", cfg.SyncCheckInterval},
+		{"warmup_timeout", cfg.WarmupTimeout},
+		{"previous_job_grace", cfg.JobGrace},
+		{"min_share_interval", cfg.MinShareInterval},
+		{"invalid_share_window", cfg.InvalidShareWindow},
+		{"diff_memory_ttl", cfg.DiffMemoryTTL},
+		{"vardiff_min_change_interval", cfg.VardiffMinInterval},
+		{"shutdown_drain", cfg.ShutdownDrain},
+		{"maintenance_drain", cfg.MaintenanceDrain},
+		{"desync_buffer", cfg.DesyncBuffer},
+		{"quarantine_cooldown", cfg.QuarantineCooldown},
+		{"node_stabilize_window", cfg.NodeStabilizeWindow},
+		{"node_refresh_interval", cfg.NodeRefreshInterval},
+		{"node_error_window", cfg.NodeErrorWindow},
+		{"instability_hold", cfg.InstabilityHold},
+		{"client_write_timeout", cfg.WriteTimeout},
+		{"latency_probe_interval", cfg.LatencyProbe},
+		{"extranonce_reuse_delay", cfg.ExtranonceReuse},
+		{"worker_metrics_ttl", cfg.WorkerMetricTTL},
+		{"hashrate_window", cfg.HashrateWindow},
+		{"log_rotate_interval", cfg.LogRotateInterval},
+	} {
+		if d.value < 0 {
+			fail("%s can't be negative", d.name)
+		}
+	}
+
+	// every listener needs its own port, except prom and the health check
+	// which deliberately share the default mux
+	ports := map[string]string{}
+	for _, p := range []struct {
+		name string
+		port string
+	}{
+		{"stratum_port", cfg.StratumPort},
+		{"stratum_tls_port", cfg.TLSPort},
+		{"prom_port", cfg.PromPort},
+		{"health_check_port", cfg.HealthCheckPort},
+		{"admin_port", cfg.AdminPort},
+	} {
+		if p.port == "" {
+			continue
+		}
+		if other, exists := ports[p.port]; exists {
+			if !(other == "prom_port" && p.name == "health_check_port") {
+				fail("%s and %s both use %s", other, p.name, p.port)
+			}
+			continue
+		}
+		ports[p.port] = p.name
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// redactURLs returns the comma separated urls with their passwords
+// redacted, or just "set" for one that doesn't parse as the whole of it
+// could be a credential
+func redactURLs(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	urls := strings.Split(raw, ",")
+	for i, raw := range urls {
+		u, err := url.Parse(strings.TrimSpace(raw))
+		if err != nil {
+			urls[i] = "set"
+			continue
+		}
+		urls[i] = u.Redacted()
+	}
+	return strings.Join(urls, ",")
+}
+
+// logSummary logs the effective config as a single structured line, secrets
+// redacted
+func (cfg BridgeConfig) logSummary(logger *zap.SugaredLogger) {
+	adminToken := ""
+	if cfg.AdminToken != "" {
+		adminToken = redacted
+	}
+	nodeAuthToken := ""
+	if cfg.NodeAuthToken != "" {
+		nodeAuthToken = redacted
+	}
+	// header values are often credentials too, only their names are logged
+	nodeHeaders := make([]string, 0, len(cfg.NodeHeaders))
+	for name := range cfg.NodeHeaders {
+		nodeHeaders = append(nodeHeaders, name)
+	}
+	sort.Strings(nodeHeaders)
+	logger.Infow("effective configuration",
+		"nodes", cfg.nodeAddresses(),
+		"stats_address", cfg.StatsRPCServer,
+		"submit_addresses", cfg.SubmitRPCServers,
+		"node_auth_token", nodeAuthToken,
+		"node_headers", nodeHeaders,
+		"node_tls", cfg.NodeTLS,
+		"node_tls_ca_file", cfg.NodeTLSCAFile,
+		"node_tls_cert_file", cfg.NodeTLSCertFile,
+		"node_tls_server_name", cfg.NodeTLSServerName,
+		"node_tls_insecure_skip_verify", cfg.NodeTLSInsecure,
+		"network", cfg.Network,
+		"network_mismatch", cfg.NetworkMismatch,
+		"payout_addresses", cfg.PayoutAddresses,
+		"coinbase_worker_name", cfg.CoinbaseWorkerName,
+		"allowed_wallets", len(cfg.AllowedWallets),
+		"denied_wallets", len(cfg.DeniedWallets),
+		"stratum_port", cfg.StratumPort,
+		"stratum_tls_port", cfg.TLSPort,
+		"prom_port", cfg.PromPort,
+		"worker_metrics_min_shares", cfg.WorkerMetricShares,
+		"worker_metrics_ttl", cfg.WorkerMetricTTL,
+		"hashrate_window", cfg.HashrateWindow,
+		"admin_port", cfg.AdminPort,
+		"admin_token", adminToken,
+		"health_check_port", cfg.HealthCheckPort,
+		"min_share_diff", cfg.MinShareDiff,
+		"max_share_diff", cfg.MaxShareDiff,
+		"diff_hard_cap", cfg.DiffHardCap,
+		"min_share_diff_fraction", cfg.MinDiffFraction,
+		"max_share_diff_fraction", cfg.MaxDiffFraction,
+		"vardiff", cfg.Vardiff,
+		"vardiff_mode", cfg.VardiffMode,
+		"shares_per_min", cfg.SharesPerMin,
+		"vardiff_target_cv", cfg.VardiffTargetCV,
+		"vardiff_min_change_interval", cfg.VardiffMinInterval,
+		"vardiff_min_change", cfg.VardiffMinChange,
+		"extranonce_size", cfg.ExtranonceSize,
+		"extranonce2_size", cfg.Extranonce2Size,
+		"unique_extranonce", cfg.UniqueExtranonce,
+		"extranonce_reuse_delay", cfg.ExtranonceReuse,
+		"block_wait_time", cfg.BlockWaitTime,
+		"disable_template_polling", cfg.DisablePolling,
+		"block_wait_auto", cfg.BlockWaitAuto,
+		"block_wait_min", cfg.BlockWaitMin,
+		"block_wait_max", cfg.BlockWaitMax,
+		"disable_handshake_job", cfg.DisableHandshakeJob,
+		"max_template_age", cfg.MaxTemplateAge,
+		"duplicate_template_refresh", cfg.DuplicateRefresh,
+		"max_jobs_per_second", cfg.MaxJobsPerSecond,
+		"job_keepalive", cfg.JobKeepalive,
+		"rpc_timeout", cfg.RPCTimeout,
+		"node_idle_timeout", cfg.NodeIdleTimeout,
+		"connect_retries", cfg.ConnectRetries,
+		"connect_backoff", cfg.ConnectBackoff,
+		"reconnect_backoff", cfg.ReconnectBackoff,
+		"reconnect_max_backoff", cfg.ReconnectMaxBackoff,
+		"reconnect_backoff_multiplier", cfg.ReconnectMultiplier,
+		"template_unsynced_retries", cfg.TemplateRetries,
+		"template_unsynced_delay", cfg.TemplateRetryDelay,
+		"sync_check_interval", cfg.SyncCheckInterval,
+		"min_node_peers", cfg.MinNodePeers,
+		"desync_policy", cfg.DesyncPolicy,
+		"desync_buffer", cfg.DesyncBuffer,
+		"quarantine_after", cfg.QuarantineAfter,
+		"quarantine_cooldown", cfg.QuarantineCooldown,
+		"node_stabilize_window", cfg.NodeStabilizeWindow,
+		"node_refresh_interval", cfg.NodeRefreshInterval,
+		"node_error_rate", cfg.NodeErrorRate,
+		"node_error_window", cfg.NodeErrorWindow,
+		"share_templates", cfg.ShareTemplates,
+		"skip_unchanged_tips", cfg.SkipUnchangedTips,
+		"pause_when_idle", cfg.PauseWhenIdle,
+		"instability_policy", cfg.InstabilityPolicy,
+		"instability_difficulty_swing", cfg.InstabilitySwing,
+		"instability_hold", cfg.InstabilityHold,
+		"lost_race_policy", cfg.LostRacePolicy,
+		"warmup_timeout", cfg.WarmupTimeout,
+		"max_concurrent_submits", cfg.MaxSubmits,
+		"validation_workers", cfg.ValidationWorkers,
+		"previous_job_grace", cfg.JobGrace,
+		"min_share_interval", cfg.MinShareInterval,
+		"invalid_share_ratio", cfg.InvalidShareRatio,
+		"invalid_share_window", cfg.InvalidShareWindow,
+		"stale_share_tolerance", cfg.StaleShareTolerance,
+		"stuck_job_lag", cfg.StuckJobLag,
+		"stuck_job_disconnect", cfg.StuckJobDisconnect,
+		"diff_memory_ttl", cfg.DiffMemoryTTL,
+		"handshake_order", cfg.HandshakeOrder,
+		"subscribe_format", cfg.SubscribeFormat,
+		"uppercase_hex", cfg.UppercaseHex,
+		"network_difficulty_message", cfg.NetworkDiffNotice,
+		"unknown_method_policy", cfg.UnknownMethodPolicy,
+		"unknown_job_policy", cfg.UnknownJobPolicy,
+		"job_ids", cfg.JobIds,
+		"strict_submit", cfg.StrictSubmit,
+		"accept_any_address", cfg.AcceptAnyAddress,
+		"max_message_size", cfg.MaxMessageSize,
+		"client_write_timeout", cfg.WriteTimeout,
+		"latency_probe_interval", cfg.LatencyProbe,
+		"accept_backlog", cfg.AcceptBacklog,
+		"keep_ipv4_mapped_addresses", cfg.KeepMappedIPv4,
+		"accept_workers", cfg.AcceptWorkers,
+		"accept_queue", cfg.AcceptQueue,
+		"max_connections_per_wallet", cfg.MaxWalletConnections,
+		"flap_window", cfg.FlapWindow,
+		"flap_reconnect_limit", cfg.FlapLimit,
+		"flap_backoff", cfg.FlapBackoff,
+		"max_tracked_workers", cfg.MaxTrackedWorkers,
+		"share_log_file", cfg.ShareLogFile,
+		"share_nats_url", redactURLs(cfg.ShareNatsURL),
+		"share_nats_subject", cfg.ShareNatsSubject,
+		"otlp_endpoint", cfg.TraceEndpoint,
+		"otlp_sample_rate", cfg.TraceSampleRate,
+		"log_every_nth_share", cfg.ShareLogSample,
+		"print_stats", cfg.PrintStats,
+		"log_to_file", cfg.UseLogFile,
+		"log_max_size_mb", cfg.LogMaxSize,
+		"log_max_backups", cfg.LogMaxBackups,
+		"log_rotate_interval", cfg.LogRotateInterval,
+		"log_compress", cfg.LogCompress,
+		"log_level", cfg.LogLevel,
+		"log_file_level", cfg.LogFileLevel,
+		"log_stdout_level", cfg.LogStdoutLevel,
+		"shutdown_drain", cfg.ShutdownDrain,
+		"maintenance_drain", cfg.MaintenanceDrain,
+		"maintenance_message", cfg.MaintenanceMessage,
+		"worker_name_lowercase", cfg.WorkerNameLowercase,
+		"worker_name_trim", cfg.WorkerNameTrim,
+		"worker_name_separators", cfg.WorkerNameSeparators,
+		"worker_name_separator_replacement", cfg.WorkerNameReplace,
+	)
+}
@@ -0,0 +1,26 @@
+package pyrinstratum
+
+// ConnectionLabeler can be implemented by operators to annotate incoming
+// stratum connections with a coarse origin label (e.g. a GeoIP country code
+// or an ASN looked up from a local database). It is called once per
+// connection at connect time with the remote ip of the client. The returned
+// value is used as a prometheus label, so keep the set of possible values
+// small (countries/ASNs, not ips). Returning "" marks the origin as unknown
+type ConnectionLabeler interface {
+	LabelConnection(remoteIp string) string
+}
+
+// noopConnectionLabeler is the default labeler, every connection is unknown
+type noopConnectionLabeler struct{}
+
+func (noopConnectionLabeler) LabelConnection(string) string { return "" }
+
+const unknownOrigin = "unknown"
+
+func labelConnection(labeler ConnectionLabeler, remoteIp string) string {
+	origin := labeler.LabelConnection(remoteIp)
+	if origin == "" {
+		return unknownOrigin
+	}
+	return origin
+}
@@ -0,0 +1,128 @@
+package pyrinstratum
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+)
+
+// DesyncPolicy controls what happens to shares for a job whose template came
+// from a node that has since reported it isn't synced. Its templates may
+// build on a stale tip, so blocks found on them won't necessarily be taken
+type DesyncPolicy string
+
+const (
+	// DesyncFailover credits shares as usual and submits block candidates to
+	// the synced nodes first, rejecting shares (retryable) if none is synced.
+	// The default with more than one node
+	DesyncFailover DesyncPolicy = "failover"
+	// DesyncReject rejects shares with a retryable error until the node is
+	// synced again, the default with a single node
+	DesyncReject DesyncPolicy = "reject"
+	// DesyncBuffer credits shares as usual and holds block candidates for up
+	// to desync_buffer waiting for a node to sync, then submits them anyway
+	DesyncBuffer DesyncPolicy = "buffer"
+)
+
+func (p DesyncPolicy) Valid() bool {
+	switch p {
+	case "", DesyncFailover, DesyncReject, DesyncBuffer:
+		return true
+	}
+	return false
+}
+
+const defaultDesyncBuffer = 10 * time.Second
+
+// how often a buffered block candidate checks whether a node synced
+const desyncPollInterval = 250 * time.Millisecond
+
+// outcomes recorded for shares handled while their node was desynced
+const (
+	desyncFailedOver    = "failover"
+	desyncRejected      = "rejected"
+	desyncBuffered      = "buffered"
+	desyncBufferExpired = "buffer_expired"
+)
+
+// nodeSyncChecker reports the node sync state last seen by the sync monitor
+type nodeSyncChecker interface {
+	NodeSynced(address string) bool
+	AnyNodeSynced() bool
+}
+
+// desyncPolicy applies the DesyncPolicy to submitted shares, it's disabled
+// while nodes is nil
+type desyncPolicy struct {
+	mode   DesyncPolicy
+	buffer time.Duration
+	nodes  nodeSyncChecker
+}
+
+// desynced returns true if the node that produced the job's template isn't
+// synced, or if no node is when the source is unknown
+func (p desyncPolicy) desynced(source string) bool {
+	if p.nodes == nil {
+		return false
+	}
+	if source == "" {
+		return !p.nodes.AnyNodeSynced()
+	}
+	return !p.nodes.NodeSynced(source)
+}
+
+// rejects returns true if shares for a job from source should be rejected
+// until the node syncs
+func (p desyncPolicy) rejects(source string) bool {
+	if !p.desynced(source) {
+		return false
+	}
+	switch p.mode {
+	case DesyncReject:
+		return true
+	case DesyncFailover:
+		return !p.nodes.AnyNodeSynced()
+	}
+	return false
+}
+
+// holds returns true if a block candidate for a job from source is held
+// until a node syncs, see submitTarget
+func (p desyncPolicy) holds(source string) bool {
+	return p.mode == DesyncBuffer && p.desynced(source)
+}
+
+// submitTarget returns the node a block candidate for a job from source is
+// submitted to first, "" leaving it to the synced nodes. With DesyncBuffer it
+// blocks (up to the buffer time) until a node is synced, so a held block is
+// submitted off the client's read loop
+func (p desyncPolicy) submitTarget(ctx *gostratum.StratumContext, source string) string {
+	if !p.desynced(source) {
+		return source
+	}
+	switch p.mode {
+	case DesyncFailover:
+		ctx.Logger.Warn(fmt.Sprintf("job node %s isn't synced, submitting block to a synced node", source))
+		RecordDesyncShare(desyncFailedOver)
+		return ""
+	case DesyncBuffer:
+		ctx.Logger.Warn(fmt.Sprintf("job node %s isn't synced, holding block for up to %s", source, p.buffer))
+		deadline := time.Now().Add(p.buffer)
+		for time.Now().Before(deadline) {
+			time.Sleep(desyncPollInterval)
+			if !p.desynced(source) {
+				RecordDesyncShare(desyncBuffered)
+				return source
+			}
+			if p.nodes.AnyNodeSynced() {
+				RecordDesyncShare(desyncBuffered)
+				return ""
+			}
+		}
+		// the node may take it regardless, nothing is lost trying
+		ctx.Logger.Warn("no node synced in time, submitting block anyway")
+		RecordDesyncShare(desyncBufferExpired)
+	}
+	return source
+}
@@ -0,0 +1,92 @@
+package pyrinstratum
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+)
+
+// max number of workers whose difficulty is remembered at once
+const maxDiffMemoryEntries = 10000
+
+type diffMemoryEntry struct {
+	diff    float64
+	expires time.Time
+}
+
+// diffMemory remembers the last difficulty of disconnected workers for a
+// short while, so a rig that briefly drops picks up where it left off
+// instead of ramping up from the starting difficulty again
+type diffMemory struct {
+	lock       sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]diffMemoryEntry
+	now        func() time.Time
+}
+
+func newDiffMemory(ttl time.Duration, maxEntries int) *diffMemory {
+	return &diffMemory{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    map[string]diffMemoryEntry{},
+		now:        time.Now,
+	}
+}
+
+func diffMemoryKey(ctx *gostratum.StratumContext) string {
+	return ctx.WalletAddr + "." + ctx.WorkerName
+}
+
+func (dm *diffMemory) remember(key string, diff float64) {
+	if dm.ttl <= 0 {
+		return
+	}
+	dm.lock.Lock()
+	defer dm.lock.Unlock()
+	now := dm.now()
+	if _, exists := dm.entries[key]; !exists && len(dm.entries) >= dm.maxEntries {
+		dm.evict(now)
+	}
+	dm.entries[key] = diffMemoryEntry{diff: diff, expires: now.Add(dm.ttl)}
+}
+
+// recall returns the remembered difficulty for the worker, if any. Entries
+// are only used once
+func (dm *diffMemory) recall(key string) (float64, bool) {
+	if dm.ttl <= 0 {
+		return 0, false
+	}
+	dm.lock.Lock()
+	defer dm.lock.Unlock()
+	entry, exists := dm.entries[key]
+	if !exists {
+		return 0, false
+	}
+	delete(dm.entries, key)
+	if dm.now().After(entry.expires) {
+		return 0, false
+	}
+	return entry.diff, true
+}
+
+// evict drops expired entries, and if that doesn't free up room the entry
+// closest to expiring. Must be called with the lock held
+func (dm *diffMemory) evict(now time.Time) {
+	oldestKey := ""
+	var oldest time.Time
+	for key, entry := range dm.entries {
+		if now.After(entry.expires) {
+			delete(dm.entries, key)
+			continue
+		}
+		if oldestKey == "" || entry.expires.Before(oldest) {
+			oldestKey, oldest = key, entry.expires
+		}
+	}
+	if len(dm.entries) >= dm.maxEntries && oldestKey != "" {
+		delete(dm.entries, oldestKey)
+		RecordTrackingEvicted(trackedDiffMemory)
+	}
+}
@@ -0,0 +1,47 @@
+package pyrinstratum
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDiffMemory(t *testing.T) {
+	now := time.Now()
+	dm := newDiffMemory(time.Minute, 2)
+	dm.now = func() time.Time { return now }
+
+	dm.remember("wallet.rig1", 64)
+	if diff, ok := dm.recall("wallet.rig1"); !ok || diff != 64 {
+		t.Fatalf("expected remembered diff 64, got %f (%t)", diff, ok)
+	}
+	if _, ok := dm.recall("wallet.rig1"); ok {
+		t.Fatalf("expected entry to be consumed by recall")
+	}
+
+	dm.remember("wallet.rig1", 64)
+	now = now.Add(2 * time.Minute)
+	if _, ok := dm.recall("wallet.rig1"); ok {
+		t.Fatalf("expected entry to expire after ttl")
+	}
+
+	// full memory evicts the entry closest to expiring
+	dm.remember("wallet.rig1", 8)
+	now = now.Add(time.Second)
+	dm.remember("wallet.rig2", 16)
+	dm.remember("wallet.rig3", 32)
+	if len(dm.entries) != 2 {
+		t.Fatalf("expected memory bounded to 2 entries, got %d", len(dm.entries))
+	}
+	if _, ok := dm.recall("wallet.rig1"); ok {
+		t.Fatalf("expected oldest entry to be evicted")
+	}
+	if diff, ok := dm.recall("wallet.rig3"); !ok || diff != 32 {
+		t.Fatalf("expected newest entry to be kept, got %f (%t)", diff, ok)
+	}
+
+	disabled := newDiffMemory(0, 2)
+	disabled.remember("wallet.rig1", 64)
+	if _, ok := disabled.recall("wallet.rig1"); ok {
+		t.Fatalf("expected a zero ttl to disable the memory")
+	}
+}
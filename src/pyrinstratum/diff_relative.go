@@ -0,0 +1,100 @@
+package pyrinstratum
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+	"go.uber.org/atomic"
+)
+
+// the last network difficulty the stats thread saw, 0 until it's known
+var currentNetworkDiff atomic.Float64
+
+func setNetworkDifficulty(difficulty float64) {
+	if difficulty > 0 {
+		currentNetworkDiff.Store(difficulty)
+	}
+}
+
+// networkShareDiff returns the stratum difficulty of a share meeting the
+// network target. A share of stratum difficulty 1 stands for DiffToHash(1)
+// GH, and at network difficulty d a block takes 2*d hashes (see
+// shareExpectedBlocks)
+func networkShareDiff(networkDiff float64) float64 {
+	return 2 * networkDiff / (DiffToHash(1) * 1e9)
+}
+
+// fixed difficulties following the network move once they're off by this
+// much, rather than on every difficulty adjustment
+const relativeDiffChange = 0.05
+
+// relativeDiff sets the share difficulty bounds as a fraction of the network
+// difficulty instead of absolute numbers, keeping share rates the same as
+// the network difficulty moves. A fraction of 0 leaves that bound absolute,
+// and the absolute bounds apply until the network difficulty is known
+type relativeDiff struct {
+	minFraction float64
+	maxFraction float64
+}
+
+func (r relativeDiff) enabled() bool {
+	return r.minFraction > 0 || r.maxFraction > 0
+}
+
+// bounds returns the min and max difficulty, the absolute ones given unless
+// set relative to the network difficulty
+func (r relativeDiff) bounds(minDiff, maxDiff float64) (float64, float64) {
+	network := currentNetworkDiff.Load()
+	if network <= 0 {
+		return minDiff, maxDiff
+	}
+	if r.minFraction > 0 {
+		minDiff = r.minFraction * networkShareDiff(network)
+	}
+	if r.maxFraction > 0 {
+		maxDiff = r.maxFraction * networkShareDiff(network)
+	}
+	return minDiff, maxDiff
+}
+
+// minDiff returns the current min share difficulty, what clients without a
+// suggested difficulty start at
+func (c *clientListener) minDiff() float64 {
+	minDiff, _ := c.relativeDiff.bounds(c.minShareDiff, 0)
+	return minDiff
+}
+
+// followNetworkDiff moves a client mining at the min difficulty (without
+// vardiff) along with it as the network difficulty changes
+func (c *clientListener) followNetworkDiff(client *gostratum.StratumContext, state *MiningState) error {
+	if !c.relativeDiff.enabled() || state.diffSource != DiffSourceMinDiff {
+		return nil
+	}
+	current, target := state.stratumDiff.diffValue, c.minDiff()
+	if current > 0 && math.Abs(target/current-1) < relativeDiffChange {
+		return nil
+	}
+	state.setDiff(target, DiffSourceMinDiff)
+	return sendClientDiff(client, state)
+}
+
+// noticeNetworkDiff tells the client the network difficulty in a
+// client.show_message, for miners that display pool messages on their
+// dashboard. Only sent once the network difficulty is known and then again
+// when it has moved by relativeDiffChange since the client was last told, so
+// the miner's log isn't flooded. Best effort like the bridge's other messages.
+// Called from job pushes, with the client's pushLock guarding
+// noticedNetworkDiff
+func (c *clientListener) noticeNetworkDiff(client *gostratum.StratumContext, state *MiningState) {
+	network := currentNetworkDiff.Load()
+	if !c.networkDiffNotice || network <= 0 {
+		return
+	}
+	if last := state.noticedNetworkDiff; last > 0 && math.Abs(network/last-1) < relativeDiffChange {
+		return
+	}
+	state.noticedNetworkDiff = network
+	showMessage(client, fmt.Sprintf("network difficulty %.4g, share difficulty %.4g for a block",
+		network, networkShareDiff(network)))
+}
@@ -0,0 +1,52 @@
+package pyrinstratum
+
+import (
+	"math"
+	"math/big"
+
+	"go.uber.org/zap"
+)
+
+// the proof of work limit the node's reported difficulty is relative to,
+// 2^255 - 1 on every pyrin network
+var powMax = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(1))
+
+// templates whose target converts to a difficulty off from the node's by more
+// than this are logged. The node reports the difficulty of the virtual block,
+// which can move a little between the template fetch and the stats query
+const difficultyMismatchTolerance = 0.05
+
+// templateDifficulty converts a template's bits to the network difficulty the
+// way the node reports it in GetBlockDAGInfo, but through CalculateTarget,
+// the same conversion share validation uses
+func templateDifficulty(bits uint32) float64 {
+	target := CalculateTarget(uint64(bits))
+	if target.Sign() <= 0 {
+		return 0
+	}
+	difficulty, _ := new(big.Rat).SetFrac(powMax, &target).Float64()
+	return difficulty
+}
+
+// checkTemplateDifficulty cross checks the difficulty derived from the last
+// template's target against the difficulty the node reported, a bug in the
+// target conversion would otherwise only show up as shares and blocks being
+// judged against the wrong target. A large mismatch can also mean the
+// template came from a node on a fork of its own
+func (py *PyrinApi) checkTemplateDifficulty(node string, reported float64) {
+	bits := py.templateBits.Load()
+	if bits == 0 || reported <= 0 {
+		// no template fetched yet
+		return
+	}
+	derived := templateDifficulty(bits)
+	ratio := derived / reported
+	RecordTemplateDifficultyRatio(ratio)
+	if math.Abs(ratio-1) <= difficultyMismatchTolerance {
+		return
+	}
+	RecordDifficultyMismatch()
+	py.logger.Warn("difficulty derived from the block template target doesn't match the node's network difficulty",
+		zap.Float64("template_difficulty", derived), zap.Float64("network_difficulty", reported),
+		zap.Uint32("bits", bits), zap.String("node", node))
+}
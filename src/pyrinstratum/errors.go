@@ -7,6 +7,7 @@ const (
 	ErrFailedBlockFetch  ErrorShortCodeT = "err_failed_block_fetch"
 	ErrInvalidAddressFmt ErrorShortCodeT = "err_malformed_wallet_address"
 	ErrMissingJob        ErrorShortCodeT = "err_missing_job"
+	ErrUnknownJob        ErrorShortCodeT = "err_unknown_job"
 	ErrBadDataFromMiner  ErrorShortCodeT = "err_bad_data_from_miner"
 	ErrFailedSendWork    ErrorShortCodeT = "err_failed_sending_work"
 	ErrFailedSetDiff     ErrorShortCodeT = "err_diff_set_failed"
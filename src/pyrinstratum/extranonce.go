@@ -0,0 +1,83 @@
+package pyrinstratum
+
+import "time"
+
+// well past the life of any job the last owner of a released extranonce was
+// sent, with templates refreshing every second or so
+const defaultExtranonceReuseDelay = time.Minute
+
+// extranoncePool leases extranonces to connections so no two connected
+// clients are given the same one, and with it the same nonce range. The
+// extranonce is the high extranonce_size bytes of the nonce, the miner
+// iterates the bytes below it, so distinct extranonces never overlap. Never
+// leased extranonces are handed out first, in sequence, after that released
+// ones are recycled oldest first from a free list. A released extranonce is
+// held back for reuseDelay so whatever work its last owner was still doing
+// on it has gone stale before another client searches the same range.
+// It's guarded by the client lock
+type extranoncePool struct {
+	max        int32
+	next       int64
+	leased     map[int32]bool
+	free       []releasedExtranonce
+	reuseDelay time.Duration
+}
+
+type releasedExtranonce struct {
+	extranonce int32
+	at         time.Time
+}
+
+func newExtranoncePool(max int32, reuseDelay time.Duration) *extranoncePool {
+	return &extranoncePool{max: max, leased: map[int32]bool{}, reuseDelay: reuseDelay}
+}
+
+// lease returns a free extranonce, false if every one is leased or still
+// cooling down
+func (p *extranoncePool) lease(now time.Time) (int32, bool) {
+	if p.next <= int64(p.max) {
+		extranonce := int32(p.next)
+		p.next++
+		p.leased[extranonce] = true
+		return extranonce, true
+	}
+	// released in order, so if the oldest hasn't cooled down none has
+	if len(p.free) == 0 || now.Sub(p.free[0].at) < p.reuseDelay {
+		return 0, false
+	}
+	released := p.free[0]
+	p.free = p.free[1:]
+	p.leased[released.extranonce] = true
+	return released.extranonce, true
+}
+
+func (p *extranoncePool) release(extranonce int32, now time.Time) {
+	if !p.leased[extranonce] {
+		return
+	}
+	delete(p.leased, extranonce)
+	p.free = append(p.free, releasedExtranonce{extranonce, now})
+}
+
+// assignExtranonce picks the extranonce for a new connection, returning true
+// if it's leased from the pool (and needs releasing on disconnect). Called
+// with the client lock held
+func (c *clientListener) assignExtranonce() (int32, bool) {
+	if c.extranonces != nil {
+		if extranonce, ok := c.extranonces.lease(time.Now()); ok {
+			return extranonce, true
+		}
+		c.logger.Warn("every extranonce is in use or cooling down! new clients may be duplicating work...")
+		RecordExtranonceExhausted()
+	}
+	extranonce := c.nextExtranonce
+	if c.nextExtranonce < c.maxExtranonce {
+		c.nextExtranonce++
+	} else {
+		c.nextExtranonce = 0
+		if c.extranonces == nil {
+			c.logger.Warn("wrapped extranonce! new clients may be duplicating work...")
+		}
+	}
+	return extranonce, false
+}
@@ -0,0 +1,111 @@
+package pyrinstratum
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const defaultFlapWindow = 10 * time.Minute
+const defaultFlapBackoff = 5 * time.Minute
+
+// max number of workers tracked at once, and connects remembered per worker
+const maxFlapEntries = 10000
+const maxFlapConnects = 1000
+
+var ErrWorkerFlapping = fmt.Errorf("worker reconnecting too often")
+
+type flapEntry struct {
+	connects     []time.Time
+	backoffUntil time.Time
+}
+
+// flapDetector counts how often each worker (wallet and normalized worker
+// name) connected over the window, to spot rigs flapping on power or
+// network trouble. With a limit, a worker reconnecting more often than that
+// within the window is turned away at authorize for the backoff
+type flapDetector struct {
+	lock    sync.Mutex
+	window  time.Duration
+	limit   int
+	backoff time.Duration
+	// most workers tracked at once, maxFlapEntries unless
+	// max_tracked_workers is set
+	maxEntries int
+	workers    map[string]*flapEntry
+	now        func() time.Time
+}
+
+func newFlapDetector(window time.Duration, limit int, backoff time.Duration) *flapDetector {
+	return &flapDetector{
+		window:     window,
+		limit:      limit,
+		backoff:    backoff,
+		maxEntries: maxFlapEntries,
+		workers:    map[string]*flapEntry{},
+		now:        time.Now,
+	}
+}
+
+// connect counts the worker connecting, returning its reconnects within the
+// window and how much longer it's backed off for, 0 letting it in. Attempts
+// while backed off aren't counted
+func (f *flapDetector) connect(key string) (int, time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	now := f.now()
+	entry, exists := f.workers[key]
+	if !exists {
+		if len(f.workers) >= f.maxEntries {
+			f.evict(now)
+		}
+		entry = &flapEntry{}
+		f.workers[key] = entry
+	}
+	if now.Before(entry.backoffUntil) {
+		return len(entry.connects), entry.backoffUntil.Sub(now)
+	}
+
+	kept := entry.connects[:0]
+	for _, connected := range entry.connects {
+		if now.Sub(connected) < f.window {
+			kept = append(kept, connected)
+		}
+	}
+	if len(kept) >= maxFlapConnects {
+		kept = kept[1:]
+	}
+	entry.connects = append(kept, now)
+	reconnects := len(entry.connects) - 1
+	if f.limit > 0 && reconnects > f.limit {
+		// starts over once the backoff is up
+		entry.connects, entry.backoffUntil = entry.connects[:0], now.Add(f.backoff)
+		return reconnects, f.backoff
+	}
+	return reconnects, 0
+}
+
+// evict drops workers with no connects in the window and no backoff left,
+// and if that doesn't free up room the one that connected least recently.
+// Must be called with the lock held
+func (f *flapDetector) evict(now time.Time) {
+	oldestKey := ""
+	var oldest time.Time
+	for key, entry := range f.workers {
+		last := time.Time{}
+		if len(entry.connects) > 0 {
+			last = entry.connects[len(entry.connects)-1]
+		}
+		if now.Sub(last) >= f.window && !now.Before(entry.backoffUntil) {
+			delete(f.workers, key)
+			continue
+		}
+		if oldestKey == "" || last.Before(oldest) {
+			oldestKey, oldest = key, last
+		}
+	}
+	if len(f.workers) >= f.maxEntries && oldestKey != "" {
+		delete(f.workers, oldestKey)
+		RecordTrackingEvicted(trackedFlaps)
+	}
+}
@@ -0,0 +1,82 @@
+package pyrinstratum
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+	"go.uber.org/zap"
+)
+
+func TestFlapDetector(t *testing.T) {
+	now := time.Now()
+	flaps := newFlapDetector(10*time.Minute, 2, 5*time.Minute)
+	flaps.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if reconnects, backoff := flaps.connect("rig1"); reconnects != i || backoff != 0 {
+			t.Fatalf("expected %d reconnects and no backoff, got %d and %s", i, reconnects, backoff)
+		}
+		now = now.Add(time.Minute)
+	}
+	if reconnects, backoff := flaps.connect("rig1"); reconnects != 3 || backoff != 5*time.Minute {
+		t.Fatalf("expected the 3rd reconnect backed off, got %d and %s", reconnects, backoff)
+	}
+	now = now.Add(time.Minute)
+	if _, backoff := flaps.connect("rig1"); backoff != 4*time.Minute {
+		t.Fatalf("expected 4m of backoff left, got %s", backoff)
+	}
+	if _, backoff := flaps.connect("rig2"); backoff != 0 {
+		t.Fatalf("expected other workers unaffected")
+	}
+
+	// back in after the backoff, counting from scratch
+	now = now.Add(5 * time.Minute)
+	if reconnects, backoff := flaps.connect("rig1"); reconnects != 0 || backoff != 0 {
+		t.Fatalf("expected the worker let in again, got %d and %s", reconnects, backoff)
+	}
+	// connects fall out of the window
+	now = now.Add(11 * time.Minute)
+	if reconnects, _ := flaps.connect("rig1"); reconnects != 0 {
+		t.Fatalf("expected old connects outside the window, got %d", reconnects)
+	}
+
+	// over max_tracked_workers the worker that connected least recently goes
+	flaps.maxEntries = 2
+	evicted := testutil.ToFloat64(trackingEvictedCounter.WithLabelValues(trackedFlaps))
+	now = now.Add(time.Second)
+	flaps.connect("rig2")
+	now = now.Add(time.Second)
+	flaps.connect("rig3")
+	if _, tracked := flaps.workers["rig1"]; tracked || len(flaps.workers) != 2 ||
+		testutil.ToFloat64(trackingEvictedCounter.WithLabelValues(trackedFlaps)) != evicted+1 {
+		t.Fatalf("expected rig1 evicted to keep 2 workers, got %v", flaps.workers)
+	}
+}
+
+func TestFlappingWorkerRejected(t *testing.T) {
+	const wallet = "pyrin:qqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqgxrehfpw"
+	listener := newClientListener(zap.NewNop().Sugar(), nil, 1, 0, 0, 0, 0, 0, nil, nil)
+	listener.flaps = newFlapDetector(time.Minute, 1, time.Minute)
+	listener.workerNames = gostratum.WorkerNameRules{Lowercase: true}
+
+	authorize := func(worker string) (error, string) {
+		ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+		replies := readAll(mc)
+		err := listener.HandleAuthorize(ctx, gostratum.JsonRpcEvent{Id: 1, Method: "mining.authorize", Params: []any{wallet + "." + worker, "x"}})
+		return err, <-replies
+	}
+	for _, worker := range []string{"Rig1", "rig1"} {
+		if err, _ := authorize(worker); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the normalized name is what's counted
+	if err, reply := authorize("RIG1"); !errors.Is(err, ErrWorkerFlapping) || !strings.Contains(reply, "Reconnecting too often, retry in 1m0s") {
+		t.Fatalf("expected the flapping worker rejected, got %v: %s", err, reply)
+	}
+}
@@ -0,0 +1,51 @@
+package pyrinstratum
+
+import (
+	"time"
+
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+)
+
+// subscribeHandler wraps the mining.subscribe handler, detecting the job
+// format from the miner app and sending clients that authorized before
+// subscribing their first job
+func (c *clientListener) subscribeHandler(subscribe gostratum.EventHandler) gostratum.EventHandler {
+	return func(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent) error {
+		if err := subscribe(ctx, event); err != nil {
+			return err
+		}
+		ctx.UpdateCapabilities(func(caps *gostratum.Capabilities) {
+			caps.BigJob = bigJobRegex.MatchString(ctx.RemoteApp)
+		})
+		if ctx.Authorized() {
+			c.handshakeComplete(ctx)
+		}
+		return nil
+	}
+}
+
+// handshakeComplete pushes a freshly authorized client its first job rather
+// than leaving it idle until the next new block, bounding how long a miner
+// waits for work after connecting by the template fetch instead of the block
+// cadence. A client that authorized without subscribing is held for what's
+// left of its subscribe grace first, like pushJob would. Whether the client
+// is still waiting for its first job is checked again under its pushLock
+// once the template is fetched, so a broadcast that initializes it in
+// between doesn't get it a second first job
+func (c *clientListener) handshakeComplete(ctx *gostratum.StratumContext) {
+	if c.handshakeJobs == nil {
+		return
+	}
+	state := GetMiningState(ctx)
+	push := func() {
+		if ctx.Connected() {
+			c.pushClientJob(c.handshakeJobs, ctx, newNotifyCache(), nil, true)
+		}
+	}
+	if ctx.Subscribed() {
+		// off the client's read loop, the fetch takes a node round trip
+		go push()
+		return
+	}
+	time.AfterFunc(subscribeGrace-time.Since(state.connectTime), push)
+}
@@ -11,6 +11,10 @@ import (
 	"math/big"
 
 	"github.com/pyrin-network/pyipad/app/appmessage"
+	"github.com/pyrin-network/pyipad/domain/consensus/model/externalapi"
+	"github.com/pyrin-network/pyipad/domain/consensus/utils/consensushashing"
+	"github.com/pyrin-network/pyipad/domain/consensus/utils/pow"
+	"github.com/pyrin-network/pyipad/domain/consensus/utils/subnetworks"
 )
 
 // static value definitions to avoid overhead in diff translations
@@ -92,18 +96,16 @@ func SerializeBlockHeader(template *appmessage.RPCBlock) ([]byte, error) {
 	}
 	hasher.Write(detailsBuff.Bytes())
 
-	bw := template.Header.BlueWork
-	padding := len(bw) + (len(bw) % 2)
-	for {
-		if len(bw) < padding {
-			bw = "0" + bw
-		} else {
-			break
+	// consensus serializes blue work as its minimal big endian bytes, so
+	// zero blue work is no bytes at all rather than a single zero byte
+	blueWork := new(big.Int)
+	if template.Header.BlueWork != "" {
+		if _, ok := blueWork.SetString(template.Header.BlueWork, 16); !ok {
+			return nil, fmt.Errorf("invalid blue work '%s'", template.Header.BlueWork)
 		}
 	}
-	hh, _ := hex.DecodeString(bw)
-	write64(hasher, uint64(len(hh)))
-	writeHexString(hasher, bw)
+	write64(hasher, uint64(len(blueWork.Bytes())))
+	hasher.Write(blueWork.Bytes())
 	writeHexString(hasher, template.Header.PruningPoint)
 
 	final := hasher.Sum(nil)
@@ -111,6 +113,51 @@ func SerializeBlockHeader(template *appmessage.RPCBlock) ([]byte, error) {
 	return final, nil
 }
 
+// shareProofOfWork is a job's header hashed with a submitted nonce
+type shareProofOfWork struct {
+	block  *externalapi.DomainBlock
+	header externalapi.MutableBlockHeader
+	value  *big.Int
+	// network target, from the header's bits
+	target *big.Int
+}
+
+// computeProofOfWork hashes the job with the nonce. The hashing is the
+// node's own consensus pow code rather than a reimplementation, so a share
+// is a block candidate exactly when the node would accept its pow. What the
+// bridge has to get right is the job header miners hash, see
+// SerializeBlockHeader and the self-test
+func computeProofOfWork(job *appmessage.RPCBlock, nonce uint64) (*shareProofOfWork, error) {
+	converted, err := appmessage.RPCBlockToDomainBlock(job)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cast block to mutable block: %+v", err)
+	}
+	header := converted.Header.ToMutable()
+	header.SetNonce(nonce)
+	state := pow.NewState(header)
+	return &shareProofOfWork{
+		block:  converted,
+		header: header,
+		value:  state.CalculateProofOfWorkValue(),
+		target: &state.Target,
+	}, nil
+}
+
+// blockCandidate returns true if the share meets the network target, the
+// same check the node applies
+func (p *shareProofOfWork) blockCandidate() bool {
+	return p.value.Cmp(p.target) <= 0
+}
+
+// prePowHash returns the hash miners are given to work on as the node
+// computes it, the header hash with the timestamp and nonce zeroed
+func prePowHash(header externalapi.BlockHeader) *externalapi.DomainHash {
+	mutable := header.ToMutable()
+	mutable.SetTimeInMilliseconds(0)
+	mutable.SetNonce(0)
+	return consensushashing.HeaderHash(mutable)
+}
+
 func GenerateJobHeader(headerData []byte) []uint64 {
 	ids := []uint64{}
 	ids = append(ids, uint64(binary.LittleEndian.Uint64(headerData[0:])))
@@ -187,6 +234,41 @@ func BigDiffToLittle(diff *big.Int) float64 {
 	return d
 }
 
+// coinbaseSubnetworkID is the subnetwork id of coinbase transactions as sent
+// over rpc
+var coinbaseSubnetworkID = subnetworks.SubnetworkIDCoinbase.String()
+
+// coinbaseReward returns the total paid out by the template's coinbase in
+// sompi, 0 if the template has no coinbase
+func coinbaseReward(block *appmessage.RPCBlock) uint64 {
+	if len(block.Transactions) == 0 || block.Transactions[0].SubnetworkID != coinbaseSubnetworkID {
+		return 0
+	}
+	reward := uint64(0)
+	for _, output := range block.Transactions[0].Outputs {
+		reward += output.Amount
+	}
+	return reward
+}
+
+// templateFingerprint identifies a template by what miners are working on,
+// its parents, transactions (through the merkle root) and reward. Templates
+// that only differ in timestamp share a fingerprint
+func templateFingerprint(block *appmessage.RPCBlock) [32]byte {
+	hasher := blake3.New(32, nil)
+	for _, level := range block.Header.Parents {
+		write64(hasher, uint64(len(level.ParentHashes)))
+		for _, hash := range level.ParentHashes {
+			writeHexString(hasher, hash)
+		}
+	}
+	writeHexString(hasher, block.Header.HashMerkleRoot)
+	write64(hasher, coinbaseReward(block))
+	var fingerprint [32]byte
+	copy(fingerprint[:], hasher.Sum(nil))
+	return fingerprint
+}
+
 func write16(hasher hash.Hash, val uint16) {
 	intBuff := make([]byte, 2)
 	binary.LittleEndian.PutUint16(intBuff, val)
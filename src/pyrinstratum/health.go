@@ -0,0 +1,55 @@
+package pyrinstratum
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// HealthStatus is the body of the /healthz and /readyz probes. It's built
+// from the state the health check and sync monitor already track, so probes
+// never call the node themselves
+type HealthStatus struct {
+	// the active node is up and synced
+	Healthy bool `json:"healthy"`
+	// healthy and a synced template has been served, miners connecting get
+	// work. Also false while draining or in maintenance
+	Ready     bool   `json:"ready"`
+	Node      string `json:"node"`
+	Connected bool   `json:"connected"`
+	Synced    bool   `json:"synced"`
+	// -1 before the first template
+	TemplateAgeSeconds float64 `json:"last_template_age_seconds"`
+}
+
+// Health reports the state of the active node and of the templates
+func (py *PyrinApi) Health() HealthStatus {
+	node := py.activeNode()
+	status := HealthStatus{
+		Node:               node.address,
+		Connected:          node.rpc() != nil && node.state.State().usable(),
+		Synced:             !node.unsynced.Load(),
+		TemplateAgeSeconds: -1,
+	}
+	if last := py.lastTemplate.Load(); last != 0 {
+		status.TemplateAgeSeconds = time.Since(time.Unix(0, last)).Seconds()
+	}
+	status.Healthy = status.Connected && status.Synced
+	status.Ready = status.Healthy && py.Ready()
+	return status
+}
+
+// healthHandler serves a probe, 200 while the status is healthy (or with
+// ready, ready) and 503 otherwise, with the status as the body either way
+func healthHandler(status func() HealthStatus, ready bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		current := status()
+		code := http.StatusOK
+		if !current.Healthy || ready && !current.Ready {
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(current)
+	}
+}
@@ -0,0 +1,18 @@
+package pyrinstratum
+
+// setIdle pauses (or resumes) the template listener's refreshes, called with
+// true when the last miner disconnects and false when the first one connects
+// (see pause_when_idle). The notification subscription and the node checks
+// keep running while paused. Notifications skipped while paused are what the
+// shared templates were invalidated on, so they're invalidated on resuming
+func (py *PyrinApi) setIdle(idle bool) {
+	if py.idle.Swap(idle) == idle {
+		return
+	}
+	if idle {
+		py.logger.Info("no miners connected, pausing template refreshes")
+		return
+	}
+	py.templateCache.invalidate()
+	py.logger.Info("miner connected, resuming template refreshes")
+}
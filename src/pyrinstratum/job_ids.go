@@ -0,0 +1,130 @@
+package pyrinstratum
+
+import (
+	"encoding/binary"
+
+	"github.com/pyrin-network/pyipad/app/appmessage"
+	"lukechampine.com/blake3"
+)
+
+// JobIdMode controls the job ids jobs are sent to miners under
+type JobIdMode string
+
+const (
+	// JobIdsSequential numbers each connection's jobs 1, 2, 3..., the
+	// default
+	JobIdsSequential JobIdMode = "sequential"
+	// JobIdsDeterministic derives each job's id from its template, so the
+	// same template always goes out under the same id, across connections
+	// and restarts
+	JobIdsDeterministic JobIdMode = "deterministic"
+)
+
+func (m JobIdMode) Valid() bool {
+	switch m {
+	case "", JobIdsSequential, JobIdsDeterministic:
+		return true
+	}
+	return false
+}
+
+// deterministic ids are kept to 31 bits, a positive number even for miners
+// that parse job ids into an int32
+const maxWireJobId = 1<<31 - 1
+
+// wireJob is the id a retained job was sent under, and the template it was
+// derived from
+type wireJob struct {
+	id  int
+	key [32]byte
+}
+
+// jobKey identifies what a job has miners hash, its template fingerprint
+// and the header timestamp (which the fingerprint leaves out)
+func jobKey(job *appmessage.RPCBlock) [32]byte {
+	fingerprint := templateFingerprint(job)
+	hasher := blake3.New(32, nil)
+	hasher.Write(fingerprint[:])
+	write64(hasher, uint64(job.Header.Timestamp))
+	var key [32]byte
+	copy(key[:], hasher.Sum(nil))
+	return key
+}
+
+// assignWireId gives the job just added under idx its deterministic id, the
+// first 31 bits of its key. Should another retained job hold that id for a
+// different template (a truncated hash collision) the next free id is used,
+// so ids stay unique among the retained jobs. Callers hold JobLock
+func (ms *MiningState) assignWireId(idx int, job *appmessage.RPCBlock) {
+	if ms.wireJobs == nil {
+		ms.wireJobs = map[int]wireJob{}
+		ms.wireJobIds = map[int]int{}
+		ms.expiredWireJobs = map[int]int{}
+		ms.expiredWireIds = map[int]int{}
+	}
+	slot := idx % maxjobs
+	if old, exists := ms.wireJobs[slot]; exists && ms.wireJobIds[old.id] == idx-maxjobs {
+		delete(ms.wireJobIds, old.id)
+		ms.expireWireId(slot, old.id)
+	}
+	key := jobKey(job)
+	id := int(binary.BigEndian.Uint32(key[:]) & maxWireJobId)
+	for {
+		if id == 0 {
+			id = 1
+		}
+		prev, taken := ms.wireJobIds[id]
+		if !taken || ms.wireJobs[prev%maxjobs].key == key {
+			break
+		}
+		id = id%maxWireJobId + 1
+	}
+	ms.wireJobs[slot] = wireJob{id: id, key: key}
+	ms.wireJobIds[id] = idx
+}
+
+// expireWireId remembers the id of the job dropped from slot, in place of the
+// one dropped from it before. Callers hold JobLock
+func (ms *MiningState) expireWireId(slot, id int) {
+	if prev, exists := ms.expiredWireJobs[slot]; exists && ms.expiredWireIds[prev] == slot {
+		delete(ms.expiredWireIds, prev)
+	}
+	ms.expiredWireJobs[slot] = id
+	ms.expiredWireIds[id] = slot
+}
+
+// WireJobId returns the id the job was sent to the client under
+func (ms *MiningState) WireJobId(id int) int {
+	ms.JobLock.Lock()
+	defer ms.JobLock.Unlock()
+	if !ms.deterministicJobs || id <= ms.jobCounter-maxjobs || id > ms.jobCounter {
+		return id
+	}
+	if job, exists := ms.wireJobs[id%maxjobs]; exists {
+		return job.id
+	}
+	return id
+}
+
+// ResolveJobId returns the job a submit's job id refers to. Sequential ids
+// are the job's own, a deterministic one only resolves while its job is
+// retained
+func (ms *MiningState) ResolveJobId(wireId int) (int, bool) {
+	ms.JobLock.Lock()
+	defer ms.JobLock.Unlock()
+	if !ms.deterministicJobs {
+		return wireId, true
+	}
+	id, exists := ms.wireJobIds[wireId]
+	return id, exists
+}
+
+// WireJobExpired returns true if a deterministic id that doesn't resolve is
+// one of the last maxjobs ids dropped. Older ids aren't told apart from ones
+// never sent
+func (ms *MiningState) WireJobExpired(wireId int) bool {
+	ms.JobLock.Lock()
+	defer ms.JobLock.Unlock()
+	_, expired := ms.expiredWireIds[wireId]
+	return expired
+}
@@ -0,0 +1,91 @@
+package pyrinstratum
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+)
+
+// how often clients are checked for a due keepalive job, at most
+const jobKeepaliveCheck = time.Second
+
+// lastNotify is the last job sent to a client, kept for resending it as a
+// keepalive. Sends go through it so a keepalive can't go out after (and
+// undo) a newer job
+type lastNotify struct {
+	lock sync.Mutex
+	line []byte
+	sent time.Time
+}
+
+// send writes the notify line to the client, recording it if it went out
+func (n *lastNotify) send(client *gostratum.StratumContext, line []byte) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if err := client.SendRaw(line); err != nil {
+		return err
+	}
+	n.line = append(n.line[:0], line...)
+	n.sent = time.Now()
+	return nil
+}
+
+// resend sends the last job again if nothing was sent to the client for the
+// interval, returning true if it did
+func (n *lastNotify) resend(client *gostratum.StratumContext, interval time.Duration, now time.Time) (bool, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.line == nil || now.Sub(n.sent) < interval {
+		return false, nil
+	}
+	if err := client.SendRaw(n.line); err != nil {
+		return false, err
+	}
+	n.sent = now
+	return true, nil
+}
+
+// startJobKeepalive resends the current job to clients that weren't sent one
+// for the keepalive interval, for firmware that disconnects without a job
+// every so often. It's the same job (same id and header), so miners carry on
+// with it, and no template is fetched for it
+func (c *clientListener) startJobKeepalive(ctx context.Context) {
+	if c.jobKeepalive <= 0 {
+		return
+	}
+	check := jobKeepaliveCheck
+	if c.jobKeepalive < check {
+		check = c.jobKeepalive
+	}
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.resendJobs(now)
+		}
+	}
+}
+
+// resendJobs sends every client due a keepalive its current job
+func (c *clientListener) resendJobs(now time.Time) {
+	for _, cl := range c.connectedClients() {
+		if !cl.Connected() {
+			continue
+		}
+		go func(client *gostratum.StratumContext) {
+			sent, err := GetMiningState(client).lastNotify.resend(client, c.jobKeepalive, now)
+			if err != nil {
+				client.Logger.Debug("failed resending job: " + err.Error())
+				return
+			}
+			if sent {
+				RecordKeepaliveJob()
+			}
+		}(cl)
+	}
+}
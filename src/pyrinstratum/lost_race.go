@@ -0,0 +1,49 @@
+package pyrinstratum
+
+import "strings"
+
+// LostRacePolicy controls how a share whose block lost the race is answered,
+// see lostRace
+type LostRacePolicy string
+
+const (
+	// LostRaceCredit credits the share like any other, the default. The work
+	// was valid, the block just got to the node too late
+	LostRaceCredit LostRacePolicy = "credit"
+	// LostRaceStale rejects the share as stale, like a block the node
+	// already had
+	LostRaceStale LostRacePolicy = "stale"
+)
+
+func (p LostRacePolicy) Valid() bool {
+	switch p {
+	case "", LostRaceCredit, LostRaceStale:
+		return true
+	}
+	return false
+}
+
+// lostRaceReasons are how the node words rejecting a block that was fine
+// when it was found, but that the DAG had moved too far past by the time it
+// was submitted: the rpc's own check for blocks far behind the virtual, and
+// the consensus rules for blocks merging past the merge depth or below the
+// pruning point
+var lostRaceReasons = []string{
+	"is too far behind virtual's DAA score",
+	"ErrViolatingBoundedMergeDepth",
+	"ErrPrunedBlock",
+}
+
+// lostRace returns true if the node rejected the block for arriving too
+// late rather than for being invalid, expected now and then with 1s blocks
+func lostRace(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, reason := range lostRaceReasons {
+		if strings.Contains(err.Error(), reason) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package pyrinstratum
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+)
+
+const defaultMaintenanceMessage = "pool in maintenance, switch to a backup pool"
+const defaultMaintenanceDrain = 5 * time.Minute
+
+var ErrMaintenance = fmt.Errorf("bridge in maintenance mode")
+
+// maintenanceMode is planned downtime. New connections are still accepted
+// but told the pool is in maintenance and turned away at authorize, while
+// the connected miners are disconnected one at a time over the drain period
+// so they don't all land on the backup pool at once
+type maintenanceMode struct {
+	lock    sync.Mutex
+	enabled bool
+	message string
+	since   time.Time
+	// closed when maintenance ends, stops disconnecting clients
+	stop chan struct{}
+}
+
+// MaintenanceStatus is the maintenance state reported by the admin endpoint
+type MaintenanceStatus struct {
+	Enabled bool       `json:"enabled"`
+	Message string     `json:"message,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+	// clients still connected
+	Clients int `json:"clients"`
+}
+
+// inMaintenance returns the message new clients are turned away with, false
+// if the bridge isn't in maintenance
+func (c *clientListener) inMaintenance() (string, bool) {
+	c.maintenance.lock.Lock()
+	defer c.maintenance.lock.Unlock()
+	return c.maintenance.message, c.maintenance.enabled
+}
+
+// enterMaintenance starts maintenance mode, warning every connected client
+// and disconnecting them over the drain period. The configured message is
+// used if message is empty. Returns false if already in maintenance
+func (c *clientListener) enterMaintenance(message string) bool {
+	if message == "" {
+		message = c.maintenanceMessage
+	}
+	m := &c.maintenance
+	m.lock.Lock()
+	if m.enabled {
+		m.lock.Unlock()
+		return false
+	}
+	m.enabled, m.message, m.since = true, message, time.Now()
+	m.stop = make(chan struct{})
+	stop := m.stop
+	m.lock.Unlock()
+
+	RecordMaintenance(true)
+	clients := c.connectedClients()
+	c.logger.Warnf("entering maintenance mode, disconnecting %d clients over %s", len(clients), c.maintenanceDrain)
+	for _, cl := range clients {
+		showMessage(cl, message)
+	}
+	go c.disconnectGradually(clients, stop)
+	return true
+}
+
+// exitMaintenance ends maintenance mode, clients not disconnected yet stay
+// connected. Returns false if not in maintenance
+func (c *clientListener) exitMaintenance() bool {
+	m := &c.maintenance
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.enabled {
+		return false
+	}
+	m.enabled, m.message = false, ""
+	close(m.stop)
+	RecordMaintenance(false)
+	c.logger.Info("leaving maintenance mode, accepting miners again")
+	return true
+}
+
+func (c *clientListener) maintenanceStatus() MaintenanceStatus {
+	m := &c.maintenance
+	m.lock.Lock()
+	status := MaintenanceStatus{Enabled: m.enabled, Message: m.message}
+	if m.enabled {
+		since := m.since
+		status.Since = &since
+	}
+	m.lock.Unlock()
+	c.clientLock.RLock()
+	status.Clients = len(c.clients)
+	c.clientLock.RUnlock()
+	return status
+}
+
+// disconnectGradually disconnects the clients evenly spread over the drain
+// period, the last one at its end. Clients keep getting jobs and having
+// their shares credited until their turn
+func (c *clientListener) disconnectGradually(clients []*gostratum.StratumContext, stop <-chan struct{}) {
+	if len(clients) == 0 {
+		return
+	}
+	interval := c.maintenanceDrain / time.Duration(len(clients))
+	for _, cl := range clients {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		if cl.Connected() {
+			cl.Logger.Info("disconnecting client for maintenance")
+			cl.Disconnect()
+		}
+	}
+	c.logger.Info("maintenance drain done, every client from before maintenance disconnected")
+}
+
+// connectedClients returns a snapshot of the connected clients
+func (c *clientListener) connectedClients() []*gostratum.StratumContext {
+	c.clientLock.RLock()
+	defer c.clientLock.RUnlock()
+	clients := make([]*gostratum.StratumContext, 0, len(c.clients))
+	for _, cl := range c.clients {
+		clients = append(clients, cl)
+	}
+	return clients
+}
+
+// watchMaintenanceSignal toggles maintenance mode whenever one of the
+// signals is received, see maintenanceSignals
+func (c *clientListener) watchMaintenanceSignal(signals ...os.Signal) {
+	if len(signals) == 0 {
+		return
+	}
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, signals...)
+	for sig := range received {
+		if !c.enterMaintenance("") {
+			c.exitMaintenance()
+		}
+		c.logger.Infof("received %s, maintenance mode toggled", sig)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package pyrinstratum
+
+import (
+	"os"
+	"syscall"
+)
+
+// maintenanceSignals toggle maintenance mode, e.g. `kill -USR1 <pid>`
+var maintenanceSignals = []os.Signal{syscall.SIGUSR1}
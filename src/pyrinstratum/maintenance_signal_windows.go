@@ -0,0 +1,7 @@
+package pyrinstratum
+
+import "os"
+
+// windows has no user signals, maintenance mode is only toggled through the
+// admin endpoint
+var maintenanceSignals []os.Signal
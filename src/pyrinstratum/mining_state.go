@@ -2,29 +2,120 @@ package pyrinstratum
 
 import (
 	"math/big"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/pyrin-network/pyipad/app/appmessage"
 	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+	"go.uber.org/atomic"
 )
 
 const maxjobs = 32
 
+// DiffSource is what a worker's current difficulty was set by
+type DiffSource string
+
+const (
+	DiffSourceMinDiff    DiffSource = "min_share_diff"
+	DiffSourceSuggested  DiffSource = "suggest_difficulty"
+	DiffSourcePassword   DiffSource = "password"
+	DiffSourceRemembered DiffSource = "diff_memory"
+	DiffSourceVardiff    DiffSource = "vardiff"
+	DiffSourceRateLimit  DiffSource = "share_rate_limit"
+)
+
 type MiningState struct {
 	Jobs        map[int]*appmessage.RPCBlock
 	JobLock     sync.Mutex
 	jobCounter  int
 	bigDiff     big.Int
 	initialized bool
-	useBigJob   bool
 	connectTime time.Time
 	stratumDiff *pyrinDiff
+	origin      string
+	// the connection's extranonce, and whether it's leased from the
+	// extranonce pool
+	extranonce       int32
+	extranonceLeased bool
+	// jobs from cleanJob on are built on the current parents, cleanJob being
+	// pushed at cleanJobTime. prevCleanJob is the first job on the parents
+	// before that
+	currentParents string
+	cleanJob       int
+	prevCleanJob   int
+	cleanJobTime   time.Time
+	// address of the node each retained job's template came from
+	jobNodes map[int]string
+	// with deterministic job ids, the id each retained job was sent under
+	// by slot, and the job each of those ids is for, see assignWireId. The
+	// last maxjobs ids dropped are kept by slot too, to tell a stale share
+	// from one for a job never sent
+	deterministicJobs bool
+	wireJobs          map[int]wireJob
+	wireJobIds        map[int]int
+	expiredWireJobs   map[int]int
+	expiredWireIds    map[int]int
+	// set once the client is gone, jobs added by an in flight broadcast are
+	// no longer counted
+	jobsReleased bool
+	// nil if vardiff is disabled
+	vardiff *vardiff
+	// label the connection is counted under by miner app, set once the
+	// client is initialized
+	minerApp string
+	// fingerprint of the last template pushed to the client, and when
+	lastFingerprint [32]byte
+	lastPush        time.Time
+	// the last job sent, see jobKeepalive
+	lastNotify lastNotify
+	// set while a coalesced job push is scheduled for the client
+	jobPending atomic.Bool
+	// serializes job pushes to the client (broadcasts, coalesced and
+	// handshake pushes) and guards what they update: initialized, the
+	// difficulty (stratumDiff, diffSource, suggestedDiff, vardiff), the last
+	// push and noticedNetworkDiff. Not held over the template fetch, see
+	// pushClientJob
+	pushLock sync.Mutex
+	// job pushes started and the latest one that went on to send its job,
+	// an older fetch finishing last doesn't replace a newer job
+	pushStarted uint64
+	pushSent    uint64
+	// difficulty requested by the miner via mining.suggest_difficulty (or
+	// the password), 0 if the miner hasn't suggested one
+	suggestedDiff   float64
+	suggestedSource DiffSource
+	// what set the current stratumDiff
+	diffSource DiffSource
+	// network difficulty the client was last told, see noticeNetworkDiff
+	noticedNetworkDiff float64
+	// share rate limiting, shares submitted in the current window
+	rateWindowStart  time.Time
+	rateWindowShares int
+	// invalid share policy, submissions and invalid ones in the current
+	// window
+	outcomeWindowStart   time.Time
+	outcomeWindowShares  int
+	outcomeWindowInvalid int
+	// consecutive submissions for jobs far behind the current one
+	laggingShares int
+	// when the client authorized, zero until then, and whether its first
+	// accepted share was recorded since
+	authorizeTime time.Time
+	firstShare    bool
+	// hashrate estimate, work (in GH) accepted in the current window. The
+	// window starts with the first accepted share
+	hashrateWindowStart time.Time
+	hashrateWindowWork  float64
+	// connection byte counts already reported to prom
+	reportedBytesRead    atomic.Int64
+	reportedBytesWritten atomic.Int64
 }
 
 func MiningStateGenerator() any {
 	return &MiningState{
 		Jobs:        map[int]*appmessage.RPCBlock{},
+		jobNodes:    map[int]string{},
 		JobLock:     sync.Mutex{},
 		connectTime: time.Now(),
 	}
@@ -34,18 +125,208 @@ func GetMiningState(ctx *gostratum.StratumContext) *MiningState {
 	return ctx.State.(*MiningState)
 }
 
-func (ms *MiningState) AddJob(job *appmessage.RPCBlock) int {
+// difficulty returns a copy of the client's current difficulty (zero before
+// its first job) and its vardiff, for share handling off the push path
+func (ms *MiningState) difficulty() (pyrinDiff, *vardiff) {
+	ms.pushLock.Lock()
+	defer ms.pushLock.Unlock()
+	if ms.stratumDiff == nil {
+		return pyrinDiff{}, ms.vardiff
+	}
+	return *ms.stratumDiff, ms.vardiff
+}
+
+// diffSnapshot is a client's difficulty settings, copied for reporting
+type diffSnapshot struct {
+	diff      pyrinDiff
+	source    DiffSource
+	requested float64
+	vardiff   bool
+}
+
+// diffStatus returns a copy of the client's difficulty settings, the
+// difficulty is zero before its first job
+func (ms *MiningState) diffStatus() diffSnapshot {
+	ms.pushLock.Lock()
+	defer ms.pushLock.Unlock()
+	snapshot := diffSnapshot{source: ms.diffSource, requested: ms.suggestedDiff, vardiff: ms.vardiff != nil}
+	if ms.stratumDiff != nil {
+		snapshot.diff = *ms.stratumDiff
+	}
+	return snapshot
+}
+
+// setDiff changes the stratum difficulty, recording what changed it. The
+// caller holds pushLock and sends it to the miner
+func (ms *MiningState) setDiff(diff float64, source DiffSource) {
+	ms.stratumDiff.setDiffValue(diff)
+	ms.diffSource = source
+}
+
+// FirstShare returns the time from authorize until now for the client's
+// first accepted share, false for any later share (or if the client never
+// authorized)
+func (ms *MiningState) FirstShare(now time.Time) (time.Duration, bool) {
+	if ms.firstShare || ms.authorizeTime.IsZero() {
+		return 0, false
+	}
+	ms.firstShare = true
+	return now.Sub(ms.authorizeTime), true
+}
+
+// AddJob retains the job for validating shares against, node is the address
+// of the pyrin node the template came from
+func (ms *MiningState) AddJob(job *appmessage.RPCBlock, node string) int {
+	ms.JobLock.Lock()
 	ms.jobCounter++
 	idx := ms.jobCounter
-	ms.JobLock.Lock()
+	if _, exists := ms.Jobs[idx%maxjobs]; !exists && !ms.jobsReleased {
+		RecordRetainedJobs(1)
+	}
 	ms.Jobs[idx%maxjobs] = job
+	ms.jobNodes[idx%maxjobs] = node
+	if ms.deterministicJobs {
+		ms.assignWireId(idx, job)
+	}
+	if parents := parentsKey(job); parents != ms.currentParents {
+		// the dag tip moved, this job supersedes the previous ones even if
+		// no new block notification came with it
+		ms.currentParents = parents
+		ms.prevCleanJob, ms.cleanJob = ms.cleanJob, idx
+		ms.cleanJobTime = time.Now()
+	}
 	ms.JobLock.Unlock()
 	return idx
 }
 
+// IsStaleJob returns true if the job was built on parents that are no longer
+// the node's tip. Refreshed jobs on the same parents are equally good, jobs
+// on the previous parents are still accepted for `grace` after the parents
+// changed, covering shares that were in flight at push time
+func (ms *MiningState) IsStaleJob(id int, grace time.Duration) bool {
+	ms.JobLock.Lock()
+	defer ms.JobLock.Unlock()
+	if id >= ms.cleanJob {
+		return false
+	}
+	return id < ms.prevCleanJob || time.Since(ms.cleanJobTime) > grace
+}
+
+// parentsKey identifies the parents a job is built on, the direct parents
+// (which include the selected parent) are enough to tell a moved tip apart
+func parentsKey(job *appmessage.RPCBlock) string {
+	if job.Header == nil || len(job.Header.Parents) == 0 {
+		return ""
+	}
+	return strings.Join(job.Header.Parents[0].ParentHashes, ",")
+}
+
+// GetJob returns a retained job. Only the last maxjobs are retained, the slot
+// of an older one holds a newer job by now
 func (ms *MiningState) GetJob(id int) (*appmessage.RPCBlock, bool) {
 	ms.JobLock.Lock()
+	defer ms.JobLock.Unlock()
+	if id <= ms.jobCounter-maxjobs || id > ms.jobCounter {
+		return nil, false
+	}
 	job, exists := ms.Jobs[id%maxjobs]
-	ms.JobLock.Unlock()
 	return job, exists
 }
+
+// JobIssued returns true if a job with the id was ever sent to the client,
+// retained or not
+func (ms *MiningState) JobIssued(id int) bool {
+	ms.JobLock.Lock()
+	defer ms.JobLock.Unlock()
+	return id > 0 && id <= ms.jobCounter
+}
+
+// GetJobNode returns the address of the node that produced the job's
+// template, empty if unknown
+func (ms *MiningState) GetJobNode(id int) string {
+	ms.JobLock.Lock()
+	defer ms.JobLock.Unlock()
+	return ms.jobNodes[id%maxjobs]
+}
+
+// ReleaseJobs drops every retained job, called once the client is gone
+func (ms *MiningState) ReleaseJobs() {
+	ms.JobLock.Lock()
+	RecordRetainedJobs(-float64(len(ms.Jobs)))
+	ms.Jobs = map[int]*appmessage.RPCBlock{}
+	ms.jobNodes = map[int]string{}
+	ms.wireJobs, ms.wireJobIds = nil, nil
+	ms.jobsReleased = true
+	ms.JobLock.Unlock()
+}
+
+// CountShareOutcome records a submission against the invalid share policy
+// window, returning the submissions and invalid ones in the current window
+// (including this one)
+func (ms *MiningState) CountShareOutcome(window time.Duration, invalid bool) (int, int) {
+	now := time.Now()
+	if now.Sub(ms.outcomeWindowStart) > window {
+		ms.outcomeWindowStart = now
+		ms.outcomeWindowShares, ms.outcomeWindowInvalid = 0, 0
+	}
+	ms.outcomeWindowShares++
+	if invalid {
+		ms.outcomeWindowInvalid++
+	}
+	return ms.outcomeWindowShares, ms.outcomeWindowInvalid
+}
+
+// how long accepted work is averaged over for each hashrate estimate unless
+// hashrate_window is set
+const defaultHashrateWindow = 5 * time.Minute
+
+// EstimateHashrate adds an accepted share's work (in GH) to the client's
+// hashrate estimate, returning the estimate in GH/s each time a full window
+// (defaultHashrateWindow if 0) has passed
+func (ms *MiningState) EstimateHashrate(now time.Time, work float64, window time.Duration) (float64, bool) {
+	if window <= 0 {
+		window = defaultHashrateWindow
+	}
+	if ms.hashrateWindowStart.IsZero() {
+		// the work for the first share was done before there's anything to
+		// measure it against
+		ms.hashrateWindowStart = now
+		return 0, false
+	}
+	ms.hashrateWindowWork += work
+	elapsed := now.Sub(ms.hashrateWindowStart)
+	if elapsed < window {
+		return 0, false
+	}
+	rate := ms.hashrateWindowWork / elapsed.Seconds()
+	ms.hashrateWindowStart, ms.hashrateWindowWork = now, 0
+	return rate, true
+}
+
+// CountJobLag records a submission against the stuck miner check, returning
+// how many jobs behind the latest one pushed to the client it is and how many
+// consecutive submissions (including this one) were at least minLag behind
+func (ms *MiningState) CountJobLag(id int, minLag int) (int, int) {
+	ms.JobLock.Lock()
+	defer ms.JobLock.Unlock()
+	lag := ms.jobCounter - id
+	if lag < minLag {
+		ms.laggingShares = 0
+	} else {
+		ms.laggingShares++
+	}
+	return lag, ms.laggingShares
+}
+
+// CountShareRate records a share submission against the rate limit window and
+// returns the number of shares submitted in the current window (including
+// this one)
+func (ms *MiningState) CountShareRate(window time.Duration) int {
+	now := time.Now()
+	if now.Sub(ms.rateWindowStart) > window {
+		ms.rateWindowStart = now
+		ms.rateWindowShares = 0
+	}
+	ms.rateWindowShares++
+	return ms.rateWindowShares
+}
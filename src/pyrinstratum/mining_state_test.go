@@ -0,0 +1,206 @@
+package pyrinstratum
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/pyrin-network/pyipad/app/appmessage"
+)
+
+func jobWithParents(parents ...string) *appmessage.RPCBlock {
+	return &appmessage.RPCBlock{
+		Header: &appmessage.RPCBlockHeader{
+			Parents: []*appmessage.RPCBlockLevelParents{{ParentHashes: parents}},
+		},
+	}
+}
+
+func TestStaleJobOnParentChange(t *testing.T) {
+	state := MiningStateGenerator().(*MiningState)
+	grace := time.Hour
+
+	first := state.AddJob(jobWithParents("a"), "")
+	refreshed := state.AddJob(jobWithParents("a"), "")
+	if state.IsStaleJob(first, 0) || state.IsStaleJob(refreshed, 0) {
+		t.Fatalf("expected jobs on the current parents to never be stale")
+	}
+
+	moved := state.AddJob(jobWithParents("b"), "")
+	if state.IsStaleJob(moved, 0) {
+		t.Fatalf("expected the current job to not be stale")
+	}
+	if !state.IsStaleJob(first, 0) || !state.IsStaleJob(refreshed, 0) {
+		t.Fatalf("expected jobs on the old parents to be stale without grace")
+	}
+	if state.IsStaleJob(first, grace) || state.IsStaleJob(refreshed, grace) {
+		t.Fatalf("expected jobs on the previous parents to be accepted within grace")
+	}
+
+	state.AddJob(jobWithParents("b", "c"), "")
+	if !state.IsStaleJob(first, grace) {
+		t.Fatalf("expected jobs two parent changes back to be stale")
+	}
+	if state.IsStaleJob(moved, grace) {
+		t.Fatalf("expected jobs on the previous parents to be accepted within grace")
+	}
+}
+
+func TestRetainedJobs(t *testing.T) {
+	state := MiningStateGenerator().(*MiningState)
+	retained := testutil.ToFloat64(retainedJobsGauge)
+	for i := 0; i < maxjobs+5; i++ {
+		state.AddJob(jobWithParents("a"), "")
+	}
+	if jobs := testutil.ToFloat64(retainedJobsGauge) - retained; jobs != maxjobs {
+		t.Fatalf("expected the %d jobs in the client's slots counted, got %f", maxjobs, jobs)
+	}
+	state.ReleaseJobs()
+	state.ReleaseJobs()
+	if jobs := testutil.ToFloat64(retainedJobsGauge) - retained; jobs != 0 {
+		t.Fatalf("expected the released jobs uncounted once, got %f left", jobs)
+	}
+}
+
+func TestShareOutcomeWindow(t *testing.T) {
+	state := MiningStateGenerator().(*MiningState)
+	for i := 0; i < 4; i++ {
+		state.CountShareOutcome(time.Hour, i%2 == 0)
+	}
+	if shares, invalid := state.CountShareOutcome(time.Hour, true); shares != 5 || invalid != 3 {
+		t.Fatalf("expected 3 of 5 shares invalid, got %d of %d", invalid, shares)
+	}
+	state.outcomeWindowStart = time.Now().Add(-2 * time.Hour)
+	if shares, invalid := state.CountShareOutcome(time.Hour, false); shares != 1 || invalid != 0 {
+		t.Fatalf("expected the window to restart, got %d of %d invalid", invalid, shares)
+	}
+}
+
+func TestJobLag(t *testing.T) {
+	state := MiningStateGenerator().(*MiningState)
+	stuck := state.AddJob(jobWithParents("a"), "")
+	for i := 0; i < 10; i++ {
+		state.AddJob(jobWithParents("a"), "")
+	}
+	for i := 1; i <= 3; i++ {
+		if lag, lagging := state.CountJobLag(stuck, 8); lag != 10 || lagging != i {
+			t.Fatalf("expected job lag 10 with %d lagging submissions, got %d with %d", i, lag, lagging)
+		}
+	}
+	current := state.AddJob(jobWithParents("a"), "")
+	if lag, lagging := state.CountJobLag(current, 8); lag != 0 || lagging != 0 {
+		t.Fatalf("expected a current job to reset the lagging count, got lag %d with %d", lag, lagging)
+	}
+}
+
+func TestFirstShare(t *testing.T) {
+	state := MiningStateGenerator().(*MiningState)
+	if _, first := state.FirstShare(time.Now()); first {
+		t.Fatalf("expected no first share for a client that never authorized")
+	}
+	state.authorizeTime = time.Now().Add(-90 * time.Second)
+	if wait, first := state.FirstShare(state.authorizeTime.Add(90 * time.Second)); !first || wait != 90*time.Second {
+		t.Fatalf("expected the first share 90s after authorize, got %s (first %t)", wait, first)
+	}
+	if _, first := state.FirstShare(time.Now()); first {
+		t.Fatalf("expected only the first share to be recorded")
+	}
+}
+
+func TestEstimateHashrate(t *testing.T) {
+	state := MiningStateGenerator().(*MiningState)
+	start := time.Now()
+	if _, estimated := state.EstimateHashrate(start, 1000, 0); estimated {
+		t.Fatalf("expected no estimate from the first share")
+	}
+	for i := 1; i < 5; i++ {
+		if _, estimated := state.EstimateHashrate(start.Add(time.Duration(i)*time.Minute), 3000, 0); estimated {
+			t.Fatalf("expected no estimate before a full window")
+		}
+	}
+	rate, estimated := state.EstimateHashrate(start.Add(defaultHashrateWindow), 3000, 0)
+	if !estimated || rate != 50 {
+		t.Fatalf("expected 15000 GH over 5 minutes to be 50 GH/s, got %f (estimated %t)", rate, estimated)
+	}
+
+	// a configured window, 4 shares a second at 64 GH each is 256 GH/s
+	window := 30 * time.Second
+	start = start.Add(defaultHashrateWindow)
+	for i := 1; i < 120; i++ {
+		if _, estimated := state.EstimateHashrate(start.Add(time.Duration(i)*250*time.Millisecond), 64, window); estimated {
+			t.Fatalf("expected no estimate before the configured window")
+		}
+	}
+	rate, estimated = state.EstimateHashrate(start.Add(window), 64, window)
+	if !estimated || rate != 256 {
+		t.Fatalf("expected 7680 GH over 30s to be 256 GH/s, got %f (estimated %t)", rate, estimated)
+	}
+}
+
+func TestDeterministicJobIds(t *testing.T) {
+	deterministic := func() *MiningState {
+		state := MiningStateGenerator().(*MiningState)
+		state.deterministicJobs = true
+		return state
+	}
+	state := deterministic()
+	first := state.AddJob(jobWithParents("aa"), "")
+	second := state.AddJob(jobWithParents("bb"), "")
+	firstId, secondId := state.WireJobId(first), state.WireJobId(second)
+	if firstId == secondId || firstId <= 0 || secondId <= 0 {
+		t.Fatalf("expected distinct positive ids for different templates, got %d and %d", firstId, secondId)
+	}
+	// another connection, or the same one after a restart
+	other := deterministic()
+	if id := other.WireJobId(other.AddJob(jobWithParents("bb"), "")); id != secondId {
+		t.Fatalf("expected the same template sent under the same id, got %d and %d", secondId, id)
+	}
+	if id, ok := state.ResolveJobId(firstId); !ok || id != first {
+		t.Fatalf("expected id %d to resolve to job %d, got %d", firstId, first, id)
+	}
+	if _, ok := state.ResolveJobId(firstId + secondId); ok {
+		t.Fatalf("expected an id never sent to not resolve")
+	}
+
+	again := state.AddJob(jobWithParents("aa"), "")
+	if id := state.WireJobId(again); id != firstId {
+		t.Fatalf("expected a resent template under its id, got %d", id)
+	}
+	if id, _ := state.ResolveJobId(firstId); id != again {
+		t.Fatalf("expected the id to resolve to the latest job for the template")
+	}
+
+	// a different template whose id is already taken moves to the next one
+	natural := other.WireJobId(other.AddJob(jobWithParents("cc"), ""))
+	state.wireJobIds[natural] = second
+	collided := state.AddJob(jobWithParents("cc"), "")
+	if id := state.WireJobId(collided); id != natural+1 {
+		t.Fatalf("expected a colliding id moved to %d, got %d", natural+1, id)
+	}
+
+	for i := 0; i < maxjobs; i++ {
+		state.AddJob(jobWithParents("dd"), "")
+	}
+	if _, ok := state.ResolveJobId(firstId); ok || !state.WireJobExpired(firstId) {
+		t.Fatalf("expected the id dropped once its jobs are no longer retained")
+	}
+	if _, ok := state.ResolveJobId(natural + 1); ok || !state.WireJobExpired(natural+1) {
+		t.Fatalf("expected the moved id dropped with its job")
+	}
+	if state.WireJobExpired(firstId + secondId) {
+		t.Fatalf("expected an id never sent told apart from an expired one")
+	}
+	for i := 0; i < 2*maxjobs; i++ {
+		state.AddJob(jobWithParents(strconv.Itoa(i)), "")
+	}
+	if state.WireJobExpired(firstId) {
+		t.Fatalf("expected only the last maxjobs expired ids remembered")
+	}
+
+	sequential := MiningStateGenerator().(*MiningState)
+	job := sequential.AddJob(jobWithParents("aa"), "")
+	if id, ok := sequential.ResolveJobId(job); sequential.WireJobId(job) != job || !ok || id != job {
+		t.Fatalf("expected sequential jobs sent under their own ids")
+	}
+}
@@ -0,0 +1,53 @@
+package pyrinstratum
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+const defaultNatsSubject = "pyrin.shares"
+
+// shares published while the nats server is unreachable are buffered up to
+// this many bytes (a few thousand records) until the client reconnects
+const natsReconnectBuffer = 1024 * 1024
+
+// NatsShareSink publishes every share as a json message to a nats subject,
+// for accounting/analytics pipelines downstream. The bridge starts (and
+// keeps mining) with the nats server down, the client reconnects on its own
+// and shares it can't buffer in the meantime are dropped and counted in
+// py_share_sink_dropped_counter
+type NatsShareSink struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func NewNatsShareSink(url, subject string) (*NatsShareSink, error) {
+	conn, err := nats.Connect(url,
+		nats.Name("pyrin-stratum-bridge"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ReconnectBufSize(natsReconnectBuffer))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed connecting to nats %s", url)
+	}
+	return &NatsShareSink{conn: conn, subject: subject}, nil
+}
+
+func (ns *NatsShareSink) RecordShare(share ShareRecord) {
+	data, err := json.Marshal(share)
+	if err == nil {
+		err = ns.conn.Publish(ns.subject, data)
+	}
+	if err != nil {
+		RecordShareSinkDrop()
+	}
+}
+
+// Close flushes shares still buffered in the client before disconnecting
+func (ns *NatsShareSink) Close() error {
+	defer ns.conn.Close()
+	return ns.conn.FlushTimeout(5 * time.Second)
+}
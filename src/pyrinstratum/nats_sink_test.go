@@ -0,0 +1,81 @@
+package pyrinstratum
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNatsServer speaks just enough of the nats client protocol (INFO,
+// CONNECT, PING/PONG, PUB) to accept publishes, handing each published
+// payload to messages
+func fakeNatsServer(t *testing.T, messages chan<- string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\",\"version\":\"2.9.0\",\"proto\":1,\"max_payload\":1048576}\r\n")
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			switch fields[0] {
+			case "PING":
+				fmt.Fprintf(conn, "PONG\r\n")
+			case "PUB":
+				size, _ := strconv.Atoi(fields[len(fields)-1])
+				payload := make([]byte, size+2) // payload is followed by \r\n
+				if _, err := io.ReadFull(reader, payload); err != nil {
+					return
+				}
+				messages <- fields[1] + " " + string(payload[:size])
+			}
+		}
+	}()
+	return "nats://" + listener.Addr().String()
+}
+
+func TestNatsShareSink(t *testing.T) {
+	messages := make(chan string, 2)
+	sink, err := NewNatsShareSink(fakeNatsServer(t, messages), "test.shares")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.RecordShare(ShareRecord{Worker: "rig1", Difficulty: 4, Result: ShareAccepted})
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case message := <-messages:
+		subject, payload, _ := strings.Cut(message, " ")
+		record := ShareRecord{}
+		if err := json.Unmarshal([]byte(payload), &record); err != nil {
+			t.Fatal(err)
+		}
+		if subject != "test.shares" || record.Worker != "rig1" || record.Result != ShareAccepted {
+			t.Fatalf("unexpected share published to %s: %+v", subject, record)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the share to be published")
+	}
+}
@@ -0,0 +1,81 @@
+package pyrinstratum
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// NetworkMismatchPolicy controls what happens when a node turns out to be on
+// a different network than the one configured
+type NetworkMismatchPolicy string
+
+const (
+	// NetworkMismatchStrict refuses to start the bridge
+	NetworkMismatchStrict NetworkMismatchPolicy = "strict"
+	// NetworkMismatchWarn logs the mismatch and carries on, for test setups
+	NetworkMismatchWarn NetworkMismatchPolicy = "warn"
+)
+
+func (p NetworkMismatchPolicy) Valid() bool {
+	switch p {
+	case "", NetworkMismatchStrict, NetworkMismatchWarn:
+		return true
+	}
+	return false
+}
+
+const networkPrefix = "pyrin-"
+
+var ErrNetworkMismatch = fmt.Errorf("pyrin node is on the wrong network")
+
+// sameNetwork compares network names, the pyrin- prefix is optional
+func sameNetwork(a, b string) bool {
+	return strings.TrimPrefix(a, networkPrefix) == strings.TrimPrefix(b, networkPrefix)
+}
+
+// CheckNetwork verifies every reachable node is on the expected network,
+// nodes that can't be reached right now are skipped. A mismatch is an error
+// unless the policy is NetworkMismatchWarn. An empty expected network skips
+// the check entirely
+func (py *PyrinApi) CheckNetwork(expected string, policy NetworkMismatchPolicy) error {
+	if expected == "" {
+		return nil
+	}
+	var mismatched []string
+	for _, node := range py.nodes {
+		client := node.rpc()
+		if client == nil {
+			py.logger.Warnw("pyrin node not connected, network not verified", zap.String("node", node.address))
+			continue
+		}
+		dagInfo, err := callNode(py, node, "GetBlockDAGInfo", client.GetBlockDAGInfo)
+		if err != nil {
+			py.logger.Warnw("failed fetching network of pyrin node, network not verified",
+				zap.String("node", node.address), zap.Error(err))
+			continue
+		}
+		if sameNetwork(dagInfo.NetworkName, expected) {
+			py.logger.Infow("pyrin node network verified", zap.String("node", node.address),
+				zap.String("network", dagInfo.NetworkName))
+			continue
+		}
+		mismatched = append(mismatched, fmt.Sprintf("%s (%s)", node.address, dagInfo.NetworkName))
+		if policy == NetworkMismatchWarn {
+			py.logger.Warnw("************ PYRIN NODE IS ON THE WRONG NETWORK, CONTINUING ANYWAY ************",
+				zap.String("node", node.address), zap.String("network", dagInfo.NetworkName),
+				zap.String("expected", expected))
+		} else {
+			py.logger.Errorw("************ PYRIN NODE IS ON THE WRONG NETWORK ************",
+				zap.String("node", node.address), zap.String("network", dagInfo.NetworkName),
+				zap.String("expected", expected))
+		}
+	}
+	if len(mismatched) == 0 || policy == NetworkMismatchWarn {
+		return nil
+	}
+	return errors.Wrapf(ErrNetworkMismatch, "expected %s, got %s (set network_mismatch: warn to run anyway)",
+		expected, strings.Join(mismatched, ", "))
+}
@@ -0,0 +1,175 @@
+package pyrinstratum
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pyrin-network/pyipad/app/appmessage"
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+)
+
+// InstabilityPolicy controls what the bridge does while the network looks
+// unstable, see checkStability. Empty (the default) only reports it
+type InstabilityPolicy string
+
+const (
+	// InstabilityPause stops serving new templates until the network is
+	// stable again, miners keep hashing their current job
+	InstabilityPause InstabilityPolicy = "pause"
+	// InstabilityWiden accepts shares for every job a miner still has
+	// retained instead of only the current one (and previous_job_grace), so
+	// work on jobs outdated by the churn is still credited
+	InstabilityWiden InstabilityPolicy = "widen"
+)
+
+func (p InstabilityPolicy) Valid() bool {
+	switch p {
+	case "", InstabilityPause, InstabilityWiden:
+		return true
+	}
+	return false
+}
+
+// a difficulty moving by half between two stats refreshes is well outside
+// the adjustment of a network that's just gaining or losing hashrate
+const defaultInstabilitySwing = 0.5
+const defaultInstabilityHold = 5 * time.Minute
+
+var ErrNetworkUnstable = fmt.Errorf("network unstable, not serving new templates")
+
+// networkStability is what the stats thread last saw of the network, and
+// when it last looked unstable
+type networkStability struct {
+	lock       sync.Mutex
+	address    string
+	daaScore   uint64
+	difficulty float64
+	lastEvent  time.Time
+	unstable   bool
+}
+
+// observe compares the node's stats to the previous ones, returning why
+// they look unstable (or "") and whether being held unstable changed. Stats
+// from a different node than last time only become the new baseline, nodes
+// never report quite the same virtual daa score. The block count isn't
+// compared, it drops on every pruning pass
+func (s *networkStability) observe(address string, daaScore uint64, difficulty float64,
+	swing float64, hold time.Duration, now time.Time) (reason string, changed bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if address == s.address && s.difficulty > 0 {
+		if daaScore < s.daaScore {
+			reason = fmt.Sprintf("virtual daa score dropped from %d to %d", s.daaScore, daaScore)
+		} else if change := math.Abs(difficulty-s.difficulty) / s.difficulty; change > swing {
+			reason = fmt.Sprintf("difficulty moved %.0f%% from %.2f to %.2f", change*100, s.difficulty, difficulty)
+		}
+	}
+	s.address, s.daaScore, s.difficulty = address, daaScore, difficulty
+	if reason != "" {
+		s.lastEvent = now
+	}
+	unstable := !s.lastEvent.IsZero() && now.Sub(s.lastEvent) < hold
+	changed = unstable != s.unstable
+	s.unstable = unstable
+	return reason, changed
+}
+
+// checkStability looks for the network churning from the stats thread's
+// view of it: difficulty swinging or the virtual daa score going backwards
+// (a reorg storm). Once it does the network is held unstable until
+// instabilityHold passed without either, with the instability policy
+// applied meanwhile
+func (py *PyrinApi) checkStability(address string, daaScore uint64, difficulty float64) {
+	swing := py.instabilitySwing
+	if swing <= 0 {
+		swing = defaultInstabilitySwing
+	}
+	hold := py.instabilityHold
+	if hold <= 0 {
+		hold = defaultInstabilityHold
+	}
+	reason, changed := py.stability.observe(address, daaScore, difficulty, swing, hold, time.Now())
+	if reason != "" {
+		py.logger.Warnw("network looks unstable", "node", address, "reason", reason, "policy", py.instability)
+	}
+	if !changed {
+		return
+	}
+	unstable := py.NetworkUnstable()
+	RecordNetworkUnstable(unstable)
+	if !unstable {
+		py.logger.Infow("network stable again", "hold", hold)
+	}
+}
+
+// NetworkUnstable returns true while the network is held unstable
+func (py *PyrinApi) NetworkUnstable() bool {
+	py.stability.lock.Lock()
+	defer py.stability.lock.Unlock()
+	return py.stability.unstable
+}
+
+// pausedForInstability returns true if new templates shouldn't be served
+func (py *PyrinApi) pausedForInstability() bool {
+	return py.instability == InstabilityPause && py.NetworkUnstable()
+}
+
+// lastTemplates keeps the last good template per templateCacheKey with the
+// pause policy, handed to clients connecting while templates are paused,
+// which have no job to keep hashing. Entries not refetched since the last
+// two new blocks seen while not paused are dropped
+type lastTemplates struct {
+	lock     sync.Mutex
+	current  map[string]cachedTemplate
+	previous map[string]cachedTemplate
+}
+
+func (t *lastTemplates) put(key string, template *appmessage.GetBlockTemplateResponseMessage, node string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.current == nil {
+		t.current = map[string]cachedTemplate{}
+	}
+	t.current[key] = cachedTemplate{template: template, node: node}
+}
+
+func (t *lastTemplates) get(key string) (cachedTemplate, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if last, exists := t.current[key]; exists {
+		return last, true
+	}
+	last, exists := t.previous[key]
+	return last, exists
+}
+
+func (t *lastTemplates) rotate() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.previous, t.current = t.current, nil
+}
+
+// rotateLastTemplates ages out the last templates of clients gone since,
+// called on every new block. Nothing is aged out while paused, new clients
+// need them then
+func (py *PyrinApi) rotateLastTemplates() {
+	if py.instability != InstabilityPause || py.pausedForInstability() {
+		return
+	}
+	py.lastTemplates.rotate()
+}
+
+// LastTemplate returns the last good template fetched for clients like
+// client and the node it came from, for a client connecting while templates
+// are paused
+func (py *PyrinApi) LastTemplate(client *gostratum.StratumContext) (*appmessage.GetBlockTemplateResponseMessage, string, bool) {
+	last, exists := py.lastTemplates.get(py.templateCacheKey(client))
+	return last.template, last.node, exists
+}
+
+// instabilityChecker reports whether the network is held unstable
+type instabilityChecker interface {
+	NetworkUnstable() bool
+}
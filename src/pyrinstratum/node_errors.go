@@ -0,0 +1,131 @@
+package pyrinstratum
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pyrin-network/pyipad/infrastructure/network/rpcclient"
+)
+
+// lenient enough that only a node failing most of what it's asked is failed
+// over from
+const defaultNodeErrorRate = 0.5
+const defaultNodeErrorWindow = time.Minute
+
+// calls a node has to have seen in a window before its error rate counts
+// towards failover, the health and sync checks alone make a couple dozen a
+// minute
+const minErrorRateCalls = 10
+
+type rpcCallCount struct {
+	calls  int
+	errors int
+}
+
+func (c rpcCallCount) rate() float64 {
+	if c.calls == 0 {
+		return 0
+	}
+	return float64(c.errors) / float64(c.calls)
+}
+
+// rpcErrors counts a node's rpc calls and their failures per method over
+// fixed windows, see checkErrorRate
+type rpcErrors struct {
+	lock        sync.Mutex
+	windowStart time.Time
+	methods     map[string]*rpcCallCount
+}
+
+// record counts a call, like for recordResult only transport failures (and
+// timeouts) count as errors, not the node declining a request
+func (r *rpcErrors) record(method string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.methods == nil {
+		r.methods = map[string]*rpcCallCount{}
+	}
+	count := r.methods[method]
+	if count == nil {
+		count = &rpcCallCount{}
+		r.methods[method] = count
+	}
+	count.calls++
+	if err != nil && !errors.Is(err, rpcclient.ErrRPC) {
+		count.errors++
+	}
+}
+
+// roll ends the window once it's lasted window, returning its counts per
+// method. Methods seen before stay in with no calls, so their rate drops to
+// 0 instead of sticking at the last window they were called in
+func (r *rpcErrors) roll(now time.Time, window time.Duration) (map[string]rpcCallCount, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.windowStart.IsZero() {
+		r.windowStart = now
+		return nil, false
+	}
+	if now.Sub(r.windowStart) < window {
+		return nil, false
+	}
+	counts := make(map[string]rpcCallCount, len(r.methods))
+	for method, count := range r.methods {
+		counts[method] = *count
+		*count = rpcCallCount{}
+	}
+	r.windowStart = now
+	return counts, true
+}
+
+// callNode is withContext for a call to one of the template nodes, counting
+// it towards the node's error rate for method
+func callNode[T any](py *PyrinApi, node *pyrinNode, method string, call func() (T, error)) (T, error) {
+	result, err := withContext(py.ctx, py.rpcTimeout, call)
+	node.rpcErrors.record(method, err)
+	return result, err
+}
+
+// checkErrorRate publishes the node's error rate per method once a window
+// has ended. A node that fails some of its calls but answers often enough
+// in between never adds up the consecutive failures that take it down in
+// the node state, yet templates and submits through it fail all the same.
+// Past errorRate of its calls failing in a window (of at least
+// minErrorRateCalls calls) it's treated as unhealthy, until a window that's
+// back under it
+func (py *PyrinApi) checkErrorRate(node *pyrinNode, now time.Time) {
+	window := py.errorWindow
+	if window <= 0 {
+		window = defaultNodeErrorWindow
+	}
+	counts, ended := node.rpcErrors.roll(now, window)
+	if !ended {
+		return
+	}
+	var total rpcCallCount
+	for method, count := range counts {
+		RecordNodeRpcErrorRate(node.address, method, count.rate())
+		total.calls += count.calls
+		total.errors += count.errors
+	}
+	node.errorRate.Store(total.rate())
+	if py.errorRate <= 0 || py.errorRate >= 1 || total.calls < minErrorRateCalls {
+		return
+	}
+	erroring := total.rate() > py.errorRate
+	if node.erroring.Swap(erroring) == erroring {
+		return
+	}
+	if !erroring {
+		py.logger.Infow("pyrin node rpc error rate back to normal", "node", node.address, "error_rate", total.rate())
+		return
+	}
+	py.logger.Warnw("pyrin node failing too many rpc calls, treating it as unhealthy",
+		"node", node.address, "error_rate", total.rate(), "calls", total.calls, "window", window)
+	if py.activeNode() == node {
+		if _, err := py.failover(); err != nil {
+			py.logger.Warn("no pyrin node with a lower error rate to fail over to")
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package pyrinstratum
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// connectionAge returns how long the node's current connection has been up
+func (n *pyrinNode) connectionAge(now time.Time) time.Duration {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return now.Sub(n.connectedAt)
+}
+
+// resetConnectionAge restarts the refresh interval without a new connection,
+// after a failed refresh
+func (n *pyrinNode) resetConnectionAge() {
+	n.lock.Lock()
+	n.connectedAt = time.Now()
+	n.lock.Unlock()
+}
+
+// refreshDue returns true once the node's connection is older than the
+// refresh interval, and the node isn't in the middle of taking a block
+func (py *PyrinApi) refreshDue(node *pyrinNode, now time.Time) bool {
+	return py.refreshInterval > 0 && node.rpc() != nil && node.submitting.Load() == 0 &&
+		node.connectionAge(now) >= py.refreshInterval
+}
+
+// refreshNode replaces a working connection to the node with a fresh one. The
+// new connection is subscribed to template notifications before it's swapped
+// in, and the old one is left open long enough for calls in flight on it to
+// finish, so the refresh loses neither notifications nor work. Notifications
+// from both during the overlap are coalesced by notifyBlockReady. If the new
+// connection can't be set up the old one is kept and retried next interval
+func (py *PyrinApi) refreshNode(node *pyrinNode) {
+	client, err := py.dial(node.address)
+	if err != nil {
+		py.logger.Warn("failed refreshing connection to pyrin node "+node.address, zap.Error(err))
+		RecordNodeRefresh(node.address, false)
+		node.resetConnectionAge()
+		return
+	}
+	if err := py.subscribeTemplates(node, client); err != nil {
+		client.Close()
+		py.logger.Warn("failed refreshing connection to pyrin node "+node.address, zap.Error(err))
+		RecordNodeRefresh(node.address, false)
+		node.resetConnectionAge()
+		return
+	}
+	old := node.rpc()
+	node.setRpc(client)
+	RecordNodeRefresh(node.address, true)
+	py.logger.Info("refreshed connection to pyrin node " + node.address)
+	if old != nil {
+		time.AfterFunc(py.refreshDrain(), func() { old.Close() })
+	}
+}
+
+// refreshDrain is how long a refreshed node's old connection stays open, long
+// enough for any call on it to have finished or timed out
+func (py *PyrinApi) refreshDrain() time.Duration {
+	if py.rpcTimeout > 0 {
+		return py.rpcTimeout
+	}
+	return defaultRpcTimeout
+}
@@ -0,0 +1,277 @@
+package pyrinstratum
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pyrin-network/pyipad/app/appmessage"
+	"github.com/pyrin-network/pyipad/infrastructure/network/netadapter/server/grpcserver/protowire"
+	"go.uber.org/zap"
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// NodeRPCOptions are extra options for the connections to the pyrin nodes,
+// for nodes behind an authenticating proxy or only reachable over TLS. They
+// apply to every node the bridge connects to, the stats and submit nodes
+// included
+type NodeRPCOptions struct {
+	// sent as an "authorization: Bearer" header with every call
+	AuthToken string
+	// sent with every call
+	Headers map[string]string
+	// connect over TLS, verified against the system roots or CAFile
+	TLS           bool
+	TLSCAFile     string
+	TLSCertFile   string // client certificate, for nodes requiring mutual TLS
+	TLSKeyFile    string
+	TLSServerName string // name verified instead of the node address' host
+	TLSInsecure   bool   // skip verifying the node's certificate entirely
+}
+
+func (o NodeRPCOptions) enabled() bool {
+	return o.AuthToken != "" || len(o.Headers) > 0 || o.TLS
+}
+
+// Validate checks the options are complete, without loading any files
+func (o NodeRPCOptions) Validate() error {
+	if !o.TLS && (o.TLSCAFile != "" || o.TLSCertFile != "" || o.TLSKeyFile != "" || o.TLSServerName != "" || o.TLSInsecure) {
+		return fmt.Errorf("node_tls_* options are set but node_tls isn't")
+	}
+	if (o.TLSCertFile == "") != (o.TLSKeyFile == "") {
+		return fmt.Errorf("node_tls_cert_file and node_tls_key_file have to be set together")
+	}
+	for name, value := range o.Headers {
+		if !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(value) {
+			return fmt.Errorf("invalid node header '%s'", name)
+		}
+		if strings.HasPrefix(name, ":") || strings.HasPrefix(strings.ToLower(name), "grpc-") {
+			return fmt.Errorf("node header '%s' is reserved by grpc", name)
+		}
+	}
+	return nil
+}
+
+// headers returns every header sent to the nodes, lowercase as grpc
+// metadata keys are
+func (o NodeRPCOptions) headers() map[string]string {
+	headers := make(map[string]string, len(o.Headers)+1)
+	for name, value := range o.Headers {
+		headers[strings.ToLower(name)] = value
+	}
+	if o.AuthToken != "" {
+		headers["authorization"] = "Bearer " + o.AuthToken
+	}
+	return headers
+}
+
+func (o NodeRPCOptions) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         o.TLSServerName,
+		InsecureSkipVerify: o.TLSInsecure,
+		NextProtos:         []string{http2.NextProtoTLS},
+		MinVersion:         tls.VersionTLS12,
+	}
+	if o.TLSCAFile != "" {
+		pem, err := os.ReadFile(o.TLSCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed reading node_tls_ca_file")
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in node_tls_ca_file %s", o.TLSCAFile)
+		}
+	}
+	if o.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.TLSCertFile, o.TLSKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed loading node_tls_cert_file/node_tls_key_file")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+var ErrNodeRejectedRPC = fmt.Errorf("pyrin node rejected the rpc connection")
+
+// nodeProxy carries the node connections when NodeRPCOptions are set. The
+// pyipad rpc client only dials plaintext grpc with no way to pass headers or
+// credentials, so instead it's pointed at a local listener per node that
+// forwards each call to the node over TLS and/or with the headers added.
+// The listeners are unix sockets only the bridge's user can open, in a
+// directory of their own, a loopback port would hand the credentials to
+// any local process
+type nodeProxy struct {
+	headers   map[string]string
+	tls       *tls.Config // nil for plaintext
+	transport *http2.Transport
+	logger    *zap.SugaredLogger
+
+	lock    sync.Mutex
+	dir     string            // holds the sockets, made on first use
+	routes  map[string]string // node address to the target of its socket
+	servers []*http.Server
+}
+
+func newNodeProxy(options NodeRPCOptions, logger *zap.SugaredLogger) (*nodeProxy, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	p := &nodeProxy{
+		headers: options.headers(),
+		logger:  logger,
+		routes:  map[string]string{},
+	}
+	p.transport = &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+	if options.TLS {
+		config, err := options.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		p.tls = config
+		p.transport = &http2.Transport{TLSClientConfig: config}
+	}
+	return p, nil
+}
+
+// route returns the grpc target calls to the node go through, starting its
+// listener on first use
+func (p *nodeProxy) route(address string) (string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if local, exists := p.routes[address]; exists {
+		return local, nil
+	}
+	listener, err := p.listen()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed starting rpc proxy for pyrin node %s", address)
+	}
+	scheme := "http"
+	if p.tls != nil {
+		scheme = "https"
+	}
+	proxy := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme, r.URL.Host, r.Host = scheme, address, address
+			for name, value := range p.headers {
+				r.Header.Set(name, value)
+			}
+		},
+		Transport:     p.transport,
+		FlushInterval: -1, // grpc streams, every message goes out right away
+		ErrorHandler: func(w http.ResponseWriter, _ *http.Request, err error) {
+			p.logger.Warn("rpc call to pyrin node "+address+" failed", zap.Error(err))
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	server := &http.Server{Handler: h2c.NewHandler(proxy, &http2.Server{}), ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(listener)
+	p.servers = append(p.servers, server)
+	p.routes[address] = "unix:" + listener.Addr().String()
+	return p.routes[address], nil
+}
+
+// listen opens the socket for the next node, readable and writable by the
+// bridge's user only. Called with the lock held
+func (p *nodeProxy) listen() (net.Listener, error) {
+	if p.dir == "" {
+		dir, err := os.MkdirTemp("", "pyrinbridge-rpc-")
+		if err != nil {
+			return nil, err
+		}
+		p.dir = dir
+	}
+	path := filepath.Join(p.dir, fmt.Sprintf("node%d.sock", len(p.routes)))
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// check makes a GetInfo call to the node with the options, returning
+// ErrNodeRejectedRPC if its TLS handshake fails or it refuses the
+// credentials. Through the proxy either only shows as the pyipad client
+// hanging in its reconnect loop. A node that can't be reached (or times out)
+// isn't an error here, connecting to it is retried as usual
+func (p *nodeProxy) check(address string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	creds := insecure.NewCredentials()
+	if p.tls != nil {
+		conn, err := (&tls.Dialer{Config: p.tls}).DialContext(ctx, "tcp", address)
+		if err != nil {
+			var opErr *net.OpError
+			if ctx.Err() != nil || (errors.As(err, &opErr) && opErr.Op == "dial") {
+				return nil
+			}
+			return errors.Wrapf(ErrNodeRejectedRPC, "tls handshake with %s failed: %s", address, err)
+		}
+		conn.Close()
+		creds = credentials.NewTLS(p.tls)
+	}
+	conn, err := grpc.DialContext(ctx, address, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stream, err := protowire.NewRPCClient(conn).MessageStream(metadata.NewOutgoingContext(ctx, metadata.New(p.headers)))
+	if err == nil {
+		var request *protowire.PyipadMessage
+		if request, err = protowire.FromAppMessage(appmessage.NewGetInfoRequestMessage()); err != nil {
+			return err
+		}
+		if err = stream.Send(request); err == nil {
+			_, err = stream.Recv()
+		} else if err == io.EOF {
+			// the node ended the stream, its status comes with the receive
+			_, err = stream.Recv()
+		}
+		stream.CloseSend()
+	}
+	switch status.Code(err) {
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return errors.Wrapf(ErrNodeRejectedRPC, "%s: %s", address, status.Convert(err).Message())
+	}
+	return nil
+}
+
+func (p *nodeProxy) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, server := range p.servers {
+		server.Close()
+	}
+	if p.dir != "" {
+		os.RemoveAll(p.dir)
+	}
+}
@@ -0,0 +1,125 @@
+package pyrinstratum
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+func TestNodeProxy(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("X-Seen-Key", r.Header.Get("X-Api-Key"))
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		// echo as it arrives, so the test sees the call streams both ways
+		buf := make([]byte, 64)
+		for {
+			n, err := r.Body.Read(buf)
+			w.Write(buf[:n])
+			w.(http.Flusher).Flush()
+			if err != nil {
+				break
+			}
+		}
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.Config.ErrorLog = log.New(io.Discard, "", 0)
+	upstream.StartTLS()
+	defer upstream.Close()
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	address := upstream.Listener.Addr().String()
+	options := NodeRPCOptions{AuthToken: "secret", Headers: map[string]string{"X-Api-Key": "key"}, TLS: true, TLSCAFile: ca}
+
+	proxy, err := newNodeProxy(options, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.close()
+	local, err := proxy.route(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := proxy.route(address); again != local {
+		t.Fatalf("expected one listener per node, got %s and %s", local, again)
+	}
+
+	socket := strings.TrimPrefix(local, "unix:")
+	if info, err := os.Stat(socket); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected a socket only the bridge's user can open, got %v: %v", info, err)
+	}
+
+	// plaintext h2 to the proxy like the pyipad client, which forwards it
+	// over TLS with the headers
+	client := &http.Client{Transport: &http2.Transport{AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, _, _ string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		}}}
+	body, send := io.Pipe()
+	request, _ := http.NewRequest(http.MethodPost, "http://localhost/protowire.RPC/MessageStream", body)
+	request.Header.Set("Te", "trailers")
+	go send.Write([]byte("ping"))
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK || response.Header.Get("X-Seen-Key") != "key" {
+		t.Fatalf("expected an authorized call with the headers, got %d %v", response.StatusCode, response.Header)
+	}
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(response.Body, echo); err != nil || string(echo) != "ping" {
+		t.Fatalf("expected the echo before the call ended, got %q: %v", echo, err)
+	}
+	send.Close()
+	io.Copy(io.Discard, response.Body)
+	if response.Trailer.Get("Grpc-Status") != "0" {
+		t.Fatalf("expected the trailers forwarded, got %v", response.Trailer)
+	}
+
+	if err := proxy.check(address, time.Second); err != nil {
+		t.Fatalf("expected the node to accept the options, got %v", err)
+	}
+	rejected, _ := newNodeProxy(NodeRPCOptions{AuthToken: "wrong", TLS: true, TLSCAFile: ca}, zap.NewNop().Sugar())
+	if err := rejected.check(address, time.Second); !errors.Is(err, ErrNodeRejectedRPC) {
+		t.Fatalf("expected a rejected token, got %v", err)
+	}
+	untrusted, _ := newNodeProxy(NodeRPCOptions{AuthToken: "secret", TLS: true}, zap.NewNop().Sugar())
+	if err := untrusted.check(address, time.Second); !errors.Is(err, ErrNodeRejectedRPC) {
+		t.Fatalf("expected an unverified certificate to fail, got %v", err)
+	}
+
+	proxy.close()
+	if _, err := os.Stat(filepath.Dir(socket)); !os.IsNotExist(err) {
+		t.Fatalf("expected the sockets removed on close, got %v", err)
+	}
+
+	// a node that's down is left to the connect retries
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	listener.Close()
+	if err := proxy.check(listener.Addr().String(), time.Second); err != nil {
+		t.Fatalf("expected an unreachable node to pass the check, got %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package pyrinstratum
+
+import (
+	"sync"
+	"time"
+)
+
+// nodeStabilization holds a node that just reconnected out of template
+// rotation (as long as another node is usable) for a grace period. A node
+// coming back from a restart or a dropped connection often reports synced
+// before it has really caught up, templates from it during that time waste
+// work on stale tips. It's only let back in once the window has passed, it
+// has reported synced and its block count has advanced since the reconnect
+type nodeStabilization struct {
+	lock sync.Mutex
+	// zero while the node isn't stabilizing
+	until  time.Time
+	synced bool
+	// block count first seen after the reconnect, the count has to move past
+	// it
+	baseline    uint64
+	hasBaseline bool
+	advanced    bool
+}
+
+func (s *nodeStabilization) start(now time.Time, window time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.until = now.Add(window)
+	s.synced, s.hasBaseline, s.advanced = false, false, false
+}
+
+func (s *nodeStabilization) active() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return !s.until.IsZero()
+}
+
+// recordSynced notes the node reporting synced, returning true if that ends
+// its stabilization
+func (s *nodeStabilization) recordSynced(now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.synced = true
+	return s.settle(now)
+}
+
+// recordBlockCount tracks the node's block count against the first one seen
+// after the reconnect, returning true if that ends its stabilization
+func (s *nodeStabilization) recordBlockCount(count uint64, now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.until.IsZero() {
+		return false
+	}
+	if !s.hasBaseline {
+		s.baseline, s.hasBaseline = count, true
+	} else if count > s.baseline {
+		s.advanced = true
+	}
+	return s.settle(now)
+}
+
+// settle ends the stabilization once every condition is met. Must be called
+// with the lock held
+func (s *nodeStabilization) settle(now time.Time) bool {
+	if s.until.IsZero() || !s.synced || !s.advanced || now.Before(s.until) {
+		return false
+	}
+	s.until = time.Time{}
+	return true
+}
+
+// stabilizeNode starts the grace period for a node that just reconnected,
+// failing over from it if it was the active node
+func (py *PyrinApi) stabilizeNode(node *pyrinNode) {
+	if py.stabilizeWindow <= 0 {
+		return
+	}
+	node.stabilization.start(time.Now(), py.stabilizeWindow)
+	py.logger.Infow("pyrin node reconnected, not using it for templates until it's stable",
+		"node", node.address, "window", py.stabilizeWindow)
+	if py.activeNode() == node {
+		// with nothing else usable it's picked right back
+		py.failover()
+	}
+}
+
+// nodeStabilized logs a node's stabilization ending
+func (py *PyrinApi) nodeStabilized(node *pyrinNode) {
+	py.logger.Infow("pyrin node stable after reconnecting, using it for templates again", "node", node.address)
+}
@@ -0,0 +1,128 @@
+package pyrinstratum
+
+import (
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// NodeState is the connection state of a single pyrin node. Transitions:
+//
+//	Connected    -> Degraded      a request to the node failed
+//	Degraded     -> Connected     a request succeeded
+//	Degraded     -> Reconnecting  degradedFailureLimit consecutive failures
+//	Reconnecting -> Connected     reconnect succeeded
+//	Reconnecting -> Failed        failedReconnectLimit consecutive failed reconnects
+//	Failed       -> Connected     reconnect succeeded (reconnects keep being attempted)
+//
+// Only Connected and Degraded nodes are used for templates, a node that
+// leaves either state is failed over from
+type NodeState string
+
+const (
+	NodeConnected    NodeState = "connected"
+	NodeDegraded     NodeState = "degraded"
+	NodeReconnecting NodeState = "reconnecting"
+	NodeFailed       NodeState = "failed"
+)
+
+var nodeStates = []NodeState{NodeConnected, NodeDegraded, NodeReconnecting, NodeFailed}
+
+const degradedFailureLimit = 3
+const failedReconnectLimit = 5
+
+// usable returns true if requests can be sent to a node in this state
+func (s NodeState) usable() bool {
+	return s == NodeConnected || s == NodeDegraded
+}
+
+// nodeStateMachine tracks the connection state of a node. It only decides
+// state, the actual reconnecting is up to the caller (see needsReconnect)
+type nodeStateMachine struct {
+	lock     sync.Mutex
+	address  string
+	logger   *zap.SugaredLogger
+	state    NodeState
+	failures int // consecutive failed requests or reconnects in the current state
+}
+
+func newNodeStateMachine(address string, logger *zap.SugaredLogger, initial NodeState) *nodeStateMachine {
+	sm := &nodeStateMachine{
+		address: address,
+		logger:  logger,
+		state:   initial,
+	}
+	RecordNodeState(address, initial)
+	return sm
+}
+
+func (sm *nodeStateMachine) State() NodeState {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	return sm.state
+}
+
+// needsReconnect returns true if the caller should attempt a reconnect and
+// report the result through ReconnectResult
+func (sm *nodeStateMachine) needsReconnect() bool {
+	return !sm.State().usable()
+}
+
+// RequestSucceeded records a successful request to the node
+func (sm *nodeStateMachine) RequestSucceeded() {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	if sm.state == NodeDegraded {
+		sm.transition(NodeConnected)
+	}
+}
+
+// RequestFailed records a request to the node that failed at the transport
+// level (rpc errors returned by a healthy node don't count)
+func (sm *nodeStateMachine) RequestFailed(err error) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	switch sm.state {
+	case NodeConnected:
+		sm.transition(NodeDegraded)
+		sm.failures = 1
+		sm.logger.Warnw("pyrin node degraded", zap.String("node", sm.address), zap.Error(err))
+	case NodeDegraded:
+		sm.failures++
+		if sm.failures >= degradedFailureLimit {
+			sm.transition(NodeReconnecting)
+		}
+	}
+}
+
+// ReconnectResult records the outcome of a reconnect attempt
+func (sm *nodeStateMachine) ReconnectResult(err error) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	if sm.state.usable() {
+		return
+	}
+	if err == nil {
+		sm.transition(NodeConnected)
+		return
+	}
+	sm.failures++
+	if sm.state == NodeReconnecting && sm.failures >= failedReconnectLimit {
+		sm.transition(NodeFailed)
+		sm.logger.Errorw("pyrin node failed, will keep attempting to reconnect",
+			zap.String("node", sm.address), zap.Error(err))
+	}
+}
+
+// transition must be called with the lock held
+func (sm *nodeStateMachine) transition(to NodeState) {
+	from := sm.state
+	if from == to {
+		return
+	}
+	sm.state = to
+	sm.failures = 0
+	sm.logger.Infow("pyrin node state changed", zap.String("node", sm.address),
+		zap.String("from", string(from)), zap.String("to", string(to)))
+	RecordNodeState(sm.address, to)
+}
@@ -0,0 +1,67 @@
+package pyrinstratum
+
+import (
+	"fmt"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestNodeStateTransitions(t *testing.T) {
+	errDown := fmt.Errorf("connection refused")
+	newSm := func() *nodeStateMachine {
+		return newNodeStateMachine("mock", zap.NewNop().Sugar(), NodeConnected)
+	}
+	expect := func(t *testing.T, sm *nodeStateMachine, state NodeState) {
+		t.Helper()
+		if sm.State() != state {
+			t.Fatalf("expected state %s, got %s", state, sm.State())
+		}
+	}
+
+	t.Run("degrades and recovers", func(t *testing.T) {
+		sm := newSm()
+		sm.RequestFailed(errDown)
+		expect(t, sm, NodeDegraded)
+		sm.RequestSucceeded()
+		expect(t, sm, NodeConnected)
+	})
+
+	t.Run("reconnects after repeated failures", func(t *testing.T) {
+		sm := newSm()
+		sm.RequestFailed(errDown)
+		for i := 1; i < degradedFailureLimit; i++ {
+			expect(t, sm, NodeDegraded)
+			sm.RequestFailed(errDown)
+		}
+		expect(t, sm, NodeReconnecting)
+		if !sm.needsReconnect() {
+			t.Fatalf("expected reconnecting node to need a reconnect")
+		}
+		sm.ReconnectResult(nil)
+		expect(t, sm, NodeConnected)
+	})
+
+	t.Run("fails after repeated reconnects", func(t *testing.T) {
+		sm := newNodeStateMachine("mock", zap.NewNop().Sugar(), NodeReconnecting)
+		for i := 0; i < failedReconnectLimit; i++ {
+			expect(t, sm, NodeReconnecting)
+			sm.ReconnectResult(errDown)
+		}
+		expect(t, sm, NodeFailed)
+		sm.ReconnectResult(errDown)
+		expect(t, sm, NodeFailed)
+		sm.ReconnectResult(nil)
+		expect(t, sm, NodeConnected)
+	})
+
+	t.Run("ignores events that don't apply", func(t *testing.T) {
+		sm := newSm()
+		sm.ReconnectResult(errDown)
+		expect(t, sm, NodeConnected)
+		sm = newNodeStateMachine("mock", zap.NewNop().Sugar(), NodeReconnecting)
+		sm.RequestSucceeded()
+		sm.RequestFailed(errDown)
+		expect(t, sm, NodeReconnecting)
+	})
+}
@@ -0,0 +1,71 @@
+package pyrinstratum
+
+import (
+	"github.com/pyrin-network/pyipad/app/appmessage"
+)
+
+// consecutive health checks a node's tips have to be disjoint from the
+// leading node's (and it behind it) before it's treated as diverged. With
+// ~1s blocks nodes disagree on the latest tips for a moment all the time
+const tipDivergedChecks = 3
+
+// nodeView is what a node reported in the latest health check
+type nodeView struct {
+	node *pyrinNode
+	info *appmessage.GetBlockDAGInfoResponseMessage
+}
+
+// checkTips compares the nodes' tips. The node furthest ahead (by virtual
+// DAA score, then block count) leads, a node behind it that shares none of
+// its tips for tipDivergedChecks checks in a row is on a fork or stuck
+// behind one. Templates built on its tips would have blocks found on them
+// rejected (or orphaned) by the rest of the network, so it's treated as
+// unhealthy until it's back on the leader's tips
+func (py *PyrinApi) checkTips(views []nodeView) {
+	if len(views) < 2 {
+		return
+	}
+	leader := views[0]
+	for _, view := range views[1:] {
+		if view.info.VirtualDAAScore > leader.info.VirtualDAAScore ||
+			view.info.VirtualDAAScore == leader.info.VirtualDAAScore && view.info.BlockCount > leader.info.BlockCount {
+			leader = view
+		}
+	}
+	for _, view := range views {
+		node := view.node
+		if view.info.VirtualDAAScore >= leader.info.VirtualDAAScore || sharesTip(view.info.TipHashes, leader.info.TipHashes) {
+			node.disjointChecks = 0
+		} else {
+			node.disjointChecks++
+		}
+		diverged := node.disjointChecks >= tipDivergedChecks
+		RecordNodeTipAgreement(node.address, !diverged)
+		if node.diverged.Swap(diverged) == diverged {
+			continue
+		}
+		if !diverged {
+			py.logger.Infow("pyrin node back on the leading tips", "node", node.address)
+			continue
+		}
+		py.logger.Warnw("pyrin node disagrees with the other nodes on the tips, treating it as unhealthy",
+			"node", node.address, "daa_score", view.info.VirtualDAAScore, "tips", view.info.TipHashes,
+			"leader", leader.node.address, "leader_daa_score", leader.info.VirtualDAAScore, "leader_tips", leader.info.TipHashes)
+		if py.activeNode() == node {
+			if _, err := py.failover(); err != nil {
+				py.logger.Warn("no pyrin node on the leading tips to fail over to")
+			}
+		}
+	}
+}
+
+func sharesTip(tips, others []string) bool {
+	for _, tip := range tips {
+		for _, other := range others {
+			if tip == other {
+				return true
+			}
+		}
+	}
+	return false
+}
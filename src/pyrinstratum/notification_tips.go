@@ -0,0 +1,35 @@
+package pyrinstratum
+
+import (
+	"sort"
+	"strings"
+)
+
+// tipsAdvanced returns true if the active node's tips changed since the last
+// notification acted on, i.e. the notification is for new work. pyrind also
+// notifies for templates on the same tips (or repeats itself under load),
+// pushing those would only have every miner restart on the same work. When
+// the tips can't be had the notification is acted on, a missed block costs
+// more than a redundant job. Only touched by the template listener
+func (py *PyrinApi) tipsAdvanced() bool {
+	node := py.activeNode()
+	if node == nil {
+		return true
+	}
+	client, err := node.connection()
+	if err != nil {
+		return true
+	}
+	dagInfo, err := callNode(py, node, "GetBlockDAGInfo", client.GetBlockDAGInfo)
+	if err != nil {
+		return true
+	}
+	tips := append([]string{}, dagInfo.TipHashes...)
+	sort.Strings(tips)
+	key := strings.Join(tips, ",")
+	if key == py.lastTips {
+		return false
+	}
+	py.lastTips = key
+	return true
+}
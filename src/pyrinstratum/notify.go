@@ -0,0 +1,71 @@
+package pyrinstratum
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+type notifyKey struct {
+	header    [32]byte
+	timestamp int64
+	bigJob    bool
+}
+
+// notifyCache holds the serialized job params of a single broadcast. Every
+// connection mining the same header (same wallet and miner app) shares them,
+// only the job id is encoded per connection
+type notifyCache struct {
+	lock   sync.Mutex
+	params map[notifyKey][]byte
+}
+
+func newNotifyCache() *notifyCache {
+	return &notifyCache{params: map[notifyKey][]byte{}}
+}
+
+// jobParams returns the encoded params following the job id, without the
+// enclosing brackets
+func (nc *notifyCache) jobParams(header []byte, timestamp int64, bigJob bool) ([]byte, error) {
+	key := notifyKey{timestamp: timestamp, bigJob: bigJob}
+	copy(key.header[:], header)
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	if encoded, exists := nc.params[key]; exists {
+		return encoded, nil
+	}
+	var params []any
+	if bigJob {
+		params = []any{GenerateLargeJobParams(header, uint64(timestamp))}
+	} else {
+		params = []any{GenerateJobHeader(header), timestamp}
+	}
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed encoding job params")
+	}
+	encoded = encoded[1 : len(encoded)-1]
+	nc.params[key] = encoded
+	return encoded, nil
+}
+
+var notifyBufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// encodeNotify writes the mining.notify line for a job into buf, byte for byte
+// what encoding the equivalent JsonRpcEvent would produce
+func encodeNotify(buf *bytes.Buffer, jobId int, params []byte) {
+	var scratch [20]byte
+	id := strconv.AppendInt(scratch[:0], int64(jobId), 10)
+	buf.WriteString(`{"id":`)
+	buf.Write(id)
+	buf.WriteString(`,"jsonrpc":"2.0","method":"mining.notify","params":["`)
+	buf.Write(id)
+	buf.WriteString(`",`)
+	buf.Write(params)
+	buf.WriteString("]}\n")
+}
@@ -0,0 +1,88 @@
+package pyrinstratum
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+)
+
+var testNotifyHeader = bytes.Repeat([]byte{0xab, 0x01, 0x7f, 0x42}, 8)
+
+const testNotifyTimestamp = 1690000000000
+
+// legacyNotify encodes the notify event the way it was before being shared
+// across connections
+func legacyNotify(jobId int, header []byte, timestamp int64, bigJob bool) ([]byte, error) {
+	jobParams := []any{fmt.Sprintf("%d", jobId)}
+	if bigJob {
+		jobParams = append(jobParams, GenerateLargeJobParams(header, uint64(timestamp)))
+	} else {
+		jobParams = append(jobParams, GenerateJobHeader(header), timestamp)
+	}
+	encoded, err := json.Marshal(gostratum.JsonRpcEvent{
+		Version: "2.0",
+		Method:  "mining.notify",
+		Id:      jobId,
+		Params:  jobParams,
+	})
+	return append(encoded, '\n'), err
+}
+
+func TestEncodeNotify(t *testing.T) {
+	cache := newNotifyCache()
+	for _, bigJob := range []bool{false, true} {
+		for _, jobId := range []int{1, 299} {
+			expected, err := legacyNotify(jobId, testNotifyHeader, testNotifyTimestamp, bigJob)
+			if err != nil {
+				t.Fatal(err)
+			}
+			params, err := cache.jobParams(testNotifyHeader, testNotifyTimestamp, bigJob)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := bytes.Buffer{}
+			encodeNotify(&buf, jobId, params)
+			if !bytes.Equal(buf.Bytes(), expected) {
+				t.Fatalf("notify mismatch (big job %t)\nexpected %s\ngot      %s", bigJob, expected, buf.Bytes())
+			}
+		}
+	}
+	if len(cache.params) != 2 {
+		t.Fatalf("expected params to be encoded once per header/format, got %d entries", len(cache.params))
+	}
+}
+
+// BenchmarkNotifyBroadcast measures a single broadcast of the same job to
+// 1000 connections
+func BenchmarkNotifyBroadcast(b *testing.B) {
+	const clients = 1000
+	b.Run("per-connection", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for c := 0; c < clients; c++ {
+				if _, err := legacyNotify(c, testNotifyHeader, testNotifyTimestamp, false); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("shared", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			cache := newNotifyCache()
+			for c := 0; c < clients; c++ {
+				params, err := cache.jobParams(testNotifyHeader, testNotifyTimestamp, false)
+				if err != nil {
+					b.Fatal(err)
+				}
+				buf := notifyBufferPool.Get().(*bytes.Buffer)
+				buf.Reset()
+				encodeNotify(buf, c, params)
+				notifyBufferPool.Put(buf)
+			}
+		}
+	})
+}
@@ -0,0 +1,40 @@
+package pyrinstratum
+
+import (
+	"sync/atomic"
+
+	"github.com/pyrin-network/pyipad/util"
+	"github.com/pkg/errors"
+)
+
+// payoutRotation hands out the configured solo payout addresses round-robin,
+// one per template fetch, spreading found blocks (and their utxos) across
+// the wallets
+type payoutRotation struct {
+	addresses []string
+	next      atomic.Uint32
+}
+
+// newPayoutRotation returns nil when no addresses are configured, templates
+// then pay out to each miner's own address
+func newPayoutRotation(addresses []string) *payoutRotation {
+	if len(addresses) == 0 {
+		return nil
+	}
+	return &payoutRotation{addresses: addresses}
+}
+
+func (p *payoutRotation) address() string {
+	idx := p.next.Add(1) - 1
+	return p.addresses[idx%uint32(len(p.addresses))]
+}
+
+// validatePayoutAddress is stricter than the cleanup applied to miner
+// provided addresses, a typo in the config must not silently send blocks
+// somewhere else
+func validatePayoutAddress(address string) error {
+	if _, err := util.DecodeAddress(address, util.Bech32PrefixUnknown); err != nil {
+		return errors.Wrapf(err, "invalid payout address %s", address)
+	}
+	return nil
+}
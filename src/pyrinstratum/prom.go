@@ -3,13 +3,17 @@ package pyrinstratum
 import (
 	"fmt"
 	"net/http"
+	"runtime"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/pyrin-network/pyipad/app/appmessage"
 	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 )
 
@@ -32,6 +36,26 @@ var invalidCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 	Help: "Number of stale shares found by worker over time",
 }, append(workerLabels, "type"))
 
+var throttledShareCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "py_throttled_share_counter",
+	Help: "Number of shares rejected by worker for exceeding the share rate limit",
+}, workerLabels)
+
+var invalidShareDisconnectCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "py_invalid_share_disconnect_counter",
+	Help: "Number of times a worker was disconnected for exceeding the invalid share ratio",
+}, workerLabels)
+
+var stuckJobWorkerCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "py_stuck_job_worker_counter",
+	Help: "Number of times a worker was flagged for consistently submitting shares for old jobs",
+}, workerLabels)
+
+var stuckJobDisconnectCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "py_stuck_job_disconnect_counter",
+	Help: "Number of times a worker was disconnected for submitting shares for old jobs",
+}, workerLabels)
+
 var blockCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "py_blocpy_mined",
 	Help: "Number of blocks mined over time",
@@ -42,16 +66,278 @@ var blockGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Help: "Gauge containing 1 unique instance per block mined",
 }, append(workerLabels, "nonce", "bluescore", "hash"))
 
+var totalShareCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "py_total_share_counter",
+	Help: "Number of accepted shares across all workers",
+})
+
+var totalBlockCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "py_total_block_counter",
+	Help: "Number of blocks found across all workers",
+})
+
+var sharedTemplateFetchCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "py_shared_template_fetch_counter",
+	Help: "Number of template requests that waited on a fetch already in flight for the same client (or with share_templates, the same address) instead of making their own",
+})
+
+var extranonceExhaustedCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "py_extranonce_exhausted_counter",
+	Help: "Number of connections given an extranonce already in use because every extranonce was leased",
+})
+
+var keepaliveJobCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "py_keepalive_job_counter",
+	Help: "Number of times a client was sent its current job again for job_keepalive",
+})
+
+var blockCandidateCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "py_block_candidate_counter",
+	Help: "Number of shares meeting the network target across all workers, whether or not the block was then accepted",
+})
+
+var idleRefreshSkippedCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "py_idle_refresh_skipped_counter",
+	Help: "Number of template notifications and polls skipped while no miners were connected (see pause_when_idle)",
+})
+
+var unchangedTipsCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "py_unchanged_tips_notification_counter",
+	Help: "Number of template notifications skipped for the same tips as the last one acted on (see skip_unchanged_tips)",
+})
+
+var templateCacheMissCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "py_template_cache_miss_counter",
+	Help: "Number of client templates not found in the shared templates (see share_templates), fetched or waited on a fetch in flight. Against py_cached_template_counter this is the cache's hit ratio",
+})
+
+var blockRejectedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "py_block_rejected_counter",
+	Help: "Number of blocks found by worker that no node took, by rejection: duplicate, stale (lost the race), syncing, invalid or failed (no node reachable)",
+}, append(workerLabels, "rejection"))
+
+var lastBlockGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "py_last_block_timestamp",
+	Help: "Unix timestamp (seconds) of the last block found and accepted by a node, across all workers",
+})
+
+var workerDifficultyGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "py_worker_difficulty_gauge",
+	Help: "Stratum difficulty the worker was last sent, by worker",
+}, workerLabels)
+
+var nodeActiveGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "py_node_active_gauge",
+	Help: "Gauge set to 1 for the pyrin node templates are currently pulled from, 0 for the other nodes",
+}, []string{"node"})
+
+var difficultyDriftGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "py_worker_difficulty_drift_gauge",
+	Help: "Ratio of the difficulty implied by the worker's share rate over the vardiff window (the one that would hit the target rate) to its assigned difficulty, as of its last vardiff evaluation. 1 is on target",
+}, workerLabels)
+
+var difficultyDriftHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "py_vardiff_drift_ratio_histogram",
+	Help:    "Ratio of the implied to the assigned difficulty at each vardiff evaluation across all workers, mass away from 1 means vardiff isn't reaching its target",
+	Buckets: []float64{0.25, 0.5, 0.67, 0.8, 1, 1.25, 1.5, 2, 4},
+})
+
+var trackingEvictedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "py_tracking_evicted_counter",
+	Help: "Number of tracked workers evicted to stay within max_tracked_workers, by what tracked them",
+}, []string{"tracking"})
+
+var blockLostRaceCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "py_block_lost_race_counter",
+	Help: "Number of found blocks the node rejected for reaching it after the dag had moved past them, near misses rather than invalid blocks, by node",
+}, []string{"node"})
+
+var statsThreadAliveGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "py_stats_thread_alive_gauge",
+	Help: "1 while the stats thread publishing the network stats is running, 0 while it's waiting to be restarted",
+})
+
+var statsThreadRestartCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "py_stats_thread_restart_counter",
+	Help: "Number of times the stats thread stopped unexpectedly (e.g. panicked) and was restarted",
+})
+
+var statsUpdatedGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "py_stats_last_update_timestamp_gauge",
+	Help: "Unix timestamp (seconds) the network stats were last fetched and recorded",
+})
+
+var networkUnstableGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "py_network_unstable_gauge",
+	Help: "1 while the network is held unstable after difficulty swings or block count regressions seen by the stats thread, 0 otherwise",
+})
+
+var cachedTemplateCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "py_cached_template_counter",
+	Help: "Number of client templates served from the template shared by clients mining to the same address (see share_templates) instead of fetched",
+})
+
+var clientLatencyHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "py_client_latency_seconds_histogram",
+	Help:    "Round trip time in seconds of latency probes to miners (see latency_probe_interval), by connection origin label",
+	Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+}, []string{"origin"})
+
+var nodeRpcErrorRateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "py_node_rpc_error_rate_gauge",
+	Help: "Share of a pyrin node's rpc calls that failed over the last node_error_window, by method",
+}, []string{"node", "method"})
+
+var writeTimeoutCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "py_write_timeout_counter",
+	Help: "Number of clients disconnected for a write to them timing out (see client_write_timeout)",
+})
+
+var nodeTipAgreementGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "py_node_tip_agreement_gauge",
+	Help: "Gauge set to 1 while a pyrin node agrees with the leading node on the tips, 0 while it's diverged (only with multiple nodes)",
+}, []string{"node"})
+
+var malformedSubmitCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "py_malformed_submit_counter",
+	Help: "Number of submits rejected for their params before validation, by reason",
+}, []string{"reason"})
+
+var nodeRefreshCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "py_node_refresh_counter",
+	Help: "Number of periodic connection refreshes per pyrin node (see node_refresh_interval) by result, refreshed or failed",
+}, []string{"node", "result"})
+
+var unknownJobCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "py_unknown_job_counter",
+	Help: "Number of submits for a job id the connection was never sent, as opposed to stale shares",
+})
+
+var roundShareDiffGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "py_round_share_diff_gauge",
+	Help: "Total difficulty of shares accepted since the last block found (or startup), reset to 0 on every block",
+})
+
+var coalescedNotificationCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "py_coalesced_template_notification_counter",
+	Help: "Number of template notifications folded into one still waiting for the template listener",
+})
+
+var nodePeersGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "py_node_peers_gauge",
+	Help: "Number of peers each pyrin node was last connected to",
+}, []string{"node"})
+
+var nonceBucketCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "py_nonce_bucket_counter",
+	Help: "Number of accepted shares by the top 4 bits of the part of the nonce the worker searched, a healthy miner spreads them about evenly",
+}, append(workerLabels, "bucket"))
+
+var workerReconnectsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "py_worker_reconnects_gauge",
+	Help: "Times the worker reconnected within the flap window, as of its latest connection",
+}, workerLabels)
+
+var traceDropCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "py_trace_dropped_span_counter",
+	Help: "Number of trace spans dropped because the export queue was full or the collector couldn't be reached",
+})
+
+var connectionAcceptCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "py_connection_accept_counter",
+	Help: "Number of accepted stratum connections, result dropped when the accept queue was full",
+}, []string{"result"})
+
+var templateUnsyncedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "py_template_unsynced_counter",
+	Help: "Number of templates a just (re)connected node handed out while reporting it isn't synced, each asked for again",
+}, []string{"node"})
+
+var templateDifficultyRatioGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "py_template_difficulty_ratio_gauge",
+	Help: "Difficulty derived from the last block template's target divided by the network difficulty the node reports, 1 when the target conversion is right",
+})
+
+var difficultyMismatchCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "py_difficulty_mismatch_counter",
+	Help: "Number of network stats refreshes where the template target's difficulty was more than 5% off the node's network difficulty",
+})
+
+var staleShareRateGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "py_stale_share_ratio_gauge",
+	Help: "Fraction of submissions across all workers that were stale over the last 5 minute window",
+})
+
+var sharesPerBlockGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "py_shares_per_block_gauge",
+	Help: "Average number of accepted shares per block found since startup, too high means share difficulty is too low",
+})
+
+var expectedBlocksGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "py_expected_blocks_gauge",
+	Help: "Number of blocks the accepted share difficulty since startup should have found on average, at the network difficulty at the time of each share",
+})
+
+var blockLuckGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "py_block_luck_gauge",
+	Help: "Blocks found divided by py_expected_blocks_gauge since startup, above 1 is finding blocks faster than the hashrate predicts",
+})
+
+var targetSharesPerBlockGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "py_target_shares_per_block_gauge",
+	Help: "Operator configured target for shares per block, for comparison against py_shares_per_block_gauge",
+})
+
+var lastShareGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "py_worker_last_share_timestamp",
+	Help: "Unix timestamp (seconds) of the last accepted share by worker",
+}, workerLabels)
+
+var workerHashrateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "py_worker_estimated_hashrate_gauge",
+	Help: "Hashrate in GH/s estimated from the work accepted by worker over the last hashrate_window (default 5 minutes)",
+}, workerLabels)
+
+var reportedHashrateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "py_worker_reported_hashrate_gauge",
+	Help: "Hashrate in GH/s the worker reported itself (hr= in the password), for comparing against py_worker_estimated_hashrate_gauge",
+}, workerLabels)
+
 var disconnectCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "py_worker_disconnect_counter",
 	Help: "Number of disconnects by worker",
 }, workerLabels)
 
+var bytesReadCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "py_worker_bytes_read_counter",
+	Help: "Number of bytes read from the miner connection by worker",
+}, workerLabels)
+
+var bytesWrittenCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "py_worker_bytes_written_counter",
+	Help: "Number of bytes written to the miner connection by worker",
+}, workerLabels)
+
+var totalBytesReadCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "py_bytes_read_counter",
+	Help: "Number of bytes read from all miner connections",
+})
+
+var totalBytesWrittenCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "py_bytes_written_counter",
+	Help: "Number of bytes written to all miner connections",
+})
+
 var jobCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "py_worker_job_counter",
 	Help: "Number of jobs sent to the miner by worker over time",
 }, workerLabels)
 
+var coalescedJobCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "py_worker_coalesced_job_counter",
+	Help: "Number of new jobs held back by max_jobs_per_second and folded into a later push, by worker",
+}, workerLabels)
+
 var balanceGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Name: "py_balance_by_wallet_gauge",
 	Help: "Gauge representing the wallet balance for connected workers",
@@ -62,21 +348,216 @@ var errorByWallet = promauto.NewCounterVec(prometheus.CounterOpts{
 	Help: "Gauge representing errors by worker",
 }, []string{"wallet", "error"})
 
-var estimatedNetworkHashrate = promauto.NewGauge(prometheus.GaugeOpts{
+var estimatedNetworkHashrate = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Name: "py_estimated_network_hashrate_gauge",
-	Help: "Gauge representing the estimated network hashrate",
-})
+	Help: "Gauge representing the estimated network hashrate, by the node it was queried from",
+}, []string{"node"})
 
-var networkDifficulty = promauto.NewGauge(prometheus.GaugeOpts{
+var networkDifficulty = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Name: "py_network_difficulty_gauge",
-	Help: "Gauge representing the network difficulty",
-})
+	Help: "Gauge representing the network difficulty, by the node it was queried from",
+}, []string{"node"})
 
-var networkBlockCount = promauto.NewGauge(prometheus.GaugeOpts{
+var networkBlockCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Name: "py_network_block_count",
-	Help: "Gauge representing the network block count",
+	Help: "Gauge representing the network block count, by the node it was queried from",
+}, []string{"node"})
+
+var templateTxGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "py_template_transaction_count_gauge",
+	Help: "Gauge representing the number of transactions (including coinbase) in the latest block template",
+})
+
+var duplicateTemplateCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "py_duplicate_template_counter",
+	Help: "Number of templates not pushed to a client because they were identical to the previous one",
+})
+
+var templateRewardGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "py_template_coinbase_reward_gauge",
+	Help: "Gauge representing the total paid out by the coinbase of the latest block template (subsidies plus fees of the merged blocks), in PYI",
+})
+
+var staleTemplateCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "py_stale_template_counter",
+	Help: "Number of block templates received from pyrin that exceeded the max template age",
+})
+
+var inflightSubmitGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "py_inflight_block_submits_gauge",
+	Help: "Gauge representing the number of block submits currently in flight to pyrin",
+})
+
+var shareValidationHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "py_share_validation_duration_histogram",
+	Help:    "Time in seconds spent validating (hashing) each submitted share locally",
+	Buckets: prometheus.ExponentialBuckets(0.00001, 2, 14),
+})
+
+var submitNodeResultCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "py_block_submit_result_counter",
+	Help: "Number of found blocks submitted to each node (template and submit_addresses nodes) by outcome, accepted, rejected or error",
+}, []string{"node", "result"})
+
+var desyncShareCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "py_desync_share_counter",
+	Help: "Number of shares submitted for a job from a node that wasn't synced, by how they were handled: failover, rejected, buffered or buffer_expired",
+}, []string{"outcome"})
+
+var blockSubmitHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "py_block_submit_duration_histogram",
+	Help:    "Time in seconds from receiving a block candidate share until the node answered the submit, by node",
+	Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+}, []string{"node"})
+
+var retainedJobsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "py_retained_jobs_gauge",
+	Help: "Gauge representing the number of jobs currently held in memory across all connected workers, for validating shares against",
+})
+
+var jobBroadcastHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "py_job_broadcast_duration_histogram",
+	Help:    "Time in seconds from a new block template notification until the job was pushed to all connected miners",
+	Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
 })
 
+var vardiffRetargetCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "py_vardiff_retarget_counter",
+	Help: "Number of difficulty changes sent to miners by vardiff, by direction",
+}, []string{"direction"})
+
+var vardiffSuppressedCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "py_vardiff_suppressed_counter",
+	Help: "Number of vardiff difficulty changes held back by vardiff_min_change_interval or vardiff_min_change",
+})
+
+var vardiffRatioHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "py_vardiff_adjustment_ratio_histogram",
+	Help:    "Ratio of the new to the previous difficulty of each vardiff retarget, mass at both ends means vardiff is oscillating",
+	Buckets: []float64{0.25, 0.5, 0.67, 0.8, 1, 1.25, 1.5, 2, 4},
+})
+
+// not labeled by worker, a histogram per worker is too many series for a farm
+var shareDifficultyHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "py_share_difficulty_histogram",
+	Help:    "Stratum difficulty each accepted share was mined at, across all workers",
+	Buckets: prometheus.ExponentialBuckets(1, 4, 13),
+})
+
+// across all workers, measured per connection from authorize
+var timeToFirstShareHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "py_time_to_first_share_histogram",
+	Help:    "Time in seconds from a connection authorizing until its first accepted share, a long tail points at a too high starting difficulty or handshake issues",
+	Buckets: prometheus.ExponentialBuckets(0.5, 2, 12),
+})
+
+var shareSinkDropCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "py_share_sink_dropped_counter",
+	Help: "Number of share records dropped because the share sink queue was full",
+})
+
+var nodeDrainingGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "py_node_draining_gauge",
+	Help: "Gauge set to 1 while a pyrin node is draining (excluded from template fetches)",
+}, []string{"node"})
+
+var maintenanceGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "py_maintenance_gauge",
+	Help: "Gauge set to 1 while the bridge is in maintenance mode",
+})
+
+var nodeStateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "py_node_state_gauge",
+	Help: "Gauge set to 1 for the current connection state of each pyrin node, 0 for the other states",
+}, []string{"node", "state"})
+
+var unknownMethodCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "py_unknown_method_counter",
+	Help: "Number of stratum messages received for methods the bridge doesn't handle, by method",
+}, []string{"method"})
+
+var queueDepthGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "py_queue_depth_gauge",
+	Help: "Gauge representing the number of items waiting in each internal queue, a queue that keeps growing means the bridge is falling behind",
+}, []string{"queue"})
+
+// bound once, these are updated on hot paths
+var (
+	templateNotifyQueueGauge = queueDepthGauge.WithLabelValues("template_notifications")
+	jobBroadcastQueueGauge   = queueDepthGauge.WithLabelValues("job_broadcast")
+	submitQueueGauge         = queueDepthGauge.WithLabelValues("block_submits")
+	shareSinkQueueGauge      = queueDepthGauge.WithLabelValues("share_sink")
+	validationQueueGauge     = queueDepthGauge.WithLabelValues("share_validation")
+)
+
+var rejectedConnectionCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "py_rejected_connection_counter",
+	Help: "Number of clients rejected at authorize (connection limit, maintenance, wallet not allowed), by reason",
+}, []string{"reason"})
+
+var oversizedMessageCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "py_oversized_message_counter",
+	Help: "Number of clients disconnected for sending a stratum message above the max message size",
+})
+
+var nodeStallGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "py_node_block_count_stalled_seconds_gauge",
+	Help: "Gauge representing the seconds since each pyrin node's block count last advanced",
+}, []string{"node"})
+
+var nodeQuarantinedGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "py_node_quarantined_gauge",
+	Help: "Gauge set to 1 while a pyrin node is quarantined from templates after other nodes kept rejecting blocks built on them",
+}, []string{"node"})
+
+var nodeSyncedGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "py_node_synced_gauge",
+	Help: "Gauge representing whether each pyrin node last reported being synced (1) or not (0)",
+}, []string{"node"})
+
+// per listen port series, for checking miners pick the port (and so the
+// difficulty) suited to them. Sum over port for the aggregate
+var connectionsByPort = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "py_connections_by_port_gauge",
+	Help: "Gauge representing the current number of connections by stratum listen port",
+}, []string{"port"})
+
+var sharesByPortCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "py_valid_share_by_port_counter",
+	Help: "Number of valid shares found by stratum listen port over time",
+}, []string{"port"})
+
+var shareDiffByPortCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "py_valid_share_diff_by_port_counter",
+	Help: "Total difficulty of shares found by stratum listen port over time",
+}, []string{"port"})
+
+var connectionsByOrigin = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "py_connections_by_origin_gauge",
+	Help: "Gauge representing the current number of connections by origin label",
+}, []string{"origin"})
+
+var buildInfoGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "py_build_info_gauge",
+	Help: "Always 1, labeled with the bridge version and the go version it was built with",
+}, []string{"version", "go_version"})
+
+// a single series, reset whenever the tip moves
+var templateTipGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "py_template_tip_gauge",
+	Help: "Always 1, labeled with the tip (first direct parent) hash the latest block template is built on and the node it came from",
+}, []string{"tip", "node"})
+
+var startTimeGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "py_bridge_start_timestamp_gauge",
+	Help: "Gauge representing the unix time the bridge process started, time() minus this is the uptime",
+})
+
+var connectionsByMinerApp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "py_connections_by_miner_app_gauge",
+	Help: "Gauge representing the current number of mining connections by miner software/version",
+}, []string{"miner"})
+
 func commonLabels(worker *gostratum.StratumContext) prometheus.Labels {
 	return prometheus.Labels{
 		"worker": worker.WorkerName,
@@ -87,55 +568,691 @@ func commonLabels(worker *gostratum.StratumContext) prometheus.Labels {
 }
 
 func RecordShareFound(worker *gostratum.StratumContext, shareDiff float64) {
-	shareCounter.With(commonLabels(worker)).Inc()
-	shareDiffCounter.With(commonLabels(worker)).Add(shareDiff)
+	if labels, shares, diff, ok := workerShare(worker, shareDiff); ok {
+		shareCounter.With(labels).Add(float64(shares))
+		shareDiffCounter.With(labels).Add(diff)
+		lastShareGauge.With(labels).SetToCurrentTime()
+	}
+	portLabels := prometheus.Labels{"port": worker.ListenPort}
+	sharesByPortCounter.With(portLabels).Inc()
+	shareDiffByPortCounter.With(portLabels).Add(shareDiff)
+	totalShareCounter.Inc()
+	updateSharesPerBlock(totalShares.Inc(), totalBlocks.Load())
+	addExpectedBlocks(shareDiff)
+	addRoundShare(shareDiff)
+}
+
+func RecordShareDifficulty(diff float64) {
+	shareDifficultyHistogram.Observe(diff)
+}
+
+func RecordTimeToFirstShare(wait time.Duration) {
+	timeToFirstShareHistogram.Observe(wait.Seconds())
+}
+
+func RecordWorkerHashrate(worker *gostratum.StratumContext, rate float64) {
+	if labels, ok := workerSeriesLabels(worker); ok {
+		workerHashrateGauge.With(labels).Set(rate)
+	}
+}
+
+func RecordReportedHashrate(worker *gostratum.StratumContext, rate float64) {
+	if labels, ok := workerSeriesLabels(worker); ok {
+		reportedHashrateGauge.With(labels).Set(rate)
+	}
+}
+
+// RemoveWorkerHashrate drops the hashrate, difficulty and drift series of a
+// disconnected worker
+func RemoveWorkerHashrate(worker *gostratum.StratumContext) {
+	workerHashrateGauge.Delete(commonLabels(worker))
+	reportedHashrateGauge.Delete(commonLabels(worker))
+	difficultyDriftGauge.Delete(commonLabels(worker))
+	workerDifficultyGauge.Delete(commonLabels(worker))
+}
+
+// RemoveWorkerLastShare drops the last share series for a worker that has
+// gone away, keeps the cardinality of the gauge bounded to active workers
+func RemoveWorkerLastShare(worker *gostratum.StratumContext) {
+	lastShareGauge.Delete(commonLabels(worker))
 }
 
 func RecordStaleShare(worker *gostratum.StratumContext) {
-	labels := commonLabels(worker)
-	labels["type"] = "stale"
-	invalidCounter.With(labels).Inc()
+	recordInvalidType(worker, "stale")
 }
 
 func RecordDupeShare(worker *gostratum.StratumContext) {
-	labels := commonLabels(worker)
-	labels["type"] = "duplicate"
-	invalidCounter.With(labels).Inc()
+	recordInvalidType(worker, "duplicate")
 }
 
 func RecordInvalidShare(worker *gostratum.StratumContext) {
-	labels := commonLabels(worker)
-	labels["type"] = "invalid"
-	invalidCounter.With(labels).Inc()
+	recordInvalidType(worker, "invalid")
 }
 
 func RecordWeakShare(worker *gostratum.StratumContext) {
-	labels := commonLabels(worker)
-	labels["type"] = "weak"
-	invalidCounter.With(labels).Inc()
+	recordInvalidType(worker, "weak")
+}
+
+func recordInvalidType(worker *gostratum.StratumContext, errorType string) {
+	if labels, ok := workerSeriesLabels(worker); ok {
+		labels["type"] = errorType
+		invalidCounter.With(labels).Inc()
+	}
+}
+
+func RecordThrottledShare(worker *gostratum.StratumContext) {
+	if labels, ok := workerSeriesLabels(worker); ok {
+		throttledShareCounter.With(labels).Inc()
+	}
+}
+
+func RecordInvalidShareDisconnect(worker *gostratum.StratumContext) {
+	if labels, ok := workerSeriesLabels(worker); ok {
+		invalidShareDisconnectCounter.With(labels).Inc()
+	}
+}
+
+func RecordStuckJobWorker(worker *gostratum.StratumContext) {
+	if labels, ok := workerSeriesLabels(worker); ok {
+		stuckJobWorkerCounter.With(labels).Inc()
+	}
+}
+
+func RecordStuckJobDisconnect(worker *gostratum.StratumContext) {
+	if labels, ok := workerSeriesLabels(worker); ok {
+		stuckJobDisconnectCounter.With(labels).Inc()
+	}
 }
 
 func RecordBlockFound(worker *gostratum.StratumContext, nonce, bluescore uint64, hash string) {
-	blockCounter.With(commonLabels(worker)).Inc()
+	// a worker finding a block is worth its series whatever its share count
+	blockCounter.With(publishWorker(worker, true)).Inc()
 	labels := commonLabels(worker)
 	labels["nonce"] = fmt.Sprintf("%d", nonce)
 	labels["bluescore"] = fmt.Sprintf("%d", bluescore)
-	labels["hash"] = fmt.Sprintf("%d", hash)
+	labels["hash"] = hash
 	blockGauge.With(labels).Set(1)
+	totalBlockCounter.Inc()
+	lastBlockGauge.SetToCurrentTime()
+	updateSharesPerBlock(totalShares.Load(), totalBlocks.Inc())
+	updateLuck()
+	resetRound()
+}
+
+// running totals backing the shares per block ratio, prom counters can't be
+// read back
+var totalShares, totalBlocks atomic.Uint64
+
+func updateSharesPerBlock(shares, blocks uint64) {
+	if blocks > 0 {
+		sharesPerBlockGauge.Set(float64(shares) / float64(blocks))
+	}
+}
+
+// share difficulty of the current round, the work since the last block
+var (
+	roundLock      sync.Mutex
+	roundShareDiff float64
+)
+
+func addRoundShare(shareDiff float64) {
+	roundLock.Lock()
+	defer roundLock.Unlock()
+	roundShareDiff += shareDiff
+	roundShareDiffGauge.Set(roundShareDiff)
+}
+
+func resetRound() {
+	roundLock.Lock()
+	defer roundLock.Unlock()
+	roundShareDiff = 0
+	roundShareDiffGauge.Set(0)
+}
+
+// luck accounting, the expected blocks are accumulated per share as the
+// network difficulty changes over the period
+var (
+	luckLock        sync.Mutex
+	expectedBlocks  float64
+	luckNetworkDiff float64 // last known, kept across stats failovers
+)
+
+// shareExpectedBlocks returns the blocks a share is expected to find. A
+// share of hashValue (GH, see DiffToHash) stands for hashValue*1e9 hashes,
+// and at network difficulty d (PowMax/target, PowMax being 2^255) a hash
+// finds a block with probability 1/(2*d)
+func shareExpectedBlocks(hashValue, networkDiff float64) float64 {
+	if networkDiff <= 0 {
+		return 0
+	}
+	return hashValue * 1e9 / (2 * networkDiff)
+}
+
+func addExpectedBlocks(hashValue float64) {
+	luckLock.Lock()
+	defer luckLock.Unlock()
+	expectedBlocks += shareExpectedBlocks(hashValue, luckNetworkDiff)
+	expectedBlocksGauge.Set(expectedBlocks)
+	setLuckLocked()
+}
+
+func updateLuck() {
+	luckLock.Lock()
+	defer luckLock.Unlock()
+	setLuckLocked()
+}
+
+func setLuckLocked() {
+	if expectedBlocks > 0 {
+		blockLuckGauge.Set(float64(totalBlocks.Load()) / expectedBlocks)
+	}
+}
+
+func setLuckNetworkDifficulty(difficulty float64) {
+	if difficulty <= 0 {
+		return
+	}
+	luckLock.Lock()
+	defer luckLock.Unlock()
+	luckNetworkDiff = difficulty
+}
+
+// processStart is taken when the package loads, so the start timestamp is
+// the same however late (or often) it's published
+var processStart = time.Now()
+
+func RecordBuildInfo(version string) {
+	buildInfoGauge.With(prometheus.Labels{"version": version, "go_version": runtime.Version()}).Set(1)
+	startTimeGauge.Set(float64(processStart.Unix()))
+}
+
+func RecordTargetSharesPerBlock(target float64) {
+	targetSharesPerBlockGauge.Set(target)
 }
 
 func RecordDisconnect(worker *gostratum.StratumContext) {
-	disconnectCounter.With(commonLabels(worker)).Inc()
+	if labels, ok := workerSeriesLabels(worker); ok {
+		disconnectCounter.With(labels).Inc()
+	}
+}
+
+func RecordBandwidth(worker *gostratum.StratumContext, read, written int64) {
+	if labels, ok := workerSeriesLabels(worker); ok {
+		bytesReadCounter.With(labels).Add(float64(read))
+		bytesWrittenCounter.With(labels).Add(float64(written))
+	}
+	totalBytesReadCounter.Add(float64(read))
+	totalBytesWrittenCounter.Add(float64(written))
 }
 
 func RecordNewJob(worker *gostratum.StratumContext) {
-	jobCounter.With(commonLabels(worker)).Inc()
+	if labels, ok := workerSeriesLabels(worker); ok {
+		jobCounter.With(labels).Inc()
+	}
+}
+
+func RecordCoalescedJob(worker *gostratum.StratumContext) {
+	if labels, ok := workerSeriesLabels(worker); ok {
+		coalescedJobCounter.With(labels).Inc()
+	}
+}
+
+var networkStatsLock sync.Mutex
+var networkStatsNode string
+
+// RecordNetworkStats publishes the network stats labelled by the node they
+// were queried from. Only the latest node's series is kept, so after a
+// failover dashboards never show the old node's values next to the new ones
+func RecordNetworkStats(node string, hashrate uint64, blockCount uint64, difficulty float64) {
+	networkStatsLock.Lock()
+	defer networkStatsLock.Unlock()
+	if node != networkStatsNode {
+		resetNetworkStats()
+		networkStatsNode = node
+	}
+	labels := prometheus.Labels{"node": node}
+	estimatedNetworkHashrate.With(labels).Set(float64(hashrate))
+	networkDifficulty.With(labels).Set(difficulty)
+	networkBlockCount.With(labels).Set(float64(blockCount))
+	setLuckNetworkDifficulty(difficulty)
+	setNetworkDifficulty(difficulty)
+}
+
+// ResetNetworkStatsFrom drops the network stats if they were last queried
+// from node, leaving them missing until the next refresh rather than stale.
+// Stats from any other node (e.g. the stats node) are left alone
+func ResetNetworkStatsFrom(node string) {
+	networkStatsLock.Lock()
+	defer networkStatsLock.Unlock()
+	if node == networkStatsNode {
+		resetNetworkStats()
+		networkStatsNode = ""
+	}
+}
+
+func resetNetworkStats() {
+	estimatedNetworkHashrate.Reset()
+	networkDifficulty.Reset()
+	networkBlockCount.Reset()
+}
+
+func RecordConnectionOrigin(origin string, delta float64) {
+	connectionsByOrigin.With(prometheus.Labels{
+		"origin": origin,
+	}).Add(delta)
+}
+
+func RecordPortConnection(port string, delta float64) {
+	connectionsByPort.With(prometheus.Labels{
+		"port": port,
+	}).Add(delta)
+}
+
+func RecordNodeDraining(node string, draining bool) {
+	value := 0.0
+	if draining {
+		value = 1
+	}
+	nodeDrainingGauge.With(prometheus.Labels{"node": node}).Set(value)
+}
+
+func RecordMaintenance(enabled bool) {
+	value := 0.0
+	if enabled {
+		value = 1
+	}
+	maintenanceGauge.Set(value)
+}
+
+func RecordNodeState(node string, current NodeState) {
+	for _, state := range nodeStates {
+		value := 0.0
+		if state == current {
+			value = 1
+		}
+		nodeStateGauge.With(prometheus.Labels{"node": node, "state": string(state)}).Set(value)
+	}
+}
+
+// method names come straight from clients, so only the first
+// maxUnknownMethodLabels distinct (and reasonably sized) names get their own
+// series, anything else is counted as "other"
+const maxUnknownMethodLabels = 32
+const maxUnknownMethodLength = 64
+
+var unknownMethodLock sync.Mutex
+var unknownMethodLabels = map[string]struct{}{}
+
+// miner apps are reported by clients as well, same bounding as methods
+const maxMinerAppLabels = 64
+const maxMinerAppLength = 64
+
+var minerAppLock sync.Mutex
+var minerAppLabels = map[string]struct{}{}
+
+// minerAppLabel returns the label a client's miner app is reported under,
+// anything but printable ascii replaced and truncated. Past the first
+// maxMinerAppLabels distinct apps everything else is "other"
+func minerAppLabel(app string) string {
+	label := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(app))
+	if len(label) > maxMinerAppLength {
+		label = label[:maxMinerAppLength]
+	}
+	if label == "" {
+		label = "unknown"
+	}
+	minerAppLock.Lock()
+	defer minerAppLock.Unlock()
+	if _, exists := minerAppLabels[label]; !exists {
+		if len(minerAppLabels) >= maxMinerAppLabels {
+			return "other"
+		}
+		minerAppLabels[label] = struct{}{}
+	}
+	return label
+}
+
+func RecordMinerApp(label string, delta float64) {
+	connectionsByMinerApp.With(prometheus.Labels{"miner": label}).Add(delta)
+}
+
+// RecordTemplateNotifyQueue tracks the template notification from the node
+// waiting for the template listener to pick it up, at most one
+func RecordTemplateNotifyQueue(delta float64) {
+	templateNotifyQueueGauge.Add(delta)
 }
 
-func RecordNetworkStats(hashrate uint64, blockCount uint64, difficulty float64) {
-	estimatedNetworkHashrate.Set(float64(hashrate))
-	networkDifficulty.Set(difficulty)
-	networkBlockCount.Set(float64(blockCount))
+// RecordJobBroadcastQueue tracks clients a job is still being sent to
+func RecordJobBroadcastQueue(delta float64) {
+	jobBroadcastQueueGauge.Add(delta)
+}
+
+// RecordSubmitQueue tracks block candidates waiting for a free submit slot
+func RecordSubmitQueue(delta float64) {
+	submitQueueGauge.Add(delta)
+}
+
+func RecordShareSinkQueue(depth int) {
+	shareSinkQueueGauge.Set(float64(depth))
+}
+
+// RecordShareValidationQueue tracks shares waiting for a validation worker
+func RecordShareValidationQueue(delta float64) {
+	validationQueueGauge.Add(delta)
+}
+
+func RecordRejectedConnection(reason string) {
+	rejectedConnectionCounter.With(prometheus.Labels{"reason": reason}).Inc()
+}
+
+func RecordOversizedMessage() {
+	oversizedMessageCounter.Inc()
+}
+
+func RecordNodeSynced(node string, synced bool) {
+	value := 0.0
+	if synced {
+		value = 1
+	}
+	nodeSyncedGauge.With(prometheus.Labels{"node": node}).Set(value)
+}
+
+func RecordNodeQuarantined(node string, quarantined bool) {
+	value := 0.0
+	if quarantined {
+		value = 1
+	}
+	nodeQuarantinedGauge.With(prometheus.Labels{"node": node}).Set(value)
+}
+
+func RecordNodeStall(node string, stalled time.Duration) {
+	nodeStallGauge.With(prometheus.Labels{"node": node}).Set(stalled.Seconds())
+}
+
+func RecordUnknownMethod(method string) {
+	unknownMethodLock.Lock()
+	if _, exists := unknownMethodLabels[method]; !exists {
+		if len(unknownMethodLabels) < maxUnknownMethodLabels && len(method) <= maxUnknownMethodLength {
+			unknownMethodLabels[method] = struct{}{}
+		} else {
+			method = "other"
+		}
+	}
+	unknownMethodLock.Unlock()
+	unknownMethodCounter.With(prometheus.Labels{"method": method}).Inc()
+}
+
+var templateTipLock sync.Mutex
+var templateTip, templateTipNode string
+
+// RecordTemplateTip publishes the tip the template was built on. Templates
+// are fetched per client, the series is only replaced when the tip or node
+// changes
+func RecordTemplateTip(template *appmessage.RPCBlock, node string) {
+	tip := ""
+	if template.Header != nil && len(template.Header.Parents) > 0 && len(template.Header.Parents[0].ParentHashes) > 0 {
+		tip = template.Header.Parents[0].ParentHashes[0]
+	}
+	templateTipLock.Lock()
+	defer templateTipLock.Unlock()
+	if tip == templateTip && node == templateTipNode {
+		return
+	}
+	templateTip, templateTipNode = tip, node
+	templateTipGauge.Reset()
+	templateTipGauge.With(prometheus.Labels{"tip": tip, "node": node}).Set(1)
+}
+
+func RecordTemplateTransactions(count int) {
+	templateTxGauge.Set(float64(count))
+}
+
+// RecordTemplateReward records the coinbase payout of the template and
+// returns it in sompi. Template inputs don't carry amounts so fees can't be
+// summed per transaction, the coinbase is the only place they show up
+func RecordTemplateReward(block *appmessage.RPCBlock) uint64 {
+	reward := coinbaseReward(block)
+	templateRewardGauge.Set(float64(reward) / 100000000)
+	return reward
+}
+
+func RecordDuplicateTemplate() {
+	duplicateTemplateCounter.Inc()
+}
+
+func RecordStaleTemplate() {
+	staleTemplateCounter.Inc()
+}
+
+func RecordInflightSubmit(delta float64) {
+	inflightSubmitGauge.Add(delta)
+}
+
+func RecordShareValidation(duration time.Duration) {
+	shareValidationHistogram.Observe(duration.Seconds())
+}
+
+// RecordVardiffRetarget records a difficulty change sent to a miner by vardiff
+func RecordVardiffRetarget(oldDiff, newDiff float64) {
+	if oldDiff <= 0 {
+		return
+	}
+	direction := "up"
+	if newDiff < oldDiff {
+		direction = "down"
+	}
+	vardiffRetargetCounter.WithLabelValues(direction).Inc()
+	vardiffRatioHistogram.Observe(newDiff / oldDiff)
+}
+
+func RecordVardiffSuppressed() {
+	vardiffSuppressedCounter.Inc()
+}
+
+func RecordSubmitNodeResult(node, result string) {
+	submitNodeResultCounter.With(prometheus.Labels{"node": node, "result": result}).Inc()
+}
+
+func RecordDesyncShare(outcome string) {
+	desyncShareCounter.With(prometheus.Labels{"outcome": outcome}).Inc()
+}
+
+func RecordIdleRefreshSkipped() {
+	idleRefreshSkippedCounter.Inc()
+}
+
+func RecordUnchangedTipsNotification() {
+	unchangedTipsCounter.Inc()
+}
+
+func RecordTemplateCacheMiss() {
+	templateCacheMissCounter.Inc()
+}
+
+func RecordBlockRejected(worker *gostratum.StratumContext, rejection string) {
+	// like a found block, worth the worker's series whatever its share count
+	blockRejectedCounter.With(withLabel(publishWorker(worker, false), "rejection", rejection)).Inc()
+}
+
+func RecordWorkerDifficulty(worker *gostratum.StratumContext, diff float64) {
+	if labels, ok := workerSeriesLabels(worker); ok {
+		workerDifficultyGauge.With(labels).Set(diff)
+	}
+}
+
+func RecordNodeActive(node string, active bool) {
+	value := 0.0
+	if active {
+		value = 1
+	}
+	nodeActiveGauge.With(prometheus.Labels{"node": node}).Set(value)
+}
+
+func RecordDifficultyDrift(worker *gostratum.StratumContext, drift float64) {
+	difficultyDriftHistogram.Observe(drift)
+	if labels, ok := workerSeriesLabels(worker); ok {
+		difficultyDriftGauge.With(labels).Set(drift)
+	}
+}
+
+func RecordTrackingEvicted(tracking string) {
+	trackingEvictedCounter.With(prometheus.Labels{"tracking": tracking}).Inc()
+}
+
+func RecordBlockLostRace(node string) {
+	blockLostRaceCounter.With(prometheus.Labels{"node": node}).Inc()
+}
+
+func RecordStatsThreadAlive(alive bool) {
+	value := 0.0
+	if alive {
+		value = 1
+	}
+	statsThreadAliveGauge.Set(value)
+}
+
+func RecordStatsThreadRestart() {
+	statsThreadRestartCounter.Inc()
+}
+
+func RecordStatsUpdated() {
+	statsUpdatedGauge.SetToCurrentTime()
+}
+
+func RecordNetworkUnstable(unstable bool) {
+	value := 0.0
+	if unstable {
+		value = 1
+	}
+	networkUnstableGauge.Set(value)
+}
+
+func RecordCachedTemplate() {
+	cachedTemplateCounter.Inc()
+}
+
+func RecordClientLatency(origin string, rtt time.Duration) {
+	clientLatencyHistogram.With(prometheus.Labels{"origin": origin}).Observe(rtt.Seconds())
+}
+
+func RecordNodeRpcErrorRate(node, method string, rate float64) {
+	nodeRpcErrorRateGauge.With(prometheus.Labels{"node": node, "method": method}).Set(rate)
+}
+
+func RecordWriteTimeout() {
+	writeTimeoutCounter.Inc()
+}
+
+func RecordNodeTipAgreement(node string, agrees bool) {
+	value := 0.0
+	if agrees {
+		value = 1
+	}
+	nodeTipAgreementGauge.With(prometheus.Labels{"node": node}).Set(value)
+}
+
+func RecordMalformedSubmit(reason string) {
+	malformedSubmitCounter.With(prometheus.Labels{"reason": reason}).Inc()
+}
+
+func RecordNodeRefresh(node string, refreshed bool) {
+	result := "refreshed"
+	if !refreshed {
+		result = "failed"
+	}
+	nodeRefreshCounter.With(prometheus.Labels{"node": node, "result": result}).Inc()
+}
+
+func RecordUnknownJob() {
+	unknownJobCounter.Inc()
+}
+
+func RecordCoalescedNotification() {
+	coalescedNotificationCounter.Inc()
+}
+
+func RecordNodePeers(node string, peers int) {
+	nodePeersGauge.With(prometheus.Labels{"node": node}).Set(float64(peers))
+}
+
+func RecordNonceBucket(worker *gostratum.StratumContext, bucket int) {
+	if labels, ok := workerSeriesLabels(worker); ok {
+		nonceBucketCounter.With(withLabel(labels, "bucket", nonceBuckets[bucket])).Inc()
+	}
+}
+
+func RecordWorkerReconnects(worker *gostratum.StratumContext, reconnects int) {
+	if labels, ok := workerSeriesLabels(worker); ok {
+		workerReconnectsGauge.With(labels).Set(float64(reconnects))
+	}
+}
+
+func RecordTraceDrop() {
+	traceDropCounter.Inc()
+}
+
+func RecordConnectionAccept(accepted bool) {
+	result := "accepted"
+	if !accepted {
+		result = "dropped"
+	}
+	connectionAcceptCounter.With(prometheus.Labels{"result": result}).Inc()
+}
+
+func RecordTemplateUnsynced(node string) {
+	templateUnsyncedCounter.With(prometheus.Labels{"node": node}).Inc()
+}
+
+func RecordTemplateDifficultyRatio(ratio float64) {
+	templateDifficultyRatioGauge.Set(ratio)
+}
+
+func RecordDifficultyMismatch() {
+	difficultyMismatchCounter.Inc()
+}
+
+func RecordStaleShareRate(rate float64) {
+	staleShareRateGauge.Set(rate)
+}
+
+func RecordSharedTemplateFetch() {
+	sharedTemplateFetchCounter.Inc()
+}
+
+func RecordExtranonceExhausted() {
+	extranonceExhaustedCounter.Inc()
+}
+
+func RecordKeepaliveJob() {
+	keepaliveJobCounter.Inc()
+}
+
+// RecordBlockCandidate counts a share that meets the network target, before
+// it's submitted. Compared with py_total_block_counter it shows blocks lost
+// between the miner finding them and a node taking them
+func RecordBlockCandidate() {
+	blockCandidateCounter.Inc()
+}
+
+func RecordBlockSubmit(node string, duration time.Duration) {
+	blockSubmitHistogram.With(prometheus.Labels{"node": node}).Observe(duration.Seconds())
+}
+
+func RecordRetainedJobs(delta float64) {
+	retainedJobsGauge.Add(delta)
+}
+
+func RecordJobBroadcast(duration time.Duration) {
+	jobBroadcastHistogram.Observe(duration.Seconds())
+}
+
+func RecordShareSinkDrop() {
+	shareSinkDropCounter.Inc()
 }
 
 func RecordWorkerError(address string, shortError ErrorShortCodeT) {
@@ -145,21 +1262,29 @@ func RecordWorkerError(address string, shortError ErrorShortCodeT) {
 	}).Inc()
 }
 
+var invalidShareTypes = []string{"stale", "duplicate", "invalid", "weak"}
+
+var nonceBuckets = []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9", "a", "b", "c", "d", "e", "f"}
+
 func InitInvalidCounter(worker *gostratum.StratumContext, errorType string) {
-	labels := commonLabels(worker)
-	labels["type"] = errorType
-	invalidCounter.With(labels).Add(0)
+	if labels, ok := workerSeriesLabels(worker); ok {
+		labels["type"] = errorType
+		invalidCounter.With(labels).Add(0)
+	}
 }
 
 func InitWorkerCounters(worker *gostratum.StratumContext) {
-	labels := commonLabels(worker)
+	if labels, ok := workerSeriesLabels(worker); ok {
+		initWorkerSeries(labels)
+	}
+}
 
+func initWorkerSeries(labels prometheus.Labels) {
 	shareCounter.With(labels).Add(0)
 	shareDiffCounter.With(labels).Add(0)
 
-	errTypes := []string{"stale", "duplicate", "invalid", "weak"}
-	for _, e := range errTypes {
-		InitInvalidCounter(worker, e)
+	for _, e := range invalidShareTypes {
+		invalidCounter.With(withLabel(labels, "type", e)).Add(0)
 	}
 
 	blockCounter.With(labels).Add(0)
@@ -169,6 +1294,51 @@ func InitWorkerCounters(worker *gostratum.StratumContext) {
 	jobCounter.With(labels).Add(0)
 }
 
+// deleteWorkerSeries drops every per worker series of the worker. The series
+// per block found are kept, and so is the block counter of a worker that
+// found one (foundBlock): blocks are rare enough that keeping who found them
+// costs next to nothing
+func deleteWorkerSeries(labels prometheus.Labels, foundBlock bool) {
+	for _, vec := range []*prometheus.MetricVec{
+		shareCounter.MetricVec, shareDiffCounter.MetricVec, throttledShareCounter.MetricVec,
+		invalidShareDisconnectCounter.MetricVec, stuckJobWorkerCounter.MetricVec,
+		stuckJobDisconnectCounter.MetricVec, lastShareGauge.MetricVec,
+		workerHashrateGauge.MetricVec, reportedHashrateGauge.MetricVec, disconnectCounter.MetricVec,
+		bytesReadCounter.MetricVec, bytesWrittenCounter.MetricVec, jobCounter.MetricVec,
+		coalescedJobCounter.MetricVec, workerReconnectsGauge.MetricVec, difficultyDriftGauge.MetricVec,
+		workerDifficultyGauge.MetricVec,
+	} {
+		vec.Delete(labels)
+	}
+	if !foundBlock {
+		blockCounter.Delete(labels)
+	}
+	for _, e := range invalidShareTypes {
+		invalidCounter.Delete(withLabel(labels, "type", e))
+	}
+	for _, bucket := range nonceBuckets {
+		nonceBucketCounter.Delete(withLabel(labels, "bucket", bucket))
+	}
+	for _, rejection := range blockRejections {
+		blockRejectedCounter.Delete(withLabel(labels, "rejection", rejection))
+	}
+}
+
+// withLabel returns a copy of labels with the extra label added
+func withLabel(labels prometheus.Labels, name, value string) prometheus.Labels {
+	extended := copyLabels(labels)
+	extended[name] = value
+	return extended
+}
+
+func copyLabels(labels prometheus.Labels) prometheus.Labels {
+	copied := make(prometheus.Labels, len(labels)+1)
+	for k, v := range labels {
+		copied[k] = v
+	}
+	return copied
+}
+
 func RecordBalances(response *appmessage.GetBalancesByAddressesResponseMessage) {
 	unique := map[string]struct{}{}
 	for _, v := range response.Entries {
@@ -1,10 +1,17 @@
 package pyrinstratum
 
 import (
+	"context"
+	"fmt"
+	"math"
 	"testing"
+	"time"
 
 	"github.com/pyrin-network/pyipad/app/appmessage"
 	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
 )
 
 func TestPromValid(t *testing.T) {
@@ -12,16 +19,110 @@ func TestPromValid(t *testing.T) {
 	// is valid to write to here
 	ctx := gostratum.StratumContext{}
 
-	RecordShareFound(&ctx)
+	RecordShareFound(&ctx, 1)
+	RecordShareDifficulty(64)
 	RecordStaleShare(&ctx)
 	RecordDupeShare(&ctx)
 	RecordInvalidShare(&ctx)
 	RecordWeakShare(&ctx)
+	RecordThrottledShare(&ctx)
+	RecordInvalidShareDisconnect(&ctx)
+	RecordStuckJobWorker(&ctx)
+	RecordStuckJobDisconnect(&ctx)
 	RecordBlockFound(&ctx, 10000, 12345, "abcdefg")
 	RecordDisconnect(&ctx)
 	RecordNewJob(&ctx)
-	RecordNetworkStats(1234, 5678, 910)
+	RecordCoalescedJob(&ctx)
+	RecordTimeToFirstShare(time.Second)
+	RecordMaintenance(true)
+	RecordBlockCandidate()
+	RecordKeepaliveJob()
+	RecordExtranonceExhausted()
+	RecordSharedTemplateFetch()
+	RecordStaleShareRate(0.02)
+	RecordTemplateDifficultyRatio(1)
+	RecordTemplateUnsynced("localhost:16110")
+	RecordDifficultyMismatch()
+	RecordConnectionAccept(true)
+	RecordConnectionAccept(false)
+	RecordTraceDrop()
+	RecordWorkerReconnects(&ctx, 3)
+	RecordRejectedConnection("flapping")
+	RecordNonceBucket(&ctx, 0xa)
+	RecordNodePeers("localhost", 8)
+	RecordCoalescedNotification()
+	RecordUnknownJob()
+	RecordNodeRefresh("localhost", true)
+	RecordMalformedSubmit("nonce_length")
+	RecordNodeTipAgreement("localhost", true)
+	RecordWriteTimeout()
+	RecordNodeRpcErrorRate("localhost", "GetBlockTemplate", 0.5)
+	RecordClientLatency(unknownOrigin, 40*time.Millisecond)
+	RecordCachedTemplate()
+	RecordNetworkUnstable(true)
+	RecordStatsThreadAlive(true)
+	RecordStatsThreadRestart()
+	RecordStatsUpdated()
+	RecordBlockLostRace("localhost")
+	RecordTrackingEvicted(trackedWorkerStats)
+	RecordDifficultyDrift(&ctx, 1.2)
+	RecordNodeActive("localhost", true)
+	RecordWorkerDifficulty(&ctx, 64)
+	RecordBlockRejected(&ctx, blockRejectedInvalid)
+	RecordTemplateCacheMiss()
+	RecordIdleRefreshSkipped()
+	RecordUnchangedTipsNotification()
+	RecordDesyncShare(desyncRejected)
+	RecordBandwidth(&ctx, 100, 200)
+	RecordNetworkStats("localhost:16110", 1234, 5678, 910)
+	ResetNetworkStatsFrom("localhost:16110")
+	RecordNodeSynced("localhost", false)
+	RecordNodeQuarantined("localhost", false)
+	RecordBuildInfo(version)
 	RecordWorkerError("localhost", ErrDisconnected)
+	RecordConnectionOrigin(unknownOrigin, 1)
+	RecordPortConnection(":5555", 1)
+	RecordWorkerHashrate(&ctx, 120)
+	RecordReportedHashrate(&ctx, 125)
+	RemoveWorkerHashrate(&ctx)
+	RemoveWorkerLastShare(&ctx)
+	RecordStaleTemplate()
+	RecordDuplicateTemplate()
+	RecordRejectedConnection("wallet_limit")
+	RecordRejectedConnection("wallet_denied")
+	RecordTemplateNotifyQueue(1)
+	RecordJobBroadcastQueue(1)
+	RecordSubmitQueue(1)
+	RecordShareSinkQueue(10)
+	RecordShareValidationQueue(1)
+	RecordBlockSubmit("localhost:13110", time.Millisecond)
+	RecordSubmitNodeResult("localhost:13110", submitAccepted)
+	RecordVardiffRetarget(64, 128)
+	RecordVardiffSuppressed()
+	RecordVardiffRetarget(64, 32)
+	RecordOversizedMessage()
+	RecordMinerApp(minerAppLabel("lolMiner 1.82"), 1)
+	RecordTemplateTransactions(12)
+	coinbase := &appmessage.RPCTransaction{
+		SubnetworkID: coinbaseSubnetworkID,
+		Outputs:      []*appmessage.RPCTransactionOutput{{Amount: 5000000000}, {Amount: 12345}},
+	}
+	if reward := RecordTemplateReward(&appmessage.RPCBlock{Transactions: []*appmessage.RPCTransaction{coinbase}}); reward != 5000012345 {
+		t.Fatalf("expected coinbase reward of 5000012345 sompi, got %d", reward)
+	}
+	if reward := RecordTemplateReward(&appmessage.RPCBlock{}); reward != 0 {
+		t.Fatalf("expected no reward without a coinbase, got %d", reward)
+	}
+	RecordInflightSubmit(1)
+	RecordRetainedJobs(1)
+	RecordShareValidation(time.Millisecond)
+	RecordJobBroadcast(time.Second)
+	RecordShareSinkDrop()
+	RecordNodeDraining("localhost:13110", true)
+	RecordNodeState("localhost:13110", NodeDegraded)
+	RecordNodeStall("localhost:13110", time.Minute)
+	RecordTargetSharesPerBlock(1000)
+	RecordUnknownMethod("mining.unknown")
 	RecordBalances(&appmessage.GetBalancesByAddressesResponseMessage{
 		Entries: []*appmessage.BalancesByAddressesEntry{
 			{
@@ -31,3 +132,144 @@ func TestPromValid(t *testing.T) {
 		},
 	})
 }
+
+func TestMinerAppLabel(t *testing.T) {
+	defer func(orig map[string]struct{}) { minerAppLabels = orig }(minerAppLabels)
+	minerAppLabels = map[string]struct{}{}
+
+	if label := minerAppLabel(" BzMiner/v14.0.1 "); label != "BzMiner/v14.0.1" {
+		t.Fatalf("expected app to be kept as is, got %s", label)
+	}
+	if label := minerAppLabel("bad\nmineré"); label != "bad_miner_" {
+		t.Fatalf("expected non printable characters to be replaced, got %s", label)
+	}
+	if label := minerAppLabel(""); label != "unknown" {
+		t.Fatalf("expected empty app to be unknown, got %s", label)
+	}
+	for i := 0; len(minerAppLabels) < maxMinerAppLabels; i++ {
+		minerAppLabel(fmt.Sprintf("miner/%d", i))
+	}
+	if label := minerAppLabel("yet another miner"); label != "other" {
+		t.Fatalf("expected apps past the label limit to be other, got %s", label)
+	}
+	if label := minerAppLabel("BzMiner/v14.0.1"); label != "BzMiner/v14.0.1" {
+		t.Fatalf("expected known app to keep its label, got %s", label)
+	}
+}
+
+func TestTemplateTip(t *testing.T) {
+	RecordTemplateTip(jobWithParents("aa", "bb"), "localhost:13110")
+	RecordTemplateTip(jobWithParents("aa", "bb"), "localhost:13110")
+	RecordTemplateTip(jobWithParents("cc"), "localhost:13110")
+	if series := testutil.CollectAndCount(templateTipGauge); series != 1 {
+		t.Fatalf("expected a single tip series, got %d", series)
+	}
+	if value := testutil.ToFloat64(templateTipGauge.WithLabelValues("cc", "localhost:13110")); value != 1 {
+		t.Fatalf("expected the latest tip to be published, got %f", value)
+	}
+}
+
+// TestShareExpectedBlocks checks the luck accounting against the targets: a
+// share whose stratum target equals the network target is worth one block
+func TestShareExpectedBlocks(t *testing.T) {
+	const stratumDiff = 4096
+	// stratum targets are maxTarget (2^224)/diff, network ones PowMax (2^255)/diff
+	networkDiff := float64(stratumDiff) * (1 << 31)
+	expected := shareExpectedBlocks(DiffToHash(stratumDiff), networkDiff)
+	if math.Abs(expected-1) > 1e-9 {
+		t.Fatalf("expected a share at the network target to be worth 1 block, got %f", expected)
+	}
+	if expected := shareExpectedBlocks(DiffToHash(stratumDiff), 2*networkDiff); math.Abs(expected-0.5) > 1e-9 {
+		t.Fatalf("expected half a block at twice the network difficulty, got %f", expected)
+	}
+	if expected := shareExpectedBlocks(DiffToHash(stratumDiff), 0); expected != 0 {
+		t.Fatalf("expected no blocks without a network difficulty, got %f", expected)
+	}
+}
+
+func TestRoundShareDiff(t *testing.T) {
+	ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	resetRound()
+	RecordShareFound(ctx, 2)
+	RecordShareFound(ctx, 3)
+	if diff := testutil.ToFloat64(roundShareDiffGauge); diff != 5 {
+		t.Fatalf("expected the round's share difficulty summed, got %f", diff)
+	}
+	RecordBlockFound(ctx, 1, 2, "round")
+	if diff := testutil.ToFloat64(roundShareDiffGauge); diff != 0 {
+		t.Fatalf("expected the round reset on a block, got %f", diff)
+	}
+	RecordShareFound(ctx, 4)
+	if diff := testutil.ToFloat64(roundShareDiffGauge); diff != 4 {
+		t.Fatalf("expected a new round counted after the block, got %f", diff)
+	}
+}
+
+// workerSeriesCount returns the number of published series labeled with the
+// worker
+func workerSeriesCount(t *testing.T, worker string) int {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "worker" && label.GetValue() == worker {
+					count++
+				}
+			}
+		}
+	}
+	return count
+}
+
+func TestWorkerMetricPolicy(t *testing.T) {
+	setWorkerMetricPolicy(3, time.Hour)
+	defer setWorkerMetricPolicy(0, 0)
+	ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+
+	InitWorkerCounters(ctx)
+	RecordNewJob(ctx)
+	RecordShareFound(ctx, 2)
+	RecordStaleShare(ctx)
+	RecordShareFound(ctx, 2)
+	if count := workerSeriesCount(t, ctx.WorkerName); count != 0 {
+		t.Fatalf("expected no series below the share threshold, got %d", count)
+	}
+
+	RecordShareFound(ctx, 2)
+	labels := commonLabels(ctx)
+	if shares := testutil.ToFloat64(shareCounter.With(labels)); shares != 3 {
+		t.Fatalf("expected the shares before publishing added, got %f", shares)
+	}
+	if diff := testutil.ToFloat64(shareDiffCounter.With(labels)); diff != 6 {
+		t.Fatalf("expected the share difficulty before publishing added, got %f", diff)
+	}
+	RecordNewJob(ctx)
+	if jobs := testutil.ToFloat64(jobCounter.With(labels)); jobs != 1 {
+		t.Fatalf("expected jobs recorded once published, got %f", jobs)
+	}
+
+	workerMetrics.sweep(time.Now().Add(30 * time.Minute))
+	if count := workerSeriesCount(t, ctx.WorkerName); count == 0 {
+		t.Fatalf("expected the series kept within the ttl")
+	}
+	workerMetrics.sweep(time.Now().Add(2 * time.Hour))
+	if count := workerSeriesCount(t, ctx.WorkerName); count != 0 {
+		t.Fatalf("expected every series dropped after the ttl, %d left", count)
+	}
+
+	// a block publishes the worker right away
+	finder, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	RecordShareFound(finder, 2)
+	RecordBlockFound(finder, 1, 2, "hash")
+	if shares := testutil.ToFloat64(shareCounter.With(commonLabels(finder))); shares != 1 {
+		t.Fatalf("expected the block finder published with its shares, got %f", shares)
+	}
+	workerMetrics.sweep(time.Now().Add(2 * time.Hour))
+	if blocks := testutil.ToFloat64(blockCounter.With(commonLabels(finder))); blocks != 1 {
+		t.Fatalf("expected the found block kept after the ttl, got %f", blocks)
+	}
+}
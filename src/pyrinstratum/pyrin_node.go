@@ -0,0 +1,309 @@
+package pyrinstratum
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pyrin-network/pyipad/infrastructure/network/rpcclient"
+	"go.uber.org/atomic"
+)
+
+// pyrinNode is a single pyrin rpc endpoint the bridge can pull templates from
+// and submit blocks to
+type pyrinNode struct {
+	address  string
+	lock     sync.RWMutex
+	client   rpcClient // nil until a connection has been established
+	draining atomic.Bool
+	state    *nodeStateMachine
+	// set while the node's block count hasn't advanced for the idle timeout
+	idle atomic.Bool
+	// set by the sync monitor while the node reports it isn't synced
+	unsynced atomic.Bool
+	// set by the sync monitor while the node has fewer peers than required
+	isolated atomic.Bool
+	// set while the node's tips disagree with the leading node's, see
+	// checkTips. disjointChecks is only touched by the health check
+	diverged       atomic.Bool
+	disjointChecks int
+	// rpc calls and failures over the current window, the last window's
+	// error rate, and set while that was past the limit, see checkErrorRate
+	rpcErrors rpcErrors
+	errorRate atomic.Float64
+	erroring  atomic.Bool
+	// blocks from the node's templates rejected by the other nodes, see
+	// nodeQuarantine
+	quarantine nodeQuarantine
+	// grace period after a reconnect, see nodeStabilization
+	stabilization nodeStabilization
+	// last block count seen by the health check, and when it last advanced
+	blockCount         uint64
+	blockCountAdvanced time.Time
+	// when the current client was set, see refreshNode
+	connectedAt time.Time
+	// block submits in flight, a refresh waits for them
+	submitting atomic.Int32
+	// the current reconnect backoff wait, and when the next attempt is due,
+	// see backOffReconnect. Only touched by the health check
+	reconnectWait time.Duration
+	nextReconnect time.Time
+}
+
+func (n *pyrinNode) rpc() rpcClient {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.client
+}
+
+// ErrNotConnected is returned for calls to a node without a connection, or on
+// a connection closed by a reconnect or shutdown. Like any transport failure
+// it's retryable, on another node or once the node has reconnected
+var ErrNotConnected = fmt.Errorf("pyrin node not connected")
+
+// connection returns the node's client, ErrNotConnected while it has none
+func (n *pyrinNode) connection() (rpcClient, error) {
+	if client := n.rpc(); client != nil {
+		return client, nil
+	}
+	return nil, errors.Wrap(ErrNotConnected, n.address)
+}
+
+func (n *pyrinNode) setRpc(client rpcClient) {
+	n.lock.Lock()
+	n.client = client
+	if client != nil {
+		n.connectedAt = time.Now()
+	}
+	n.lock.Unlock()
+}
+
+// usable returns true if the node can be used for template sourcing
+func (n *pyrinNode) usable() bool {
+	return n.healthy() && !n.stabilization.active()
+}
+
+// healthy is usable without the check for a node still stabilizing after a
+// reconnect
+func (n *pyrinNode) healthy() bool {
+	return n.reachable() && !n.idle.Load() && !n.unsynced.Load() && !n.isolated.Load() && !n.diverged.Load() &&
+		!n.erroring.Load() && !n.quarantine.active(time.Now())
+}
+
+// reachable is usable without the idle, sync, peer and quarantine checks, a
+// node that's up but not making progress, behind, isolated or quarantined
+func (n *pyrinNode) reachable() bool {
+	return n.rpc() != nil && !n.draining.Load() && n.state.State().usable()
+}
+
+// recordBlockCount tracks the node's block count progression, returning how
+// long it's been since the count last advanced
+func (n *pyrinNode) recordBlockCount(count uint64, now time.Time) time.Duration {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if count != n.blockCount || n.blockCountAdvanced.IsZero() {
+		n.blockCount = count
+		n.blockCountAdvanced = now
+	}
+	return now.Sub(n.blockCountAdvanced)
+}
+
+// recordResult feeds the outcome of a request into the node state, only
+// transport failures count against the node
+func (n *pyrinNode) recordResult(err error) {
+	if err != nil && !errors.Is(err, rpcclient.ErrRPC) {
+		n.state.RequestFailed(err)
+		return
+	}
+	n.state.RequestSucceeded()
+}
+
+type NodeStatus struct {
+	Address     string    `json:"address"`
+	Connected   bool      `json:"connected"`
+	Draining    bool      `json:"draining"`
+	Active      bool      `json:"active"`
+	State       NodeState `json:"state"`
+	Idle        bool      `json:"idle"`
+	Synced      bool      `json:"synced"`
+	Isolated    bool      `json:"isolated"`
+	TipDiverged bool      `json:"tip_diverged"`
+	ErrorRate   float64   `json:"error_rate"`
+	Erroring    bool      `json:"erroring"`
+	Quarantined bool      `json:"quarantined"`
+	Stabilizing bool      `json:"stabilizing"`
+}
+
+var ErrNoNodesAvailable = fmt.Errorf("no pyrin nodes available")
+var ErrUnknownNode = fmt.Errorf("unknown pyrin node")
+
+// activeNode returns the node currently used for template sourcing
+func (py *PyrinApi) activeNode() *pyrinNode {
+	return py.nodes[py.active.Load()]
+}
+
+// templateNode returns the active node if it's usable, otherwise fails over.
+// If every node is idle (or unsynced) the active one keeps serving, stalled
+// templates beat none at all
+func (py *PyrinApi) templateNode() (*pyrinNode, error) {
+	active := py.activeNode()
+	if active.usable() {
+		return active, nil
+	}
+	node, err := py.failover()
+	if err != nil && active.reachable() {
+		return active, nil
+	}
+	return node, err
+}
+
+// failover moves the active node to the next usable node in the list, or
+// without one to a node still stabilizing after a reconnect
+func (py *PyrinApi) failover() (*pyrinNode, error) {
+	if node, err := py.failoverTo((*pyrinNode).usable); err == nil {
+		return node, nil
+	}
+	return py.failoverTo((*pyrinNode).healthy)
+}
+
+func (py *PyrinApi) failoverTo(usable func(*pyrinNode) bool) (*pyrinNode, error) {
+	current := int(py.active.Load())
+	for i := 1; i <= len(py.nodes); i++ {
+		idx := (current + i) % len(py.nodes)
+		if node := py.nodes[idx]; usable(node) {
+			if idx != current {
+				py.logger.Warn(fmt.Sprintf("failing over from pyrin node %s to %s",
+					py.nodes[current].address, node.address))
+				py.active.Store(int32(idx))
+				py.recordActiveNode()
+				// the old node's stats are dropped and refreshed from the new
+				// one rather than left up for up to a stats interval
+				ResetNetworkStatsFrom(py.nodes[current].address)
+				py.refreshStats()
+			}
+			return node, nil
+		}
+	}
+	return nil, ErrNoNodesAvailable
+}
+
+// recordActiveNode publishes which node is the active one
+func (py *PyrinApi) recordActiveNode() {
+	active := py.activeNode()
+	for _, node := range py.nodes {
+		RecordNodeActive(node.address, node == active)
+	}
+}
+
+// failoverFrom fails over away from a node that just failed a request
+func (py *PyrinApi) failoverFrom(failed *pyrinNode) (*pyrinNode, error) {
+	if py.activeNode() != failed {
+		return py.templateNode()
+	}
+	node, err := py.failover()
+	if err != nil {
+		return nil, err
+	}
+	if node == failed {
+		return nil, ErrNoNodesAvailable
+	}
+	return node, nil
+}
+
+// submitOrder returns the nodes in the order blocks should be submitted to
+// them, the node the template came from first (if known), then the active
+// node. Draining nodes are included since they're still perfectly good for
+// propagating a found block, unsynced and isolated nodes are only tried last
+func (py *PyrinApi) submitOrder(sourceNode string) []*pyrinNode {
+	current := int(py.active.Load())
+	order := make([]*pyrinNode, 0, len(py.nodes))
+	if source, err := py.findNode(sourceNode); err == nil {
+		order = append(order, source)
+	}
+	var unsynced []*pyrinNode
+	for i := 0; i < len(py.nodes); i++ {
+		node := py.nodes[(current+i)%len(py.nodes)]
+		if node.address == sourceNode {
+			continue
+		}
+		if node.unsynced.Load() || node.isolated.Load() || node.diverged.Load() || node.erroring.Load() {
+			unsynced = append(unsynced, node)
+		} else {
+			order = append(order, node)
+		}
+	}
+	return append(order, unsynced...)
+}
+
+// NodeSynced returns false if the node last reported it isn't synced, unknown
+// nodes are assumed to be
+func (py *PyrinApi) NodeSynced(address string) bool {
+	node, err := py.findNode(address)
+	return err != nil || !node.unsynced.Load()
+}
+
+// AnyNodeSynced returns true unless every node last reported it isn't synced
+func (py *PyrinApi) AnyNodeSynced() bool {
+	for _, node := range py.nodes {
+		if !node.unsynced.Load() {
+			return true
+		}
+	}
+	return false
+}
+
+func (py *PyrinApi) findNode(address string) (*pyrinNode, error) {
+	for _, node := range py.nodes {
+		if node.address == address {
+			return node, nil
+		}
+	}
+	return nil, ErrUnknownNode
+}
+
+// SetDraining marks a node as draining (or not). Draining nodes are no
+// longer used for new templates but are still used for block submits, so a
+// node can be restarted for maintenance without disruption
+func (py *PyrinApi) SetDraining(address string, draining bool) error {
+	node, err := py.findNode(address)
+	if err != nil {
+		return err
+	}
+	node.draining.Store(draining)
+	RecordNodeDraining(address, draining)
+	if draining {
+		py.logger.Info("draining pyrin node " + address)
+		if py.activeNode() == node {
+			if _, err := py.failover(); err != nil {
+				py.logger.Warn("all pyrin nodes are draining, no templates can be served")
+			}
+		}
+	} else {
+		py.logger.Info("pyrin node " + address + " no longer draining")
+	}
+	return nil
+}
+
+func (py *PyrinApi) NodeStatuses() []NodeStatus {
+	active := py.activeNode()
+	statuses := make([]NodeStatus, 0, len(py.nodes))
+	for _, node := range py.nodes {
+		statuses = append(statuses, NodeStatus{
+			Address:     node.address,
+			Connected:   node.rpc() != nil,
+			Draining:    node.draining.Load(),
+			Active:      node == active,
+			State:       node.state.State(),
+			Idle:        node.idle.Load(),
+			Synced:      !node.unsynced.Load(),
+			Isolated:    node.isolated.Load(),
+			TipDiverged: node.diverged.Load(),
+			ErrorRate:   node.errorRate.Load(),
+			Erroring:    node.erroring.Load(),
+			Quarantined: node.quarantine.active(time.Now()),
+			Stabilizing: node.stabilization.active(),
+		})
+	}
+	return statuses
+}
@@ -3,127 +3,839 @@ package pyrinstratum
 import (
 	"context"
 	"fmt"
+	mrand "math/rand"
 	"time"
 
 	"github.com/pyrin-network/pyipad/app/appmessage"
+	"github.com/pyrin-network/pyipad/domain/consensus/model/externalapi"
 	"github.com/pyrin-network/pyipad/infrastructure/network/rpcclient"
 	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
 	"github.com/pkg/errors"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 )
 
+// rpcClient is the subset of the pyipad rpc client used by the bridge, split
+// out so the api can be exercised against a mocked node in tests
+type rpcClient interface {
+	GetBlockTemplate(miningAddress, extraData string) (*appmessage.GetBlockTemplateResponseMessage, error)
+	GetBlockDAGInfo() (*appmessage.GetBlockDAGInfoResponseMessage, error)
+	GetInfo() (*appmessage.GetInfoResponseMessage, error)
+	GetConnectedPeerInfo() (*appmessage.GetConnectedPeerInfoResponseMessage, error)
+	EstimateNetworkHashesPerSecond(startHash string, windowSize uint32) (*appmessage.EstimateNetworkHashesPerSecondResponseMessage, error)
+	GetBalancesByAddresses(addresses []string) (*appmessage.GetBalancesByAddressesResponseMessage, error)
+	RegisterForNewBlockTemplateNotifications(onNewBlockTemplate func(notification *appmessage.NewBlockTemplateNotificationMessage)) error
+	SubmitBlock(block *externalapi.DomainBlock) (appmessage.RejectReason, error)
+	Close() error
+}
+
 type PyrinApi struct {
-	address       string
-	blockWaitTime time.Duration
-	logger        *zap.SugaredLogger
-	pyrin         *rpcclient.RPCClient
-	connected     bool
+	nodes          []*pyrinNode
+	active         atomic.Int32
+	blockWaitTime  time.Duration
+	maxTemplateAge time.Duration
+	logger         *zap.SugaredLogger
+	connected      bool
+	blockReadyChan chan bool
+	// ctx is cancelled on shutdown, aborting in-flight rpc calls
+	ctx        context.Context
+	rpcTimeout time.Duration
+	// nodes whose block count hasn't advanced for this long are failed over
+	// from, 0 disables the check
+	idleTimeout time.Duration
+	// set once the node has handed out a synced template
+	warm atomic.Bool
+	// when the last template was fetched in unix nanoseconds, 0 before the
+	// first, see Health
+	lastTemplate atomic.Int64
+	// solo payout addresses templates are fetched for instead of the miner's
+	// address, nil to pay out to the miner
+	payouts *payoutRotation
+	// when set templates are only fetched on new template notifications,
+	// never on the blockWaitTime fallback
+	pollingDisabled bool
+	// tunes the fallback to the notification cadence, nil polls every
+	// blockWaitTime
+	blockWait *adaptiveBlockWait
+	// optional node network stats are queried from instead of the active node
+	statsNode *statsNode
+	// how often every node's sync state is checked, see startSyncMonitor
+	syncInterval time.Duration
+	// nodes found blocks are additionally broadcast to, never used for
+	// templates
+	submitNodes []*submitNode
+	// signals the stats thread to refresh early, e.g. after a failover
+	statsRefresh chan struct{}
+	// template fetches in flight, shared by concurrent requests for a client
+	templateFlights templateFlight
+	// retries for a node still starting up, see getSyncedBlockTemplate
+	templateRetry templateRetry
+	// bits of the last template fetched, 0 until there is one, see
+	// checkTemplateDifficulty
+	templateBits atomic.Uint32
+	// nodes are quarantined from templates for quarantineCooldown once this
+	// many blocks in a row from their templates were rejected by the other
+	// nodes, 0 disables it
+	quarantineAfter    int
+	quarantineCooldown time.Duration
+	// nodes are held out of template rotation for this long after a
+	// reconnect, and until they've reported synced and their block count
+	// advanced. 0 disables it
+	stabilizeWindow time.Duration
+	// nodes connected to fewer peers than this are treated as isolated by
+	// the sync monitor, 0 disables the check
+	minPeers int
+	// tags the coinbase of a client's templates with its worker name, see
+	// coinbaseTag
+	tagWorker bool
+	// connections to the nodes are replaced with fresh ones once they've
+	// been up this long, see refreshNode. 0 disables it
+	refreshInterval time.Duration
+	// nodes failing more than this share of their rpc calls over
+	// errorWindow are failed over from, see checkErrorRate. 0 (or 1)
+	// disables it
+	errorRate   float64
+	errorWindow time.Duration
+	// templates shared between clients mining to the same address, nil to
+	// fetch per client
+	templateCache *templateCache
+	// applied while the stats thread sees the network churning, see
+	// checkStability. Empty only reports it
+	instability      InstabilityPolicy
+	instabilitySwing float64
+	instabilityHold  time.Duration
+	stability        networkStability
+	lastTemplates    lastTemplates
+	// carries the node connections when there are node rpc options, nil
+	// otherwise
+	nodeProxy *nodeProxy
+	// spaces out the attempts to reconnect nodes that went down, the jitter
+	// is only drawn from by the health check
+	reconnectBackoff ReconnectBackoff
+	reconnectJitter  *mrand.Rand
+	// when set notifications for the tips last acted on are skipped, see
+	// tipsAdvanced. The blockWaitTime fallback always refreshes
+	skipUnchangedTips bool
+	lastTips          string
+	// set while no miners are connected with pause_when_idle, the template
+	// listener skips refreshes, see setIdle
+	idle atomic.Bool
 }
 
-func NewPyrinAPI(address string, blockWaitTime time.Duration, logger *zap.SugaredLogger) (*PyrinApi, error) {
+const defaultRpcTimeout = 10 * time.Second
+
+var ErrRpcTimeout = fmt.Errorf("pyrin rpc call timed out")
+
+// withContext runs an rpc call bounded by ctx and the per call timeout (0 for
+// none). The pyipad client doesn't take a context, so an abandoned call is
+// left to finish in the background and its result dropped
+func withContext[T any](ctx context.Context, timeout time.Duration, call func() (T, error)) (T, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	type result struct {
+		value T
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := call()
+		done <- result{value, err}
+	}()
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-ctx.Done():
+		var zero T
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return zero, errors.Wrapf(ErrRpcTimeout, "no response after %s", timeout)
+		}
+		return zero, ctx.Err()
+	}
+}
+
+// dialNode connects to a pyrin node, swapped out in tests
+var dialNode = func(address string) (rpcClient, error) {
 	client, err := rpcclient.NewRPCClient(address)
 	if err != nil {
 		return nil, err
 	}
+	return newGuardedClient(client), nil
+}
+
+// dial connects to a pyrin node, through the node proxy if there are rpc
+// options
+func (py *PyrinApi) dial(address string) (rpcClient, error) {
+	if py.nodeProxy != nil {
+		local, err := py.nodeProxy.route(address)
+		if err != nil {
+			return nil, err
+		}
+		return dialNode(local)
+	}
+	return dialNode(address)
+}
+
+const nodeHealthInterval = 5 * time.Second
+
+// with ~1s blocks this long without a template notification means the
+// subscription is likely broken
+const notificationSilenceWarning = 30 * time.Second
+
+// ConnectRetry is how long NewPyrinAPI waits for a node to come up when none
+// can be reached at startup, e.g. with the bridge and node started together.
+// The backoff doubles after each attempt up to maxConnectBackoff
+type ConnectRetry struct {
+	// retries after the first attempt, 0 fails right away
+	Attempts int
+	Backoff  time.Duration
+}
+
+const defaultConnectRetries = 5
+const defaultConnectBackoff = 2 * time.Second
+const maxConnectBackoff = 30 * time.Second
+
+// delay returns the wait before the given retry (from 0)
+func (r ConnectRetry) delay(retry int) time.Duration {
+	delay := r.Backoff
+	for i := 0; i < retry && delay < maxConnectBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxConnectBackoff {
+		delay = maxConnectBackoff
+	}
+	return delay
+}
+
+// NewPyrinAPI connects to each of the given nodes. Nodes that can't be
+// reached at startup are retried later, only failing to reach every node
+// (after the connect retries) is an error. So is a node rejecting the rpc
+// options, which retrying wouldn't change
+func NewPyrinAPI(addresses []string, blockWaitTime, maxTemplateAge, rpcTimeout, idleTimeout time.Duration, retry ConnectRetry, rpc NodeRPCOptions, logger *zap.SugaredLogger) (*PyrinApi, error) {
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no pyrin node addresses configured")
+	}
+	py := &PyrinApi{
+		blockWaitTime:  blockWaitTime,
+		maxTemplateAge: maxTemplateAge,
+		logger:         logger.With(zap.String("component", "pyrinapi")),
+		connected:      true,
+		blockReadyChan: make(chan bool, 1),
+		statsRefresh:   make(chan struct{}, 1),
+		ctx:            context.Background(),
+		rpcTimeout:     rpcTimeout,
+		idleTimeout:    idleTimeout,
 
-	return &PyrinApi{
-		address:       address,
-		blockWaitTime: blockWaitTime,
-		logger:        logger.With(zap.String("component", "pyrinapi:"+address)),
-		pyrin:         client,
-		connected:     true,
-	}, nil
+		reconnectJitter: newReconnectJitter(),
+	}
+	for _, address := range addresses {
+		py.nodes = append(py.nodes, &pyrinNode{address: address})
+	}
+	if rpc.enabled() {
+		proxy, err := newNodeProxy(rpc, py.logger)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid pyrin node rpc options")
+		}
+		timeout := rpcTimeout
+		if timeout <= 0 {
+			timeout = defaultRpcTimeout
+		}
+		for _, address := range addresses {
+			if err := proxy.check(address, timeout); err != nil {
+				proxy.close()
+				return nil, err
+			}
+		}
+		py.nodeProxy = proxy
+	}
+	for attempt := 0; ; attempt++ {
+		err := py.dialNodes()
+		if err == nil {
+			return py, nil
+		}
+		if attempt >= retry.Attempts {
+			return nil, errors.Wrap(err, "failed connecting to any pyrin node")
+		}
+		delay := retry.delay(attempt)
+		py.logger.Warn(fmt.Sprintf("no pyrin node reachable, retrying in %s (%d/%d)", delay, attempt+1, retry.Attempts))
+		time.Sleep(delay)
+	}
+}
+
+// dialNodes connects to each node, returning the last connect error if none
+// could be reached
+func (py *PyrinApi) dialNodes() error {
+	var lastErr error
+	for _, node := range py.nodes {
+		client, err := py.dial(node.address)
+		if err != nil {
+			py.logger.Warn(fmt.Sprintf("failed connecting to pyrin node %s", node.address), zap.Error(err))
+			node.state = newNodeStateMachine(node.address, py.logger, NodeReconnecting)
+			lastErr = err
+		} else {
+			node.setRpc(client)
+			node.state = newNodeStateMachine(node.address, py.logger, NodeConnected)
+		}
+	}
+	_, err := py.failover()
+	py.recordActiveNode()
+	if err != nil {
+		if lastErr == nil {
+			return err
+		}
+		return lastErr
+	}
+	return nil
 }
 
 func (py *PyrinApi) Start(ctx context.Context, blockCb func()) {
-	py.waitForSync(true)
+	py.ctx = ctx
+	for _, node := range py.nodes {
+		if node.rpc() != nil {
+			py.registerForTemplates(node)
+		}
+	}
 	go py.startBlockTemplateListener(ctx, blockCb)
-	go py.startStatsThread(ctx)
+	go py.startHealthThread(ctx)
+	go py.startSyncMonitor(ctx)
+	go py.superviseStatsThread(ctx)
 }
 
 func (py *PyrinApi) startStatsThread(ctx context.Context) {
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			py.logger.Warn("context cancelled, stopping stats thread")
 			return
 		case <-ticker.C:
-			dagResponse, err := py.pyrin.GetBlockDAGInfo()
-			if err != nil {
-				py.logger.Warn("failed to get network hashrate from pyrin, prom stats will be out of date", zap.Error(err))
-				continue
+			py.updateNetworkStats()
+		case <-py.statsRefresh:
+			py.updateNetworkStats()
+		}
+	}
+}
+
+// refreshStats asks the stats thread for an early refresh without blocking,
+// a refresh that's already pending covers this one
+func (py *PyrinApi) refreshStats() {
+	select {
+	case py.statsRefresh <- struct{}{}:
+	default:
+	}
+}
+
+// startHealthThread periodically checks every node, feeding the results
+// into the node's state machine and reconnecting nodes that need it
+func (py *PyrinApi) startHealthThread(ctx context.Context) {
+	ticker := time.NewTicker(nodeHealthInterval)
+	for {
+		select {
+		case <-ctx.Done():
+			py.logger.Warn("context cancelled, stopping node health thread")
+			return
+		case <-ticker.C:
+			py.checkNodes()
+		}
+	}
+}
+
+func (py *PyrinApi) checkNodes() {
+	py.releaseQuarantines(time.Now())
+	views := make([]nodeView, 0, len(py.nodes))
+	for _, node := range py.nodes {
+		if node.state.needsReconnect() {
+			if now := time.Now(); node.reconnectDue(now) {
+				err := py.reconnectNode(node)
+				node.state.ReconnectResult(err)
+				py.backOffReconnect(node, err, now)
 			}
-			response, err := py.pyrin.EstimateNetworkHashesPerSecond(dagResponse.TipHashes[0], 1000)
-			if err != nil {
-				py.logger.Warn("failed to get network hashrate from pyrin, prom stats will be out of date", zap.Error(err))
-				continue
+			continue
+		}
+		py.checkErrorRate(node, time.Now())
+		if py.refreshDue(node, time.Now()) {
+			py.refreshNode(node)
+		}
+		client, err := node.connection()
+		if err != nil {
+			node.recordResult(err)
+			continue
+		}
+		dagInfo, err := callNode(py, node, "GetBlockDAGInfo", client.GetBlockDAGInfo)
+		node.recordResult(err)
+		if err == nil {
+			now := time.Now()
+			py.resetReconnectBackoff(node)
+			py.checkProgress(node, dagInfo.BlockCount, now)
+			if node.stabilization.recordBlockCount(dagInfo.BlockCount, now) {
+				py.nodeStabilized(node)
 			}
-			RecordNetworkStats(response.NetworkHashesPerSecond, dagResponse.BlockCount, dagResponse.Difficulty)
+			views = append(views, nodeView{node, dagInfo})
+		}
+	}
+	py.checkTips(views)
+}
+
+const defaultSyncCheckInterval = 10 * time.Second
+
+// startSyncMonitor periodically asks every node whether it's synced. Nodes
+// that aren't are taken out of template rotation and tried last for block
+// submits until they've caught up, an unsynced node hands out templates
+// nobody else will accept blocks for
+func (py *PyrinApi) startSyncMonitor(ctx context.Context) {
+	interval := py.syncInterval
+	if interval <= 0 {
+		interval = defaultSyncCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			py.logger.Warn("context cancelled, stopping node sync monitor")
+			return
+		case <-ticker.C:
+			py.checkSync()
 		}
 	}
 }
 
-func (py *PyrinApi) reconnect() error {
-	if py.pyrin != nil {
-		return py.pyrin.Reconnect()
+func (py *PyrinApi) checkSync() {
+	for _, node := range py.nodes {
+		client, err := node.connection()
+		if err != nil {
+			continue // the health check takes care of reconnecting
+		}
+		info, err := callNode(py, node, "GetInfo", client.GetInfo)
+		node.recordResult(err)
+		if err != nil {
+			continue
+		}
+		py.checkPeers(node, client)
+		RecordNodeSynced(node.address, info.IsSynced)
+		if info.IsSynced && node.stabilization.recordSynced(time.Now()) {
+			py.nodeStabilized(node)
+		}
+		unsynced := !info.IsSynced
+		if node.unsynced.Swap(unsynced) == unsynced {
+			continue
+		}
+		if !unsynced {
+			py.logger.Infow("pyrin node synced again", "node", node.address)
+			continue
+		}
+		py.logger.Warnw("pyrin node isn't synced, not using it for templates", "node", node.address)
+		if py.activeNode() == node {
+			if _, err := py.failover(); err != nil {
+				py.logger.Warn("no synced pyrin node to fail over to")
+			}
+		}
 	}
+}
+
+const defaultMinNodePeers = 1
 
-	client, err := rpcclient.NewRPCClient(py.address)
+// checkPeers catches a node that's synced but has (next to) no peers. An
+// isolated node doesn't see the network's blocks, so its templates are
+// stale, and blocks submitted to it go nowhere. The peer count is published
+// either way, the check only applies with minPeers set
+func (py *PyrinApi) checkPeers(node *pyrinNode, client rpcClient) {
+	response, err := callNode(py, node, "GetConnectedPeerInfo", client.GetConnectedPeerInfo)
+	node.recordResult(err)
 	if err != nil {
-		return err
+		// e.g. an rpc endpoint restricting the call, the sync check still applies
+		return
+	}
+	peers := len(response.Infos)
+	RecordNodePeers(node.address, peers)
+	if py.minPeers <= 0 {
+		return
+	}
+	isolated := peers < py.minPeers
+	if node.isolated.Swap(isolated) == isolated {
+		return
+	}
+	if !isolated {
+		py.logger.Infow("pyrin node has enough peers again", "node", node.address, "peers", peers)
+		return
+	}
+	py.logger.Warnw("pyrin node has too few peers, not using it for templates",
+		"node", node.address, "peers", peers, "min_peers", py.minPeers)
+	if py.activeNode() == node {
+		if _, err := py.failover(); err != nil {
+			py.logger.Warn("no pyrin node with enough peers to fail over to")
+		}
 	}
-	py.pyrin = client
-	return nil
 }
 
-func (s *PyrinApi) waitForSync(verbose bool) error {
-	if verbose {
-		s.logger.Info("checking pyrin sync state")
+// checkProgress catches a node that's up and synced but not making progress
+// (e.g. lost its peers), which none of the other checks notice
+func (py *PyrinApi) checkProgress(node *pyrinNode, blockCount uint64, now time.Time) {
+	stalled := node.recordBlockCount(blockCount, now)
+	RecordNodeStall(node.address, stalled)
+	if py.idleTimeout <= 0 {
+		return
 	}
-	if verbose {
-		s.logger.Info("pyrin synced, starting server")
+	idle := stalled > py.idleTimeout
+	if node.idle.Swap(idle) == idle {
+		return
+	}
+	if !idle {
+		py.logger.Infow("pyrin node block count advancing again", "node", node.address)
+		return
+	}
+	py.logger.Warnw("pyrin node block count hasn't advanced, treating it as unhealthy",
+		"node", node.address, "block_count", blockCount, "stalled", stalled)
+	if py.activeNode() == node {
+		if _, err := py.failover(); err != nil {
+			py.logger.Warn("no progressing pyrin node to fail over to")
+		}
 	}
-	return nil
 }
 
-func (s *PyrinApi) startBlockTemplateListener(ctx context.Context, blockReadyCb func()) {
-	blockReadyChan := make(chan bool)
-	err := s.pyrin.RegisterForNewBlockTemplateNotifications(func(_ *appmessage.NewBlockTemplateNotificationMessage) {
-		blockReadyChan <- true
-	})
+// reconnectNode replaces the node's client with a fresh connection. The
+// pyipad client's own Reconnect blocks until it succeeds, so a new client is
+// dialed instead to make each attempt bounded
+func (py *PyrinApi) reconnectNode(node *pyrinNode) error {
+	if old := node.rpc(); old != nil {
+		node.setRpc(nil)
+		old.Close()
+	}
+	client, err := py.dial(node.address)
 	if err != nil {
-		s.logger.Error("fatal: failed to register for block notifications from pyrin")
+		return err
 	}
+	node.setRpc(client)
+	py.registerForTemplates(node)
+	py.stabilizeNode(node)
+	return nil
+}
 
+func (s *PyrinApi) startBlockTemplateListener(ctx context.Context, blockReadyCb func()) {
 	ticker := time.NewTicker(s.blockWaitTime)
+	defer ticker.Stop()
+	poll := ticker.C
+	if s.pollingDisabled {
+		ticker.Stop()
+		poll = nil // never fires
+	}
+	watchdog := time.NewTicker(nodeHealthInterval)
+	defer watchdog.Stop()
+	lastNotification := time.Now()
+	silent := false
 	for {
-		if err := s.waitForSync(false); err != nil {
-			s.logger.Error("error checking pyrin sync state, attempting reconnect: ", err)
-			if err := s.reconnect(); err != nil {
-				s.logger.Error("error reconnecting to pyrin, waiting before retry: ", err)
-				time.Sleep(5 * time.Second)
-			}
-		}
 		select {
 		case <-ctx.Done():
 			s.logger.Warn("context cancelled, stopping block update listener")
 			return
-		case <-blockReadyChan:
+		case <-s.blockReadyChan:
+			RecordTemplateNotifyQueue(-1)
+			if silent {
+				s.logger.Infow("block template notifications resumed", "silent_for", time.Since(lastNotification))
+				silent = false
+			}
+			lastNotification = time.Now()
+			if s.idle.Load() {
+				RecordIdleRefreshSkipped()
+				continue
+			}
+			if s.skipUnchangedTips && !s.tipsAdvanced() {
+				// the fallback isn't pushed back, it refreshes regardless
+				RecordUnchangedTipsNotification()
+				continue
+			}
+			s.templateCache.invalidate()
+			s.rotateLastTemplates()
 			blockReadyCb()
-			ticker.Reset(s.blockWaitTime)
-		case <-ticker.C: // timeout, manually check for new blocks
+			if s.blockWait != nil {
+				ticker.Reset(s.blockWait.notified(lastNotification))
+				s.logBlockWait()
+			} else if !s.pollingDisabled {
+				ticker.Reset(s.blockWaitTime)
+			}
+		case <-poll: // timeout, manually check for new blocks
+			if s.idle.Load() {
+				RecordIdleRefreshSkipped()
+				continue
+			}
+			s.templateCache.invalidate()
+			s.rotateLastTemplates()
 			blockReadyCb()
+			if s.blockWait != nil {
+				ticker.Reset(s.blockWait.polled())
+				s.logBlockWait()
+			}
+		case <-watchdog.C:
+			if !silent && time.Since(lastNotification) > notificationSilenceWarning {
+				silent = true
+				s.logger.Warnw("no block template notification from pyrin recently",
+					"silent_for", time.Since(lastNotification), "fallback_polling", !s.pollingDisabled)
+			}
+		}
+	}
+}
+
+func (s *PyrinApi) logBlockWait() {
+	if s.blockWait.adjusted() {
+		s.logger.Infow("adjusted template polling fallback to the notification cadence",
+			"block_wait", s.blockWait.current, "notification_interval", time.Duration(s.blockWait.interval*float64(time.Second)))
+	}
+}
+
+// registerForTemplates subscribes to new template notifications from the
+// node, notifications are only acted on while the node is the active one
+func (s *PyrinApi) registerForTemplates(node *pyrinNode) {
+	client, err := node.connection()
+	if err != nil {
+		s.logger.Warn("not registering for block notifications", zap.Error(err))
+		return
+	}
+	if err := s.subscribeTemplates(node, client); err != nil {
+		s.logger.Error("failed to register for block notifications from pyrin node " + node.address)
+	}
+}
+
+// subscribeTemplates registers for the node's template notifications on the
+// client, which needn't be the node's current one yet
+func (s *PyrinApi) subscribeTemplates(node *pyrinNode, client rpcClient) error {
+	return client.RegisterForNewBlockTemplateNotifications(func(_ *appmessage.NewBlockTemplateNotificationMessage) {
+		if s.activeNode() == node {
+			s.notifyBlockReady()
 		}
+	})
+}
+
+// notifyBlockReady wakes the template listener without ever blocking the rpc
+// client's notification handler, which would hold up every notification
+// behind it while the listener is busy. A notification still waiting to be
+// picked up already covers this one, the listener fetches the latest
+// template either way
+func (s *PyrinApi) notifyBlockReady() {
+	RecordTemplateNotifyQueue(1)
+	select {
+	case s.blockReadyChan <- true:
+	default:
+		RecordTemplateNotifyQueue(-1)
+		RecordCoalescedNotification()
 	}
 }
 
+const defaultWarmupTimeout = 30 * time.Second
+const warmupRetryInterval = 500 * time.Millisecond
+
+// warmupAddress is only used to request a template during warmup, the
+// template is discarded so the coinbase doesn't matter
+const warmupAddress = "pyrin:qqkrl0er5ka5snd55gr9rcf6rlpx8nln8gf3jxf83w4dc0khfqmauy6qs83zm"
+
+var ErrWarmupTimeout = fmt.Errorf("timed out waiting for an initial block template")
+
+// Warmup blocks until a node hands out a synced block template, so miners
+// connecting right after startup get work immediately
+func (py *PyrinApi) Warmup(ctx context.Context, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		node, err := py.templateNode()
+		if err == nil {
+			var template *appmessage.GetBlockTemplateResponseMessage
+			template, err = py.getBlockTemplate(node, warmupAddress, "warmup")
+			if err == nil {
+				py.lastTemplate.Store(time.Now().UnixNano())
+			}
+			if err == nil && template.IsSynced {
+				py.warm.Store(true)
+				return nil
+			} else if err == nil {
+				err = fmt.Errorf("node %s not synced", node.address)
+			}
+		}
+		py.logger.Info("waiting for initial block template: ", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline.C:
+			return errors.Wrapf(ErrWarmupTimeout, "last error: %s", err)
+		case <-time.After(warmupRetryInterval):
+		}
+	}
+}
+
+// Ready returns true once a synced template has been served
+func (py *PyrinApi) Ready() bool {
+	return py.warm.Load()
+}
+
+var ErrStaleTemplate = fmt.Errorf("stale block template")
+
+// GetBlockTemplate returns a new template for the client along with the
+// address of the node that produced it. Concurrent calls for the same client
+// share a single fetch
 func (py *PyrinApi) GetBlockTemplate(
-	client *gostratum.StratumContext) (*appmessage.GetBlockTemplateResponseMessage, error) {
-	template, err := py.pyrin.GetBlockTemplate(client.WalletAddr,
-		fmt.Sprintf(`'%s' via pyrin-network/pyrin-stratum-bridge_%s`, client.RemoteApp, version))
+	client *gostratum.StratumContext) (*appmessage.GetBlockTemplateResponseMessage, string, error) {
+	if py.pausedForInstability() {
+		return nil, "", ErrNetworkUnstable
+	}
+	return py.templateFlights.do(templateFlightKey(client), func() (*appmessage.GetBlockTemplateResponseMessage, string, error) {
+		if py.templateCache != nil {
+			return py.sharedTemplate(client)
+		}
+		return py.clientTemplate(client)
+	})
+}
+
+func (py *PyrinApi) clientTemplate(
+	client *gostratum.StratumContext) (*appmessage.GetBlockTemplateResponseMessage, string, error) {
+	template, node, err := py.fetchBlockTemplate(client)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed fetching new block template from pyrin")
+		return nil, "", err
+	}
+	if py.templateTooOld(template) {
+		// an old template means the node's view is stale (or it's handing out
+		// a cached template), try once more before giving up on it
+		RecordStaleTemplate()
+		py.logger.Warn("block template from pyrin exceeds max age, refetching",
+			zap.Duration("age", templateAge(template)))
+		template, node, err = py.fetchBlockTemplate(client)
+		if err != nil {
+			return nil, "", err
+		}
+		if py.templateTooOld(template) {
+			RecordStaleTemplate()
+			return nil, "", errors.Wrapf(ErrStaleTemplate, "template age %s exceeds max %s",
+				templateAge(template), py.maxTemplateAge)
+		}
 	}
-	return template, nil
+	RecordTemplateTip(template.Block, node.address)
+	py.templateBits.Store(template.Block.Header.Bits)
+	if py.instability == InstabilityPause {
+		py.lastTemplates.put(py.templateCacheKey(client), template, node.address)
+	}
+	return template, node.address, nil
+}
+
+func (py *PyrinApi) fetchBlockTemplate(
+	client *gostratum.StratumContext) (*appmessage.GetBlockTemplateResponseMessage, *pyrinNode, error) {
+	node, err := py.templateNode()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed fetching new block template from pyrin")
+	}
+	extraData := coinbaseTag(client, py.tagWorker)
+	miningAddress := py.miningAddress(client)
+	template, err := py.getSyncedBlockTemplate(node, miningAddress, extraData)
+	if err != nil && !errors.Is(err, rpcclient.ErrRPC) {
+		// transport level failure, the node is likely down so try elsewhere
+		py.logger.Warn("failed fetching block template from pyrin node "+node.address, zap.Error(err))
+		if fallback, ferr := py.failoverFrom(node); ferr == nil {
+			node = fallback
+			template, err = py.getSyncedBlockTemplate(node, miningAddress, extraData)
+		}
+	}
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed fetching new block template from pyrin")
+	}
+	if err := checkCompactBits(template.Block.Header.Bits); err != nil {
+		return nil, nil, errors.Wrapf(err, "invalid block template from pyrin node %s", node.address)
+	}
+	py.lastTemplate.Store(time.Now().UnixNano())
+	if template.IsSynced {
+		py.warm.Store(true)
+	}
+	return template, node, nil
+}
+
+// miningAddress returns the address the client's next template pays out to,
+// the next solo payout address if configured and the client's own otherwise
+func (py *PyrinApi) miningAddress(client *gostratum.StratumContext) string {
+	if py.payouts != nil {
+		return py.payouts.address()
+	}
+	return client.WalletAddr
+}
+
+// SubmitBlock submits the block to the node that produced its template, as
+// that node is guaranteed to know the parents. If that node can't be reached
+// (or the source is unknown) it falls back to the active node and then the
+// remaining nodes, draining ones included. Returns the address of the node
+// that processed the block. What the other nodes make of the block counts
+// towards quarantining the source, see nodeQuarantine
+func (py *PyrinApi) SubmitBlock(block *externalapi.DomainBlock, sourceNode string) (appmessage.RejectReason, string, error) {
+	// submit nodes only speed up propagation, the outcome is still decided
+	// by the template nodes
+	broadcast := py.broadcastBlock(block)
+	reason, address, err := py.submitToTemplateNodes(block, sourceNode)
+	verdict := verdictNone
+	if address != "" && address != sourceNode {
+		verdict = submitVerdict(reason, err)
+	}
+	go py.judgeTemplate(sourceNode, verdict, broadcast)
+	return reason, address, err
+}
+
+func (py *PyrinApi) submitToTemplateNodes(block *externalapi.DomainBlock, sourceNode string) (appmessage.RejectReason, string, error) {
+	err := ErrNoNodesAvailable
+	for _, node := range py.submitOrder(sourceNode) {
+		client := node.rpc()
+		if client == nil {
+			continue
+		}
+		var reason appmessage.RejectReason
+		node.submitting.Inc()
+		reason, err = callNode(py, node, "SubmitBlock", func() (appmessage.RejectReason, error) {
+			return client.SubmitBlock(block)
+		})
+		node.submitting.Dec()
+		node.recordResult(err)
+		if err == nil {
+			RecordSubmitNodeResult(node.address, submitAccepted)
+			return reason, node.address, nil
+		}
+		if errors.Is(err, rpcclient.ErrRPC) {
+			// the node processed the block, it just didn't take it
+			RecordSubmitNodeResult(node.address, submitRejected)
+			return reason, node.address, err
+		}
+		RecordSubmitNodeResult(node.address, submitFailed)
+		py.logger.Warn("failed submitting block to pyrin node "+node.address, zap.Error(err))
+	}
+	return appmessage.RejectReasonNone, "", err
+}
+
+func (py *PyrinApi) GetBalancesByAddresses(addresses []string) (*appmessage.GetBalancesByAddressesResponseMessage, error) {
+	node, err := py.templateNode()
+	if err != nil {
+		return nil, err
+	}
+	client, err := node.connection()
+	if err != nil {
+		return nil, err
+	}
+	return callNode(py, node, "GetBalancesByAddresses", func() (*appmessage.GetBalancesByAddressesResponseMessage, error) {
+		return client.GetBalancesByAddresses(addresses)
+	})
+}
+
+func (py *PyrinApi) getBlockTemplate(node *pyrinNode, address, extraData string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+	client, err := node.connection()
+	if err != nil {
+		node.recordResult(err)
+		return nil, err
+	}
+	template, err := callNode(py, node, "GetBlockTemplate", func() (*appmessage.GetBlockTemplateResponseMessage, error) {
+		return client.GetBlockTemplate(address, extraData)
+	})
+	node.recordResult(err)
+	return template, err
+}
+
+func (py *PyrinApi) templateTooOld(template *appmessage.GetBlockTemplateResponseMessage) bool {
+	return py.maxTemplateAge > 0 && templateAge(template) > py.maxTemplateAge
+}
+
+// templateAge returns how long ago the node built the template, based on the
+// header timestamp (ms)
+func templateAge(template *appmessage.GetBlockTemplateResponseMessage) time.Duration {
+	return time.Since(time.UnixMilli(template.Block.Header.Timestamp))
 }
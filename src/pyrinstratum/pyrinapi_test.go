@@ -0,0 +1,1511 @@
+package pyrinstratum
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/pyrin-network/pyipad/app/appmessage"
+	"github.com/pyrin-network/pyipad/domain/consensus/model/externalapi"
+	"github.com/pyrin-network/pyipad/infrastructure/network/rpcclient"
+	"github.com/pyrin-network/pyipad/util/difficulty"
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// mockRpcClient embeds the interface so tests only need to implement the
+// methods they exercise, anything else will panic if called
+type mockRpcClient struct {
+	rpcClient
+	templates     []*appmessage.GetBlockTemplateResponseMessage
+	templateCalls int
+	miningAddrs   []string
+	extraData     []string
+	hashrateCalls int
+	dagInfoErr    error
+	blockCount    uint64
+	daaScore      uint64
+	tips          []string
+	difficulty    float64
+	unsynced      bool
+	peers         int
+	network       string
+	closed        bool
+	submitErr     error
+	submitReason  appmessage.RejectReason
+	submitted     int
+	notify        func(*appmessage.NewBlockTemplateNotificationMessage)
+}
+
+func (m *mockRpcClient) SubmitBlock(*externalapi.DomainBlock) (appmessage.RejectReason, error) {
+	m.submitted++
+	return m.submitReason, m.submitErr
+}
+
+func (m *mockRpcClient) GetBlockDAGInfo() (*appmessage.GetBlockDAGInfoResponseMessage, error) {
+	tips := m.tips
+	if tips == nil {
+		tips = []string{"tip"}
+	}
+	return &appmessage.GetBlockDAGInfoResponseMessage{NetworkName: m.network, TipHashes: tips, Difficulty: m.difficulty,
+		BlockCount: m.blockCount, VirtualDAAScore: m.daaScore}, m.dagInfoErr
+}
+
+func (m *mockRpcClient) GetInfo() (*appmessage.GetInfoResponseMessage, error) {
+	return &appmessage.GetInfoResponseMessage{IsSynced: !m.unsynced}, nil
+}
+
+func (m *mockRpcClient) GetConnectedPeerInfo() (*appmessage.GetConnectedPeerInfoResponseMessage, error) {
+	return &appmessage.GetConnectedPeerInfoResponseMessage{Infos: make([]*appmessage.GetConnectedPeerInfoMessage, m.peers)}, nil
+}
+
+func (m *mockRpcClient) EstimateNetworkHashesPerSecond(string, uint32) (*appmessage.EstimateNetworkHashesPerSecondResponseMessage, error) {
+	m.hashrateCalls++
+	return &appmessage.EstimateNetworkHashesPerSecondResponseMessage{}, nil
+}
+
+func (m *mockRpcClient) RegisterForNewBlockTemplateNotifications(notify func(*appmessage.NewBlockTemplateNotificationMessage)) error {
+	m.notify = notify
+	return nil
+}
+
+func (m *mockRpcClient) Close() error {
+	m.closed = true
+	return nil
+}
+
+func (m *mockRpcClient) GetBlockTemplate(miningAddress, extraData string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+	m.miningAddrs = append(m.miningAddrs, miningAddress)
+	m.extraData = append(m.extraData, extraData)
+	template := m.templates[m.templateCalls%len(m.templates)]
+	m.templateCalls++
+	return template, nil
+}
+
+func templateWithTimestamp(ts time.Time) *appmessage.GetBlockTemplateResponseMessage {
+	return &appmessage.GetBlockTemplateResponseMessage{
+		Block: &appmessage.RPCBlock{
+			Header: &appmessage.RPCBlockHeader{Timestamp: ts.UnixMilli(), Bits: 0x1e7fffff},
+		},
+		IsSynced: true,
+	}
+}
+
+func testApi(client rpcClient, maxTemplateAge time.Duration) *PyrinApi {
+	return testMultiNodeApi(maxTemplateAge, client)
+}
+
+func testMultiNodeApi(maxTemplateAge time.Duration, clients ...rpcClient) *PyrinApi {
+	api := &PyrinApi{
+		maxTemplateAge: maxTemplateAge,
+		logger:         zap.NewNop().Sugar(),
+		connected:      true,
+		ctx:            context.Background(),
+	}
+	for i, client := range clients {
+		node := &pyrinNode{address: fmt.Sprintf("mock%d", i)}
+		node.setRpc(client)
+		node.state = newNodeStateMachine(node.address, api.logger, NodeConnected)
+		api.nodes = append(api.nodes, node)
+	}
+	return api
+}
+
+func TestTemplateAgeGuard(t *testing.T) {
+	ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	old := templateWithTimestamp(time.Now().Add(-5 * time.Minute))
+	fresh := templateWithTimestamp(time.Now())
+
+	t.Run("refetches old template", func(t *testing.T) {
+		mock := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{old, fresh}}
+		template, _, err := testApi(mock, 30*time.Second).GetBlockTemplate(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if template != fresh {
+			t.Fatalf("expected the refetched template to be served")
+		}
+		if mock.templateCalls != 2 {
+			t.Fatalf("expected 2 template fetches, got %d", mock.templateCalls)
+		}
+	})
+
+	t.Run("fails on persistently old template", func(t *testing.T) {
+		mock := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{old}}
+		_, _, err := testApi(mock, 30*time.Second).GetBlockTemplate(ctx)
+		if !errors.Is(err, ErrStaleTemplate) {
+			t.Fatalf("expected stale template error, got %v", err)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		mock := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{old}}
+		template, _, err := testApi(mock, 0).GetBlockTemplate(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if template != old || mock.templateCalls != 1 {
+			t.Fatalf("expected the template to be served as is when the guard is disabled")
+		}
+	})
+}
+
+func TestNodeDraining(t *testing.T) {
+	ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	template := templateWithTimestamp(time.Now())
+	first := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{template}}
+	second := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{template}}
+	api := testMultiNodeApi(0, first, second)
+
+	if err := api.SetDraining("mock0", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := api.GetBlockTemplate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if first.templateCalls != 0 || second.templateCalls != 1 {
+		t.Fatalf("expected template to be fetched from the non-draining node")
+	}
+	if testutil.ToFloat64(nodeActiveGauge.WithLabelValues("mock0")) != 0 ||
+		testutil.ToFloat64(nodeActiveGauge.WithLabelValues("mock1")) != 1 {
+		t.Fatalf("expected the active node gauge to follow the failover")
+	}
+	if order := api.submitOrder(""); len(order) != 2 {
+		t.Fatalf("expected draining node to still be used for submits")
+	}
+
+	if err := api.SetDraining("mock1", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := api.GetBlockTemplate(ctx); !errors.Is(err, ErrNoNodesAvailable) {
+		t.Fatalf("expected no nodes available with every node draining, got %v", err)
+	}
+
+	if err := api.SetDraining("mock0", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := api.GetBlockTemplate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if first.templateCalls != 1 {
+		t.Fatalf("expected undrained node to serve templates again")
+	}
+
+	if err := api.SetDraining("nope", true); !errors.Is(err, ErrUnknownNode) {
+		t.Fatalf("expected unknown node error, got %v", err)
+	}
+}
+
+func TestSubmitRouting(t *testing.T) {
+	ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	template := templateWithTimestamp(time.Now())
+	first := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{template}}
+	second := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{template}}
+	api := testMultiNodeApi(0, first, second)
+
+	if _, source, err := api.GetBlockTemplate(ctx); err != nil || source != "mock0" {
+		t.Fatalf("expected template sourced from mock0, got %s (%v)", source, err)
+	}
+
+	// submits go to the node the template came from, even if it isn't active
+	if _, node, err := api.SubmitBlock(&externalapi.DomainBlock{}, "mock1"); err != nil || node != "mock1" {
+		t.Fatalf("expected block submitted to mock1, got %s (%v)", node, err)
+	}
+	if first.submitted != 0 || second.submitted != 1 {
+		t.Fatalf("expected block submitted to the source node only")
+	}
+
+	// source node down, falls back to the others
+	second.submitErr = fmt.Errorf("connection refused")
+	if _, node, err := api.SubmitBlock(&externalapi.DomainBlock{}, "mock1"); err != nil || node != "mock0" {
+		t.Fatalf("expected block submitted to the fallback mock0, got %s (%v)", node, err)
+	}
+	if first.submitted != 1 || second.submitted != 2 {
+		t.Fatalf("expected block submitted to the fallback node after the source failed")
+	}
+
+	// unknown source uses the active node
+	if _, _, err := api.SubmitBlock(&externalapi.DomainBlock{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if first.submitted != 2 {
+		t.Fatalf("expected block submitted to the active node without a source")
+	}
+}
+
+func TestSubmitNodes(t *testing.T) {
+	api := testApi(&mockRpcClient{}, 0)
+	api.submitNodes = newSubmitNodes([]string{"fast0", "fast1", "fast2"})
+	fast := map[string]*mockRpcClient{
+		"fast0": {},
+		"fast1": {submitErr: errors.Wrap(rpcclient.ErrRPC, "block already known")},
+	}
+	defer func(orig func(string) (rpcClient, error)) { dialNode = orig }(dialNode)
+	dialNode = func(address string) (rpcClient, error) {
+		if client, ok := fast[address]; ok {
+			return client, nil
+		}
+		return nil, fmt.Errorf("connection refused")
+	}
+
+	outcome := func(node, result string) float64 {
+		return testutil.ToFloat64(submitNodeResultCounter.WithLabelValues(node, result))
+	}
+	<-api.broadcastBlock(&externalapi.DomainBlock{})
+	if fast["fast0"].submitted != 1 || fast["fast1"].submitted != 1 {
+		t.Fatalf("expected the block submitted to every reachable submit node")
+	}
+	if outcome("fast0", submitAccepted) != 1 || outcome("fast1", submitRejected) != 1 || outcome("fast2", submitFailed) != 1 {
+		t.Fatalf("expected each submit node's outcome recorded")
+	}
+
+	fast["fast0"].submitErr = fmt.Errorf("connection reset")
+	<-api.broadcastBlock(&externalapi.DomainBlock{})
+	if !fast["fast0"].closed || api.submitNodes[0].client != nil {
+		t.Fatalf("expected the connection dropped after a transport failure")
+	}
+}
+
+func TestNodeQuarantine(t *testing.T) {
+	api := testMultiNodeApi(0, &mockRpcClient{}, &mockRpcClient{})
+	api.quarantineAfter, api.quarantineCooldown = 2, time.Minute
+	api.submitNodes = newSubmitNodes([]string{"fast0"})
+	fast := &mockRpcClient{}
+	defer func(orig func(string) (rpcClient, error)) { dialNode = orig }(dialNode)
+	dialNode = func(string) (rpcClient, error) { return fast, nil }
+	forked := api.nodes[0]
+
+	reject := func(err string) {
+		fast.submitReason, fast.submitErr = appmessage.RejectReasonBlockInvalid, errors.Wrap(rpcclient.ErrRPC, err)
+	}
+	submit := func() {
+		api.judgeTemplate(forked.address, verdictNone, api.broadcastBlock(&externalapi.DomainBlock{}))
+	}
+
+	// duplicates are the block arriving through its source first
+	reject("ErrDuplicateBlock")
+	submit()
+	submit()
+	if forked.quarantine.active(time.Now()) {
+		t.Fatalf("expected duplicate rejections not to count against the node")
+	}
+
+	reject("ErrMissingParents")
+	submit()
+	fast.submitReason, fast.submitErr = appmessage.RejectReasonNone, nil
+	submit()
+	reject("ErrMissingParents")
+	submit()
+	if forked.quarantine.active(time.Now()) {
+		t.Fatalf("expected an accepted block to reset the count")
+	}
+	submit()
+	if !forked.quarantine.active(time.Now()) || forked.usable() {
+		t.Fatalf("expected the node quarantined after 2 rejected blocks in a row")
+	}
+	if api.activeNode() == forked {
+		t.Fatalf("expected failover away from the quarantined node")
+	}
+	if testutil.ToFloat64(nodeQuarantinedGauge.WithLabelValues(forked.address)) != 1 {
+		t.Fatalf("expected the quarantine published")
+	}
+	if statuses := api.NodeStatuses(); !statuses[0].Quarantined || statuses[1].Quarantined {
+		t.Fatalf("expected only the forked node reported quarantined, got %+v", statuses)
+	}
+
+	api.releaseQuarantines(time.Now().Add(2 * time.Minute))
+	if forked.quarantine.active(time.Now().Add(2*time.Minute)) || !forked.usable() {
+		t.Fatalf("expected the node back in rotation after the cooldown")
+	}
+	if testutil.ToFloat64(nodeQuarantinedGauge.WithLabelValues(forked.address)) != 0 {
+		t.Fatalf("expected the quarantine cleared")
+	}
+
+	// a template node the block fell back to judges it too
+	unreachable := &mockRpcClient{submitErr: fmt.Errorf("connection refused")}
+	other := &mockRpcClient{submitReason: appmessage.RejectReasonBlockInvalid, submitErr: errors.Wrap(rpcclient.ErrRPC, "ErrMissingParents")}
+	api = testMultiNodeApi(0, unreachable, other)
+	api.quarantineAfter, api.quarantineCooldown = 1, time.Minute
+	if _, node, _ := api.SubmitBlock(&externalapi.DomainBlock{}, "mock0"); node != "mock1" {
+		t.Fatalf("expected the block to fall back to mock1, got %s", node)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !api.nodes[0].quarantine.active(time.Now()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the source quarantined after its fallback rejected the block")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNodeIdleDetection(t *testing.T) {
+	ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	template := templateWithTimestamp(time.Now())
+	first := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{template}}
+	second := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{template}}
+	api := testMultiNodeApi(0, first, second)
+	api.idleTimeout = time.Minute
+	stuck, progressing := api.nodes[0], api.nodes[1]
+
+	start := time.Now()
+	api.checkProgress(stuck, 100, start)
+	api.checkProgress(progressing, 100, start)
+	api.checkProgress(stuck, 100, start.Add(2*time.Minute))
+	api.checkProgress(progressing, 200, start.Add(2*time.Minute))
+	if !stuck.idle.Load() || progressing.idle.Load() {
+		t.Fatalf("expected only the stalled node to be idle")
+	}
+	if _, _, err := api.GetBlockTemplate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if first.templateCalls != 0 || second.templateCalls != 1 {
+		t.Fatalf("expected failover away from the idle node")
+	}
+
+	// every node idle, the active one keeps serving
+	api.checkProgress(progressing, 200, start.Add(4*time.Minute))
+	if _, _, err := api.GetBlockTemplate(ctx); err != nil || second.templateCalls != 2 {
+		t.Fatalf("expected the active node to keep serving with every node idle, got %v", err)
+	}
+
+	api.checkProgress(stuck, 101, start.Add(5*time.Minute))
+	if stuck.idle.Load() {
+		t.Fatalf("expected node to recover once its block count advances")
+	}
+}
+
+func TestSyncMonitor(t *testing.T) {
+	ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	template := templateWithTimestamp(time.Now())
+	first := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{template}, unsynced: true}
+	second := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{template}}
+	third := &mockRpcClient{}
+	api := testMultiNodeApi(0, first, second, third)
+	behind := api.nodes[0]
+
+	api.checkSync()
+	if !behind.unsynced.Load() || api.nodes[1].unsynced.Load() {
+		t.Fatalf("expected only the first node to be unsynced")
+	}
+	if _, _, err := api.GetBlockTemplate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if first.templateCalls != 0 || second.templateCalls != 1 {
+		t.Fatalf("expected failover away from the unsynced node")
+	}
+	order := api.submitOrder("")
+	if order[0] != api.nodes[1] || order[len(order)-1] != behind {
+		t.Fatalf("expected the unsynced node to be tried last for submits")
+	}
+
+	first.unsynced = false
+	api.checkSync()
+	if behind.unsynced.Load() || !behind.usable() {
+		t.Fatalf("expected the node back in rotation once synced")
+	}
+}
+
+func TestTipDivergence(t *testing.T) {
+	forked := &mockRpcClient{daaScore: 90, tips: []string{"b"}}
+	leader := &mockRpcClient{daaScore: 100, tips: []string{"a", "c"}}
+	api := testMultiNodeApi(0, forked, leader)
+	node := api.nodes[0]
+
+	for i := 0; i < tipDivergedChecks-1; i++ {
+		api.checkNodes()
+	}
+	if node.diverged.Load() || !node.usable() {
+		t.Fatalf("expected a brief tip disagreement tolerated")
+	}
+	api.checkNodes()
+	if !node.diverged.Load() || node.usable() || !api.NodeStatuses()[0].TipDiverged {
+		t.Fatalf("expected a node behind on other tips treated as diverged")
+	}
+	if active, _ := api.templateNode(); active != api.nodes[1] {
+		t.Fatalf("expected templates from the leading node")
+	}
+	if order := api.submitOrder(""); order[len(order)-1] != node {
+		t.Fatalf("expected the diverged node tried last for submits")
+	}
+	if testutil.ToFloat64(nodeTipAgreementGauge.WithLabelValues(node.address)) != 0 {
+		t.Fatalf("expected the disagreement published")
+	}
+
+	// behind but on one of the leader's tips is just catching up
+	forked.tips = []string{"c"}
+	api.checkNodes()
+	if node.diverged.Load() || !node.usable() {
+		t.Fatalf("expected the node back once it shares the leading tips")
+	}
+	if testutil.ToFloat64(nodeTipAgreementGauge.WithLabelValues(node.address)) != 1 {
+		t.Fatalf("expected the agreement published")
+	}
+}
+
+func TestNodeErrorRate(t *testing.T) {
+	api := testMultiNodeApi(0, &mockRpcClient{}, &mockRpcClient{})
+	api.errorRate = 0.3
+	node := api.nodes[0]
+	start := time.Now()
+	api.checkErrorRate(node, start)
+
+	for i := 0; i < 6; i++ {
+		node.rpcErrors.record("GetBlockTemplate", nil)
+	}
+	for i := 0; i < 4; i++ {
+		node.rpcErrors.record("GetBlockTemplate", ErrRpcTimeout)
+	}
+	// declined by the node, not a failure of it
+	node.rpcErrors.record("SubmitBlock", errors.Wrap(rpcclient.ErrRPC, "block invalid"))
+	node.rpcErrors.record("SubmitBlock", errors.Wrap(rpcclient.ErrRPC, "block invalid"))
+	api.checkErrorRate(node, start.Add(defaultNodeErrorWindow/2))
+	if node.erroring.Load() {
+		t.Fatalf("expected the rate only judged once the window ended")
+	}
+
+	api.checkErrorRate(node, start.Add(defaultNodeErrorWindow))
+	if !node.erroring.Load() || node.usable() || !api.NodeStatuses()[0].Erroring {
+		t.Fatalf("expected a node failing a third of its calls treated as unhealthy")
+	}
+	if active, _ := api.templateNode(); active != api.nodes[1] {
+		t.Fatalf("expected a failover away from the erroring node")
+	}
+	if order := api.submitOrder(""); order[len(order)-1] != node {
+		t.Fatalf("expected the erroring node tried last for submits")
+	}
+	if rate := testutil.ToFloat64(nodeRpcErrorRateGauge.WithLabelValues(node.address, "GetBlockTemplate")); rate != 0.4 {
+		t.Fatalf("expected a template error rate of 0.4, got %f", rate)
+	}
+	if rate := testutil.ToFloat64(nodeRpcErrorRateGauge.WithLabelValues(node.address, "SubmitBlock")); rate != 0 {
+		t.Fatalf("expected declined submits not counted as errors, got %f", rate)
+	}
+
+	// too few calls to tell
+	node.rpcErrors.record("GetBlockTemplate", nil)
+	api.checkErrorRate(node, start.Add(2*defaultNodeErrorWindow))
+	if !node.erroring.Load() {
+		t.Fatalf("expected a quiet window to leave the node as it was")
+	}
+	for i := 0; i < minErrorRateCalls; i++ {
+		node.rpcErrors.record("GetBlockDAGInfo", nil)
+	}
+	api.checkErrorRate(node, start.Add(3*defaultNodeErrorWindow))
+	if node.erroring.Load() || !node.usable() {
+		t.Fatalf("expected the node back after a window without errors")
+	}
+	if rate := testutil.ToFloat64(nodeRpcErrorRateGauge.WithLabelValues(node.address, "GetBlockTemplate")); rate != 0 {
+		t.Fatalf("expected the rate of a method not called reset, got %f", rate)
+	}
+}
+
+func TestNetworkStability(t *testing.T) {
+	ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	ctx.WalletAddr = "pyrin:a"
+	mock := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{templateWithTimestamp(time.Now())},
+		blockCount: 100, daaScore: 5000, difficulty: 1000}
+	api := testApi(mock, 0)
+	api.instability = InstabilityPause
+	good, _, err := api.GetBlockTemplate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, difficulty := range []float64{1000, 1400} {
+		mock.difficulty = difficulty
+		if err := api.fetchNetworkStats("mock0", mock); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if api.NetworkUnstable() {
+		t.Fatal("expected a 40% difficulty change to be within the default swing")
+	}
+	// pruning drops the block count on a healthy node
+	mock.blockCount = 90
+	if err := api.fetchNetworkStats("mock0", mock); err != nil {
+		t.Fatal(err)
+	}
+	if api.NetworkUnstable() {
+		t.Fatal("expected a block count drop not to make the network unstable")
+	}
+	mock.daaScore = 4990
+	if err := api.fetchNetworkStats("mock0", mock); err != nil {
+		t.Fatal(err)
+	}
+	if !api.NetworkUnstable() {
+		t.Fatal("expected a virtual daa score regression to make the network unstable")
+	}
+	if _, _, err := api.GetBlockTemplate(ctx); !errors.Is(err, ErrNetworkUnstable) || mock.templateCalls != 1 {
+		t.Fatalf("expected templates to be paused, got %v after %d fetches", err, mock.templateCalls)
+	}
+
+	// a miner connecting meanwhile starts on the last good template
+	listener := newClientListener(zap.NewNop().Sugar(), nil, 1, 0, 0, 0, 0, 0, nil, nil)
+	newcomer, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	newcomer.WalletAddr = ctx.WalletAddr
+	state := GetMiningState(newcomer)
+	state.connectTime = time.Now().Add(-subscribeGrace)
+	jobs := readAll(mc)
+	api.rotateLastTemplates()
+	listener.pushJob(api, newcomer, newNotifyCache())
+	if !state.initialized || mock.templateCalls != 1 {
+		t.Fatalf("expected the new miner started without a fetch, %d fetches", mock.templateCalls)
+	}
+	if job, exists := state.GetJob(1); !exists || job != good.Block {
+		t.Fatal("expected the new miner sent the last good template")
+	}
+	for notified := false; !notified; {
+		select {
+		case job := <-jobs:
+			notified = strings.Contains(job, "mining.notify")
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the new miner notified of the job")
+		}
+	}
+
+	// stats from another node only become the baseline
+	var stability networkStability
+	now := time.Now()
+	stability.observe("a", 100, 1000, 0.5, time.Minute, now)
+	if reason, _ := stability.observe("b", 50, 100, 0.5, time.Minute, now); reason != "" {
+		t.Fatalf("unexpected instability switching nodes: %s", reason)
+	}
+	if reason, changed := stability.observe("b", 60, 300, 0.5, time.Minute, now); reason == "" || !changed {
+		t.Fatal("expected a difficulty swing to make the network unstable")
+	}
+	if _, changed := stability.observe("b", 70, 300, 0.5, time.Minute, now.Add(30*time.Second)); changed {
+		t.Fatal("expected the network to be held unstable")
+	}
+	if _, changed := stability.observe("b", 80, 300, 0.5, time.Minute, now.Add(time.Minute)); !changed || stability.unstable {
+		t.Fatal("expected the network to be stable again after the hold")
+	}
+}
+
+func TestMinPeers(t *testing.T) {
+	ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	template := templateWithTimestamp(time.Now())
+	first := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{template}}
+	second := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{template}, peers: 8}
+	api := testMultiNodeApi(0, first, second)
+	alone := api.nodes[0]
+
+	api.checkSync()
+	if alone.isolated.Load() || testutil.ToFloat64(nodePeersGauge.WithLabelValues(alone.address)) != 0 {
+		t.Fatalf("expected the peer count only published without min peers")
+	}
+
+	api.minPeers = 1
+	api.checkSync()
+	if !alone.isolated.Load() || api.nodes[1].isolated.Load() || !api.NodeStatuses()[0].Isolated {
+		t.Fatalf("expected only the node without peers to be isolated")
+	}
+	if _, _, err := api.GetBlockTemplate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if first.templateCalls != 0 || second.templateCalls != 1 {
+		t.Fatalf("expected failover away from the isolated node")
+	}
+	if order := api.submitOrder(""); order[len(order)-1] != alone {
+		t.Fatalf("expected the isolated node to be tried last for submits")
+	}
+
+	first.peers = 3
+	api.checkSync()
+	if alone.isolated.Load() || !alone.usable() {
+		t.Fatalf("expected the node back in rotation once it has peers")
+	}
+	if testutil.ToFloat64(nodePeersGauge.WithLabelValues(alone.address)) != 3 {
+		t.Fatalf("expected the node's peer count published")
+	}
+}
+
+func TestNodeHealthCheck(t *testing.T) {
+	unreachable := fmt.Errorf("connection refused")
+	failing := &mockRpcClient{dagInfoErr: unreachable}
+	backup := &mockRpcClient{}
+	api := testMultiNodeApi(0, failing, backup)
+
+	redialed := &mockRpcClient{}
+	dialErr := unreachable
+	defer func(orig func(string) (rpcClient, error)) { dialNode = orig }(dialNode)
+	dialNode = func(string) (rpcClient, error) {
+		if dialErr != nil {
+			return nil, dialErr
+		}
+		return redialed, nil
+	}
+
+	for i := 0; i < degradedFailureLimit; i++ {
+		api.checkNodes()
+	}
+	if state := api.nodes[0].state.State(); state != NodeReconnecting {
+		t.Fatalf("expected node to be reconnecting, got %s", state)
+	}
+	if node, _ := api.templateNode(); node != api.nodes[1] {
+		t.Fatalf("expected templates to fail over to the healthy node")
+	}
+
+	api.checkNodes()
+	if !failing.closed {
+		t.Fatalf("expected the old client to be closed on reconnect")
+	}
+	if state := api.nodes[0].state.State(); state != NodeReconnecting {
+		t.Fatalf("expected node to still be reconnecting after a failed attempt, got %s", state)
+	}
+
+	dialErr = nil
+	api.checkNodes()
+	if state := api.nodes[0].state.State(); state != NodeConnected {
+		t.Fatalf("expected node to be connected after reconnecting, got %s", state)
+	}
+	if api.nodes[0].rpc() != redialed {
+		t.Fatalf("expected the node to use the redialed client")
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	backoff := ReconnectBackoff{Base: time.Second, Max: 5 * time.Second, Multiplier: 2}
+	var waits []time.Duration
+	for wait := time.Duration(0); len(waits) < 5; {
+		wait = backoff.next(wait)
+		waits = append(waits, wait)
+	}
+	if fmt.Sprint(waits) != "[1s 2s 4s 5s 5s]" {
+		t.Fatalf("expected the wait to double up to the max, got %v", waits)
+	}
+
+	unreachable := fmt.Errorf("connection refused")
+	api := testMultiNodeApi(0, &mockRpcClient{})
+	api.reconnectBackoff = ReconnectBackoff{Base: time.Hour, Max: 4 * time.Hour, Multiplier: 2}
+	api.reconnectJitter = newReconnectJitter()
+	node := api.nodes[0]
+	node.state = newNodeStateMachine(node.address, api.logger, NodeReconnecting)
+	dials := 0
+	defer func(orig func(string) (rpcClient, error)) { dialNode = orig }(dialNode)
+	dialNode = func(string) (rpcClient, error) {
+		dials++
+		return nil, unreachable
+	}
+
+	start := time.Now()
+	api.checkNodes()
+	api.checkNodes()
+	if dials != 1 {
+		t.Fatalf("expected no attempt during the backoff, got %d", dials)
+	}
+	if wait := node.nextReconnect.Sub(start); wait < 30*time.Minute || wait > time.Hour+time.Second {
+		t.Fatalf("expected the first wait jittered within half to all of the base, got %s", wait)
+	}
+	node.nextReconnect = time.Time{}
+	api.checkNodes()
+	if dials != 2 || node.reconnectWait != 2*time.Hour {
+		t.Fatalf("expected the wait to grow after another failure, got %s after %d attempts", node.reconnectWait, dials)
+	}
+
+	// reconnected, the backoff only starts over once the node's synced
+	dialNode = func(string) (rpcClient, error) { return &mockRpcClient{}, nil }
+	node.nextReconnect = time.Time{}
+	node.unsynced.Store(true)
+	api.checkNodes()
+	api.checkNodes()
+	if state := node.state.State(); state != NodeConnected || node.reconnectWait != 2*time.Hour {
+		t.Fatalf("expected the node reconnected with its backoff kept while unsynced, got %s and %s", state, node.reconnectWait)
+	}
+	node.unsynced.Store(false)
+	api.checkNodes()
+	if node.reconnectWait != 0 {
+		t.Fatalf("expected the backoff reset once synced, got %s", node.reconnectWait)
+	}
+}
+
+func TestNodeRefresh(t *testing.T) {
+	old := &mockRpcClient{}
+	api := testMultiNodeApi(0, old)
+	api.blockReadyChan = make(chan bool, 1)
+	api.refreshInterval = time.Hour
+	api.stabilizeWindow = time.Hour
+	node := api.nodes[0]
+	api.registerForTemplates(node)
+
+	fresh := &mockRpcClient{}
+	defer func(orig func(string) (rpcClient, error)) { dialNode = orig }(dialNode)
+	dialNode = func(string) (rpcClient, error) { return fresh, nil }
+
+	api.checkNodes()
+	if node.rpc() != old {
+		t.Fatalf("expected a connection younger than the interval kept")
+	}
+
+	node.connectedAt = time.Now().Add(-2 * time.Hour)
+	node.submitting.Inc()
+	api.checkNodes()
+	if node.rpc() != old {
+		t.Fatalf("expected no refresh while a block is being submitted")
+	}
+	node.submitting.Dec()
+
+	api.checkNodes()
+	if node.rpc() != fresh || fresh.notify == nil {
+		t.Fatalf("expected the connection replaced by a fresh one subscribed to notifications")
+	}
+	if old.closed {
+		t.Fatalf("expected the old connection left open for calls in flight on it")
+	}
+	if !node.usable() {
+		t.Fatalf("expected a refreshed node kept in rotation")
+	}
+	// notifications from both connections during the overlap are coalesced
+	old.notify(nil)
+	fresh.notify(nil)
+	<-api.blockReadyChan
+	select {
+	case <-api.blockReadyChan:
+		t.Fatalf("expected overlapping notifications coalesced")
+	default:
+	}
+}
+
+func TestNodeStabilization(t *testing.T) {
+	backup := &mockRpcClient{}
+	api := testMultiNodeApi(0, &mockRpcClient{}, backup)
+	api.stabilizeWindow = time.Minute
+	node := api.nodes[0]
+
+	redialed := &mockRpcClient{blockCount: 100}
+	defer func(orig func(string) (rpcClient, error)) { dialNode = orig }(dialNode)
+	dialNode = func(string) (rpcClient, error) { return redialed, nil }
+
+	node.state.ReconnectResult(api.reconnectNode(node))
+	if node.usable() || !api.NodeStatuses()[0].Stabilizing {
+		t.Fatalf("expected a reconnected node to be stabilizing")
+	}
+	if active, _ := api.templateNode(); active != api.nodes[1] {
+		t.Fatalf("expected templates from the other node while stabilizing")
+	}
+
+	start := time.Now()
+	api.checkSync()
+	if node.stabilization.recordBlockCount(100, start) {
+		t.Fatalf("expected the node to stabilize only once its block count advances")
+	}
+	if node.stabilization.recordBlockCount(101, start) {
+		t.Fatalf("expected the node to stabilize only after the window")
+	}
+	if !node.stabilization.recordBlockCount(102, start.Add(2*time.Minute)) || !node.usable() {
+		t.Fatalf("expected the node back in rotation once stable")
+	}
+
+	// with nothing else usable a stabilizing node beats none
+	api.nodes[1].draining.Store(true)
+	node.state.ReconnectResult(api.reconnectNode(node))
+	if active, err := api.templateNode(); err != nil || active != node {
+		t.Fatalf("expected the stabilizing node used without another, got %v", err)
+	}
+}
+
+func TestCoinbaseTag(t *testing.T) {
+	ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	ctx.RemoteApp, ctx.WorkerName = "lolMiner 1.88", "rig 01/<b>"
+	mock := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{templateWithTimestamp(time.Now())}}
+	api := testApi(mock, 0)
+
+	if _, _, err := api.GetBlockTemplate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	api.tagWorker = true
+	if _, _, err := api.GetBlockTemplate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	untagged := "'lolMiner 1.88' via pyrin-network/pyrin-stratum-bridge_" + version
+	if mock.extraData[0] != untagged || mock.extraData[1] != untagged+" worker 'rig01b'" {
+		t.Fatalf("unexpected coinbase tags %q", mock.extraData)
+	}
+
+	// an overlong miner app is cut, the worker name is kept
+	ctx.RemoteApp, ctx.WorkerName = strings.Repeat("é", 100), strings.Repeat("w", 50)
+	tag := coinbaseTag(ctx, true)
+	if len(tag) > maxExtraDataLength || !utf8.ValidString(tag) || !strings.HasSuffix(tag, " worker '"+strings.Repeat("w", maxTagWorkerLength)+"'") {
+		t.Fatalf("unexpected coinbase tag %q (%d bytes)", tag, len(tag))
+	}
+}
+
+func TestSharedTemplates(t *testing.T) {
+	client := func(addr string) *gostratum.StratumContext {
+		ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+		ctx.WalletAddr = addr
+		return ctx
+	}
+	first, second, other := client("pyrin:a"), client("pyrin:a"), client("pyrin:b")
+	mock := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{templateWithTimestamp(time.Now())}}
+	api := testApi(mock, 0)
+	api.templateCache = &templateCache{}
+	misses := testutil.ToFloat64(templateCacheMissCounter)
+
+	for _, ctx := range []*gostratum.StratumContext{first, second} {
+		if _, source, err := api.GetBlockTemplate(ctx); err != nil || source != "mock0" {
+			t.Fatalf("unexpected template from %q: %v", source, err)
+		}
+	}
+	if mock.templateCalls != 1 {
+		t.Fatalf("expected clients on the same address to share a template, got %d fetches", mock.templateCalls)
+	}
+	if _, _, err := api.GetBlockTemplate(other); err != nil || mock.templateCalls != 2 {
+		t.Fatalf("expected another address to fetch its own template, got %d fetches: %v", mock.templateCalls, err)
+	}
+	if got := testutil.ToFloat64(templateCacheMissCounter) - misses; got != 2 {
+		t.Fatalf("expected a cache miss per fetched template, got %v", got)
+	}
+
+	// a new block drops the shared templates
+	api.templateCache.invalidate()
+	if _, _, err := api.GetBlockTemplate(second); err != nil || mock.templateCalls != 3 {
+		t.Fatalf("expected a refetch after invalidation, got %d fetches: %v", mock.templateCalls, err)
+	}
+
+	// differing coinbase tags aren't shared
+	api.tagWorker = true
+	first.WorkerName, second.WorkerName = "rig1", "rig2"
+	for _, ctx := range []*gostratum.StratumContext{first, second} {
+		if _, _, err := api.GetBlockTemplate(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if mock.templateCalls != 5 {
+		t.Fatalf("expected a template per worker tag, got %d fetches", mock.templateCalls)
+	}
+}
+
+func TestRpcContext(t *testing.T) {
+	hang := func() (int, error) {
+		time.Sleep(time.Second)
+		return 1, nil
+	}
+
+	t.Run("completes", func(t *testing.T) {
+		value, err := withContext(context.Background(), time.Second, func() (int, error) { return 1, nil })
+		if err != nil || value != 1 {
+			t.Fatalf("expected call result, got %d, %v", value, err)
+		}
+	})
+
+	t.Run("times out", func(t *testing.T) {
+		_, err := withContext(context.Background(), 10*time.Millisecond, hang)
+		if !errors.Is(err, ErrRpcTimeout) {
+			t.Fatalf("expected timeout, got %v", err)
+		}
+		if errors.Is(err, rpcclient.ErrRPC) {
+			t.Fatalf("timeouts must count as transport failures for failover")
+		}
+	})
+
+	t.Run("cancelled on shutdown", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := withContext(ctx, 0, hang)
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected cancellation, got %v", err)
+		}
+	})
+}
+
+func TestWarmup(t *testing.T) {
+	synced := templateWithTimestamp(time.Now())
+	unsynced := templateWithTimestamp(time.Now())
+	unsynced.IsSynced = false
+
+	t.Run("waits for synced template", func(t *testing.T) {
+		mock := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{unsynced, synced}}
+		api := testApi(mock, 0)
+		if err := api.Warmup(context.Background(), 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if !api.Ready() || mock.templateCalls != 2 {
+			t.Fatalf("expected api to be ready after the synced template")
+		}
+	})
+
+	t.Run("times out", func(t *testing.T) {
+		mock := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{unsynced}}
+		api := testApi(mock, 0)
+		if err := api.Warmup(context.Background(), 100*time.Millisecond); !errors.Is(err, ErrWarmupTimeout) {
+			t.Fatalf("expected warmup timeout, got %v", err)
+		}
+		if api.Ready() {
+			t.Fatalf("expected api to not be ready")
+		}
+	})
+}
+
+func TestCheckNetwork(t *testing.T) {
+	mainnet := &mockRpcClient{network: "pyrin-mainnet"}
+	testnet := &mockRpcClient{network: "pyrin-testnet-10"}
+
+	if err := testMultiNodeApi(0, mainnet, mainnet).CheckNetwork("mainnet", NetworkMismatchStrict); err != nil {
+		t.Fatalf("expected matching network to pass, got %s", err)
+	}
+	api := testMultiNodeApi(0, mainnet, testnet)
+	if err := api.CheckNetwork("pyrin-mainnet", NetworkMismatchStrict); !errors.Is(err, ErrNetworkMismatch) {
+		t.Fatalf("expected network mismatch, got %v", err)
+	}
+	if err := api.CheckNetwork("pyrin-mainnet", NetworkMismatchWarn); err != nil {
+		t.Fatalf("expected mismatch to only warn, got %s", err)
+	}
+	if err := api.CheckNetwork("", NetworkMismatchStrict); err != nil {
+		t.Fatalf("expected no check without an expected network, got %s", err)
+	}
+	unreachable := &mockRpcClient{dagInfoErr: fmt.Errorf("connection refused")}
+	if err := testMultiNodeApi(0, mainnet, unreachable).CheckNetwork("pyrin-mainnet", NetworkMismatchStrict); err != nil {
+		t.Fatalf("expected unreachable node to be skipped, got %s", err)
+	}
+}
+
+func TestPayoutRotation(t *testing.T) {
+	ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	ctx.WalletAddr = "pyrin:miner"
+	fresh := templateWithTimestamp(time.Now())
+
+	t.Run("pays out to the miner by default", func(t *testing.T) {
+		mock := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{fresh}}
+		if _, _, err := testApi(mock, 0).GetBlockTemplate(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if len(mock.miningAddrs) != 1 || mock.miningAddrs[0] != ctx.WalletAddr {
+			t.Fatalf("expected the template to pay out to the miner, got %v", mock.miningAddrs)
+		}
+	})
+
+	t.Run("round-robin across payout addresses", func(t *testing.T) {
+		mock := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{fresh}}
+		api := testApi(mock, 0)
+		api.payouts = newPayoutRotation([]string{"pyrin:a", "pyrin:b", "pyrin:c"})
+		for i := 0; i < 4; i++ {
+			if _, _, err := api.GetBlockTemplate(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expected := []string{"pyrin:a", "pyrin:b", "pyrin:c", "pyrin:a"}
+		if fmt.Sprint(mock.miningAddrs) != fmt.Sprint(expected) {
+			t.Fatalf("expected payouts %v, got %v", expected, mock.miningAddrs)
+		}
+	})
+}
+
+func TestHealth(t *testing.T) {
+	mock := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{templateWithTimestamp(time.Now())}}
+	api := testApi(mock, 0)
+	probe := func(ready bool) (int, string) {
+		recorder := httptest.NewRecorder()
+		healthHandler(api.Health, ready)(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		return recorder.Code, recorder.Body.String()
+	}
+
+	if code, body := probe(false); code != http.StatusOK || !strings.Contains(body, `"node":"mock0"`) ||
+		!strings.Contains(body, `"last_template_age_seconds":-1`) {
+		t.Fatalf("expected healthy before any template, got %d %s", code, body)
+	}
+	if code, _ := probe(true); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected not ready before a synced template, got %d", code)
+	}
+	if err := api.Warmup(context.Background(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := probe(true); code != http.StatusOK || strings.Contains(body, `"last_template_age_seconds":-1`) {
+		t.Fatalf("expected ready once a synced template was served, got %d %s", code, body)
+	}
+
+	// an unsynced node fails both, from the tracked state alone
+	api.nodes[0].unsynced.Store(true)
+	if code, _ := probe(false); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected unhealthy with the node unsynced, got %d", code)
+	}
+	if code, _ := probe(true); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected not ready with the node unsynced, got %d", code)
+	}
+}
+
+func TestDisabledPolling(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	api := testApi(&mockRpcClient{}, 0)
+	api.blockWaitTime = 5 * time.Millisecond
+	api.blockReadyChan = make(chan bool)
+	api.pollingDisabled = true
+	calls := make(chan struct{}, 100)
+	go api.startBlockTemplateListener(ctx, func() { calls <- struct{}{} })
+
+	time.Sleep(50 * time.Millisecond)
+	if len(calls) != 0 {
+		t.Fatalf("expected no template fetches without a notification, got %d", len(calls))
+	}
+	api.blockReadyChan <- true
+	select {
+	case <-calls:
+	case <-time.After(time.Second):
+		t.Fatalf("expected a template fetch on notification")
+	}
+}
+
+func TestSkipUnchangedTips(t *testing.T) {
+	mock := &mockRpcClient{tips: []string{"b", "a"}}
+	api := testApi(mock, 0)
+	if !api.tipsAdvanced() || api.tipsAdvanced() {
+		t.Fatalf("expected only the first notification for the tips acted on")
+	}
+	mock.tips = []string{"a", "b"}
+	if api.tipsAdvanced() {
+		t.Fatalf("expected the tips compared regardless of their order")
+	}
+	mock.tips = []string{"a", "c"}
+	if !api.tipsAdvanced() {
+		t.Fatalf("expected a notification for new tips acted on")
+	}
+	mock.dagInfoErr = fmt.Errorf("unavailable")
+	if !api.tipsAdvanced() {
+		t.Fatalf("expected a notification acted on when the tips can't be had")
+	}
+	mock.dagInfoErr = nil
+
+	// skipped notifications aren't fetched for
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	api.blockWaitTime = time.Hour
+	api.blockReadyChan = make(chan bool)
+	api.skipUnchangedTips = true
+	skipped := testutil.ToFloat64(unchangedTipsCounter)
+	calls := make(chan struct{}, 100)
+	go api.startBlockTemplateListener(ctx, func() { calls <- struct{}{} })
+	api.blockReadyChan <- true
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(unchangedTipsCounter) != skipped+1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if testutil.ToFloat64(unchangedTipsCounter) != skipped+1 || len(calls) != 0 {
+		t.Fatalf("expected the notification for the same tips skipped, got %d fetches", len(calls))
+	}
+}
+
+func TestPauseWhenIdle(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	api := testApi(&mockRpcClient{}, 0)
+	api.blockWaitTime = time.Hour
+	api.blockReadyChan = make(chan bool)
+	shareHandler := newShareHandler(nil, 1, 0, nil, 0, invalidSharePolicy{}, 0)
+	listener := newClientListener(zap.NewNop().Sugar(), shareHandler, 1, 0, 0, 0, 0, 0, nil, nil)
+	api.setIdle(true)
+	listener.onIdle = api.setIdle
+	calls := make(chan struct{}, 100)
+	go api.startBlockTemplateListener(ctx, func() { calls <- struct{}{} })
+
+	skipped := testutil.ToFloat64(idleRefreshSkippedCounter)
+	api.blockReadyChan <- true
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(idleRefreshSkippedCounter) != skipped+1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if testutil.ToFloat64(idleRefreshSkippedCounter) != skipped+1 || len(calls) != 0 {
+		t.Fatalf("expected the notification skipped without miners, got %d refreshes", len(calls))
+	}
+
+	client, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	listener.OnConnect(client)
+	api.blockReadyChan <- true
+	select {
+	case <-calls:
+	case <-time.After(time.Second):
+		t.Fatalf("expected refreshes resumed as soon as a miner connected")
+	}
+
+	listener.OnDisconnect(client)
+	api.blockReadyChan <- true
+	deadline = time.Now().Add(time.Second)
+	for testutil.ToFloat64(idleRefreshSkippedCounter) != skipped+2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if testutil.ToFloat64(idleRefreshSkippedCounter) != skipped+2 || len(calls) != 0 {
+		t.Fatalf("expected refreshes paused again once the last miner left, got %d refreshes", len(calls))
+	}
+}
+
+func TestNotificationsNeverBlock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mock := &mockRpcClient{}
+	api := testApi(mock, 0)
+	api.blockWaitTime = time.Hour
+	api.blockReadyChan = make(chan bool, 1)
+	api.registerForTemplates(api.nodes[0])
+
+	busy, release := make(chan struct{}), make(chan struct{})
+	calls := make(chan struct{}, 100)
+	first := true
+	go api.startBlockTemplateListener(ctx, func() {
+		if first {
+			first = false
+			close(busy)
+			<-release
+		}
+		calls <- struct{}{}
+	})
+	mock.notify(nil)
+	<-busy
+
+	coalesced := testutil.ToFloat64(coalescedNotificationCounter)
+	fired := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			mock.notify(nil)
+		}
+		close(fired)
+	}()
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatalf("expected notifications not to block while the listener is busy")
+	}
+	if got := testutil.ToFloat64(coalescedNotificationCounter) - coalesced; got != 99 {
+		t.Fatalf("expected 99 notifications coalesced into the pending one, got %v", got)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-calls:
+		case <-time.After(time.Second):
+			t.Fatalf("expected the pending notification handled once the listener is free")
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	if len(calls) != 0 {
+		t.Fatalf("expected the rapid notifications folded into one fetch, got %d more", len(calls))
+	}
+}
+
+func TestStatsNode(t *testing.T) {
+	primary, replica := &mockRpcClient{}, &mockRpcClient{}
+	api := testApi(primary, 0)
+	api.statsNode = newStatsNode("replica")
+
+	dialErr := fmt.Errorf("connection refused")
+	defer func(orig func(string) (rpcClient, error)) { dialNode = orig }(dialNode)
+	dialNode = func(string) (rpcClient, error) {
+		if dialErr != nil {
+			return nil, dialErr
+		}
+		return replica, nil
+	}
+
+	api.updateNetworkStats()
+	if primary.hashrateCalls != 1 || replica.hashrateCalls != 0 {
+		t.Fatalf("expected stats from the primary while the stats node is unreachable")
+	}
+
+	dialErr = nil
+	api.updateNetworkStats()
+	if primary.hashrateCalls != 1 || replica.hashrateCalls != 1 {
+		t.Fatalf("expected stats from the stats node once it's reachable")
+	}
+
+	replica.dagInfoErr = fmt.Errorf("connection reset")
+	api.updateNetworkStats()
+	if primary.hashrateCalls != 2 || !replica.closed {
+		t.Fatalf("expected fallback to the primary and the stats connection dropped after a failure")
+	}
+}
+
+// panickyStatsClient answers the first dag info request with no response
+// and no error, which the stats thread panics on
+type panickyStatsClient struct {
+	*mockRpcClient
+	calls atomic.Int32
+}
+
+func (c *panickyStatsClient) GetBlockDAGInfo() (*appmessage.GetBlockDAGInfoResponseMessage, error) {
+	if c.calls.Add(1) == 1 {
+		return nil, nil
+	}
+	return c.mockRpcClient.GetBlockDAGInfo()
+}
+
+func TestStatsThreadSupervision(t *testing.T) {
+	client := &panickyStatsClient{mockRpcClient: &mockRpcClient{}}
+	api := testApi(client, 0)
+	api.statsRefresh = make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		api.superviseStatsThread(ctx)
+		close(stopped)
+	}()
+
+	// the first refresh panics, the restarted thread serves the next one
+	api.refreshStats()
+	deadline := time.Now().Add(5 * time.Second)
+	for client.calls.Load() < 2 && time.Now().Before(deadline) {
+		api.refreshStats()
+		time.Sleep(50 * time.Millisecond)
+	}
+	if client.calls.Load() < 2 {
+		t.Fatal("expected the stats thread to be restarted after a panic")
+	}
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("expected the supervisor to stop with its context")
+	}
+}
+
+func TestTemplateDifficultyCheck(t *testing.T) {
+	template, err := LoadBlockTemplate("example_template.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bits := template.Block.Header.Bits
+	// the node's own conversion, see GetDifficultyRatio
+	expected, _ := new(big.Rat).SetFrac(powMax, difficulty.CompactToBig(bits)).Float64()
+	if derived := templateDifficulty(bits); math.Abs(derived/expected-1) > 1e-9 {
+		t.Fatalf("expected the template target to convert to difficulty %f, got %f", expected, derived)
+	}
+
+	mock := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{template}, difficulty: expected}
+	api := testApi(mock, 0)
+	mismatches := testutil.ToFloat64(difficultyMismatchCounter)
+	RecordTemplateDifficultyRatio(0)
+	api.updateNetworkStats()
+	if testutil.ToFloat64(templateDifficultyRatioGauge) == 1 {
+		t.Fatalf("expected nothing checked before a template is fetched")
+	}
+	ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	if _, _, err := api.GetBlockTemplate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	api.updateNetworkStats()
+	if ratio := testutil.ToFloat64(templateDifficultyRatioGauge); math.Abs(ratio-1) > 1e-9 {
+		t.Fatalf("expected the template and network difficulty to match, got ratio %f", ratio)
+	}
+
+	mock.difficulty = expected * 2
+	api.updateNetworkStats()
+	if testutil.ToFloat64(difficultyMismatchCounter) != mismatches+1 {
+		t.Fatalf("expected a mismatch counted")
+	}
+
+	// a live template is held to the same target checks as a captured one
+	broken := templateWithTimestamp(time.Now())
+	broken.Block.Header.Bits = 0
+	mock.templates = []*appmessage.GetBlockTemplateResponseMessage{broken}
+	if _, _, err := api.GetBlockTemplate(ctx); err == nil || !strings.Contains(err.Error(), "no positive target") {
+		t.Fatalf("expected a template without a target refused, got %v", err)
+	}
+}
+
+func TestTemplateUnsyncedRetry(t *testing.T) {
+	unsynced := templateWithTimestamp(time.Now())
+	unsynced.IsSynced = false
+	synced := templateWithTimestamp(time.Now())
+	mock := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{unsynced, unsynced, synced}}
+	api := testApi(mock, 0)
+	api.templateRetry = templateRetry{attempts: 3, delay: time.Millisecond}
+	ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	counted := testutil.ToFloat64(templateUnsyncedCounter.WithLabelValues("mock0"))
+	if template, _, err := api.GetBlockTemplate(ctx); err != nil || !template.IsSynced {
+		t.Fatalf("expected the synced template once the restarted node caught up, got %v", err)
+	}
+	if mock.templateCalls != 3 {
+		t.Fatalf("expected the just connected node asked again while unsynced, got %d fetches", mock.templateCalls)
+	}
+	if got := testutil.ToFloat64(templateUnsyncedCounter.WithLabelValues("mock0")) - counted; got != 2 {
+		t.Fatalf("expected both unsynced templates counted, got %f", got)
+	}
+
+	// out of retries the unsynced template is used
+	mock.templates, mock.templateCalls = []*appmessage.GetBlockTemplateResponseMessage{unsynced}, 0
+	api.templateRetry.attempts = 1
+	if template, _, err := api.GetBlockTemplate(ctx); err != nil || template.IsSynced || mock.templateCalls != 2 {
+		t.Fatalf("expected the unsynced template after a single retry, got %d fetches (%v)", mock.templateCalls, err)
+	}
+
+	// a node that's been up for a while is left to the sync monitor
+	mock.templateCalls = 0
+	api.nodes[0].connectedAt = time.Now().Add(-time.Hour)
+	if _, _, err := api.GetBlockTemplate(ctx); err != nil || mock.templateCalls != 1 {
+		t.Fatalf("expected no retry for a node connected long ago, got %d fetches (%v)", mock.templateCalls, err)
+	}
+}
+
+func TestNetworkStatsFailover(t *testing.T) {
+	api := testMultiNodeApi(0, &mockRpcClient{}, &mockRpcClient{})
+	api.statsRefresh = make(chan struct{}, 1)
+	// only the source node's series should exist
+	labelledBy := func(node string) bool {
+		return testutil.CollectAndCount(networkBlockCount) == 1 && networkStatsNode == node
+	}
+
+	api.updateNetworkStats()
+	if !labelledBy("mock0") {
+		t.Fatalf("expected network stats labelled by the active node")
+	}
+
+	api.nodes[0].state = newNodeStateMachine("mock0", api.logger, NodeReconnecting)
+	if node, _ := api.templateNode(); node != api.nodes[1] {
+		t.Fatalf("expected templates to fail over to the healthy node")
+	}
+	if count := testutil.CollectAndCount(networkBlockCount); count != 0 {
+		t.Fatalf("expected the old node's stats dropped on failover, got %d series", count)
+	}
+	select {
+	case <-api.statsRefresh:
+	default:
+		t.Fatalf("expected a stats refresh requested on failover")
+	}
+
+	api.updateNetworkStats()
+	if !labelledBy("mock1") {
+		t.Fatalf("expected network stats relabelled to the new active node")
+	}
+}
+
+func TestClosedClient(t *testing.T) {
+	mock := &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{templateWithTimestamp(time.Now())}}
+	guarded := newGuardedClient(mock)
+	api := testApi(guarded, 0)
+	ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+
+	if _, _, err := api.GetBlockTemplate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	guarded.Close()
+	guarded.Close()
+	if _, _, err := api.GetBlockTemplate(ctx); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("expected not connected error from a closed client, got %v", err)
+	}
+	if _, _, err := api.SubmitBlock(&externalapi.DomainBlock{}, ""); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("expected not connected error submitting to a closed client, got %v", err)
+	}
+	if mock.templateCalls != 1 || mock.submitted != 0 {
+		t.Fatalf("expected no calls to reach the closed client")
+	}
+
+	// a node between dropping its client and redialing has none at all, the
+	// health check counts that as a transport failure rather than panicking
+	api = testApi(mock, 0)
+	api.nodes[0].setRpc(nil)
+	for i := 0; i < degradedFailureLimit; i++ {
+		api.checkNodes()
+	}
+	if state := api.nodes[0].state.State(); state != NodeReconnecting {
+		t.Fatalf("expected node without a client to be reconnecting, got %s", state)
+	}
+	api.updateNetworkStats()
+}
+
+func TestConnectRetry(t *testing.T) {
+	defer func(orig func(string) (rpcClient, error)) { dialNode = orig }(dialNode)
+	dials := 0
+	dialNode = func(string) (rpcClient, error) {
+		if dials++; dials < 3 {
+			return nil, fmt.Errorf("connection refused")
+		}
+		return &mockRpcClient{}, nil
+	}
+	retry := ConnectRetry{Attempts: 2, Backoff: time.Millisecond}
+	if _, err := NewPyrinAPI([]string{"node0"}, 0, 0, 0, 0, retry, NodeRPCOptions{}, zap.NewNop().Sugar()); err != nil || dials != 3 {
+		t.Fatalf("expected the node reached on the last retry, got %v after %d dials", err, dials)
+	}
+
+	dials = 0
+	retry.Attempts = 1
+	if _, err := NewPyrinAPI([]string{"node0"}, 0, 0, 0, 0, retry, NodeRPCOptions{}, zap.NewNop().Sugar()); err == nil || dials != 2 {
+		t.Fatalf("expected giving up after the retries, got %v after %d dials", err, dials)
+	}
+
+	backoff := ConnectRetry{Backoff: 2 * time.Second}
+	if backoff.delay(0) != 2*time.Second || backoff.delay(2) != 8*time.Second || backoff.delay(10) != maxConnectBackoff {
+		t.Fatalf("expected the backoff doubling up to %s", maxConnectBackoff)
+	}
+}
+
+// blockingTemplateClient holds template requests until released
+type blockingTemplateClient struct {
+	*mockRpcClient
+	release chan struct{}
+}
+
+func (m *blockingTemplateClient) GetBlockTemplate(miningAddress, extraData string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+	<-m.release
+	return m.mockRpcClient.GetBlockTemplate(miningAddress, extraData)
+}
+
+func TestSharedTemplateFetch(t *testing.T) {
+	mock := &blockingTemplateClient{
+		mockRpcClient: &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{templateWithTimestamp(time.Now())}},
+		release:       make(chan struct{}),
+	}
+	api := testApi(mock, 0)
+	ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+
+	const requests = 4
+	shared := testutil.ToFloat64(sharedTemplateFetchCounter)
+	results := make(chan *appmessage.GetBlockTemplateResponseMessage, requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			template, _, err := api.GetBlockTemplate(ctx)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- template
+		}()
+	}
+	// every request but the first joins the one in flight
+	time.Sleep(100 * time.Millisecond)
+	close(mock.release)
+	for i := 0; i < requests; i++ {
+		if template := <-results; template != mock.templates[0] {
+			t.Fatalf("expected every request given the fetched template")
+		}
+	}
+	if mock.templateCalls != 1 {
+		t.Fatalf("expected concurrent requests to share one fetch, got %d", mock.templateCalls)
+	}
+	if got := testutil.ToFloat64(sharedTemplateFetchCounter) - shared; got != requests-1 {
+		t.Fatalf("expected the requests that waited counted, got %f", got)
+	}
+
+	// only fetches in flight are shared, the next request fetches anew
+	if _, _, err := api.GetBlockTemplate(ctx); err != nil || mock.templateCalls != 2 {
+		t.Fatalf("expected a later request to fetch again, got %d fetches (%v)", mock.templateCalls, err)
+	}
+	other, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	if templateFlightKey(other) == templateFlightKey(ctx) {
+		t.Fatalf("expected clients to fetch separately")
+	}
+
+	// a fetch panicking panics in the caller rather than leaving the key in
+	// flight for good
+	flight := &templateFlight{}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("expected the fetch's panic passed on")
+			}
+		}()
+		flight.do("k", func() (*appmessage.GetBlockTemplateResponseMessage, string, error) {
+			panic("fetch failed")
+		})
+	}()
+	if _, node, err := flight.do("k", func() (*appmessage.GetBlockTemplateResponseMessage, string, error) {
+		return nil, "mock0", nil
+	}); err != nil || node != "mock0" {
+		t.Fatalf("expected a fetch after the panicked one to run, got %s (%v)", node, err)
+	}
+}
@@ -0,0 +1,133 @@
+package pyrinstratum
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pyrin-network/pyipad/app/appmessage"
+)
+
+const defaultQuarantineAfter = 3
+const defaultQuarantineCooldown = 10 * time.Minute
+
+// blockVerdict is what the nodes other than the one a block's template came
+// from made of the block
+type blockVerdict int
+
+const (
+	// no other node saw the block, or none could judge it
+	verdictNone blockVerdict = iota
+	// another node took the block, the template was fine
+	verdictAccepted
+	// another node rejected the block as invalid, other than as a duplicate
+	verdictInvalid
+)
+
+// merge combines verdicts on the same block, a single node accepting it
+// outweighs any number rejecting it
+func (v blockVerdict) merge(other blockVerdict) blockVerdict {
+	if v == verdictAccepted || other == verdictAccepted {
+		return verdictAccepted
+	}
+	if v == verdictInvalid || other == verdictInvalid {
+		return verdictInvalid
+	}
+	return verdictNone
+}
+
+// submitVerdict judges a node's answer to a block submit
+func submitVerdict(reason appmessage.RejectReason, err error) blockVerdict {
+	if err == nil {
+		return verdictAccepted
+	}
+	// usually the block just got there through its source first, or it lost
+	// the race, neither says anything about the template
+	if reason == appmessage.RejectReasonBlockInvalid && !strings.Contains(err.Error(), "ErrDuplicateBlock") && !lostRace(err) {
+		return verdictInvalid
+	}
+	return verdictNone
+}
+
+// nodeQuarantine takes a node out of template rotation for a cooldown once
+// blocks built on its templates are rejected as invalid by the other nodes
+// (template fallbacks and submit_addresses nodes) too often in a row, a
+// sign it's on a fork of its own and miners are wasting work on it
+type nodeQuarantine struct {
+	lock sync.Mutex
+	// consecutive blocks from the node's templates rejected elsewhere
+	strikes int
+	until   time.Time
+}
+
+// record counts the verdict on a block from the node's templates, returning
+// true if it puts the node into quarantine
+func (q *nodeQuarantine) record(verdict blockVerdict, after int, cooldown time.Duration, now time.Time) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	switch verdict {
+	case verdictAccepted:
+		q.strikes = 0
+	case verdictInvalid:
+		q.strikes++
+		if q.strikes >= after && !now.Before(q.until) {
+			q.strikes = 0
+			q.until = now.Add(cooldown)
+			return true
+		}
+	}
+	return false
+}
+
+func (q *nodeQuarantine) active(now time.Time) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return now.Before(q.until)
+}
+
+// expire clears a quarantine whose cooldown has passed, returning true if it
+// did
+func (q *nodeQuarantine) expire(now time.Time) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.until.IsZero() || now.Before(q.until) {
+		return false
+	}
+	q.until = time.Time{}
+	return true
+}
+
+// judgeTemplate records the other nodes' verdict on a block against the node
+// its template came from, once the submit nodes have answered too
+func (py *PyrinApi) judgeTemplate(sourceNode string, verdict blockVerdict, broadcast <-chan blockVerdict) {
+	verdict = verdict.merge(<-broadcast)
+	if py.quarantineAfter <= 0 || verdict == verdictNone {
+		return
+	}
+	node, err := py.findNode(sourceNode)
+	if err != nil {
+		return
+	}
+	if !node.quarantine.record(verdict, py.quarantineAfter, py.quarantineCooldown, time.Now()) {
+		return
+	}
+	py.logger.Warnw("other nodes keep rejecting blocks from this node's templates, quarantining it",
+		"node", node.address, "rejected_blocks", py.quarantineAfter, "cooldown", py.quarantineCooldown)
+	RecordNodeQuarantined(node.address, true)
+	if py.activeNode() == node {
+		if _, err := py.failover(); err != nil {
+			py.logger.Warn("no other pyrin node to fail over to from the quarantined node")
+		}
+	}
+}
+
+// releaseQuarantines puts nodes whose quarantine cooldown passed back into
+// template rotation
+func (py *PyrinApi) releaseQuarantines(now time.Time) {
+	for _, node := range py.nodes {
+		if node.quarantine.expire(now) {
+			py.logger.Infow("pyrin node quarantine over, using it for templates again", "node", node.address)
+			RecordNodeQuarantined(node.address, false)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package pyrinstratum
+
+import (
+	"math"
+	mrand "math/rand"
+	"time"
+)
+
+const defaultReconnectBackoff = time.Second
+const defaultReconnectMaxBackoff = time.Minute
+const defaultReconnectMultiplier = 2
+
+// ReconnectBackoff spaces out the attempts to reconnect a node that went
+// down. The wait starts at Base and grows by Multiplier after each failed
+// attempt up to Max, and each wait is randomized to between half and all of
+// it, so bridges that lost the same node (e.g. restarted for an upgrade)
+// spread their attempts out rather than retrying it in lockstep. It's back
+// to Base once the node is reconnected and synced. Attempts are made by the
+// node health check, so waits shorter than nodeHealthInterval round up to
+// it. A zero Base attempts on every health check
+type ReconnectBackoff struct {
+	Base       time.Duration
+	Max        time.Duration
+	Multiplier float64
+}
+
+// next returns the wait after a failed attempt that came previous after the
+// one before it (0 for the first failure), before the jitter
+func (b ReconnectBackoff) next(previous time.Duration) time.Duration {
+	if b.Base <= 0 {
+		return 0
+	}
+	if previous <= 0 {
+		return b.Base
+	}
+	next := time.Duration(float64(previous) * math.Max(b.Multiplier, 1))
+	if b.Max > 0 && next > b.Max {
+		next = b.Max
+	}
+	return next
+}
+
+// newReconnectJitter returns the source of the reconnect jitter, one per
+// PyrinApi. The global source is only seeded randomly from go 1.20 on, with
+// the older go directive bridges would all draw the same waits
+func newReconnectJitter() *mrand.Rand {
+	return mrand.New(mrand.NewSource(time.Now().UnixNano()))
+}
+
+// reconnectDue returns true if the backoff allows another attempt to
+// reconnect the node. Only touched by the health check
+func (n *pyrinNode) reconnectDue(now time.Time) bool {
+	return !now.Before(n.nextReconnect)
+}
+
+// backOffReconnect records the outcome of an attempt to reconnect the node,
+// holding the next attempt back for the backoff after a failure
+func (py *PyrinApi) backOffReconnect(node *pyrinNode, err error, now time.Time) {
+	if err == nil {
+		// the wait only starts over once the node is synced, see
+		// resetReconnectBackoff
+		node.nextReconnect = time.Time{}
+		return
+	}
+	node.reconnectWait = py.reconnectBackoff.next(node.reconnectWait)
+	wait := node.reconnectWait
+	if wait > 0 && py.reconnectJitter != nil {
+		wait = wait/2 + time.Duration(py.reconnectJitter.Int63n(int64(wait/2)+1))
+	}
+	node.nextReconnect = now.Add(wait)
+	py.logger.Debugw("reconnecting to pyrin node failed", "node", node.address, "retry_in", wait, "error", err)
+}
+
+// resetReconnectBackoff starts the node's backoff over once it's responding
+// and not known to be out of sync
+func (py *PyrinApi) resetReconnectBackoff(node *pyrinNode) {
+	if node.reconnectWait > 0 && !node.unsynced.Load() {
+		node.reconnectWait = 0
+	}
+}
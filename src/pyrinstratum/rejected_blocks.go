@@ -0,0 +1,96 @@
+package pyrinstratum
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pyrin-network/pyipad/app/appmessage"
+)
+
+// how many rejected blocks are kept for the admin endpoint
+const rejectedBlockHistory = 50
+
+// RejectedBlock is a block found by a miner that no node took, kept for
+// working out afterwards why it was lost
+type RejectedBlock struct {
+	Time       time.Time `json:"time"`
+	Hash       string    `json:"hash"`
+	DAAScore   uint64    `json:"daa_score"`
+	BlueScore  uint64    `json:"blue_score"`
+	Wallet     string    `json:"wallet"`
+	Worker     string    `json:"worker"`
+	RemoteAddr string    `json:"remote_addr"`
+	Job        int       `json:"job"`
+	// node the template came from, and the one whose answer was final (empty
+	// if no node could be reached)
+	SourceNode string `json:"source_node"`
+	Node       string `json:"node"`
+	Reason     string `json:"reason"`
+	Error      string `json:"error"`
+	// the node already had the block, it most likely got there another way
+	Duplicate bool `json:"duplicate"`
+	// the block reached the node too late, see lostRace
+	LostRace bool `json:"lost_race"`
+	// what the block is counted as in py_block_rejected_counter, see
+	// classify
+	Rejection string `json:"rejection"`
+}
+
+// what rejected blocks are counted as, by the answer of the last node to
+// get the block
+const (
+	// the node already had the block
+	blockRejectedDuplicate = "duplicate"
+	// the block lost the race, see lostRace
+	blockRejectedStale = "stale"
+	// the node was still syncing, in IBD
+	blockRejectedSyncing = "syncing"
+	blockRejectedInvalid = "invalid"
+	// no node could be reached, the submit failed at the transport
+	blockRejectedFailed = "failed"
+)
+
+var blockRejections = []string{blockRejectedDuplicate, blockRejectedStale, blockRejectedSyncing, blockRejectedInvalid, blockRejectedFailed}
+
+// classify returns what the block is counted as once Node, Reason,
+// Duplicate and LostRace are set
+func (b RejectedBlock) classify() string {
+	switch {
+	case b.Node == "":
+		return blockRejectedFailed
+	case b.Duplicate:
+		return blockRejectedDuplicate
+	case b.LostRace:
+		return blockRejectedStale
+	case b.Reason == appmessage.RejectReasonIsInIBD.String():
+		return blockRejectedSyncing
+	}
+	return blockRejectedInvalid
+}
+
+// rejectedBlocks holds the most recent rejected blocks, the zero value is
+// ready to use
+type rejectedBlocks struct {
+	lock   sync.Mutex
+	blocks []RejectedBlock
+}
+
+func (r *rejectedBlocks) add(block RejectedBlock) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.blocks = append(r.blocks, block)
+	if len(r.blocks) > rejectedBlockHistory {
+		r.blocks = append(r.blocks[:0], r.blocks[len(r.blocks)-rejectedBlockHistory:]...)
+	}
+}
+
+// recent returns the kept rejected blocks, newest first
+func (r *rejectedBlocks) recent() []RejectedBlock {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	recent := make([]RejectedBlock, 0, len(r.blocks))
+	for i := len(r.blocks) - 1; i >= 0; i-- {
+		recent = append(recent, r.blocks[i])
+	}
+	return recent
+}
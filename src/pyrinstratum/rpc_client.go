@@ -0,0 +1,84 @@
+package pyrinstratum
+
+import (
+	"github.com/pyrin-network/pyipad/app/appmessage"
+	"github.com/pyrin-network/pyipad/domain/consensus/model/externalapi"
+	"go.uber.org/atomic"
+)
+
+// guardedClient fails calls made after Close with ErrNotConnected instead of
+// handing them to the closed pyipad client, whose errors for that are
+// confusing at best. Callers may still hold a client that a reconnect or
+// shutdown has since closed
+type guardedClient struct {
+	client rpcClient
+	closed atomic.Bool
+}
+
+func newGuardedClient(client rpcClient) *guardedClient {
+	return &guardedClient{client: client}
+}
+
+func (g *guardedClient) GetBlockTemplate(miningAddress, extraData string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+	if g.closed.Load() {
+		return nil, ErrNotConnected
+	}
+	return g.client.GetBlockTemplate(miningAddress, extraData)
+}
+
+func (g *guardedClient) GetBlockDAGInfo() (*appmessage.GetBlockDAGInfoResponseMessage, error) {
+	if g.closed.Load() {
+		return nil, ErrNotConnected
+	}
+	return g.client.GetBlockDAGInfo()
+}
+
+func (g *guardedClient) GetInfo() (*appmessage.GetInfoResponseMessage, error) {
+	if g.closed.Load() {
+		return nil, ErrNotConnected
+	}
+	return g.client.GetInfo()
+}
+
+func (g *guardedClient) GetConnectedPeerInfo() (*appmessage.GetConnectedPeerInfoResponseMessage, error) {
+	if g.closed.Load() {
+		return nil, ErrNotConnected
+	}
+	return g.client.GetConnectedPeerInfo()
+}
+
+func (g *guardedClient) EstimateNetworkHashesPerSecond(startHash string, windowSize uint32) (*appmessage.EstimateNetworkHashesPerSecondResponseMessage, error) {
+	if g.closed.Load() {
+		return nil, ErrNotConnected
+	}
+	return g.client.EstimateNetworkHashesPerSecond(startHash, windowSize)
+}
+
+func (g *guardedClient) GetBalancesByAddresses(addresses []string) (*appmessage.GetBalancesByAddressesResponseMessage, error) {
+	if g.closed.Load() {
+		return nil, ErrNotConnected
+	}
+	return g.client.GetBalancesByAddresses(addresses)
+}
+
+func (g *guardedClient) RegisterForNewBlockTemplateNotifications(onNewBlockTemplate func(notification *appmessage.NewBlockTemplateNotificationMessage)) error {
+	if g.closed.Load() {
+		return ErrNotConnected
+	}
+	return g.client.RegisterForNewBlockTemplateNotifications(onNewBlockTemplate)
+}
+
+func (g *guardedClient) SubmitBlock(block *externalapi.DomainBlock) (appmessage.RejectReason, error) {
+	if g.closed.Load() {
+		return appmessage.RejectReasonNone, ErrNotConnected
+	}
+	return g.client.SubmitBlock(block)
+}
+
+// Close closes the underlying client once, later calls are no-ops
+func (g *guardedClient) Close() error {
+	if g.closed.Swap(true) {
+		return nil
+	}
+	return g.client.Close()
+}
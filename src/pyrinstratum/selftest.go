@@ -0,0 +1,80 @@
+package pyrinstratum
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pyrin-network/pyipad/app/appmessage"
+	"github.com/pyrin-network/pyipad/domain/consensus/utils/consensushashing"
+	"github.com/pkg/errors"
+)
+
+// known good header (with its nonce) the validation pipeline is checked
+// against on startup
+//
+//go:embed example_header.json
+var selfTestHeader []byte
+
+// expected results for selfTestHeader, generated with a known good build. A
+// mismatch means header serialization or pow hashing changed behavior, most
+// likely through a dependency bump
+var (
+	selfTestJobHeader = []byte{188, 115, 173, 196, 48, 146, 141, 180, 96, 132, 173, 62, 24, 194, 181, 135, 188, 231, 195, 244, 165, 24, 201, 121, 14, 229, 5, 124, 83, 0, 109, 7}
+	selfTestBlockHash = "66bf1ced677593b4a7f605dd06461bc841468e9a137f24b5537eaa820e2e4ec7"
+	selfTestPowValue  = "80410c907d0f73fc6dd56b7027608a0002b13bc9be4a29115c3651699c3140a3"
+	// network difficulty for the header's bits, ~12617.375671633985
+	selfTestMinDiff = 12617.0
+	selfTestMaxDiff = 12618.0
+)
+
+var ErrSelfTestFailed = fmt.Errorf("hashing self-test failed")
+
+// SelfTest runs the share validation pipeline (job header serialization, block
+// hashing, proof of work and difficulty) against a known header and fails if
+// any result differs from the expected one. The bridge refuses to start on a
+// failure, it would otherwise reject valid shares or submit invalid blocks
+func SelfTest() error {
+	return runSelfTest(selfTestHeader)
+}
+
+func runSelfTest(rawHeader []byte) error {
+	block := appmessage.RPCBlock{}
+	if err := json.Unmarshal(rawHeader, &block.Header); err != nil {
+		return errors.Wrap(err, "failed parsing self-test header")
+	}
+	fail := func(what string, expected, got any) error {
+		return errors.Wrapf(ErrSelfTestFailed, "%s: expected %v, got %v", what, expected, got)
+	}
+
+	jobHeader, err := SerializeBlockHeader(&block)
+	if err != nil {
+		return errors.Wrap(err, "failed serializing self-test header")
+	}
+	if !bytes.Equal(jobHeader, selfTestJobHeader) {
+		return fail("job header", selfTestJobHeader, jobHeader)
+	}
+
+	work, err := computeProofOfWork(&block, block.Header.Nonce)
+	if err != nil {
+		return errors.Wrap(err, "failed converting self-test header")
+	}
+	// the job header is the bridge's own serialization, miners hashing
+	// anything but the node's pre-pow hash never find a valid share
+	if prePow := prePowHash(work.block.Header); !bytes.Equal(prePow.ByteSlice(), jobHeader) {
+		return fail("job header against the node's pre-pow hash", prePow, jobHeader)
+	}
+	if hash := consensushashing.HeaderHash(work.header).String(); hash != selfTestBlockHash {
+		return fail("block hash", selfTestBlockHash, hash)
+	}
+	if powValue := work.value.Text(16); powValue != selfTestPowValue {
+		return fail("pow value", selfTestPowValue, powValue)
+	}
+
+	target := CalculateTarget(uint64(block.Header.Bits))
+	if diff := BigDiffToLittle(&target); diff < selfTestMinDiff || diff > selfTestMaxDiff {
+		return fail("difficulty", "~12617.375671633985", diff)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package pyrinstratum
 
 import (
+	"container/list"
 	"fmt"
 	"log"
 	"sort"
@@ -12,8 +13,6 @@ import (
 	"github.com/pyrin-network/pyipad/app/appmessage"
 	"github.com/pyrin-network/pyipad/domain/consensus/model/externalapi"
 	"github.com/pyrin-network/pyipad/domain/consensus/utils/consensushashing"
-	"github.com/pyrin-network/pyipad/domain/consensus/utils/pow"
-	"github.com/pyrin-network/pyipad/infrastructure/network/rpcclient"
 	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
 	"github.com/pkg/errors"
 	"go.uber.org/atomic"
@@ -28,23 +27,175 @@ type WorkStats struct {
 	InvalidShares atomic.Int64
 	WorkerName    string
 	StartTime     time.Time
-	LastShare     time.Time
+	// guarded by the share handler's statsLock, see touchStats
+	LastShare time.Time
+	// the worker's place in statsOrder, its value the worker's stats key
+	order *list.Element
+}
+
+// blockSubmitter is anything blocks can be submitted to, normally the
+// PyrinApi which handles routing the block to a reachable node, preferring
+// the node the template came from, and returns the node that processed it
+type blockSubmitter interface {
+	SubmitBlock(block *externalapi.DomainBlock, sourceNode string) (appmessage.RejectReason, string, error)
 }
 
 type shareHandler struct {
-	pyrin        *rpcclient.RPCClient
-	stats        map[string]*WorkStats
-	statsLock    sync.Mutex
+	pyrin     blockSubmitter
+	stats     map[string]*WorkStats
+	statsLock sync.Mutex
+	// the workers in stats by last share, most recent first, see evictStats
+	statsOrder   *list.List
 	overall      WorkStats
 	tipBlueScore uint64
+	submitSlots  chan struct{}
+	// when non-zero only the current job (and the previous one for this long
+	// after a new job is pushed) is accepted, older jobs are rejected as stale
+	jobGrace time.Duration
+	// while set and reporting the network unstable jobGrace is lifted, any
+	// retained job is accepted
+	instability instabilityChecker
+	shareSink   ShareSink
+	// when non-zero workers submitting faster than one share per interval
+	// (averaged over shareRateWindow) are throttled
+	minShareInterval time.Duration
+	invalidShares    invalidSharePolicy
+	staleShares      staleShareRate
+	// when non-zero every Nth accepted share (across all workers) is logged
+	shareLogSample int64
+	stuckJobs      stuckJobPolicy
+	desync         desyncPolicy
+	// how shares whose block lost the race are answered
+	lostRaces LostRacePolicy
+	// recent blocks no node took, for the admin endpoint
+	rejections rejectedBlocks
+	// traces each submission when set
+	tracer *tracer
+	// hashes shares when set, otherwise they're hashed on the submitting
+	// connection's goroutine
+	validation *validationPool
+	// how submits for jobs the client was never sent are answered
+	unknownJobs UnknownJobPolicy
+	// submit params are held to exactly what was negotiated, see
+	// validateSubmit and checkSubmitNonce
+	strictSubmit bool
+	// when non-zero the most workers kept in stats, see evictStats
+	maxStats int
+	// set once the shutdown drain is over, see drainConnections
+	drained atomic.Bool
+	// accepted work is averaged over this long for each worker's hashrate
+	// estimate, see EstimateHashrate
+	hashrateWindow time.Duration
+}
+
+// invalidSharePolicy disconnects workers whose share of invalid submissions
+// over the window exceeds ratio, a ratio of 0 or 1 (or above) disables it
+type invalidSharePolicy struct {
+	ratio  float64
+	window time.Duration
+}
+
+func (p invalidSharePolicy) enabled() bool {
+	return p.ratio > 0 && p.ratio < 1 && p.window > 0
+}
+
+// stuckJobPolicy flags workers that keep submitting for jobs at least lag
+// jobs behind the latest one they were sent, a miner that stopped picking up
+// new jobs rather than the odd share in flight at push time. A lag of 0
+// (or -1) disables the check, disconnectAfter (when non-zero) is the number of
+// consecutive lagging submissions the worker is disconnected after
+type stuckJobPolicy struct {
+	lag             int
+	disconnectAfter int
 }
 
-func newShareHandler(pyrin *rpcclient.RPCClient) *shareHandler {
+// consecutive lagging submissions before a worker is flagged as stuck
+const stuckJobShares = 10
+
+func newShareHandler(pyrin blockSubmitter, maxConcurrentSubmits int, jobGrace time.Duration, sink ShareSink, minShareInterval time.Duration, invalidShares invalidSharePolicy, shareLogSample int) *shareHandler {
+	if maxConcurrentSubmits < 1 {
+		maxConcurrentSubmits = 1
+	}
+	if sink == nil {
+		sink = noopShareSink{}
+	}
 	return &shareHandler{
-		pyrin:     pyrin,
-		stats:     map[string]*WorkStats{},
-		statsLock: sync.Mutex{},
+		pyrin:       pyrin,
+		stats:       map[string]*WorkStats{},
+		statsLock:   sync.Mutex{},
+		statsOrder:  list.New(),
+		submitSlots: make(chan struct{}, maxConcurrentSubmits),
+		jobGrace:    jobGrace,
+		shareSink:   sink,
+
+		minShareInterval: minShareInterval,
+		invalidShares:    invalidShares,
+		shareLogSample:   int64(shareLogSample),
+	}
+}
+
+func (sh *shareHandler) recordShare(ctx *gostratum.StratumContext, jobId int, result ShareResult) {
+	state := GetMiningState(ctx)
+	diff, _ := state.difficulty()
+	sh.shareSink.RecordShare(newShareRecord(ctx, state.WireJobId(jobId), diff.diffValue, result))
+	sh.checkInvalidShares(ctx, result == ShareInvalid)
+	sh.checkStaleShares(ctx, result == ShareStale)
+}
+
+// workers need at least this many submissions in the window before the
+// invalid share policy applies, a couple of bad shares right after connecting
+// shouldn't get a rig kicked
+const minInvalidShareSamples = 20
+
+// checkInvalidShares counts a submission against the invalid share policy
+// and disconnects the worker if it's over the threshold
+func (sh *shareHandler) checkInvalidShares(ctx *gostratum.StratumContext, invalid bool) {
+	if !sh.invalidShares.enabled() {
+		return
+	}
+	shares, bad := GetMiningState(ctx).CountShareOutcome(sh.invalidShares.window, invalid)
+	if shares < minInvalidShareSamples || float64(bad)/float64(shares) <= sh.invalidShares.ratio {
+		return
+	}
+	msg := fmt.Sprintf("%d of the last %d shares were invalid, check the miner configuration", bad, shares)
+	ctx.Logger.Warn("disconnecting worker for invalid shares: " + msg)
+	RecordInvalidShareDisconnect(ctx)
+	disconnectWithMessage(ctx, msg)
+}
+
+// showMessage sends the client a client.show_message, best effort as only
+// miners that support it display the message to the user
+func showMessage(ctx *gostratum.StratumContext, msg string) {
+	ctx.Send(gostratum.NewEvent("", "client.show_message", []any{msg}))
+}
+
+// disconnectWithMessage tells the client why it's being disconnected before
+// disconnecting it
+func disconnectWithMessage(ctx *gostratum.StratumContext, reason string) {
+	showMessage(ctx, "disconnected: "+reason)
+	ctx.Disconnect()
+}
+
+// checkStuckJob counts a submission against the stuck job policy, returning
+// true if the worker was disconnected
+func (sh *shareHandler) checkStuckJob(ctx *gostratum.StratumContext, state *MiningState, jobId int) bool {
+	if sh.stuckJobs.lag <= 0 {
+		return false
+	}
+	lag, lagging := state.CountJobLag(jobId, sh.stuckJobs.lag)
+	if lagging == stuckJobShares {
+		ctx.Logger.Warn("worker appears stuck on an old job", zap.String("worker", ctx.WorkerName),
+			zap.Int("job", jobId), zap.Int("job_lag", lag), zap.Int("submissions", lagging))
+		RecordStuckJobWorker(ctx)
 	}
+	if sh.stuckJobs.disconnectAfter <= 0 || lagging < sh.stuckJobs.disconnectAfter {
+		return false
+	}
+	msg := fmt.Sprintf("the last %d shares were for jobs at least %d behind, the miner isn't picking up new jobs", lagging, sh.stuckJobs.lag)
+	ctx.Logger.Warn("disconnecting worker stuck on an old job: "+msg, zap.Int("job_lag", lag))
+	RecordStuckJobDisconnect(ctx)
+	disconnectWithMessage(ctx, msg)
+	return true
 }
 
 func (sh *shareHandler) getCreateStats(ctx *gostratum.StratumContext) *WorkStats {
@@ -62,13 +213,18 @@ func (sh *shareHandler) getCreateStats(ctx *gostratum.StratumContext) *WorkStats
 			delete(sh.stats, ctx.RemoteAddr)
 			stats.WorkerName = ctx.WorkerName
 			sh.stats[ctx.WorkerName] = stats
+			stats.order.Value = ctx.WorkerName
 		}
 	}
 	if !found { // legit doesn't exist, create it
+		if sh.maxStats > 0 && len(sh.stats) >= sh.maxStats {
+			sh.evictStats()
+		}
 		stats = &WorkStats{}
 		stats.LastShare = time.Now()
 		stats.WorkerName = ctx.RemoteAddr
 		stats.StartTime = time.Now()
+		stats.order = sh.statsOrder.PushFront(ctx.RemoteAddr)
 		sh.stats[ctx.RemoteAddr] = stats
 
 		// TODO: not sure this is the best place, nor whether we shouldn't be
@@ -83,40 +239,67 @@ func (sh *shareHandler) getCreateStats(ctx *gostratum.StratumContext) *WorkStats
 type submitInfo struct {
 	block    *appmessage.RPCBlock
 	state    *MiningState
+	jobId    int
 	noncestr string
 	nonceVal uint64
 }
 
-func validateSubmit(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent) (*submitInfo, error) {
+// validateSubmit parses the submit's params, [worker, job id, nonce].
+// There's no time field, jobs are hashed with their template's timestamp, so
+// strict rejects any params past the nonce rather than ignoring them
+func validateSubmit(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent, strict bool) (*submitInfo, error) {
 	if len(event.Params) < 3 {
-		RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
-		return nil, fmt.Errorf("malformed event, expected at least 2 params")
+		return nil, malformedSubmit(ctx, "params", "expected 3 params, got %d", len(event.Params))
+	}
+	if strict && len(event.Params) > 3 {
+		return nil, malformedSubmit(ctx, "extra_params", "expected 3 params, got %d", len(event.Params))
+	}
+	if _, ok := event.Params[0].(string); !ok {
+		return nil, malformedSubmit(ctx, "params", "unexpected type for param 0: %+v", event.Params...)
 	}
 	jobIdStr, ok := event.Params[1].(string)
 	if !ok {
-		RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
-		return nil, fmt.Errorf("unexpected type for param 1: %+v", event.Params...)
+		return nil, malformedSubmit(ctx, "params", "unexpected type for param 1: %+v", event.Params...)
 	}
-	jobId, err := strconv.ParseInt(jobIdStr, 10, 0)
+	wireId, err := strconv.ParseInt(jobIdStr, 10, 0)
 	if err != nil {
-		RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
-		return nil, errors.Wrap(err, "job id is not parsable as an number")
+		return nil, malformedSubmit(ctx, "job_id", "job id %q is not parsable as a number", jobIdStr)
 	}
+	noncestr, ok := event.Params[2].(string)
+	if !ok {
+		return nil, malformedSubmit(ctx, "params", "unexpected type for param 2: %+v", event.Params...)
+	}
+	noncestr = strings.TrimPrefix(noncestr, "0x")
+	if err := checkSubmitNonce(ctx, noncestr, strict); err != nil {
+		return nil, err
+	}
+	// a job that was sent but dropped for newer ones is stale, one that never
+	// was is something else entirely
 	state := GetMiningState(ctx)
-	block, exists := state.GetJob(int(jobId))
-	if !exists {
+	jobId, resolved := state.ResolveJobId(int(wireId))
+	if !resolved && state.WireJobExpired(int(wireId)) {
+		// a deterministic id for a job that aged out
 		RecordWorkerError(ctx.WalletAddr, ErrMissingJob)
-		return nil, fmt.Errorf("job does not exist. stale?")
+		return &submitInfo{state: state}, errors.Wrapf(ErrExpiredJobId, "job %d", wireId)
 	}
-	noncestr, ok := event.Params[2].(string)
-	if !ok {
-		RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
-		return nil, fmt.Errorf("unexpected type for param 2: %+v", event.Params...)
+	if !resolved {
+		RecordWorkerError(ctx.WalletAddr, ErrUnknownJob)
+		return &submitInfo{state: state}, errors.Wrapf(ErrUnknownJobId, "job %d was never sent", wireId)
+	}
+	block, exists := state.GetJob(jobId)
+	if !exists && state.JobIssued(jobId) {
+		RecordWorkerError(ctx.WalletAddr, ErrMissingJob)
+		return &submitInfo{state: state, jobId: jobId}, errors.Wrapf(ErrExpiredJobId, "job %d", jobId)
+	}
+	if !exists {
+		RecordWorkerError(ctx.WalletAddr, ErrUnknownJob)
+		return &submitInfo{state: state, jobId: jobId}, errors.Wrapf(ErrUnknownJobId, "job %d was never sent", jobId)
 	}
 	return &submitInfo{
 		state:    state,
 		block:    block,
-		noncestr: strings.Replace(noncestr, "0x", "", 1),
+		jobId:    jobId,
+		noncestr: noncestr,
 	}, nil
 }
 
@@ -125,6 +308,10 @@ var (
 	ErrDupeShare  = fmt.Errorf("duplicate share")
 )
 
+// how long a block candidate waits for a free submit slot before it's dropped,
+// any longer and the block would be stale anyway with 1s block times
+const submitQueueTimeout = 5 * time.Second
+
 // the max difference between tip blue score and job blue score that we'll accept
 // anything greater than this is considered a stale
 const workWindow = 8
@@ -143,37 +330,181 @@ func (sh *shareHandler) checkStales(ctx *gostratum.StratumContext, si *submitInf
 	return nil
 }
 
+// window over which the per-worker share rate limit is averaged
+const shareRateWindow = 10 * time.Second
+
+// checkShareRate is a safety valve against misconfigured miners flooding the
+// bridge with shares (e.g. stuck at a tiny difficulty). Once a worker exceeds
+// the rate its difficulty is doubled, once per window, and the excess shares
+// are rejected without being validated
+func (sh *shareHandler) checkShareRate(ctx *gostratum.StratumContext, state *MiningState) bool {
+	if sh.minShareInterval <= 0 {
+		return false
+	}
+	allowed := int(shareRateWindow / sh.minShareInterval)
+	if allowed < 1 {
+		allowed = 1
+	}
+	count := state.CountShareRate(shareRateWindow)
+	if count <= allowed {
+		return false
+	}
+	RecordThrottledShare(ctx)
+	state.pushLock.Lock()
+	defer state.pushLock.Unlock()
+	if count == allowed+1 && state.stratumDiff != nil {
+		ctx.Logger.Warn(fmt.Sprintf("share rate limit exceeded, raising difficulty to %f", state.stratumDiff.diffValue*2))
+		state.setDiff(state.stratumDiff.diffValue*2, DiffSourceRateLimit)
+		sendClientDiff(ctx, state)
+	}
+	return true
+}
+
+const nonceHexLen = 16
+
+// assembleNonce builds the header nonce the block is hashed and submitted
+// with from the miner's submission. The node has no notion of an extranonce,
+// it only sees the uint64 header nonce, so the split is purely between the
+// bridge and the miner: the hex nonce is read as a big endian number, the
+// extranonce taking its most significant bytes and the miner's extranonce2
+// the least significant ones. This matches how miners build the nonce they
+// hash with, a different arrangement would have the node (and the local pow
+// check) hash another nonce than the miner did
+func assembleNonce(extranonce string, extranonce2Size int, submitted string) (uint64, error) {
+	full, err := fullNonce(extranonce, extranonce2Size, submitted)
+	if err != nil {
+		return 0, err
+	}
+	nonce, err := strconv.ParseUint(full, 16, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed parsing nonce %s", full)
+	}
+	return nonce, nil
+}
+
+// nonceBucket returns the top 4 bits of the part of the nonce the miner
+// searched, below the extranonce the bridge handed out. Nonces from a
+// healthy miner fall about evenly across the 16 buckets over time, a miner
+// stuck on a few of them has broken nonce generation or isn't really
+// hashing. False if the extranonce leaves the miner too little of the nonce
+func nonceBucket(nonce uint64, extranonce string) (int, bool) {
+	bits := (nonceHexLen - len(extranonce)) * 4
+	if bits < 4 {
+		return 0, false
+	}
+	return int(nonce >> (bits - 4) & 0xf), true
+}
+
+// fullNonce rebuilds the 8 byte nonce (hex) from what the miner submitted.
+// With an extranonce the miner only submits its own part (extranonce2) which
+// is zero padded and appended to the extranonce, unless it's already the full
+// nonce. extranonce2Size is the negotiated size in bytes, 0 meaning the rest
+// of the nonce after the extranonce
+func fullNonce(extranonce string, extranonce2Size int, submitted string) (string, error) {
+	if extranonce == "" || len(submitted) == nonceHexLen {
+		return submitted, nil
+	}
+	extranonce2Len := extranonce2HexLen(extranonce, extranonce2Size)
+	if len(submitted) > extranonce2Len {
+		return "", fmt.Errorf("submitted nonce %s longer than the %d byte extranonce2", submitted, extranonce2Len/2)
+	}
+	return extranonce + fmt.Sprintf("%0*s", nonceHexLen-len(extranonce), submitted), nil
+}
+
+// staleWindowWidened returns true while shares for any retained job are
+// accepted, see InstabilityWiden
+func (sh *shareHandler) staleWindowWidened() bool {
+	return sh.instability != nil && sh.instability.NetworkUnstable()
+}
+
+// rejectStale counts and rejects a share for a job that's been superseded
+func (sh *shareHandler) rejectStale(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent, jobId int) error {
+	ctx.Logger.Info(fmt.Sprintf("stale share for job %d", jobId))
+	sh.getCreateStats(ctx).StaleShares.Add(1)
+	sh.overall.StaleShares.Add(1)
+	RecordStaleShare(ctx)
+	sh.recordShare(ctx, jobId, ShareStale)
+	return ctx.ReplyStaleShare(event.Id)
+}
+
+// rejectBlock counts and rejects a share whose block candidate wasn't taken,
+// as stale or invalid per result
+func (sh *shareHandler) rejectBlock(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent, jobId int, result ShareResult) error {
+	if result == ShareStale {
+		sh.getCreateStats(ctx).StaleShares.Add(1)
+		sh.overall.StaleShares.Add(1)
+		RecordStaleShare(ctx)
+		sh.recordShare(ctx, jobId, ShareStale)
+		return ctx.ReplyStaleShare(event.Id)
+	}
+	sh.getCreateStats(ctx).InvalidShares.Add(1)
+	sh.overall.InvalidShares.Add(1)
+	RecordInvalidShare(ctx)
+	sh.recordShare(ctx, jobId, ShareInvalid)
+	return ctx.ReplyBadShare(event.Id)
+}
+
 func (sh *shareHandler) HandleSubmit(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent) error {
-	submitInfo, err := validateSubmit(ctx, event)
+	trace := sh.tracer.start("share", workerAttrs(ctx)...)
+	err := sh.handleSubmit(ctx, event, trace)
+	trace.fail(err)
+	trace.finish()
+	return err
+}
+
+func (sh *shareHandler) handleSubmit(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent, trace *span) error {
+	received := time.Now()
+	if sh.drained.Load() {
+		// the connections are about to be closed, the share couldn't be
+		// credited anymore
+		ctx.Logger.Warn("dropping share submitted after the shutdown drain")
+		return ctx.ReplyMaintenance(event.Id, "Bridge shutting down")
+	}
+	submitInfo, err := validateSubmit(ctx, event, sh.strictSubmit)
+	if errors.Is(err, ErrMalformedSubmit) {
+		ctx.Logger.Warn("rejecting submit", zap.Error(err))
+		sh.checkInvalidShares(ctx, true)
+		return ctx.ReplyMalformedSubmit(event.Id)
+	}
+	if errors.Is(err, ErrExpiredJobId) {
+		return sh.rejectStale(ctx, event, submitInfo.jobId)
+	}
+	if errors.Is(err, ErrUnknownJobId) {
+		return sh.handleUnknownJob(ctx, event, err)
+	}
 	if err != nil {
+		sh.checkInvalidShares(ctx, true)
 		return err
 	}
+	trace.setAttr("job_id", submitInfo.jobId)
+	if sh.checkStuckJob(ctx, submitInfo.state, submitInfo.jobId) {
+		return nil
+	}
+	if sh.checkShareRate(ctx, submitInfo.state) {
+		return ctx.ReplyThrottledShare(event.Id)
+	}
 
-	// add extranonce to noncestr if enabled and submitted nonce is shorter than
-	// expected (16 - <extranonce length> characters)
-	if ctx.Extranonce != "" {
-		extranonce2Len := 16 - len(ctx.Extranonce)
-		if len(submitInfo.noncestr) <= extranonce2Len {
-			submitInfo.noncestr = ctx.Extranonce + fmt.Sprintf("%0*s", extranonce2Len, submitInfo.noncestr)
-		}
+	// the same nonce for big (bzminer) and split jobs
+	submitInfo.nonceVal, err = assembleNonce(ctx.Extranonce, ctx.Extranonce2Size, submitInfo.noncestr)
+	if err != nil {
+		sh.checkInvalidShares(ctx, true)
+		RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
+		return errors.Wrap(err, "failed rebuilding nonce")
 	}
 
 	//ctx.Logger.Debug(submitInfo.block.Header.BlueScore, " submit ", submitInfo.noncestr)
 	state := GetMiningState(ctx)
-	if state.useBigJob {
-		submitInfo.nonceVal, err = strconv.ParseUint(submitInfo.noncestr, 16, 64)
-		if err != nil {
-			RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
-			return errors.Wrap(err, "failed parsing noncestr")
-		}
-	} else {
-		submitInfo.nonceVal, err = strconv.ParseUint(submitInfo.noncestr, 16, 64)
-		if err != nil {
-			RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
-			return errors.Wrap(err, "failed parsing noncestr")
-		}
-	}
 	stats := sh.getCreateStats(ctx)
+	if sh.jobGrace > 0 && !sh.staleWindowWidened() && state.IsStaleJob(submitInfo.jobId, sh.jobGrace) {
+		return sh.rejectStale(ctx, event, submitInfo.jobId)
+	}
+	source := state.GetJobNode(submitInfo.jobId)
+	trace.setAttr("node", source)
+	if sh.desync.rejects(source) {
+		ctx.Logger.Info(fmt.Sprintf("node for job %d isn't synced, rejecting share", submitInfo.jobId))
+		RecordDesyncShare(desyncRejected)
+		return ctx.ReplyNodeSyncing(event.Id)
+	}
 	// if err := sh.checkStales(ctx, submitInfo); err != nil {
 	// 	if err == ErrDupeShare {
 	// 		ctx.Logger.Info("dupe share "+submitInfo.noncestr, ctx.WorkerName, ctx.WalletAddr)
@@ -191,81 +522,190 @@ func (sh *shareHandler) HandleSubmit(ctx *gostratum.StratumContext, event gostra
 	// 	return ctx.ReplyBadShare(event.Id)
 	// }
 
-	converted, err := appmessage.RPCBlockToDomainBlock(submitInfo.block)
+	// local validation is cpu bound, time it to spot when hashing becomes
+	// the bottleneck
+	validationStart := time.Now()
+	validate := trace.child("share.validate")
+	work, err := sh.validation.validate(submitInfo.block, submitInfo.nonceVal)
+	validate.fail(err)
+	validate.finish()
 	if err != nil {
-		return fmt.Errorf("failed to cast block to mutable block: %+v", err)
+		return err
+	}
+	RecordShareValidation(time.Since(validationStart))
+	diff, vardiff := state.difficulty()
+	// checking the hash is expensive enough to only do it when it's logged
+	if ce := ctx.Logger.Check(zap.DebugLevel, "share validated"); ce != nil {
+		ce.Write(
+			zap.Int("job", submitInfo.jobId),
+			zap.String("nonce", fmt.Sprintf("%016x", submitInfo.nonceVal)),
+			zap.String("hash", consensushashing.HeaderHash(work.header).String()),
+			zap.String("pow", work.value.Text(16)),
+			zap.Bool("block_candidate", work.blockCandidate()),
+			zap.Bool("meets_pool_diff", diff.targetValue != nil && work.value.Cmp(diff.targetValue) <= 0),
+			zap.Float64("pool_diff", diff.diffValue),
+		)
 	}
-	mutableHeader := converted.Header.ToMutable()
-	mutableHeader.SetNonce(submitInfo.nonceVal)
-	powState := pow.NewState(mutableHeader)
-	powValue := powState.CalculateProofOfWorkValue()
 
-	// The block hash must be less or equal than the claimed target.
-	if powValue.Cmp(&powState.Target) <= 0 {
-		if err := sh.submit(ctx, converted, submitInfo.nonceVal, event.Id); err != nil {
-			return err
-		}
+	// a share has to meet the client's difficulty to be credited, a random
+	// nonce would otherwise be paid like real work. Block candidates are
+	// submitted regardless
+	if !work.blockCandidate() && diff.targetValue != nil && work.value.Cmp(diff.targetValue) > 0 {
+		ctx.Logger.Debug(fmt.Sprintf("weak share for job %d", submitInfo.jobId))
+		stats.InvalidShares.Add(1)
+		sh.overall.InvalidShares.Add(1)
+		RecordWeakShare(ctx)
+		sh.recordShare(ctx, submitInfo.jobId, ShareInvalid)
+		return ctx.ReplyLowDiffShare(event.Id)
 	}
-	// remove for now until I can figure it out. No harm here as we're not
-	// } else if powValue.Cmp(state.stratumDiff.targetValue) >= 0 {
-	// 	ctx.Logger.Warn("weak block")
-	// 	RecordWeakShare(ctx)
-	// 	return ctx.ReplyLowDiffShare(event.Id)
-	// }
 
+	// only block candidates go to a node, every other share is accounted by
+	// the bridge alone and never costs an rpc call
+	if work.blockCandidate() {
+		RecordBlockCandidate()
+		if sh.desync.holds(source) {
+			// waiting for a node to sync would stall the miner's next shares,
+			// the share is credited now and the block submitted once a node
+			// synced. submit records the block if it's rejected after all
+			go func(block *externalapi.DomainBlock, nonce uint64, jobId int) {
+				sh.submit(ctx, block, nonce, jobId, sh.desync.submitTarget(ctx, source), received, nil)
+			}(work.block, submitInfo.nonceVal, submitInfo.jobId)
+		} else {
+			source = sh.desync.submitTarget(ctx, source)
+			if result := sh.submit(ctx, work.block, submitInfo.nonceVal, submitInfo.jobId, source, received, trace); result != ShareAccepted {
+				return sh.rejectBlock(ctx, event, submitInfo.jobId, result)
+			}
+		}
+	}
 	stats.SharesFound.Add(1)
-	stats.SharesDiff.Add(state.stratumDiff.hashValue)
-	stats.LastShare = time.Now()
-	sh.overall.SharesFound.Add(1)
-	RecordShareFound(ctx, state.stratumDiff.hashValue)
+	stats.SharesDiff.Add(diff.hashValue)
+	sh.touchStats(stats)
+	if accepted := sh.overall.SharesFound.Add(1); sh.shareLogSample > 0 && accepted%sh.shareLogSample == 0 {
+		ctx.Logger.Info("share accepted", zap.Int("job", submitInfo.jobId),
+			zap.Float64("diff", diff.diffValue), zap.Int64("total_accepted", accepted))
+	}
+	RecordShareFound(ctx, diff.hashValue)
+	if bucket, ok := nonceBucket(submitInfo.nonceVal, ctx.Extranonce); ok {
+		RecordNonceBucket(ctx, bucket)
+	}
+	RecordShareDifficulty(diff.diffValue)
+	if wait, first := state.FirstShare(time.Now()); first {
+		RecordTimeToFirstShare(wait)
+	}
+	if rate, estimated := state.EstimateHashrate(time.Now(), diff.hashValue, sh.hashrateWindow); estimated {
+		RecordWorkerHashrate(ctx, rate)
+	}
+	sh.recordShare(ctx, submitInfo.jobId, ShareAccepted)
+	if vardiff != nil {
+		vardiff.addShare(time.Now(), diff.diffValue)
+	}
 
-	return ctx.Reply(gostratum.JsonRpcResponse{
+	respond := trace.child("share.respond")
+	err = ctx.Reply(gostratum.JsonRpcResponse{
 		Id:     event.Id,
 		Result: true,
 	})
+	respond.fail(err)
+	respond.finish()
+	return err
 }
 
+// submit sends a block candidate to the node, returning how the share is
+// credited. It records a rejected block but leaves counting and answering the
+// share to the caller, see rejectBlock, so every share gets a single reply
 func (sh *shareHandler) submit(ctx *gostratum.StratumContext,
-	block *externalapi.DomainBlock, nonce uint64, eventId any) error {
+	block *externalapi.DomainBlock, nonce uint64, jobId int, source string, received time.Time, trace *span) ShareResult {
 	mutable := block.Header.ToMutable()
 	mutable.SetNonce(nonce)
 	block = &externalapi.DomainBlock{
 		Header:       mutable.ToImmutable(),
 		Transactions: block.Transactions,
 	}
-	_, err := sh.pyrin.SubmitBlock(block)
 	blockhash := consensushashing.BlockHash(block)
+
+	// bound the number of concurrent submits so a burst of block candidates
+	// can't flood the node, queue briefly for a free slot
+	RecordSubmitQueue(1)
+	select {
+	case sh.submitSlots <- struct{}{}:
+		RecordSubmitQueue(-1)
+	case <-time.After(submitQueueTimeout):
+		RecordSubmitQueue(-1)
+		ctx.Logger.Error(fmt.Sprintf("timed out waiting for a free submit slot, dropping block %s", blockhash))
+		return ShareInvalid
+	}
+	RecordInflightSubmit(1)
+	submitSpan := trace.child("share.submit", spanAttr{key: "hash", value: blockhash.String()})
+	reason, node, err := sh.pyrin.SubmitBlock(block, source)
+	submitSpan.setAttr("node", node)
+	submitSpan.fail(err)
+	submitSpan.finish()
+	RecordInflightSubmit(-1)
+	<-sh.submitSlots
+	if node != "" {
+		RecordBlockSubmit(node, time.Since(received))
+	}
+
 	// print after the submit to get it submitted faster
 	ctx.Logger.Info(fmt.Sprintf("Submitted block %s", blockhash))
 
 	if err != nil {
 		// :'(
-		if strings.Contains(err.Error(), "ErrDuplicateBlock") {
-			ctx.Logger.Warn("block rejected, stale")
-			// stale
-			sh.getCreateStats(ctx).StaleShares.Add(1)
-			sh.overall.StaleShares.Add(1)
-			RecordStaleShare(ctx)
-			return ctx.ReplyStaleShare(eventId)
+		rejected := RejectedBlock{
+			Time:       time.Now(),
+			Hash:       blockhash.String(),
+			DAAScore:   block.Header.DAAScore(),
+			BlueScore:  block.Header.BlueScore(),
+			Wallet:     ctx.WalletAddr,
+			Worker:     ctx.WorkerName,
+			RemoteAddr: ctx.RemoteAddr,
+			Job:        jobId,
+			SourceNode: source,
+			Node:       node,
+			Reason:     reason.String(),
+			Error:      err.Error(),
+			Duplicate:  strings.Contains(err.Error(), "ErrDuplicateBlock"),
+			LostRace:   lostRace(err),
+		}
+		rejected.Rejection = rejected.classify()
+		sh.rejections.add(rejected)
+		RecordBlockRejected(ctx, rejected.Rejection)
+		logFields := []zap.Field{zap.String("hash", rejected.Hash), zap.Uint64("daa_score", rejected.DAAScore),
+			zap.Int("job", jobId), zap.String("node", node), zap.String("reason", rejected.Reason)}
+		if rejected.Duplicate {
+			ctx.Logger.Warn("block rejected, stale", logFields...)
+			return ShareStale
+		} else if rejected.LostRace {
+			// bad luck rather than a problem, the share itself was fine
+			ctx.Logger.Info("block lost the race, the dag moved past it before it was submitted",
+				append(logFields, zap.Error(err))...)
+			RecordBlockLostRace(node)
+			if sh.lostRaces == LostRaceStale {
+				return ShareStale
+			}
+			return ShareAccepted
 		} else {
-			ctx.Logger.Warn("block rejected, unknown issue (probably bad pow", zap.Error(err))
-			sh.getCreateStats(ctx).InvalidShares.Add(1)
-			sh.overall.InvalidShares.Add(1)
-			RecordInvalidShare(ctx)
-			return ctx.ReplyBadShare(eventId)
+			ctx.Logger.Warn("block rejected, unknown issue (probably bad pow", append(logFields, zap.Error(err))...)
+			return ShareInvalid
 		}
 	}
 
 	// :)
-	ctx.Logger.Info(fmt.Sprintf("block accepted %s", blockhash))
+	ctx.Logger.Info(fmt.Sprintf("block accepted %s", blockhash),
+		zap.Uint64("daa_score", block.Header.DAAScore()),
+		zap.Uint64("blue_score", block.Header.BlueScore()),
+		zap.Int("job", jobId))
 	stats := sh.getCreateStats(ctx)
 	stats.BlocksFound.Add(1)
 	sh.overall.BlocksFound.Add(1)
 	RecordBlockFound(ctx, block.Header.Nonce(), block.Header.BlueScore(), blockhash.String())
+	// the submit response is only true/false, tell the rig which block it
+	// found where the miner supports it so farms can attribute it
+	showMessage(ctx, fmt.Sprintf("block found %s, daa score %d", blockhash, block.Header.DAAScore()))
 
-	// nil return allows HandleSubmit to record share (blocks are shares too!) and
+	// accepted allows HandleSubmit to record share (blocks are shares too!) and
 	// handle the response to the client
-	return nil
+	return ShareAccepted
 }
 
 func (sh *shareHandler) startStatsThread() error {
@@ -0,0 +1,999 @@
+package pyrinstratum
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/pyrin-network/pyipad/app/appmessage"
+	"github.com/pyrin-network/pyipad/domain/consensus/model/externalapi"
+	"github.com/pyrin-network/pyipad/domain/consensus/utils/consensushashing"
+	"github.com/pyrin-network/pyipad/domain/consensus/utils/pow"
+	"github.com/pyrin-network/pyipad/infrastructure/network/rpcclient"
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestFullNonce(t *testing.T) {
+	tests := []struct {
+		name            string
+		extranonce      string
+		extranonce2Size int
+		submitted       string
+		expected        string
+		err             bool
+	}{
+		{"no extranonce", "", 0, "00112233aabbccdd", "00112233aabbccdd", false},
+		{"1 byte extranonce, implied size", "0a", 0, "112233aabbccdd", "0a112233aabbccdd", false},
+		{"2 byte extranonce, short submit is padded", "0a0b", 0, "ff", "0a0b0000000000ff", false},
+		{"3 byte extranonce, implied size", "0a0b0c", 0, "33aabbccdd", "0a0b0c33aabbccdd", false},
+		{"2 byte extranonce, 4 byte extranonce2", "0a0b", 4, "aabbccdd", "0a0b0000aabbccdd", false},
+		{"1 byte extranonce, 7 byte extranonce2", "0a", 7, "112233aabbccdd", "0a112233aabbccdd", false},
+		{"3 byte extranonce, 2 byte extranonce2", "0a0b0c", 2, "ccdd", "0a0b0c000000ccdd", false},
+		{"full nonce submitted", "0a0b", 4, "0a0b1122aabbccdd", "0a0b1122aabbccdd", false},
+		{"longer than negotiated size", "0a0b", 4, "11aabbccdd", "", true},
+		{"longer than implied size", "0a0b0c", 0, "1133aabbccdd", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nonce, err := fullNonce(tt.extranonce, tt.extranonce2Size, tt.submitted)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, got nonce %s", nonce)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if nonce != tt.expected {
+				t.Fatalf("expected nonce %s, got %s", tt.expected, nonce)
+			}
+		})
+	}
+}
+
+func TestMalformedSubmit(t *testing.T) {
+	tests := []struct {
+		name   string
+		params []any
+		strict bool
+		reason string
+	}{
+		{"valid extranonce2", []any{"w", "1", "aabbccdd"}, true, ""},
+		{"valid full nonce", []any{"w", "1", "0x0a0b1122aabbccdd"}, true, ""},
+		{"short extranonce2 padded", []any{"w", "1", "ccdd"}, false, ""},
+		{"extra params ignored", []any{"w", "1", "aabbccdd", "65ab1234"}, false, ""},
+		{"missing nonce", []any{"w", "1"}, false, "params"},
+		{"numeric worker", []any{1, "1", "aabbccdd"}, false, "params"},
+		{"numeric nonce", []any{"w", "1", 12}, false, "params"},
+		{"job id not a number", []any{"w", "1a", "aabbccdd"}, false, "job_id"},
+		{"empty nonce", []any{"w", "1", ""}, false, "nonce_format"},
+		{"nonce not hex", []any{"w", "1", "aabbccxx"}, false, "nonce_format"},
+		{"nonce longer than 8 bytes", []any{"w", "1", "0a0b1122aabbccdd00"}, false, "nonce_format"},
+		{"nonce longer than extranonce2", []any{"w", "1", "11aabbccdd"}, false, "nonce_length"},
+		{"strict short extranonce2", []any{"w", "1", "ccdd"}, true, "nonce_length"},
+		{"strict full nonce without extranonce", []any{"w", "1", "ffff1122aabbccdd"}, true, "extranonce_mismatch"},
+		{"strict extra params", []any{"w", "1", "aabbccdd", "65ab1234"}, true, "extra_params"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+			ctx.Extranonce, ctx.Extranonce2Size = "0a0b", 4
+			GetMiningState(ctx).AddJob(&appmessage.RPCBlock{}, "mock")
+			counted := testutil.ToFloat64(malformedSubmitCounter.WithLabelValues(tt.reason))
+			_, err := validateSubmit(ctx, gostratum.JsonRpcEvent{Params: tt.params}, tt.strict)
+			if tt.reason == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrMalformedSubmit) {
+				t.Fatalf("expected the submit rejected as malformed, got %v", err)
+			}
+			if testutil.ToFloat64(malformedSubmitCounter.WithLabelValues(tt.reason)) != counted+1 {
+				t.Fatalf("expected the submit counted as %s: %s", tt.reason, err)
+			}
+		})
+	}
+
+	// rejected with a reply rather than dropping the connection
+	sh := newShareHandler(&mockSubmitter{}, 1, 0, nil, 0, invalidSharePolicy{}, 0)
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	replies := readAll(mc)
+	if err := sh.HandleSubmit(ctx, gostratum.JsonRpcEvent{Id: 1, Method: gostratum.StratumMethodSubmit, Params: []any{"w", "1", "zz"}}); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-replies; !strings.Contains(r, "Malformed submit") {
+		t.Fatalf("expected a malformed submit error, got %s", r)
+	}
+}
+
+func TestNonceBucket(t *testing.T) {
+	tests := []struct {
+		extranonce string
+		nonce      uint64
+		bucket     int
+	}{
+		{"", 0xa0112233aabbccdd, 0xa},
+		{"0a", 0x0a512233aabbccdd, 0x5},
+		{"0a0b", 0x0a0bf000aabbccdd, 0xf},
+		{"0a0b0c", 0x0a0b0c0000000000, 0},
+	}
+	for _, tt := range tests {
+		if bucket, ok := nonceBucket(tt.nonce, tt.extranonce); !ok || bucket != tt.bucket {
+			t.Fatalf("expected bucket %x for %016x with extranonce '%s', got %x", tt.bucket, tt.nonce, tt.extranonce, bucket)
+		}
+	}
+	if _, ok := nonceBucket(0, "0a0b0c0d0e0f0102"); ok {
+		t.Fatalf("expected no bucket with the whole nonce taken by the extranonce")
+	}
+}
+
+type mockSubmitter struct {
+	blocks []*externalapi.DomainBlock
+	// rejects every block with the error when set
+	err error
+}
+
+func (m *mockSubmitter) SubmitBlock(block *externalapi.DomainBlock, _ string) (appmessage.RejectReason, string, error) {
+	m.blocks = append(m.blocks, block)
+	if m.err != nil {
+		return appmessage.RejectReasonBlockInvalid, "mock", m.err
+	}
+	return appmessage.RejectReasonNone, "mock", nil
+}
+
+// the extranonce and its size solvedTestBlock mines with
+const testExtranonce, testExtranonce2Size = "0a0b", 4
+
+// solvedTestBlock returns an easy block and the extranonce2 a miner with
+// testExtranonce submits for it, along with the header nonce it solves with
+func solvedTestBlock(t *testing.T) (appmessage.RPCBlock, *externalapi.DomainBlock, string, uint64) {
+	block := appmessage.RPCBlock{}
+	if err := json.Unmarshal(selfTestHeader, &block.Header); err != nil {
+		t.Fatal(err)
+	}
+	block.Header.Bits = 0x1f7fffff // easy enough to solve in a few hundred hashes
+	converted, err := appmessage.RPCBlockToDomainBlock(&block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// miner side: the extranonce is the high bytes, the miner iterates the
+	// low (extranonce2) bytes
+	miner := pow.NewState(converted.Header.ToMutable())
+	var extranonce2 uint32
+	for ; extranonce2 < 1<<20; extranonce2++ {
+		miner.Nonce = 0x0a0b<<48 | uint64(extranonce2)
+		if miner.CalculateProofOfWorkValue().Cmp(&miner.Target) <= 0 {
+			return block, converted, fmt.Sprintf("%08x", extranonce2), miner.Nonce
+		}
+	}
+	t.Fatalf("failed solving the test block")
+	return block, nil, "", 0
+}
+
+// solvedTestShare returns a client mining the solved test block and the
+// share solving it
+func solvedTestShare(t *testing.T) (*gostratum.StratumContext, *gostratum.MockConnection, gostratum.JsonRpcEvent) {
+	block, _, submitted, _ := solvedTestBlock(t)
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	ctx.Extranonce, ctx.Extranonce2Size = testExtranonce, testExtranonce2Size
+	state := GetMiningState(ctx)
+	state.stratumDiff = newPyrinDiff()
+	state.stratumDiff.setDiffValue(1)
+	jobId := state.AddJob(&block, "mock")
+	return ctx, mc, gostratum.JsonRpcEvent{
+		Id:     1,
+		Method: gostratum.StratumMethodSubmit,
+		Params: []any{ctx.WalletAddr + "." + ctx.WorkerName, strconv.Itoa(jobId), submitted},
+	}
+}
+
+// testShareNonce returns the first nonce whose pow meets the target, or
+// with meets unset the first that doesn't
+func testShareNonce(t *testing.T, block *appmessage.RPCBlock, target *big.Int, meets bool) uint64 {
+	for nonce := uint64(1); nonce < 1<<20; nonce++ {
+		work, err := computeProofOfWork(block, nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (work.value.Cmp(target) <= 0) == meets {
+			return nonce
+		}
+	}
+	t.Fatalf("failed finding a share nonce")
+	return 0
+}
+
+type recordingShareSink struct {
+	shares []ShareRecord
+}
+
+func (rs *recordingShareSink) RecordShare(share ShareRecord) {
+	rs.shares = append(rs.shares, share)
+}
+
+func TestWeakShare(t *testing.T) {
+	sink := &recordingShareSink{}
+	sh := newShareHandler(&mockSubmitter{}, 1, 0, sink, 0, invalidSharePolicy{}, 0)
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	state := GetMiningState(ctx)
+	state.stratumDiff = newPyrinDiff()
+	state.stratumDiff.setDiffValue(1.0 / (1 << 24)) // a share in a few hundred hashes
+	block := appmessage.RPCBlock{}
+	if err := json.Unmarshal(selfTestHeader, &block.Header); err != nil {
+		t.Fatal(err)
+	}
+	jobId := state.AddJob(&block, "mock")
+	replies := readAll(mc)
+	submit := func(nonce uint64) string {
+		if err := sh.HandleSubmit(ctx, gostratum.JsonRpcEvent{
+			Id:     1,
+			Method: gostratum.StratumMethodSubmit,
+			Params: []any{ctx.WalletAddr + "." + ctx.WorkerName, strconv.Itoa(jobId), fmt.Sprintf("%016x", nonce)},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return <-replies
+	}
+
+	if r := submit(testShareNonce(t, &block, state.stratumDiff.targetValue, false)); !strings.Contains(r, "Invalid difficulty") {
+		t.Fatalf("expected a share below the difficulty rejected, got %s", r)
+	}
+	if sh.overall.SharesFound.Load() != 0 || sh.overall.InvalidShares.Load() != 1 ||
+		len(sink.shares) != 1 || sink.shares[0].Result != ShareInvalid {
+		t.Fatalf("expected the weak share counted invalid and not credited, got %+v", sink.shares)
+	}
+	if r := submit(testShareNonce(t, &block, state.stratumDiff.targetValue, true)); !strings.Contains(r, `"result":true`) {
+		t.Fatalf("expected a share meeting the difficulty accepted, got %s", r)
+	}
+	if sh.overall.SharesFound.Load() != 1 || len(sink.shares) != 2 || sink.shares[1].Result != ShareAccepted {
+		t.Fatalf("expected the share credited, got %+v", sink.shares)
+	}
+}
+
+// TestSubmitSolvedBlock mines a block the way a miner with an extranonce
+// does and checks the block handed to the node carries the nonce that was
+// actually hashed, and that the node would accept its pow
+func TestSubmitSolvedBlock(t *testing.T) {
+	_, converted, submitted, solved := solvedTestBlock(t)
+	if nonce, err := assembleNonce(testExtranonce, testExtranonce2Size, submitted); err != nil || nonce != solved {
+		t.Fatalf("expected nonce %016x assembled from %s, got %016x (%v)", solved, submitted, nonce, err)
+	}
+
+	submitter := &mockSubmitter{}
+	sh := newShareHandler(submitter, 1, 0, nil, 0, invalidSharePolicy{}, 0)
+	ctx, mc, event := solvedTestShare(t)
+
+	writes := make(chan string, 2)
+	for i := 0; i < 2; i++ { // block found message and the submit response
+		mc.AsyncReadTestDataFromBuffer(func(b []byte) { writes <- string(b) })
+	}
+	candidates := testutil.ToFloat64(blockCandidateCounter)
+	if err := sh.HandleSubmit(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	found, reply := <-writes, <-writes
+	if !strings.Contains(reply, "true") {
+		t.Fatalf("expected the share accepted, got %s", reply)
+	}
+
+	if testutil.ToFloat64(blockCandidateCounter) != candidates+1 {
+		t.Fatalf("expected the share counted as a block candidate")
+	}
+	if len(submitter.blocks) != 1 {
+		t.Fatalf("expected the solved block to be submitted, got %d submits", len(submitter.blocks))
+	}
+	header := submitter.blocks[0].Header
+	if header.Nonce() != solved {
+		t.Fatalf("expected submitted nonce %016x, got %016x", solved, header.Nonce())
+	}
+	node := pow.NewState(header.ToMutable())
+	if node.CalculateProofOfWorkValue().Cmp(&node.Target) > 0 {
+		t.Fatalf("submitted block doesn't meet its target")
+	}
+	expectedHeader := converted.Header.ToMutable()
+	expectedHeader.SetNonce(solved)
+	hash := consensushashing.BlockHash(submitter.blocks[0])
+	if !hash.Equal(consensushashing.HeaderHash(expectedHeader)) {
+		t.Fatalf("unexpected submitted block hash %s", hash)
+	}
+
+	// the block is attributed to the worker that found it
+	if !strings.Contains(found, "client.show_message") || !strings.Contains(found, "block found "+hash.String()) {
+		t.Fatalf("expected the miner told which block it found, got %s", found)
+	}
+	if blocks := testutil.ToFloat64(blockCounter.With(commonLabels(ctx))); blocks != 1 {
+		t.Fatalf("expected the block counted for the worker, got %f", blocks)
+	}
+	if stats := sh.getCreateStats(ctx); stats.BlocksFound.Load() != 1 || sh.overall.BlocksFound.Load() != 1 {
+		t.Fatalf("expected the block in the worker's stats")
+	}
+}
+
+func TestRejectedBlockReply(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		err   error
+		reply string
+	}{
+		{"duplicate", fmt.Errorf("ErrDuplicateBlock"), "Job not found"},
+		{"lost race", fmt.Errorf("block is too far behind virtual's DAA score"), "Job not found"},
+		{"invalid", fmt.Errorf("block has invalid merkle root"), "Unknown problem"},
+	} {
+		sh := newShareHandler(&mockSubmitter{err: c.err}, 1, 0, nil, 0, invalidSharePolicy{}, 0)
+		sh.lostRaces = LostRaceStale
+		ctx, mc, event := solvedTestShare(t)
+		messages := readAll(mc)
+		if err := sh.HandleSubmit(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+		var replies []string
+		for done := false; !done; {
+			select {
+			case msg := <-messages:
+				replies = append(replies, msg)
+			case <-time.After(100 * time.Millisecond):
+				done = true
+			}
+		}
+		if len(replies) != 1 || !strings.Contains(replies[0], c.reply) {
+			t.Errorf("%s: expected a single %q reply, got %v", c.name, c.reply, replies)
+		}
+		stats := sh.getCreateStats(ctx)
+		if stats.SharesFound.Load() != 0 || sh.overall.SharesFound.Load() != 0 ||
+			stats.StaleShares.Load()+stats.InvalidShares.Load() != 1 {
+			t.Errorf("%s: expected the share counted once and not accepted", c.name)
+		}
+	}
+}
+
+// blockingSubmitter holds every submit until released
+type blockingSubmitter struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (m *blockingSubmitter) SubmitBlock(*externalapi.DomainBlock, string) (appmessage.RejectReason, string, error) {
+	m.started <- struct{}{}
+	<-m.release
+	return appmessage.RejectReasonNone, "mock", nil
+}
+
+func TestConcurrentSubmitLimit(t *testing.T) {
+	submitter := &blockingSubmitter{started: make(chan struct{}), release: make(chan struct{})}
+	sh := newShareHandler(submitter, 1, 0, nil, 0, invalidSharePolicy{}, 0)
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	for i := 0; i < 2; i++ { // block found messages
+		mc.AsyncReadTestDataFromBuffer(func([]byte) {})
+	}
+	block := appmessage.RPCBlock{}
+	if err := json.Unmarshal(selfTestHeader, &block.Header); err != nil {
+		t.Fatal(err)
+	}
+	converted, err := appmessage.RPCBlockToDomainBlock(&block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inflight, queued := testutil.ToFloat64(inflightSubmitGauge), testutil.ToFloat64(submitQueueGauge)
+	done := make(chan ShareResult, 2)
+	for nonce := uint64(1); nonce <= 2; nonce++ {
+		go func(nonce uint64) {
+			done <- sh.submit(ctx, converted, nonce, 1, "mock", time.Now(), nil)
+		}(nonce)
+	}
+	<-submitter.started
+	for deadline := time.Now().Add(time.Second); testutil.ToFloat64(submitQueueGauge) != queued+1; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the second submit queued for the slot")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if testutil.ToFloat64(inflightSubmitGauge) != inflight+1 {
+		t.Fatalf("expected a single submit in flight, got %f", testutil.ToFloat64(inflightSubmitGauge)-inflight)
+	}
+
+	submitter.release <- struct{}{}
+	<-submitter.started
+	if testutil.ToFloat64(submitQueueGauge) != queued || testutil.ToFloat64(inflightSubmitGauge) != inflight+1 {
+		t.Fatalf("expected the queued submit to take the freed slot")
+	}
+	submitter.release <- struct{}{}
+	for i := 0; i < 2; i++ {
+		if result := <-done; result != ShareAccepted {
+			t.Fatalf("expected both blocks accepted, got %s", result)
+		}
+	}
+	if testutil.ToFloat64(inflightSubmitGauge) != inflight || sh.overall.BlocksFound.Load() != 2 {
+		t.Fatalf("expected both blocks submitted and nothing left in flight")
+	}
+}
+
+// mockSyncChecker has nodes a and b, synced unless listed
+type mockSyncChecker struct {
+	lock     sync.Mutex
+	unsynced map[string]bool
+}
+
+func (m *mockSyncChecker) set(unsynced ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.unsynced = map[string]bool{}
+	for _, node := range unsynced {
+		m.unsynced[node] = true
+	}
+}
+
+func (m *mockSyncChecker) NodeSynced(address string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return !m.unsynced[address]
+}
+
+func (m *mockSyncChecker) AnyNodeSynced() bool {
+	return m.NodeSynced("a") || m.NodeSynced("b")
+}
+
+func TestDesyncPolicy(t *testing.T) {
+	ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	nodes := &mockSyncChecker{}
+	nodes.set("a")
+
+	disabled := desyncPolicy{mode: DesyncReject}
+	if disabled.rejects("a") || disabled.submitTarget(ctx, "a") != "a" {
+		t.Fatalf("expected the policy to be disabled without a sync checker")
+	}
+
+	reject := desyncPolicy{mode: DesyncReject, nodes: nodes}
+	if !reject.rejects("a") || reject.rejects("b") {
+		t.Fatalf("expected only shares for the unsynced node to be rejected")
+	}
+
+	failover := desyncPolicy{mode: DesyncFailover, nodes: nodes}
+	if failover.rejects("a") {
+		t.Fatalf("expected failover to credit shares while another node is synced")
+	}
+	if target := failover.submitTarget(ctx, "a"); target != "" {
+		t.Fatalf("expected the block to be left to the synced nodes, got %s", target)
+	}
+	if target := failover.submitTarget(ctx, "b"); target != "b" {
+		t.Fatalf("expected a synced source to be submitted to, got %s", target)
+	}
+
+	nodes.set("a", "b")
+	if !failover.rejects("a") {
+		t.Fatalf("expected failover to reject shares with no synced node")
+	}
+
+	buffer := desyncPolicy{mode: DesyncBuffer, buffer: time.Second, nodes: nodes}
+	if buffer.rejects("a") {
+		t.Fatalf("expected buffer to credit shares")
+	}
+	go func() {
+		time.Sleep(desyncPollInterval / 2)
+		nodes.set("b")
+	}()
+	if target := buffer.submitTarget(ctx, "a"); target != "a" {
+		t.Fatalf("expected the block to be held until its node synced, got %s", target)
+	}
+}
+
+func TestDesyncBufferedSubmit(t *testing.T) {
+	submitter := &blockingSubmitter{started: make(chan struct{}, 1), release: make(chan struct{}, 1)}
+	sh := newShareHandler(submitter, 1, 0, nil, 0, invalidSharePolicy{}, 0)
+	nodes := &mockSyncChecker{}
+	nodes.set("mock", "a", "b")
+	sh.desync = desyncPolicy{mode: DesyncBuffer, buffer: time.Minute, nodes: nodes}
+	ctx, mc, event := solvedTestShare(t)
+	messages := readAll(mc)
+
+	// the share is answered while the block is still held
+	if err := sh.HandleSubmit(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	if reply := <-messages; !strings.Contains(reply, "true") || sh.overall.SharesFound.Load() != 1 {
+		t.Fatalf("expected the share credited right away, got %s", reply)
+	}
+	select {
+	case <-submitter.started:
+		t.Fatalf("expected the block held while no node is synced")
+	case <-time.After(2 * desyncPollInterval):
+	}
+
+	nodes.set()
+	submitter.release <- struct{}{}
+	select {
+	case <-submitter.started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the held block submitted once its node synced")
+	}
+}
+
+func TestDesyncReject(t *testing.T) {
+	sh := newShareHandler(&mockSubmitter{}, 1, 0, nil, 0, invalidSharePolicy{}, 0)
+	nodes := &mockSyncChecker{}
+	nodes.set("mock")
+	sh.desync = desyncPolicy{mode: DesyncReject, nodes: nodes}
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	state := GetMiningState(ctx)
+	state.stratumDiff = newPyrinDiff()
+	block := appmessage.RPCBlock{}
+	if err := json.Unmarshal(selfTestHeader, &block.Header); err != nil {
+		t.Fatal(err)
+	}
+	jobId := state.AddJob(&block, "mock")
+
+	reply := make(chan string, 1)
+	mc.AsyncReadTestDataFromBuffer(func(b []byte) { reply <- string(b) })
+	event := gostratum.JsonRpcEvent{
+		Id:     1,
+		Method: gostratum.StratumMethodSubmit,
+		Params: []any{ctx.WalletAddr + "." + ctx.WorkerName, strconv.Itoa(jobId), "0000000000000001"},
+	}
+	if err := sh.HandleSubmit(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-reply; !strings.Contains(r, "Node syncing") {
+		t.Fatalf("expected a retryable node syncing error, got %s", r)
+	}
+	if found := sh.overall.SharesFound.Load(); found != 0 {
+		t.Fatalf("expected the share not to be credited, got %d", found)
+	}
+}
+
+func TestOnlyCandidatesSubmitted(t *testing.T) {
+	submitter := &mockSubmitter{}
+	sh := newShareHandler(submitter, 1, 0, nil, 0, invalidSharePolicy{}, 0)
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	state := GetMiningState(ctx)
+	state.stratumDiff = newPyrinDiff()
+	block := appmessage.RPCBlock{}
+	if err := json.Unmarshal(selfTestHeader, &block.Header); err != nil {
+		t.Fatal(err)
+	}
+	jobId := state.AddJob(&block, "mock")
+
+	replies := readAll(mc)
+	for i := 1; i <= 3; i++ {
+		event := gostratum.JsonRpcEvent{
+			Id:     i,
+			Method: gostratum.StratumMethodSubmit,
+			Params: []any{ctx.WalletAddr + "." + ctx.WorkerName, strconv.Itoa(jobId), fmt.Sprintf("%016x", i)},
+		}
+		if err := sh.HandleSubmit(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+		if r := <-replies; !strings.Contains(r, `"result":true`) {
+			t.Fatalf("expected the share accepted, got %s", r)
+		}
+	}
+	if found := sh.overall.SharesFound.Load(); found != 3 {
+		t.Fatalf("expected 3 shares credited, got %d", found)
+	}
+	if len(submitter.blocks) != 0 {
+		t.Fatalf("expected shares below the network target not to reach a node, got %d submits", len(submitter.blocks))
+	}
+}
+
+func TestPreviousJobGrace(t *testing.T) {
+	sh := newShareHandler(&mockSubmitter{}, 1, time.Hour, nil, 0, invalidSharePolicy{}, 0)
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	state := GetMiningState(ctx)
+	state.stratumDiff = newPyrinDiff()
+	addJob := func(parent string) int {
+		block := appmessage.RPCBlock{}
+		if err := json.Unmarshal(selfTestHeader, &block.Header); err != nil {
+			t.Fatal(err)
+		}
+		block.Header.Parents[0].ParentHashes[0] = strings.Repeat(parent, 64)
+		return state.AddJob(&block, "mock")
+	}
+
+	replies := readAll(mc)
+	submit := func(jobId int) string {
+		if err := sh.HandleSubmit(ctx, gostratum.JsonRpcEvent{
+			Id:     1,
+			Method: gostratum.StratumMethodSubmit,
+			Params: []any{ctx.WalletAddr + "." + ctx.WorkerName, strconv.Itoa(jobId), "0000000000000001"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return <-replies
+	}
+	first := addJob("a")
+	current := addJob("b")
+	if r := submit(first); !strings.Contains(r, "true") {
+		t.Fatalf("expected a share for the previous job accepted within the grace, got %s", r)
+	}
+	if r := submit(current); !strings.Contains(r, "true") {
+		t.Fatalf("expected a share for the current job accepted, got %s", r)
+	}
+
+	addJob("c")
+	if r := submit(first); !strings.Contains(r, "Job not found") {
+		t.Fatalf("expected a share two jobs back rejected as stale, got %s", r)
+	}
+	sh.jobGrace = time.Nanosecond
+	if r := submit(current); !strings.Contains(r, "Job not found") {
+		t.Fatalf("expected a share for the previous job rejected once the grace is over, got %s", r)
+	}
+	if sh.overall.SharesFound.Load() != 2 || sh.overall.StaleShares.Load() != 2 {
+		t.Fatalf("expected 2 accepted and 2 stale shares, got %d and %d",
+			sh.overall.SharesFound.Load(), sh.overall.StaleShares.Load())
+	}
+}
+
+func TestUnknownJob(t *testing.T) {
+	sh := newShareHandler(&mockSubmitter{}, 1, 0, nil, 0, invalidSharePolicy{}, 0)
+	sh.unknownJobs = UnknownJobReject
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	state := GetMiningState(ctx)
+	state.stratumDiff = newPyrinDiff()
+	block := appmessage.RPCBlock{}
+	if err := json.Unmarshal(selfTestHeader, &block.Header); err != nil {
+		t.Fatal(err)
+	}
+	// the first job's slot has long been reused by a newer one
+	first := state.AddJob(&block, "mock")
+	for i := 0; i < maxjobs; i++ {
+		state.AddJob(&block, "mock")
+	}
+
+	replies := readAll(mc)
+	submit := func(jobId int) error {
+		return sh.HandleSubmit(ctx, gostratum.JsonRpcEvent{
+			Id:     1,
+			Method: gostratum.StratumMethodSubmit,
+			Params: []any{ctx.WalletAddr + "." + ctx.WorkerName, strconv.Itoa(jobId), "0000000000000001"},
+		})
+	}
+	unknown := testutil.ToFloat64(unknownJobCounter)
+	if err := submit(first); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-replies; !strings.Contains(r, "Job not found") {
+		t.Fatalf("expected a job no longer retained rejected as stale, got %s", r)
+	}
+	if stale := sh.overall.StaleShares.Load(); stale != 1 || testutil.ToFloat64(unknownJobCounter) != unknown {
+		t.Fatalf("expected the share counted stale and not as an unknown job, got %d stale", stale)
+	}
+
+	if err := submit(first + 1000); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-replies; !strings.Contains(r, "Unknown job") {
+		t.Fatalf("expected a job never sent rejected as unknown, got %s", r)
+	}
+	if stale := sh.overall.StaleShares.Load(); stale != 1 || testutil.ToFloat64(unknownJobCounter) != unknown+1 {
+		t.Fatalf("expected the share counted as an unknown job and not stale, got %d stale", stale)
+	}
+
+	// deterministic ids that aged out are stale, ones never sent unknown
+	ctx, mc = gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	state = GetMiningState(ctx)
+	state.stratumDiff = newPyrinDiff()
+	state.deterministicJobs = true
+	aged := state.WireJobId(state.AddJob(jobWithParents("aa"), "mock"))
+	for i := 0; i < maxjobs; i++ {
+		state.AddJob(jobWithParents(strconv.Itoa(i)), "mock")
+	}
+	replies = readAll(mc)
+	if err := submit(aged); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-replies; !strings.Contains(r, "Job not found") {
+		t.Fatalf("expected an aged out deterministic id rejected as stale, got %s", r)
+	}
+	if err := submit(aged ^ 1); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-replies; !strings.Contains(r, "Unknown job") {
+		t.Fatalf("expected a deterministic id never sent rejected as unknown, got %s", r)
+	}
+	if stale := sh.overall.StaleShares.Load(); stale != 2 || testutil.ToFloat64(unknownJobCounter) != unknown+2 {
+		t.Fatalf("expected one stale and one unknown job share, got %d stale", stale)
+	}
+
+	sh.unknownJobs = UnknownJobDisconnect
+	if err := submit(-1); !errors.Is(err, ErrUnknownJobId) {
+		t.Fatalf("expected the client dropped for an unknown job, got %v", err)
+	}
+}
+
+func TestRejectedBlocks(t *testing.T) {
+	sh := newShareHandler(&mockSubmitter{err: fmt.Errorf("block has invalid merkle root")}, 1, 0, nil, 0, invalidSharePolicy{}, 0)
+	ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	ctx.WorkerName = "rig1"
+	block := appmessage.RPCBlock{}
+	if err := json.Unmarshal(selfTestHeader, &block.Header); err != nil {
+		t.Fatal(err)
+	}
+	converted, err := appmessage.RPCBlockToDomainBlock(&block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < rejectedBlockHistory+1; i++ {
+		if result := sh.submit(ctx, converted, uint64(i), 7, "a", time.Now(), nil); result != ShareInvalid {
+			t.Fatalf("expected the rejected block's share invalid, got %s", result)
+		}
+	}
+	rejected := sh.rejections.recent()
+	if len(rejected) != rejectedBlockHistory {
+		t.Fatalf("expected the last %d rejected blocks kept, got %d", rejectedBlockHistory, len(rejected))
+	}
+	latest := rejected[0]
+	if latest.Worker != "rig1" || latest.Job != 7 || latest.SourceNode != "a" || latest.Node != "mock" ||
+		latest.Reason != appmessage.RejectReasonBlockInvalid.String() || latest.Duplicate ||
+		!strings.Contains(latest.Error, "merkle root") || latest.DAAScore != converted.Header.DAAScore() {
+		t.Fatalf("unexpected rejected block details %+v", latest)
+	}
+	mutable := converted.Header.ToMutable()
+	mutable.SetNonce(rejectedBlockHistory)
+	if latest.Hash != consensushashing.HeaderHash(mutable).String() {
+		t.Fatalf("expected the latest rejected block first, got %s", latest.Hash)
+	}
+}
+
+func TestBlockRejections(t *testing.T) {
+	node := &mockRpcClient{}
+	sh := newShareHandler(testMultiNodeApi(0, node), 1, 0, nil, 0, invalidSharePolicy{}, 0)
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	ctx.WorkerName = "rig1"
+	go func() {
+		for range readAll(mc) {
+		}
+	}()
+	block := appmessage.RPCBlock{}
+	if err := json.Unmarshal(selfTestHeader, &block.Header); err != nil {
+		t.Fatal(err)
+	}
+	converted, err := appmessage.RPCBlockToDomainBlock(&block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, c := range []struct {
+		reason    appmessage.RejectReason
+		err       error
+		rejection string
+	}{
+		{appmessage.RejectReasonBlockInvalid, errors.Wrap(rpcclient.ErrRPC, "ErrDuplicateBlock"), blockRejectedDuplicate},
+		{appmessage.RejectReasonBlockInvalid, errors.Wrap(rpcclient.ErrRPC, "block is too far behind virtual's DAA score"), blockRejectedStale},
+		{appmessage.RejectReasonIsInIBD, errors.Wrap(rpcclient.ErrRPC, "node is not synced"), blockRejectedSyncing},
+		{appmessage.RejectReasonBlockInvalid, errors.Wrap(rpcclient.ErrRPC, "ErrBadMerkleRoot"), blockRejectedInvalid},
+		{appmessage.RejectReasonNone, fmt.Errorf("connection refused"), blockRejectedFailed},
+	} {
+		counter := blockRejectedCounter.With(withLabel(commonLabels(ctx), "rejection", c.rejection))
+		before := testutil.ToFloat64(counter)
+		node.submitReason, node.submitErr = c.reason, c.err
+		sh.submit(ctx, converted, uint64(i), 7, "mock0", time.Now(), nil)
+		if testutil.ToFloat64(counter) != before+1 {
+			t.Errorf("expected %q counted as %s", c.err, c.rejection)
+		}
+		if latest := sh.rejections.recent()[0]; latest.Rejection != c.rejection {
+			t.Errorf("expected %q kept as %s, got %s", c.err, c.rejection, latest.Rejection)
+		}
+	}
+
+	node.submitReason, node.submitErr = appmessage.RejectReasonNone, nil
+	lastBlockGauge.Set(0)
+	if result := sh.submit(ctx, converted, 100, 7, "mock0", time.Now(), nil); result != ShareAccepted {
+		t.Fatalf("expected the accepted block's share credited, got %s", result)
+	}
+	if last := testutil.ToFloat64(lastBlockGauge); time.Since(time.Unix(int64(last), 0)) > time.Minute {
+		t.Fatalf("expected the accepted block's time published, got %f", last)
+	}
+	if len(sh.rejections.recent()) != 5 {
+		t.Fatalf("expected the accepted block not kept as rejected")
+	}
+}
+
+func TestLostRaceBlocks(t *testing.T) {
+	submitter := &mockSubmitter{err: fmt.Errorf("block is too far behind virtual's DAA score")}
+	sh := newShareHandler(submitter, 1, 0, nil, 0, invalidSharePolicy{}, 0)
+	sh.lostRaces = LostRaceCredit
+	ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	block := appmessage.RPCBlock{}
+	if err := json.Unmarshal(selfTestHeader, &block.Header); err != nil {
+		t.Fatal(err)
+	}
+	converted, err := appmessage.RPCBlockToDomainBlock(&block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lost := testutil.ToFloat64(blockLostRaceCounter.WithLabelValues("mock"))
+	if result := sh.submit(ctx, converted, 1, 7, "a", time.Now(), nil); result != ShareAccepted {
+		t.Fatalf("expected the lost race credited, got %s", result)
+	}
+	if rejected := sh.rejections.recent(); len(rejected) != 1 || !rejected[0].LostRace || rejected[0].Duplicate {
+		t.Fatalf("expected the block recorded as a lost race, got %+v", rejected)
+	}
+	if sh.overall.InvalidShares.Load() != 0 || sh.overall.StaleShares.Load() != 0 ||
+		testutil.ToFloat64(blockLostRaceCounter.WithLabelValues("mock")) != lost+1 {
+		t.Fatalf("expected the share left to be credited and the lost race counted")
+	}
+	if submitVerdict(appmessage.RejectReasonBlockInvalid, submitter.err) == verdictInvalid {
+		t.Fatalf("expected a lost race not to count against the node")
+	}
+
+	sh.lostRaces = LostRaceStale
+	if result := sh.submit(ctx, converted, 2, 7, "a", time.Now(), nil); result != ShareStale {
+		t.Fatalf("expected the share rejected as stale, got %s", result)
+	}
+
+	submitter.err = fmt.Errorf("block has invalid merkle root")
+	if lostRace(submitter.err) || !lostRace(fmt.Errorf("rule error: ErrViolatingBoundedMergeDepth")) {
+		t.Fatalf("expected only late blocks to be lost races")
+	}
+}
+
+func TestWorkerStatsEviction(t *testing.T) {
+	sh := newShareHandler(nil, 1, 0, nil, 0, invalidSharePolicy{}, 0)
+	sh.maxStats = 2
+	evicted := testutil.ToFloat64(trackingEvictedCounter.WithLabelValues(trackedWorkerStats))
+	worker := func(name string) *WorkStats {
+		ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+		ctx.WorkerName, ctx.RemoteAddr = name, name
+		return sh.getCreateStats(ctx)
+	}
+	rig1 := worker("rig1")
+	rig2 := worker("rig2")
+	rig2.SharesFound.Add(1)
+	sh.touchStats(rig1)
+	sh.touchStats(rig2)
+	worker("rig3")
+	if _, tracked := sh.stats["rig1"]; tracked || len(sh.stats) != 2 ||
+		testutil.ToFloat64(trackingEvictedCounter.WithLabelValues(trackedWorkerStats)) != evicted+1 {
+		t.Fatalf("expected the least recently sharing worker evicted, got %v", sh.stats)
+	}
+	if shares := worker("rig2").SharesFound.Load(); shares != 1 {
+		t.Fatalf("expected the other workers' stats kept, got %d shares", shares)
+	}
+	// a share from an evicted worker's old stats doesn't bring them back
+	sh.touchStats(rig1)
+	sh.touchStats(rig2)
+	worker("rig4")
+	if _, tracked := sh.stats["rig3"]; tracked || sh.statsOrder.Len() != len(sh.stats) {
+		t.Fatalf("expected the least recently sharing worker evicted, got %v", sh.stats)
+	}
+}
+
+func TestInvalidShareDisconnect(t *testing.T) {
+	sh := newShareHandler(nil, 1, 0, nil, 0, invalidSharePolicy{ratio: 0.5, window: time.Minute}, 0)
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	messages := readAll(mc)
+	disconnects := testutil.ToFloat64(invalidShareDisconnectCounter.With(commonLabels(ctx)))
+	for i := 0; i < minInvalidShareSamples-1; i++ {
+		sh.checkInvalidShares(ctx, true)
+	}
+	if !ctx.Connected() {
+		t.Fatalf("expected the worker kept until there are enough samples")
+	}
+	sh.checkInvalidShares(ctx, true)
+	if msg := <-messages; !strings.Contains(msg, "client.show_message") ||
+		!strings.Contains(msg, "disconnected: 20 of the last 20 shares were invalid") {
+		t.Fatalf("expected the reason shown to the miner, got %s", msg)
+	}
+	if ctx.Connected() || testutil.ToFloat64(invalidShareDisconnectCounter.With(commonLabels(ctx))) != disconnects+1 {
+		t.Fatalf("expected the worker disconnected and counted")
+	}
+}
+
+func TestWeakShareDisconnect(t *testing.T) {
+	sh := newShareHandler(&mockSubmitter{}, 1, 0, nil, 0, invalidSharePolicy{ratio: 0.5, window: time.Minute}, 0)
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	state := GetMiningState(ctx)
+	state.stratumDiff = newPyrinDiff()
+	state.stratumDiff.setDiffValue(1.0 / (1 << 24))
+	block := appmessage.RPCBlock{}
+	if err := json.Unmarshal(selfTestHeader, &block.Header); err != nil {
+		t.Fatal(err)
+	}
+	jobId := state.AddJob(&block, "mock")
+	weak := fmt.Sprintf("%016x", testShareNonce(t, &block, state.stratumDiff.targetValue, false))
+	messages := readAll(mc)
+	shown := make(chan string, 1)
+	go func() {
+		for msg := range messages {
+			if strings.Contains(msg, "client.show_message") {
+				shown <- msg
+			}
+		}
+	}()
+	disconnects := testutil.ToFloat64(invalidShareDisconnectCounter.With(commonLabels(ctx)))
+	for i := 0; i < minInvalidShareSamples && ctx.Connected(); i++ {
+		if err := sh.HandleSubmit(ctx, gostratum.JsonRpcEvent{
+			Id:     i,
+			Method: gostratum.StratumMethodSubmit,
+			Params: []any{ctx.WalletAddr + "." + ctx.WorkerName, strconv.Itoa(jobId), weak},
+		}); err != nil && ctx.Connected() { // the last reply goes to a closed connection
+			t.Fatal(err)
+		}
+	}
+	if msg := <-shown; !strings.Contains(msg, "20 of the last 20 shares were invalid") {
+		t.Fatalf("expected the reason shown to the miner, got %s", msg)
+	}
+	if ctx.Connected() || testutil.ToFloat64(invalidShareDisconnectCounter.With(commonLabels(ctx))) != disconnects+1 {
+		t.Fatalf("expected a worker sending shares below its difficulty disconnected")
+	}
+}
+
+func TestStuckJobDisconnect(t *testing.T) {
+	sh := newShareHandler(nil, 1, 0, nil, 0, invalidSharePolicy{}, 0)
+	sh.stuckJobs = stuckJobPolicy{lag: 8, disconnectAfter: 12}
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	state := GetMiningState(ctx)
+	stuck := state.AddJob(jobWithParents("a"), "")
+	for i := 0; i < 10; i++ {
+		state.AddJob(jobWithParents("a"), "")
+	}
+
+	messages := readAll(mc)
+	disconnects := testutil.ToFloat64(stuckJobDisconnectCounter.With(commonLabels(ctx)))
+	for i := 1; i < sh.stuckJobs.disconnectAfter; i++ {
+		if sh.checkStuckJob(ctx, state, stuck) {
+			t.Fatalf("expected the worker kept after %d lagging shares", i)
+		}
+	}
+	if !sh.checkStuckJob(ctx, state, stuck) {
+		t.Fatalf("expected the worker disconnected once it kept lagging")
+	}
+	if msg := <-messages; !strings.Contains(msg, "client.show_message") ||
+		!strings.Contains(msg, "disconnected: the last 12 shares were for jobs at least 8 behind") {
+		t.Fatalf("expected the reason shown to the miner, got %s", msg)
+	}
+	if ctx.Connected() || testutil.ToFloat64(stuckJobDisconnectCounter.With(commonLabels(ctx))) != disconnects+1 {
+		t.Fatalf("expected the worker disconnected and counted")
+	}
+}
+
+func TestStaleShareRate(t *testing.T) {
+	var rate staleShareRate
+	start := time.Now()
+	for i := 0; i < 9; i++ {
+		if _, _, done := rate.count(start.Add(time.Duration(i)*time.Second), i%3 == 0); done {
+			t.Fatalf("expected no rate before the window is up")
+		}
+	}
+	stale, shares, done := rate.count(start.Add(staleShareWindow), false)
+	if !done || shares != 10 || stale != 0.3 {
+		t.Fatalf("expected 3 of 10 shares stale once the window is up, got %f of %d (%t)", stale, shares, done)
+	}
+
+	core, logs := observer.New(zap.WarnLevel)
+	ctx, _ := gostratum.NewMockContext(context.Background(), zap.New(core), MiningStateGenerator())
+	sh := newShareHandler(nil, 1, 30*time.Second, nil, 0, invalidSharePolicy{}, 0)
+	sh.staleShares.tolerance = 0.05
+	fill := func(stale int) {
+		sh.staleShares.start = time.Now().Add(-staleShareWindow)
+		sh.staleShares.shares, sh.staleShares.stale = minStaleShareSamples-1, stale
+	}
+	fill(1)
+	sh.checkStaleShares(ctx, false)
+	if logs.Len() != 0 || testutil.ToFloat64(staleShareRateGauge) != 0.01 {
+		t.Fatalf("expected the rate published without a hint under the tolerance, got %d logs", logs.Len())
+	}
+	fill(19)
+	sh.checkStaleShares(ctx, true)
+	if testutil.ToFloat64(staleShareRateGauge) != 0.2 {
+		t.Fatalf("expected the stale rate published, got %f", testutil.ToFloat64(staleShareRateGauge))
+	}
+	if logs.Len() != 1 || !strings.Contains(logs.All()[0].Message, "previous_job_grace (30s)") {
+		t.Fatalf("expected a hint naming the job grace, got %v", logs.All())
+	}
+}
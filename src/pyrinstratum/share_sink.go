@@ -0,0 +1,153 @@
+package pyrinstratum
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+)
+
+type ShareResult string
+
+const (
+	ShareAccepted ShareResult = "accepted"
+	ShareStale    ShareResult = "stale"
+	ShareInvalid  ShareResult = "invalid"
+)
+
+// ShareRecord holds the full details of a single share submission
+type ShareRecord struct {
+	Timestamp  time.Time   `json:"timestamp"`
+	Worker     string      `json:"worker"`
+	Wallet     string      `json:"wallet"`
+	Miner      string      `json:"miner"`
+	Ip         string      `json:"ip"`
+	JobId      int         `json:"job_id"`
+	Difficulty float64     `json:"difficulty"`
+	Result     ShareResult `json:"result"`
+}
+
+func newShareRecord(ctx *gostratum.StratumContext, jobId int, diff float64, result ShareResult) ShareRecord {
+	return ShareRecord{
+		Timestamp:  time.Now(),
+		Worker:     ctx.WorkerName,
+		Wallet:     ctx.WalletAddr,
+		Miner:      ctx.RemoteApp,
+		Ip:         ctx.RemoteAddr,
+		JobId:      jobId,
+		Difficulty: diff,
+		Result:     result,
+	}
+}
+
+// ShareSink can be implemented by operators to persist every accepted/rejected
+// share (database, message queue, ...) for payouts and auditing. The bridge
+// never calls the sink from the mining hot path directly, records are handed
+// off through a bounded queue so a slow sink can't stall mining
+type ShareSink interface {
+	RecordShare(share ShareRecord)
+}
+
+// multiShareSink hands every share to each of the sinks, when more than one
+// is configured
+type multiShareSink []ShareSink
+
+func (ms multiShareSink) RecordShare(share ShareRecord) {
+	for _, sink := range ms {
+		sink.RecordShare(share)
+	}
+}
+
+// noopShareSink is the default sink, shares are only counted in prom
+type noopShareSink struct{}
+
+func (noopShareSink) RecordShare(ShareRecord) {}
+
+// JsonlShareSink is a reference sink that appends each share as a json line
+// to a file
+type JsonlShareSink struct {
+	lock    sync.Mutex
+	file    io.WriteCloser
+	encoder *json.Encoder
+}
+
+func NewJsonlShareSink(path string) (*JsonlShareSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed opening share log %s", path)
+	}
+	return &JsonlShareSink{
+		file:    file,
+		encoder: json.NewEncoder(file),
+	}, nil
+}
+
+func (js *JsonlShareSink) RecordShare(share ShareRecord) {
+	js.lock.Lock()
+	defer js.lock.Unlock()
+	js.encoder.Encode(share) // best effort
+}
+
+func (js *JsonlShareSink) Close() error {
+	js.lock.Lock()
+	defer js.lock.Unlock()
+	return js.file.Close()
+}
+
+const shareSinkQueueSize = 4096
+
+// asyncShareSink decouples the sink from share handling, records are dropped
+// (and counted) rather than blocking when the queue is full. It runs until
+// the context is cancelled, done is closed once it has stopped
+type asyncShareSink struct {
+	sink  ShareSink
+	queue chan ShareRecord
+	done  chan struct{}
+}
+
+func newAsyncShareSink(ctx context.Context, sink ShareSink, queueSize int) *asyncShareSink {
+	as := &asyncShareSink{
+		sink:  sink,
+		queue: make(chan ShareRecord, queueSize),
+		done:  make(chan struct{}),
+	}
+	go as.run(ctx)
+	return as
+}
+
+func (as *asyncShareSink) RecordShare(share ShareRecord) {
+	select {
+	case as.queue <- share:
+		RecordShareSinkQueue(len(as.queue))
+	default:
+		RecordShareSinkDrop()
+	}
+}
+
+// run hands the queued records to the sink, once cancelled the records
+// still queued are handed over before it returns
+func (as *asyncShareSink) run(ctx context.Context) {
+	defer close(as.done)
+	for {
+		select {
+		case share := <-as.queue:
+			as.sink.RecordShare(share)
+			RecordShareSinkQueue(len(as.queue))
+		case <-ctx.Done():
+			for {
+				select {
+				case share := <-as.queue:
+					as.sink.RecordShare(share)
+				default:
+					RecordShareSinkQueue(0)
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package pyrinstratum
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJsonlShareSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shares.jsonl")
+	sink, err := NewJsonlShareSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.RecordShare(ShareRecord{Worker: "rig1", Difficulty: 4, Result: ShareAccepted})
+	sink.RecordShare(ShareRecord{Worker: "rig2", Difficulty: 8, Result: ShareStale})
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []ShareRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		record := ShareRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 || records[0].Worker != "rig1" || records[1].Result != ShareStale {
+		t.Fatalf("unexpected share records: %+v", records)
+	}
+}
+
+type blockingShareSink struct {
+	release chan struct{}
+}
+
+func (bs *blockingShareSink) RecordShare(ShareRecord) { <-bs.release }
+
+func TestAsyncShareSinkNonBlocking(t *testing.T) {
+	blocking := &blockingShareSink{release: make(chan struct{})}
+	defer close(blocking.release)
+	sink := newAsyncShareSink(context.Background(), blocking, 2)
+
+	done := make(chan struct{})
+	go func() {
+		// more records than the queue holds, a stalled sink must not block
+		for i := 0; i < 10; i++ {
+			sink.RecordShare(ShareRecord{})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("recording shares blocked on a stalled sink")
+	}
+}
+
+type countingShareSink struct {
+	lock   sync.Mutex
+	shares int
+}
+
+func (cs *countingShareSink) RecordShare(ShareRecord) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.shares++
+}
+
+func TestAsyncShareSinkStops(t *testing.T) {
+	blocking := &blockingShareSink{release: make(chan struct{})}
+	counting := &countingShareSink{}
+	ctx, cancel := context.WithCancel(context.Background())
+	sink := newAsyncShareSink(ctx, multiShareSink{blocking, counting}, 4)
+	for i := 0; i < 3; i++ {
+		sink.RecordShare(ShareRecord{})
+	}
+	cancel()
+	close(blocking.release)
+	select {
+	case <-sink.done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the sink to stop once cancelled")
+	}
+	if counting.shares != 3 {
+		t.Fatalf("expected the queued shares handed to the sink before stopping, got %d", counting.shares)
+	}
+}
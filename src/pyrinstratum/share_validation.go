@@ -0,0 +1,62 @@
+package pyrinstratum
+
+import (
+	"runtime"
+
+	"github.com/pyrin-network/pyipad/app/appmessage"
+)
+
+// validationJob is a share waiting for a validation worker
+type validationJob struct {
+	block  *appmessage.RPCBlock
+	nonce  uint64
+	result chan validationResult
+}
+
+type validationResult struct {
+	work *shareProofOfWork
+	err  error
+}
+
+// validationPool hashes shares on a fixed number of workers instead of on
+// the submitting connection's goroutine. With thousands of connections
+// submitting at once, hashing on each of them has the scheduler juggle far
+// more cpu bound goroutines than there are cores and every share waits on
+// all of them. The pool keeps hashing to as many at a time as there are
+// workers, shares past that queue in order. A nil pool hashes inline
+type validationPool struct {
+	jobs chan validationJob
+}
+
+// newValidationPool starts the workers, size 0 being one per GOMAXPROCS.
+// The workers run for the life of the process
+func newValidationPool(size int) *validationPool {
+	if size <= 0 {
+		size = runtime.GOMAXPROCS(0)
+	}
+	pool := &validationPool{jobs: make(chan validationJob, size)}
+	for i := 0; i < size; i++ {
+		go pool.work()
+	}
+	return pool
+}
+
+func (p *validationPool) work() {
+	for job := range p.jobs {
+		RecordShareValidationQueue(-1)
+		work, err := computeProofOfWork(job.block, job.nonce)
+		job.result <- validationResult{work, err}
+	}
+}
+
+// validate hashes the job with the nonce, waiting for a free worker
+func (p *validationPool) validate(block *appmessage.RPCBlock, nonce uint64) (*shareProofOfWork, error) {
+	if p == nil {
+		return computeProofOfWork(block, nonce)
+	}
+	job := validationJob{block: block, nonce: nonce, result: make(chan validationResult, 1)}
+	RecordShareValidationQueue(1)
+	p.jobs <- job
+	result := <-job.result
+	return result.work, result.err
+}
@@ -0,0 +1,80 @@
+package pyrinstratum
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pyrin-network/pyipad/app/appmessage"
+)
+
+func testValidationBlock(t testing.TB) *appmessage.RPCBlock {
+	block := &appmessage.RPCBlock{}
+	if err := json.Unmarshal(selfTestHeader, &block.Header); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func TestValidationPool(t *testing.T) {
+	block := testValidationBlock(t)
+	pool := newValidationPool(2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(nonce uint64) {
+			defer wg.Done()
+			inline, err := (*validationPool)(nil).validate(block, nonce)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			pooled, err := pool.validate(block, nonce)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if pooled.value.Cmp(inline.value) != 0 || pooled.header.Nonce() != nonce {
+				t.Errorf("expected the pool to hash nonce %d like inline validation", nonce)
+			}
+		}(uint64(i))
+	}
+	wg.Wait()
+}
+
+// BenchmarkShareValidation validates shares from many more connections than
+// there are cores, reporting the 99th percentile time a share takes
+func BenchmarkShareValidation(b *testing.B) {
+	block := testValidationBlock(b)
+	run := func(b *testing.B, pool *validationPool) {
+		var lock sync.Mutex
+		latencies := make([]time.Duration, 0, b.N)
+		b.SetParallelism(64)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			var nonce uint64
+			for pb.Next() {
+				nonce++
+				start := time.Now()
+				if _, err := pool.validate(block, nonce); err != nil {
+					b.Error(err)
+					return
+				}
+				elapsed := time.Since(start)
+				lock.Lock()
+				latencies = append(latencies, elapsed)
+				lock.Unlock()
+			}
+		})
+		b.StopTimer()
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		if len(latencies) > 0 {
+			b.ReportMetric(float64(latencies[len(latencies)*99/100].Nanoseconds()), "p99-ns")
+		}
+	}
+	b.Run("inline", func(b *testing.B) { run(b, nil) })
+	b.Run("pool", func(b *testing.B) { run(b, newValidationPool(0)) })
+}
@@ -0,0 +1,41 @@
+package pyrinstratum
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+	"go.uber.org/zap"
+)
+
+// notifyShutdown tells every connected client the bridge is going away,
+// returning how many were told
+func (c *clientListener) notifyShutdown(drain time.Duration) int {
+	clients := c.connectedClients()
+	msg := fmt.Sprintf("bridge restarting in %s, switch to a backup pool", drain)
+	for _, cl := range clients {
+		showMessage(cl, msg)
+	}
+	return len(clients)
+}
+
+// drainConnections stops the listeners accepting new connections and warns
+// the connected miners, then keeps serving them for the drain period so
+// shares in flight are still credited while they fail over elsewhere.
+// Shares submitted once it's over are dropped. A second signal cuts the
+// drain short
+func drainConnections(logger *zap.SugaredLogger, listeners []*gostratum.StratumListener,
+	clients *clientListener, drain time.Duration, signals <-chan os.Signal) {
+	for _, listener := range listeners {
+		listener.StopAccepting()
+	}
+	notified := clients.notifyShutdown(drain)
+	logger.Infof("stopped accepting connections, draining %d clients for %s", notified, drain)
+	select {
+	case <-time.After(drain):
+	case <-signals:
+		logger.Warn("signalled again, exiting without waiting for the drain")
+	}
+	clients.shareHandler.drained.Store(true)
+}
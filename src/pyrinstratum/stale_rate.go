@@ -0,0 +1,70 @@
+package pyrinstratum
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+	"go.uber.org/zap"
+)
+
+// how long the bridge wide stale share rate is measured over
+const staleShareWindow = 5 * time.Minute
+
+// windows with fewer submissions than this don't trigger the tuning hint, a
+// couple of stales with one slow miner connected don't mean much
+const minStaleShareSamples = 100
+
+// staleShareRate measures the fraction of submissions across all workers
+// that were stale over consecutive windows, published each time a window is
+// up. When tolerance is non-zero a window over it logs what to look at, a
+// high stale rate is almost always jobs reaching miners late or the bridge
+// dropping jobs miners are still on rather than the miners themselves
+type staleShareRate struct {
+	tolerance float64
+	lock      sync.Mutex
+	start     time.Time
+	shares    int
+	stale     int
+}
+
+// count records a submission, returning the stale rate and number of
+// submissions of the window it completed (if it did)
+func (r *staleShareRate) count(now time.Time, stale bool) (float64, int, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.start.IsZero() {
+		r.start = now
+	}
+	r.shares++
+	if stale {
+		r.stale++
+	}
+	if now.Sub(r.start) < staleShareWindow {
+		return 0, 0, false
+	}
+	rate, shares := float64(r.stale)/float64(r.shares), r.shares
+	r.start, r.shares, r.stale = now, 0, 0
+	return rate, shares, true
+}
+
+// checkStaleShares counts a submission towards the stale share rate, logging
+// a tuning hint for windows over the tolerance (the hint is bridge wide, it's
+// only logged with the worker whose share completed the window)
+func (sh *shareHandler) checkStaleShares(ctx *gostratum.StratumContext, stale bool) {
+	rate, shares, done := sh.staleShares.count(time.Now(), stale)
+	if !done {
+		return
+	}
+	RecordStaleShareRate(rate)
+	if sh.staleShares.tolerance <= 0 || shares < minStaleShareSamples || rate <= sh.staleShares.tolerance {
+		return
+	}
+	hint := "check py_job_broadcast_duration_histogram for jobs reaching miners late (max_jobs_per_second holds jobs back too) and the node's sync and latency"
+	if sh.jobGrace > 0 {
+		hint = fmt.Sprintf("previous_job_grace (%s) may be too short for miners on slow links, or %s", sh.jobGrace, hint)
+	}
+	ctx.Logger.Warn(fmt.Sprintf("%.1f%% of the last %d shares were stale, above stale_share_tolerance %.1f%%: %s",
+		100*rate, shares, 100*sh.staleShares.tolerance, hint), zap.Duration("window", staleShareWindow))
+}
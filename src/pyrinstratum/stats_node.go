@@ -0,0 +1,109 @@
+package pyrinstratum
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/pyrin-network/pyipad/app/appmessage"
+	"github.com/pyrin-network/pyipad/infrastructure/network/rpcclient"
+	"go.uber.org/zap"
+)
+
+// statsNode is an optional separate node (e.g. a read-only replica) network
+// stats are queried from, keeping that load off the nodes serving templates
+// and submits. Only used by the stats thread
+type statsNode struct {
+	address string
+	client  rpcClient // nil until connected, and after a transport failure
+	// false while the node can't be used and stats come from the active node
+	healthy bool
+}
+
+func newStatsNode(address string) *statsNode {
+	if address == "" {
+		return nil
+	}
+	return &statsNode{address: address, healthy: true}
+}
+
+// connect returns the node's client, dialing it if there's no connection
+func (sn *statsNode) connect(dial func(string) (rpcClient, error)) (rpcClient, error) {
+	if sn.client != nil {
+		return sn.client, nil
+	}
+	client, err := dial(sn.address)
+	if err != nil {
+		return nil, err
+	}
+	sn.client = client
+	return client, nil
+}
+
+// drop closes the connection after a transport failure, it's redialed on the
+// next attempt
+func (sn *statsNode) drop() {
+	if sn.client != nil {
+		sn.client.Close()
+		sn.client = nil
+	}
+}
+
+// updateNetworkStats refreshes the network stats from the stats node if one
+// is configured, falling back to the active node when it can't be reached
+func (py *PyrinApi) updateNetworkStats() {
+	if sn := py.statsNode; sn != nil {
+		client, err := sn.connect(py.dial)
+		if err == nil {
+			err = py.fetchNetworkStats(sn.address, client)
+			if err == nil {
+				if !sn.healthy {
+					py.logger.Infow("stats node reachable again", "node", sn.address)
+					sn.healthy = true
+				}
+				return
+			}
+			if !errors.Is(err, rpcclient.ErrRPC) {
+				sn.drop()
+			}
+		}
+		if sn.healthy {
+			py.logger.Warnw("stats node unavailable, querying the active node instead",
+				"node", sn.address, "error", err)
+			sn.healthy = false
+		}
+	}
+
+	node, err := py.templateNode()
+	if err != nil {
+		py.logger.Warn("no pyrin node available, prom stats will be out of date", zap.Error(err))
+		return
+	}
+	client, err := node.connection()
+	if err == nil {
+		err = py.fetchNetworkStats(node.address, client)
+	}
+	if err != nil {
+		py.logger.Warn("failed to get network hashrate from pyrin, prom stats will be out of date", zap.Error(err))
+	}
+}
+
+func (py *PyrinApi) fetchNetworkStats(address string, client rpcClient) error {
+	dagResponse, err := withContext(py.ctx, py.rpcTimeout, client.GetBlockDAGInfo)
+	if err != nil {
+		return err
+	}
+	if len(dagResponse.TipHashes) == 0 {
+		return fmt.Errorf("node reported no dag tips")
+	}
+	response, err := withContext(py.ctx, py.rpcTimeout, func() (*appmessage.EstimateNetworkHashesPerSecondResponseMessage, error) {
+		return client.EstimateNetworkHashesPerSecond(dagResponse.TipHashes[0], 1000)
+	})
+	if err != nil {
+		return err
+	}
+	RecordNetworkStats(address, response.NetworkHashesPerSecond, dagResponse.BlockCount, dagResponse.Difficulty)
+	py.checkTemplateDifficulty(address, dagResponse.Difficulty)
+	py.checkStability(address, dagResponse.VirtualDAAScore, dagResponse.Difficulty)
+	RecordStatsUpdated()
+	return nil
+}
@@ -0,0 +1,62 @@
+package pyrinstratum
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const statsInterval = 30 * time.Second
+
+// backoff between restarts of a stats thread that keeps stopping, doubling
+// up to the max. One that ran longer than the max before stopping starts
+// over from the min
+const minStatsRestartBackoff = time.Second
+const maxStatsRestartBackoff = time.Minute
+
+// superviseStatsThread runs the stats thread until ctx is done, restarting
+// it whenever it stops before that, a panic included. Without it a bad
+// response from the node silently ends the network stats for good
+func (py *PyrinApi) superviseStatsThread(ctx context.Context) {
+	backoff := minStatsRestartBackoff
+	for {
+		started := time.Now()
+		RecordStatsThreadAlive(true)
+		err := py.runStatsThread(ctx)
+		RecordStatsThreadAlive(false)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > maxStatsRestartBackoff {
+			backoff = minStatsRestartBackoff
+		}
+		RecordStatsThreadRestart()
+		py.logger.Error("stats thread stopped unexpectedly, restarting", zap.Error(err), zap.Duration("backoff", backoff))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxStatsRestartBackoff {
+			backoff = maxStatsRestartBackoff
+		}
+	}
+}
+
+// runStatsThread runs startStatsThread, returning why it stopped
+func (py *PyrinApi) runStatsThread(ctx context.Context) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	py.startStatsThread(ctx)
+	if ctx.Err() == nil {
+		return fmt.Errorf("stats thread returned")
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,191 @@
+package pyrinstratum
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// BridgeStatus is what the status page shows, the connected workers and the
+// bridge wide totals
+type BridgeStatus struct {
+	Version string
+	Uptime  time.Duration
+	// GH/s averaged since each worker's first share
+	Hashrate      float64
+	SharesFound   int64
+	StaleShares   int64
+	InvalidShares int64
+	BlocksFound   int64
+	Workers       []WorkerStatus
+	Nodes         []NodeStatus
+}
+
+// WorkerStatus is a connected client on the status page and the admin
+// workers endpoint, the share counts are the worker's (all connections with
+// its name) since it first connected
+type WorkerStatus struct {
+	Id               int32         `json:"id"`
+	Wallet           string        `json:"wallet"`
+	Worker           string        `json:"worker"`
+	RemoteAddr       string        `json:"remote_addr"`
+	Miner            string        `json:"miner"`
+	Capabilities     string        `json:"capabilities"`
+	Difficulty       float64       `json:"difficulty"`
+	DifficultySource DiffSource    `json:"difficulty_source,omitempty"`
+	Vardiff          bool          `json:"vardiff"`
+	Hashrate         float64       `json:"hashrate_ghs"`
+	SharesFound      int64         `json:"accepted"`
+	StaleShares      int64         `json:"stale"`
+	InvalidShares    int64         `json:"invalid"`
+	BlocksFound      int64         `json:"blocks"`
+	Connected        time.Duration `json:"-"`
+	ConnectedSeconds int64         `json:"connected_seconds"`
+	// zero until the worker's first share
+	LastShare time.Time `json:"last_share"`
+}
+
+// statusSnapshot collects the status page data
+func (c *clientListener) statusSnapshot() BridgeStatus {
+	status := BridgeStatus{Version: version, Uptime: time.Since(processStart).Round(time.Second)}
+	sh := c.shareHandler
+	if sh != nil {
+		status.SharesFound = sh.overall.SharesFound.Load()
+		status.StaleShares = sh.overall.StaleShares.Load()
+		status.InvalidShares = sh.overall.InvalidShares.Load()
+		status.BlocksFound = sh.overall.BlocksFound.Load()
+	}
+	// the worker stats are looked up under a single hold of the stats lock,
+	// the counts themselves are atomics, the last share is read under it
+	workers := map[string]*WorkStats{}
+	lastShares := map[string]time.Time{}
+	if sh != nil {
+		sh.statsLock.Lock()
+		for name, stats := range sh.stats {
+			workers[name] = stats
+			lastShares[name] = stats.LastShare
+		}
+		sh.statsLock.Unlock()
+	}
+	for _, cl := range c.connectedClients() {
+		if cl.WalletAddr == "" { // not authorized yet
+			continue
+		}
+		state := GetMiningState(cl)
+		connected := time.Since(state.connectTime).Round(time.Second)
+		worker := WorkerStatus{
+			Id:               cl.Id,
+			Wallet:           cl.WalletAddr,
+			Worker:           cl.WorkerName,
+			RemoteAddr:       cl.RemoteAddr,
+			Miner:            cl.RemoteApp,
+			Capabilities:     cl.Capabilities().String(),
+			Connected:        connected,
+			ConnectedSeconds: int64(connected / time.Second),
+		}
+		// under the client's push lock, difficulty changes take it
+		diff := state.diffStatus()
+		worker.Difficulty, worker.Vardiff = diff.diff.diffValue, diff.vardiff
+		if diff.diff.diffValue > 0 {
+			worker.DifficultySource = diff.source
+		}
+		if stats, ok := workers[cl.WorkerName]; ok {
+			worker.Hashrate = GetAverageHashrateGHs(stats)
+			worker.SharesFound = stats.SharesFound.Load()
+			worker.StaleShares = stats.StaleShares.Load()
+			worker.InvalidShares = stats.InvalidShares.Load()
+			worker.BlocksFound = stats.BlocksFound.Load()
+			worker.LastShare = lastShares[cl.WorkerName]
+		}
+		status.Hashrate += worker.Hashrate
+		status.Workers = append(status.Workers, worker)
+	}
+	sort.Slice(status.Workers, func(i, j int) bool {
+		a, b := status.Workers[i], status.Workers[j]
+		if a.Wallet != b.Wallet {
+			return a.Wallet < b.Wallet
+		}
+		return a.Worker < b.Worker
+	})
+	return status
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"hashrate": formatHashrate,
+	"since": func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return time.Since(t).Round(time.Second).String() + " ago"
+	},
+	"percent": func(rate float64) string {
+		return fmt.Sprintf("%.1f%%", rate*100)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="30">
+<title>pyrin bridge status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { padding: 4px 10px; border-bottom: 1px solid #ddd; text-align: right; }
+th:first-child, td:first-child, .text { text-align: left; }
+</style>
+</head>
+<body>
+<h2>pyrin bridge {{.Version}}</h2>
+<table>
+<tr><th>uptime</th><th>workers</th><th>hashrate</th><th>accepted</th><th>stale</th><th>invalid</th><th>blocks</th></tr>
+<tr><td>{{.Uptime}}</td><td>{{len .Workers}}</td><td>{{hashrate .Hashrate}}</td><td>{{.SharesFound}}</td><td>{{.StaleShares}}</td><td>{{.InvalidShares}}</td><td>{{.BlocksFound}}</td></tr>
+</table>
+<h3>workers</h3>
+<table>
+<tr><th>worker</th><th class="text">wallet</th><th class="text">ip</th><th class="text">miner</th><th class="text">capabilities</th><th>difficulty</th><th>hashrate</th><th>accepted</th><th>stale</th><th>invalid</th><th>blocks</th><th>last share</th><th>connected</th></tr>
+{{range .Workers}}<tr><td>{{.Worker}}</td><td class="text">{{.Wallet}}</td><td class="text">{{.RemoteAddr}}</td><td class="text">{{.Miner}}</td><td class="text">{{.Capabilities}}</td><td>{{.Difficulty}}</td><td>{{hashrate .Hashrate}}</td><td>{{.SharesFound}}</td><td>{{.StaleShares}}</td><td>{{.InvalidShares}}</td><td>{{.BlocksFound}}</td><td>{{since .LastShare}}</td><td>{{.Connected}}</td></tr>
+{{else}}<tr><td colspan="13">no workers connected</td></tr>
+{{end}}</table>
+{{if .Nodes}}<h3>nodes</h3>
+<table>
+<tr><th>node</th><th class="text">state</th><th class="text">active</th><th class="text">synced</th><th class="text">draining</th><th class="text">quarantined</th><th class="text">tip diverged</th><th>rpc errors</th></tr>
+{{range .Nodes}}<tr><td>{{.Address}}</td><td class="text">{{.State}}</td><td class="text">{{.Active}}</td><td class="text">{{.Synced}}</td><td class="text">{{.Draining}}</td><td class="text">{{.Quarantined}}</td><td class="text">{{.TipDiverged}}</td><td>{{percent .ErrorRate}}</td></tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`))
+
+// formatHashrate renders a GH/s rate with a fitting unit
+func formatHashrate(ghs float64) string {
+	units := []string{"GH/s", "TH/s", "PH/s"}
+	unit := 0
+	for ghs >= 1000 && unit < len(units)-1 {
+		ghs /= 1000
+		unit++
+	}
+	return fmt.Sprintf("%.2f %s", ghs, units[unit])
+}
+
+// handleWorkers lists every authorized worker as on the status page, for
+// dashboards wanting the per worker view in one request
+func (as *adminServer) handleWorkers(w http.ResponseWriter, _ *http.Request) {
+	workers := as.clients.statusSnapshot().Workers
+	if workers == nil {
+		workers = []WorkerStatus{}
+	}
+	writeJson(w, workers)
+}
+
+// handleStatus serves the status page, for operators without a dashboard
+func (as *adminServer) handleStatus(w http.ResponseWriter, _ *http.Request) {
+	status := as.clients.statusSnapshot()
+	if as.pyApi != nil {
+		status.Nodes = as.pyApi.NodeStatuses()
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, status); err != nil {
+		as.logger.Warn("failed rendering status page: ", err)
+	}
+}
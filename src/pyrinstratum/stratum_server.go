@@ -2,30 +2,176 @@ package pyrinstratum
 
 import (
 	"context"
+	"io"
+	"math"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
 	"github.com/mattn/go-colorable"
+	"github.com/pkg/errors"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 const version = "v1.1.6"
 const minBlockWaitTime = 500 * time.Millisecond
+const defaultMaxSubmits = 4
 
 type BridgeConfig struct {
-	StratumPort     string        `yaml:"stratum_port"`
-	RPCServer       string        `yaml:"pyrin_address"`
-	PromPort        string        `yaml:"prom_port"`
-	PrintStats      bool          `yaml:"print_stats"`
-	UseLogFile      bool          `yaml:"log_to_file"`
-	HealthCheckPort string        `yaml:"health_check_port"`
-	BlockWaitTime   time.Duration `yaml:"block_wait_time"`
-	MinShareDiff    uint          `yaml:"min_share_diff"`
-	ExtranonceSize  uint          `yaml:"extranonce_size"`
+	StratumPort          string        `yaml:"stratum_port"`
+	RPCServer            string        `yaml:"pyrin_address"`
+	RPCServers           []string      `yaml:"pyrin_addresses"`
+	StatsRPCServer       string        `yaml:"stats_address"`
+	SubmitRPCServers     []string      `yaml:"submit_addresses"`
+	PayoutAddresses      []string      `yaml:"payout_addresses"`
+	AllowedWallets       []string      `yaml:"allowed_wallets"`
+	DeniedWallets        []string      `yaml:"denied_wallets"`
+	Network              string        `yaml:"network"`
+	NetworkMismatch      string        `yaml:"network_mismatch"`
+	PromPort             string        `yaml:"prom_port"`
+	PrintStats           bool          `yaml:"print_stats"`
+	UseLogFile           bool          `yaml:"log_to_file"`
+	LogMaxSize           int           `yaml:"log_max_size_mb"`
+	LogMaxBackups        int           `yaml:"log_max_backups"`
+	LogRotateInterval    time.Duration `yaml:"log_rotate_interval"`
+	LogCompress          bool          `yaml:"log_compress"`
+	LogLevel             string        `yaml:"log_level"`
+	LogFileLevel         string        `yaml:"log_file_level"`
+	LogStdoutLevel       string        `yaml:"log_stdout_level"`
+	HealthCheckPort      string        `yaml:"health_check_port"`
+	BlockWaitTime        time.Duration `yaml:"block_wait_time"`
+	DisablePolling       bool          `yaml:"disable_template_polling"`
+	BlockWaitAuto        bool          `yaml:"block_wait_auto"`
+	BlockWaitMin         time.Duration `yaml:"block_wait_min"`
+	BlockWaitMax         time.Duration `yaml:"block_wait_max"`
+	DisableHandshakeJob  bool          `yaml:"disable_handshake_job"`
+	MinShareDiff         uint          `yaml:"min_share_diff"`
+	ExtranonceSize       uint          `yaml:"extranonce_size"`
+	Extranonce2Size      uint          `yaml:"extranonce2_size"`
+	MaxTemplateAge       time.Duration `yaml:"max_template_age"`
+	DuplicateRefresh     time.Duration `yaml:"duplicate_template_refresh"`
+	MaxJobsPerSecond     float64       `yaml:"max_jobs_per_second"`
+	JobKeepalive         time.Duration `yaml:"job_keepalive"`
+	RPCTimeout           time.Duration `yaml:"rpc_timeout"`
+	NodeIdleTimeout      time.Duration `yaml:"node_idle_timeout"`
+	ConnectRetries       int           `yaml:"connect_retries"`
+	ConnectBackoff       time.Duration `yaml:"connect_backoff"`
+	ReconnectBackoff     time.Duration `yaml:"reconnect_backoff"`
+	ReconnectMaxBackoff  time.Duration `yaml:"reconnect_max_backoff"`
+	ReconnectMultiplier  float64       `yaml:"reconnect_backoff_multiplier"`
+	TemplateRetries      int           `yaml:"template_unsynced_retries"`
+	TemplateRetryDelay   time.Duration `yaml:"template_unsynced_delay"`
+	SyncCheckInterval    time.Duration `yaml:"sync_check_interval"`
+	MinNodePeers         int           `yaml:"min_node_peers"`
+	CoinbaseWorkerName   bool          `yaml:"coinbase_worker_name"`
+	WarmupTimeout        time.Duration `yaml:"warmup_timeout"`
+	MaxSubmits           uint          `yaml:"max_concurrent_submits"`
+	ValidationWorkers    int           `yaml:"validation_workers"`
+	JobGrace             time.Duration `yaml:"previous_job_grace"`
+	ShareLogFile         string        `yaml:"share_log_file"`
+	ShareNatsURL         string        `yaml:"share_nats_url"`
+	ShareNatsSubject     string        `yaml:"share_nats_subject"`
+	TraceEndpoint        string        `yaml:"otlp_endpoint"`
+	TraceSampleRate      float64       `yaml:"otlp_sample_rate"`
+	ShareLogSample       int           `yaml:"log_every_nth_share"`
+	MinShareInterval     time.Duration `yaml:"min_share_interval"`
+	InvalidShareRatio    float64       `yaml:"invalid_share_ratio"`
+	InvalidShareWindow   time.Duration `yaml:"invalid_share_window"`
+	StaleShareTolerance  float64       `yaml:"stale_share_tolerance"`
+	StuckJobLag          int           `yaml:"stuck_job_lag"`
+	StuckJobDisconnect   int           `yaml:"stuck_job_disconnect"`
+	DiffMemoryTTL        time.Duration `yaml:"diff_memory_ttl"`
+	Vardiff              bool          `yaml:"vardiff"`
+	SharesPerMin         float64       `yaml:"shares_per_min"`
+	MaxShareDiff         uint          `yaml:"max_share_diff"`
+	DiffHardCap          uint          `yaml:"diff_hard_cap"`
+	MinDiffFraction      float64       `yaml:"min_share_diff_fraction"`
+	MaxDiffFraction      float64       `yaml:"max_share_diff_fraction"`
+	VardiffMode          string        `yaml:"vardiff_mode"`
+	VardiffTargetCV      float64       `yaml:"vardiff_target_cv"`
+	VardiffMinInterval   time.Duration `yaml:"vardiff_min_change_interval"`
+	VardiffMinChange     float64       `yaml:"vardiff_min_change"`
+	HandshakeOrder       string        `yaml:"handshake_order"`
+	SubscribeFormat      string        `yaml:"subscribe_format"`
+	UppercaseHex         bool          `yaml:"uppercase_hex"`
+	NetworkDiffNotice    bool          `yaml:"network_difficulty_message"`
+	UniqueExtranonce     bool          `yaml:"unique_extranonce"`
+	ExtranonceReuse      time.Duration `yaml:"extranonce_reuse_delay"`
+	TargetSharesPerBlock float64       `yaml:"target_shares_per_block"`
+	UnknownMethodPolicy  string        `yaml:"unknown_method_policy"`
+	UnknownMethodLimit   int           `yaml:"unknown_method_limit"`
+	UnknownJobPolicy     string        `yaml:"unknown_job_policy"`
+	JobIds               string        `yaml:"job_ids"`
+	StrictSubmit         bool          `yaml:"strict_submit"`
+	AcceptAnyAddress     bool          `yaml:"accept_any_address"`
+	MaxMessageSize       int           `yaml:"max_message_size"`
+	WriteTimeout         time.Duration `yaml:"client_write_timeout"`
+	LatencyProbe         time.Duration `yaml:"latency_probe_interval"`
+	AcceptBacklog        int           `yaml:"accept_backlog"`
+	AcceptWorkers        int           `yaml:"accept_workers"`
+	AcceptQueue          int           `yaml:"accept_queue"`
+	KeepMappedIPv4       bool          `yaml:"keep_ipv4_mapped_addresses"`
+	MaxWalletConnections int           `yaml:"max_connections_per_wallet"`
+	FlapWindow           time.Duration `yaml:"flap_window"`
+	FlapLimit            int           `yaml:"flap_reconnect_limit"`
+	FlapBackoff          time.Duration `yaml:"flap_backoff"`
+	MaxTrackedWorkers    int           `yaml:"max_tracked_workers"`
+	TLSPort              string        `yaml:"stratum_tls_port"`
+	TLSCertFile          string        `yaml:"tls_cert_file"`
+	TLSKeyFile           string        `yaml:"tls_key_file"`
+	AdminPort            string        `yaml:"admin_port"`
+	AdminToken           string        `yaml:"admin_token"`
+	ShutdownDrain        time.Duration `yaml:"shutdown_drain"`
+	MaintenanceDrain     time.Duration `yaml:"maintenance_drain"`
+	MaintenanceMessage   string        `yaml:"maintenance_message"`
+	WorkerNameLowercase  bool          `yaml:"worker_name_lowercase"`
+	WorkerNameTrim       bool          `yaml:"worker_name_trim"`
+	WorkerNameSeparators string        `yaml:"worker_name_separators"`
+	WorkerNameReplace    string        `yaml:"worker_name_separator_replacement"`
+	DesyncPolicy         string        `yaml:"desync_policy"`
+	DesyncBuffer         time.Duration `yaml:"desync_buffer"`
+	QuarantineAfter      int           `yaml:"quarantine_after"`
+	QuarantineCooldown   time.Duration `yaml:"quarantine_cooldown"`
+	NodeStabilizeWindow  time.Duration `yaml:"node_stabilize_window"`
+	NodeRefreshInterval  time.Duration `yaml:"node_refresh_interval"`
+	NodeErrorRate        float64       `yaml:"node_error_rate"`
+	NodeErrorWindow      time.Duration `yaml:"node_error_window"`
+	ShareTemplates       bool          `yaml:"share_templates"`
+	InstabilityPolicy    string        `yaml:"instability_policy"`
+	InstabilitySwing     float64       `yaml:"instability_difficulty_swing"`
+	InstabilityHold      time.Duration `yaml:"instability_hold"`
+	LostRacePolicy       string        `yaml:"lost_race_policy"`
+	WorkerMetricShares   int64         `yaml:"worker_metrics_min_shares"`
+	WorkerMetricTTL      time.Duration `yaml:"worker_metrics_ttl"`
+	SkipUnchangedTips    bool          `yaml:"skip_unchanged_tips"`
+	PauseWhenIdle        bool          `yaml:"pause_when_idle"`
+	HashrateWindow       time.Duration `yaml:"hashrate_window"`
+
+	// extra options for the connections to the pyrin nodes, see
+	// NodeRPCOptions
+	NodeAuthToken     string            `yaml:"node_auth_token"`
+	NodeHeaders       map[string]string `yaml:"node_headers"`
+	NodeTLS           bool              `yaml:"node_tls"`
+	NodeTLSCAFile     string            `yaml:"node_tls_ca_file"`
+	NodeTLSCertFile   string            `yaml:"node_tls_cert_file"`
+	NodeTLSKeyFile    string            `yaml:"node_tls_key_file"`
+	NodeTLSServerName string            `yaml:"node_tls_server_name"`
+	NodeTLSInsecure   bool              `yaml:"node_tls_insecure_skip_verify"`
+
+	// ConnectionLabeler is an optional operator provided hook used to label
+	// connections by origin (geo/ASN), defaults to a no-op
+	ConnectionLabeler ConnectionLabeler `yaml:"-"`
+	// ShareSink is an optional operator provided hook called for every
+	// accepted/rejected share. If unset shares are written to ShareLogFile as
+	// json lines and/or published to ShareNatsURL, whichever is configured
+	ShareSink ShareSink `yaml:"-"`
 }
 
 func configureZap(cfg BridgeConfig) (*zap.SugaredLogger, func()) {
@@ -33,59 +179,246 @@ func configureZap(cfg BridgeConfig) (*zap.SugaredLogger, func()) {
 	pe.EncodeTime = zapcore.RFC3339TimeEncoder
 	fileEncoder := zapcore.NewJSONEncoder(pe)
 	consoleEncoder := zapcore.NewConsoleEncoder(pe)
+	level := logLevel(cfg.LogLevel, zap.InfoLevel)
+	stdout := zapcore.NewCore(consoleEncoder, zapcore.AddSync(colorable.NewColorableStdout()),
+		logLevel(cfg.LogStdoutLevel, level))
 
 	if !cfg.UseLogFile {
-		return zap.New(zapcore.NewCore(consoleEncoder,
-			zapcore.AddSync(colorable.NewColorableStdout()), zap.InfoLevel)).Sugar(), func() {}
+		return zap.New(stdout).Sugar(), func() {}
 	}
 
-	// log file fun
-	logFile, err := os.OpenFile("bridge.log", os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666)
-	if err != nil {
-		panic(err)
-	}
+	logFile, cleanup := openLogFile(logFileName, cfg)
 	core := zapcore.NewTee(
-		zapcore.NewCore(fileEncoder, zapcore.AddSync(logFile), zap.InfoLevel),
-		zapcore.NewCore(consoleEncoder, zapcore.AddSync(colorable.NewColorableStdout()), zap.InfoLevel),
+		zapcore.NewCore(fileEncoder, zapcore.AddSync(logFile), logLevel(cfg.LogFileLevel, level)),
+		stdout,
 	)
-	return zap.New(core).Sugar(), func() { logFile.Close() }
+	return zap.New(core).Sugar(), cleanup
+}
+
+// logLevel parses a configured level, fallback if it's unset. Left at the
+// fallback if invalid too, validate rejects it right after
+func logLevel(raw string, fallback zapcore.Level) zapcore.Level {
+	level := fallback
+	if raw != "" {
+		if err := level.UnmarshalText([]byte(raw)); err != nil {
+			return fallback
+		}
+	}
+	return level
+}
+
+const logFileName = "bridge.log"
+
+// openLogFile returns the writer for the log file at path. Without rotation
+// settings the file is truncated on start as it always was, with them it's
+// appended to and rotated by lumberjack once it reaches the max size and/or
+// on every rotate interval, keeping (and optionally gzipping) the configured
+// backups
+func openLogFile(path string, cfg BridgeConfig) (io.Writer, func()) {
+	if cfg.LogMaxSize <= 0 && cfg.LogRotateInterval <= 0 {
+		logFile, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666)
+		if err != nil {
+			panic(err)
+		}
+		return logFile, func() { logFile.Close() }
+	}
+
+	rotating := &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    cfg.LogMaxSize,
+		MaxBackups: cfg.LogMaxBackups,
+		Compress:   cfg.LogCompress,
+	}
+	if cfg.LogMaxSize <= 0 {
+		// only rotated on the interval, lumberjack has no way to disable
+		// size based rotation so make it unreachable
+		rotating.MaxSize = math.MaxInt32
+	}
+	done := make(chan struct{})
+	if cfg.LogRotateInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(cfg.LogRotateInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					rotating.Rotate()
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	return rotating, func() {
+		close(done)
+		rotating.Close()
+	}
 }
 
 func ListenAndServe(cfg BridgeConfig) error {
 	logger, logCleanup := configureZap(cfg)
 	defer logCleanup()
 
+	cfg = cfg.withDefaults()
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	cfg.logSummary(logger)
+	if err := SelfTest(); err != nil {
+		return err
+	}
+	logger.Info("hashing self-test passed")
+
 	if cfg.PromPort != "" {
 		StartPromServer(logger, cfg.PromPort)
+		RecordTargetSharesPerBlock(cfg.TargetSharesPerBlock)
+		RecordBuildInfo(version)
 	}
+	setWorkerMetricPolicy(cfg.WorkerMetricShares, cfg.WorkerMetricTTL)
 
-	blockWaitTime := cfg.BlockWaitTime
-	if blockWaitTime < minBlockWaitTime {
-		blockWaitTime = minBlockWaitTime
-	}
-	pyApi, err := NewPyrinAPI(cfg.RPCServer, blockWaitTime, logger)
+	pyApi, err := NewPyrinAPI(cfg.nodeAddresses(), cfg.BlockWaitTime, cfg.MaxTemplateAge, cfg.RPCTimeout, cfg.NodeIdleTimeout, ConnectRetry{
+		Attempts: cfg.ConnectRetries,
+		Backoff:  cfg.ConnectBackoff,
+	}, cfg.nodeRPCOptions(), logger)
 	if err != nil {
 		return err
 	}
+	if err := pyApi.CheckNetwork(cfg.Network, NetworkMismatchPolicy(cfg.NetworkMismatch)); err != nil {
+		return err
+	}
+	pyApi.payouts = newPayoutRotation(cfg.PayoutAddresses)
+	pyApi.pollingDisabled = cfg.DisablePolling
+	pyApi.reconnectBackoff = ReconnectBackoff{Base: cfg.ReconnectBackoff, Max: cfg.ReconnectMaxBackoff, Multiplier: cfg.ReconnectMultiplier}
+	pyApi.templateRetry = templateRetry{attempts: cfg.TemplateRetries, delay: cfg.TemplateRetryDelay}
+	if cfg.BlockWaitAuto {
+		pyApi.blockWait = newAdaptiveBlockWait(cfg.BlockWaitTime, cfg.BlockWaitMin, cfg.BlockWaitMax)
+	}
+	pyApi.statsNode = newStatsNode(cfg.StatsRPCServer)
+	pyApi.submitNodes = newSubmitNodes(cfg.SubmitRPCServers)
+	pyApi.syncInterval = cfg.SyncCheckInterval
+	pyApi.minPeers = cfg.MinNodePeers
+	pyApi.tagWorker = cfg.CoinbaseWorkerName
+	pyApi.quarantineAfter = cfg.QuarantineAfter
+	pyApi.quarantineCooldown = cfg.QuarantineCooldown
+	pyApi.stabilizeWindow = cfg.NodeStabilizeWindow
+	pyApi.refreshInterval = cfg.NodeRefreshInterval
+	pyApi.errorRate = cfg.NodeErrorRate
+	pyApi.errorWindow = cfg.NodeErrorWindow
+	if cfg.ShareTemplates {
+		pyApi.templateCache = &templateCache{}
+	}
+	pyApi.instability = InstabilityPolicy(cfg.InstabilityPolicy)
+	pyApi.instabilitySwing = cfg.InstabilitySwing
+	pyApi.instabilityHold = cfg.InstabilityHold
+	pyApi.skipUnchangedTips = cfg.SkipUnchangedTips
 
+	shareSink := cfg.ShareSink
+	if shareSink == nil {
+		var sinks multiShareSink
+		if cfg.ShareLogFile != "" {
+			jsonlSink, err := NewJsonlShareSink(cfg.ShareLogFile)
+			if err != nil {
+				return err
+			}
+			defer jsonlSink.Close()
+			sinks = append(sinks, jsonlSink)
+		}
+		if cfg.ShareNatsURL != "" {
+			natsSink, err := NewNatsShareSink(cfg.ShareNatsURL, cfg.ShareNatsSubject)
+			if err != nil {
+				return err
+			}
+			defer natsSink.Close()
+			sinks = append(sinks, natsSink)
+		}
+		if len(sinks) == 1 {
+			shareSink = sinks[0]
+		} else if len(sinks) > 1 {
+			shareSink = sinks
+		}
+	}
+	if shareSink != nil {
+		// stopped before the sinks above are closed
+		sinkCtx, stopSink := context.WithCancel(context.Background())
+		async := newAsyncShareSink(sinkCtx, shareSink, shareSinkQueueSize)
+		defer func() {
+			stopSink()
+			<-async.done
+		}()
+		shareSink = async
+	}
+	shareHandler := newShareHandler(pyApi, int(cfg.MaxSubmits), cfg.JobGrace, shareSink, cfg.MinShareInterval,
+		invalidSharePolicy{ratio: cfg.InvalidShareRatio, window: cfg.InvalidShareWindow}, cfg.ShareLogSample)
+	shareHandler.staleShares.tolerance = cfg.StaleShareTolerance
+	if cfg.ValidationWorkers >= 0 {
+		shareHandler.validation = newValidationPool(cfg.ValidationWorkers)
+	}
+	shareHandler.unknownJobs = UnknownJobPolicy(cfg.UnknownJobPolicy)
+	shareHandler.strictSubmit = cfg.StrictSubmit
+	shareHandler.hashrateWindow = cfg.HashrateWindow
+	shareHandler.stuckJobs = stuckJobPolicy{lag: cfg.StuckJobLag, disconnectAfter: cfg.StuckJobDisconnect}
+	if pyApi.instability == InstabilityWiden {
+		shareHandler.instability = pyApi
+	}
+	shareHandler.lostRaces = LostRacePolicy(cfg.LostRacePolicy)
+	shareHandler.desync = desyncPolicy{mode: DesyncPolicy(cfg.DesyncPolicy), buffer: cfg.DesyncBuffer, nodes: pyApi}
+	clientHandler := newClientListener(logger, shareHandler, float64(cfg.MinShareDiff), int8(cfg.ExtranonceSize), int(cfg.Extranonce2Size), cfg.DiffMemoryTTL, cfg.DuplicateRefresh, cfg.walletConnectionLimit(), cfg.vardiffSettings(), cfg.ConnectionLabeler)
+	clientHandler.uppercaseHex = cfg.UppercaseHex
+	clientHandler.networkDiffNotice = cfg.NetworkDiffNotice
+	clientHandler.relativeDiff = cfg.relativeDiff()
+	if cfg.UniqueExtranonce {
+		clientHandler.extranonces = newExtranoncePool(clientHandler.maxExtranonce, cfg.ExtranonceReuse)
+	}
+	clientHandler.minJobInterval = cfg.minJobInterval()
+	clientHandler.jobKeepalive = cfg.JobKeepalive
+	if !cfg.DisableHandshakeJob {
+		clientHandler.handshakeJobs = pyApi
+	}
+	clientHandler.maintenanceDrain = cfg.MaintenanceDrain
+	clientHandler.maintenanceMessage = cfg.MaintenanceMessage
+	clientHandler.workerNames = cfg.workerNameRules()
+	if cfg.AcceptAnyAddress {
+		logger.Warn("accept_any_address set, miner addresses aren't validated at authorize")
+		clientHandler.cleanWallet = gostratum.SanitizeWallet
+	}
+	clientHandler.jobIds = JobIdMode(cfg.JobIds)
+	clientHandler.walletAccess = newWalletAccess(cfg.AllowedWallets, cfg.DeniedWallets)
+	clientHandler.flaps = newFlapDetector(cfg.FlapWindow, cfg.FlapLimit, cfg.FlapBackoff)
+	if cfg.PauseWhenIdle {
+		// nobody's connected yet
+		pyApi.setIdle(true)
+		clientHandler.onIdle = pyApi.setIdle
+	}
+	if cfg.MaxTrackedWorkers > 0 {
+		shareHandler.maxStats = cfg.MaxTrackedWorkers
+		clientHandler.diffMemory.maxEntries = cfg.MaxTrackedWorkers
+		clientHandler.flaps.maxEntries = cfg.MaxTrackedWorkers
+	}
+	var traces *tracer
+	if cfg.TraceEndpoint != "" {
+		traces = newTracer(cfg.TraceEndpoint, cfg.TraceSampleRate, logger)
+		shareHandler.tracer, clientHandler.tracer = traces, traces
+	}
+	go clientHandler.watchMaintenanceSignal(maintenanceSignals...)
+	var draining atomic.Bool
 	if cfg.HealthCheckPort != "" {
 		logger.Info("enabling health check on port " + cfg.HealthCheckPort)
-		http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
-			w.WriteHeader(http.StatusOK)
-		})
+		http.Handle("/healthz", healthHandler(pyApi.Health, false))
+		http.Handle("/readyz", healthHandler(func() HealthStatus {
+			status := pyApi.Health()
+			if _, maintenance := clientHandler.inMaintenance(); draining.Load() || maintenance {
+				// shutting down or in maintenance, load balancers should stop
+				// sending miners
+				status.Ready = false
+			}
+			return status
+		}, true))
 		go http.ListenAndServe(cfg.HealthCheckPort, nil)
 	}
 
-	shareHandler := newShareHandler(pyApi.pyrin)
-	minDiff := cfg.MinShareDiff
-	if minDiff < 1 {
-		minDiff = 1
-	}
-	extranonceSize := cfg.ExtranonceSize
-	if extranonceSize > 3 {
-		extranonceSize = 3
+	if cfg.AdminPort != "" {
+		newAdminServer(logger, pyApi, clientHandler, cfg.AdminToken).start(cfg.AdminPort)
 	}
-	clientHandler := newClientListener(logger, shareHandler, float64(minDiff), int8(extranonceSize))
 	handlers := gostratum.DefaultHandlers()
 	// override the submit handler with an actual useful handler
 	handlers[string(gostratum.StratumMethodSubmit)] =
@@ -95,6 +428,9 @@ func ListenAndServe(cfg BridgeConfig) error {
 			}
 			return nil
 		}
+	handlers[string(gostratum.StratumMethodSubscribe)] = clientHandler.subscribeHandler(gostratum.NewSubscribeHandler(gostratum.SubscribeFormat(cfg.SubscribeFormat)))
+	handlers[string(gostratum.StratumMethodSuggestDifficulty)] = clientHandler.HandleSuggestDifficulty
+	handlers[string(gostratum.StratumMethodAuthorize)] = clientHandler.HandleAuthorize
 
 	stratumConfig := gostratum.StratumListenerConfig{
 		Port:           cfg.StratumPort,
@@ -102,10 +438,38 @@ func ListenAndServe(cfg BridgeConfig) error {
 		StateGenerator: MiningStateGenerator,
 		ClientListener: clientHandler,
 		Logger:         logger.Desugar(),
+		HandshakeOrder: gostratum.HandshakeOrder(cfg.HandshakeOrder),
+
+		UnknownMethodPolicy: gostratum.UnknownMethodPolicy(cfg.UnknownMethodPolicy),
+		UnknownMethodLimit:  cfg.UnknownMethodLimit,
+		OnUnknownMethod: func(_ *gostratum.StratumContext, method string) {
+			RecordUnknownMethod(method)
+		},
+		MaxMessageSize: cfg.MaxMessageSize,
+		OnOversizedMessage: func(_ *gostratum.StratumContext) {
+			RecordOversizedMessage()
+		},
+		WriteTimeout: cfg.WriteTimeout,
+		OnWriteTimeout: func(_ *gostratum.StratumContext) {
+			RecordWriteTimeout()
+		},
+		OnLatency:     recordLatency,
+		AcceptBacklog: cfg.AcceptBacklog,
+		AcceptWorkers: cfg.AcceptWorkers,
+		AcceptQueue:   cfg.AcceptQueue,
+		OnAccept:      RecordConnectionAccept,
+
+		KeepMappedIPv4: cfg.KeepMappedIPv4,
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	go startWorkerMetricSweeper(ctx)
+	if traces != nil {
+		go traces.run(ctx)
+	}
+	go clientHandler.startJobKeepalive(ctx)
+	go clientHandler.startLatencyProbes(ctx, cfg.LatencyProbe)
 	pyApi.Start(ctx, func() {
 		clientHandler.NewBlockAvailable(pyApi)
 	})
@@ -114,5 +478,50 @@ func ListenAndServe(cfg BridgeConfig) error {
 		go shareHandler.startStatsThread()
 	}
 
-	return gostratum.NewListener(stratumConfig).Listen(context.Background())
+	// don't open the stratum ports until there's work to hand out
+	if err := pyApi.Warmup(ctx, cfg.WarmupTimeout); err != nil {
+		logger.Warn("starting stratum listener without an initial block template: ", err)
+	}
+
+	// cancelled on shutdown, disconnecting every client
+	serveCtx, stopServing := context.WithCancel(context.Background())
+	defer stopServing()
+	listener := gostratum.NewListener(stratumConfig)
+	listeners := []*gostratum.StratumListener{listener}
+	if cfg.TLSPort != "" {
+		certs, err := gostratum.NewCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile, logger.Desugar())
+		if err != nil {
+			return err
+		}
+		tlsConfig := stratumConfig
+		tlsConfig.Port = cfg.TLSPort
+		tlsConfig.TLSConfig = certs.TLSConfig()
+		tlsListener := gostratum.NewListener(tlsConfig)
+		listeners = append(listeners, tlsListener)
+		go func() {
+			logger.Info("serving stratum over tls on " + cfg.TLSPort)
+			if err := tlsListener.Listen(serveCtx); err != nil && !errors.Is(err, context.Canceled) {
+				logger.Error("tls stratum listener stopped", zap.Error(err))
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	served := make(chan error, 1)
+	go func() { served <- listener.Listen(serveCtx) }()
+	select {
+	case err := <-served:
+		return err
+	case sig := <-signals:
+		logger.Infof("received %s, shutting down", sig)
+	}
+	if cfg.ShutdownDrain > 0 {
+		draining.Store(true)
+		drainConnections(logger, listeners, clientHandler, cfg.ShutdownDrain, signals)
+	}
+	stopServing()
+	<-served
+	return nil
 }
@@ -1,17 +1,23 @@
 package pyrinstratum
 
 import (
+	"bytes"
 	"encoding/json"
 	"io/ioutil"
 	"log"
 	"math/big"
 	"net"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/pyrin-network/pyipad/app/appmessage"
+	"github.com/pyrin-network/pyipad/domain/consensus/utils/consensushashing"
+	"github.com/pyrin-network/pyipad/domain/consensus/utils/pow"
+	"github.com/pyrin-network/pyipad/domain/dagconfig"
 	"github.com/pyrin-network/pyipad/util/difficulty"
 	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
 )
 
 func TestHeaderSerialization(t *testing.T) {
@@ -28,14 +34,14 @@ func TestHeaderSerialization(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	headerExpected := []byte{133, 58, 11, 178, 12, 232, 111, 38, 102, 218, 38, 0, 153, 227, 171, 36, 187, 77, 247, 200, 58, 150, 48, 227, 245, 25, 242, 154, 65, 20, 46, 210}
+	headerExpected := []byte{188, 115, 173, 196, 48, 146, 141, 180, 96, 132, 173, 62, 24, 194, 181, 135, 188, 231, 195, 244, 165, 24, 201, 121, 14, 229, 5, 124, 83, 0, 109, 7}
 	if d := cmp.Diff(headerExpected, header); d != "" {
 		t.Fatalf("header generated incorrectly: %s", d)
 	}
 
 	{ // job separated to parts (lolminer/srbminer)
 		jobs := GenerateJobHeader(header)
-		expected := []uint64{2769687437080476293, 2642455852654975590, 16370749824715673019, 15145064868898544117}
+		expected := []uint64{13010215636699018172, 9778935575291462752, 8775572449963272124, 535084289290003726}
 		if d := cmp.Diff(expected, jobs); d != "" {
 			t.Fatalf("jobs generated incorrectly: %s", d)
 		}
@@ -44,7 +50,7 @@ func TestHeaderSerialization(t *testing.T) {
 
 	{ // job as single string (bzminer)
 		job := GenerateLargeJobParams(header, 1662696346)
-		expected := "853a0bb20ce86f2666da260099e3ab24bb4df7c83a9630e3f519f29a41142ed29abb1a6300000000"
+		expected := "bc73adc430928db46084ad3e18c2b587bce7c3f4a518c9790ee5057c53006d079abb1a6300000000"
 		if d := cmp.Diff(expected, job); d != "" {
 			t.Fatalf("jobs generated incorrectly: %s", d)
 		}
@@ -59,6 +65,130 @@ func TestHeaderSerialization(t *testing.T) {
 	}
 }
 
+// TestGenesisVectors runs the real genesis headers of mainnet and testnet,
+// as a template would arrive over rpc, through the bridge's hashing: the
+// block hash must be the one consensus hardcodes and the job header the
+// node's pre-pow hash. Pow values are pinned (pyipad v0.14.4) so a
+// dependency bump changing them is caught
+func TestGenesisVectors(t *testing.T) {
+	vectors := []struct {
+		params *dagconfig.Params
+		pow    string
+	}{
+		{&dagconfig.MainnetParams, "b6a446ddc3fa8e5c1e54a911fc223913299d73789e14cc6ce115867c343677d0"},
+		{&dagconfig.TestnetParams, "570efbd5a6a008087f0d4e27bdcddba9c7c1e88737c1223983fbccd427990500"},
+	}
+	for _, v := range vectors {
+		t.Run(v.params.Name, func(t *testing.T) {
+			raw, err := json.Marshal(appmessage.DomainBlockToRPCBlock(v.params.GenesisBlock))
+			if err != nil {
+				t.Fatal(err)
+			}
+			template := &appmessage.RPCBlock{}
+			if err := json.Unmarshal(raw, template); err != nil {
+				t.Fatal(err)
+			}
+
+			jobHeader, err := SerializeBlockHeader(template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if prePow := prePowHash(v.params.GenesisBlock.Header); !bytes.Equal(prePow.ByteSlice(), jobHeader) {
+				t.Fatalf("expected job header %s, got %x", prePow, jobHeader)
+			}
+			work, err := computeProofOfWork(template, template.Header.Nonce)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hash := consensushashing.HeaderHash(work.header); !hash.Equal(v.params.GenesisHash) {
+				t.Fatalf("expected block hash %s, got %s", v.params.GenesisHash, hash)
+			}
+			if value := work.value.Text(16); value != v.pow {
+				t.Fatalf("expected pow value %s, got %s", v.pow, value)
+			}
+		})
+	}
+}
+
+// TestBlockCandidates checks shares are taken as block candidates exactly
+// when the node's own pow check passes, on a target both outcomes are common
+func TestBlockCandidates(t *testing.T) {
+	template := &appmessage.RPCBlock{}
+	if err := json.Unmarshal(selfTestHeader, &template.Header); err != nil {
+		t.Fatal(err)
+	}
+	template.Header.Bits = 0x207fffff
+	converted, err := appmessage.RPCBlockToDomainBlock(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates := 0
+	for nonce := uint64(0); nonce < 256; nonce++ {
+		work, err := computeProofOfWork(template, nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := converted.Header.ToMutable()
+		header.SetNonce(nonce)
+		if accepted := pow.CheckProofOfWorkByBits(header); work.blockCandidate() != accepted {
+			t.Fatalf("nonce %d: block candidate %t but node accepts %t", nonce, work.blockCandidate(), accepted)
+		}
+		if work.blockCandidate() {
+			candidates++
+		}
+	}
+	if candidates == 0 || candidates == 256 {
+		t.Fatalf("expected some but not all nonces to be candidates, got %d", candidates)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	if err := SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+	// any change to the header has to be caught
+	tampered := bytes.Replace(selfTestHeader, []byte(`"Nonce": 123456789`), []byte(`"Nonce": 123456788`), 1)
+	if bytes.Equal(tampered, selfTestHeader) {
+		t.Fatalf("failed tampering with self-test header")
+	}
+	if err := runSelfTest(tampered); !errors.Is(err, ErrSelfTestFailed) {
+		t.Fatalf("expected self-test failure for a different nonce, got %v", err)
+	}
+}
+
+func TestTemplateFingerprint(t *testing.T) {
+	block := func(timestamp int64, parent, merkleRoot string, reward uint64) *appmessage.RPCBlock {
+		return &appmessage.RPCBlock{
+			Header: &appmessage.RPCBlockHeader{
+				Parents:        []*appmessage.RPCBlockLevelParents{{ParentHashes: []string{parent}}},
+				HashMerkleRoot: merkleRoot,
+				Timestamp:      timestamp,
+			},
+			Transactions: []*appmessage.RPCTransaction{{
+				SubnetworkID: coinbaseSubnetworkID,
+				Outputs:      []*appmessage.RPCTransactionOutput{{Amount: reward}},
+			}},
+		}
+	}
+	parent := "aa00000000000000000000000000000000000000000000000000000000000000"
+	merkleRoot := "bb00000000000000000000000000000000000000000000000000000000000000"
+	base := templateFingerprint(block(1000, parent, merkleRoot, 50))
+
+	if templateFingerprint(block(2000, parent, merkleRoot, 50)) != base {
+		t.Errorf("timestamp change shouldn't change the fingerprint")
+	}
+	other := "cc00000000000000000000000000000000000000000000000000000000000000"
+	if templateFingerprint(block(1000, other, merkleRoot, 50)) == base {
+		t.Errorf("parent change should change the fingerprint")
+	}
+	if templateFingerprint(block(1000, parent, other, 50)) == base {
+		t.Errorf("merkle root change should change the fingerprint")
+	}
+	if templateFingerprint(block(1000, parent, merkleRoot, 51)) == base {
+		t.Errorf("reward change should change the fingerprint")
+	}
+}
+
 func TestPoolHzCalculation(t *testing.T) {
 	// TODO: figure out what we really want to test here.
 	// currently set up diff object to mimic old static settings
@@ -97,3 +227,22 @@ func TestBridge(t *testing.T) {
 		c.Write(buff)
 	}
 }
+
+func TestLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	logFile, cleanup := openLogFile(filepath.Join(dir, "bridge.log"), BridgeConfig{LogRotateInterval: 10 * time.Millisecond, LogCompress: true})
+	defer cleanup()
+	if _, err := logFile.Write([]byte("first\n")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if rotated, _ := filepath.Glob(filepath.Join(dir, "bridge-*.log.gz")); len(rotated) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the log file to be rotated and compressed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,114 @@
+package pyrinstratum
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/pyrin-network/pyipad/app/appmessage"
+	"github.com/pyrin-network/pyipad/domain/consensus/model/externalapi"
+	"github.com/pyrin-network/pyipad/infrastructure/network/rpcclient"
+)
+
+// submitNode is a node (e.g. a well peered one close to the big pools) found
+// blocks are broadcast to for faster propagation. It's never used for
+// templates, and its outcome doesn't decide whether a block was accepted,
+// only the template nodes do. Submits are concurrent, so unlike the stats
+// node the connection is guarded
+type submitNode struct {
+	address string
+	lock    sync.Mutex
+	client  rpcClient // nil until connected, and after a transport failure
+}
+
+func newSubmitNodes(addresses []string) []*submitNode {
+	nodes := make([]*submitNode, 0, len(addresses))
+	for _, address := range addresses {
+		nodes = append(nodes, &submitNode{address: address})
+	}
+	return nodes
+}
+
+// connect returns the node's client, dialing it if there's no connection
+func (sn *submitNode) connect(dial func(string) (rpcClient, error)) (rpcClient, error) {
+	sn.lock.Lock()
+	defer sn.lock.Unlock()
+	if sn.client != nil {
+		return sn.client, nil
+	}
+	client, err := dial(sn.address)
+	if err != nil {
+		return nil, err
+	}
+	sn.client = client
+	return client, nil
+}
+
+// drop closes the connection after a transport failure, unless another
+// submit already replaced it. It's redialed on the next block
+func (sn *submitNode) drop(client rpcClient) {
+	sn.lock.Lock()
+	defer sn.lock.Unlock()
+	if sn.client == client {
+		sn.client.Close()
+		sn.client = nil
+	}
+}
+
+// submit outcomes recorded per submit node
+const (
+	submitAccepted = "accepted"
+	submitRejected = "rejected"
+	submitFailed   = "error"
+)
+
+// broadcastBlock submits the block to every submit node in the background,
+// recording each outcome. Returns a channel receiving the submit nodes'
+// combined verdict once all of them are done
+func (py *PyrinApi) broadcastBlock(block *externalapi.DomainBlock) <-chan blockVerdict {
+	done := make(chan blockVerdict, 1)
+	wg := sync.WaitGroup{}
+	verdicts := make(chan blockVerdict, len(py.submitNodes))
+	for _, sn := range py.submitNodes {
+		wg.Add(1)
+		go func(sn *submitNode) {
+			defer wg.Done()
+			outcome, verdict := py.submitTo(sn, block)
+			RecordSubmitNodeResult(sn.address, outcome)
+			verdicts <- verdict
+		}(sn)
+	}
+	go func() {
+		wg.Wait()
+		close(verdicts)
+		combined := verdictNone
+		for verdict := range verdicts {
+			combined = combined.merge(verdict)
+		}
+		done <- combined
+		close(done)
+	}()
+	return done
+}
+
+func (py *PyrinApi) submitTo(sn *submitNode, block *externalapi.DomainBlock) (string, blockVerdict) {
+	client, err := sn.connect(py.dial)
+	if err != nil {
+		py.logger.Warnw("failed connecting to submit node", "node", sn.address, "error", err)
+		return submitFailed, verdictNone
+	}
+	reason, err := withContext(py.ctx, py.rpcTimeout, func() (appmessage.RejectReason, error) {
+		return client.SubmitBlock(block)
+	})
+	if err == nil {
+		return submitAccepted, verdictAccepted
+	}
+	if !errors.Is(err, rpcclient.ErrRPC) {
+		sn.drop(client)
+		py.logger.Warnw("failed submitting block to submit node", "node", sn.address, "error", err)
+		return submitFailed, verdictNone
+	}
+	// usually the block already arrived through the template node, which is
+	// the point of broadcasting
+	py.logger.Debugw("submit node rejected block", "node", sn.address, "reason", reason, "error", err)
+	return submitRejected, submitVerdict(reason, err)
+}
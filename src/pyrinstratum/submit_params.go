@@ -0,0 +1,55 @@
+package pyrinstratum
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+)
+
+// ErrMalformedSubmit is a submit rejected for its params alone, before the
+// job is looked up or the share hashed
+var ErrMalformedSubmit = fmt.Errorf("malformed submit")
+
+// malformedSubmit counts the submit under reason (the
+// py_malformed_submit_counter label) and returns the error it's rejected
+// with
+func malformedSubmit(ctx *gostratum.StratumContext, reason string, format string, args ...any) error {
+	RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
+	RecordMalformedSubmit(reason)
+	return errors.Wrapf(ErrMalformedSubmit, "%s: "+format, append([]any{reason}, args...)...)
+}
+
+// checkSubmitNonce validates the submitted nonce (0x prefix already removed)
+// against the extranonce negotiated with the client: hex, and either the
+// full 8 byte nonce or at most the client's extranonce2. Shorter extranonce2
+// are zero padded (see fullNonce) unless strict, which also requires a full
+// nonce to carry the client's extranonce
+func checkSubmitNonce(ctx *gostratum.StratumContext, nonce string, strict bool) error {
+	if nonce == "" || len(nonce) > nonceHexLen || strings.Trim(nonce, "0123456789abcdefABCDEF") != "" {
+		return malformedSubmit(ctx, "nonce_format", "nonce %q isn't up to %d hex digits", nonce, nonceHexLen)
+	}
+	if len(nonce) == nonceHexLen {
+		if strict && !strings.EqualFold(nonce[:len(ctx.Extranonce)], ctx.Extranonce) {
+			return malformedSubmit(ctx, "extranonce_mismatch", "nonce %s doesn't start with the extranonce %s", nonce, ctx.Extranonce)
+		}
+		return nil
+	}
+	expected := extranonce2HexLen(ctx.Extranonce, ctx.Extranonce2Size)
+	if len(nonce) > expected || strict && len(nonce) != expected {
+		return malformedSubmit(ctx, "nonce_length", "nonce %s is %d hex digits, expected %d or %d", nonce, len(nonce), expected, nonceHexLen)
+	}
+	return nil
+}
+
+// extranonce2HexLen is the number of hex digits of the nonce the miner
+// controls, extranonce2Size bytes when negotiated and otherwise the rest of
+// the nonce after the extranonce
+func extranonce2HexLen(extranonce string, extranonce2Size int) int {
+	length := nonceHexLen - len(extranonce)
+	if extranonce2Size > 0 && extranonce2Size*2 < length {
+		length = extranonce2Size * 2
+	}
+	return length
+}
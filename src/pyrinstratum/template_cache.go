@@ -0,0 +1,100 @@
+package pyrinstratum
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pyrin-network/pyipad/app/appmessage"
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+)
+
+// templateCache shares templates between clients whose templates would be
+// the same anyway, those mining to the same address with the same coinbase
+// tag. On a pool where every rig mines to one address each new block is a
+// template fetch per connection otherwise, all returning the same template.
+// Every new block (or fallback poll) starts a new generation, templates are
+// only shared within one. Connections still search apart, each has its own
+// extranonce. A nil cache fetches per client
+type templateCache struct {
+	lock       sync.Mutex
+	generation uint64
+	entries    map[string]cachedTemplate
+	// fetches in flight per generation and key, so clients missing the
+	// cache at once fetch a single template between them
+	flights templateFlight
+}
+
+type cachedTemplate struct {
+	template *appmessage.GetBlockTemplateResponseMessage
+	node     string
+}
+
+// invalidate drops every cached template, called when templates have to be
+// fetched anew
+func (c *templateCache) invalidate() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	c.generation++
+	c.entries = nil
+	c.lock.Unlock()
+}
+
+// get returns the template cached for key in the current generation and
+// its generation, the template only if it came from node
+func (c *templateCache) get(key, node string) (*appmessage.GetBlockTemplateResponseMessage, uint64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cached, exists := c.entries[key]
+	if !exists || cached.node != node {
+		return nil, c.generation, false
+	}
+	return cached.template, c.generation, true
+}
+
+// put caches a template fetched in generation, unless a newer generation
+// started meanwhile
+func (c *templateCache) put(key string, generation uint64, template *appmessage.GetBlockTemplateResponseMessage, node string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if c.entries == nil {
+		c.entries = map[string]cachedTemplate{}
+	}
+	c.entries[key] = cachedTemplate{template: template, node: node}
+}
+
+// templateCacheKey is what the client's template is built from, the address
+// (or the solo payout addresses, which replace every client's) and the
+// coinbase tag
+func (py *PyrinApi) templateCacheKey(client *gostratum.StratumContext) string {
+	address := client.WalletAddr
+	if py.payouts != nil {
+		address = "payout"
+	}
+	return address + "/" + coinbaseTag(client, py.tagWorker)
+}
+
+// sharedTemplate returns the template for the client from the cache, from
+// the active node only, so a failover isn't undone by templates from the
+// node failed over from. A miss fetches it for every client waiting on it
+func (py *PyrinApi) sharedTemplate(client *gostratum.StratumContext) (*appmessage.GetBlockTemplateResponseMessage, string, error) {
+	key := py.templateCacheKey(client)
+	active := py.activeNode().address
+	template, generation, cached := py.templateCache.get(key, active)
+	if cached && !py.templateTooOld(template) {
+		RecordCachedTemplate()
+		return template, active, nil
+	}
+	RecordTemplateCacheMiss()
+	return py.templateCache.flights.do(fmt.Sprintf("%d/%s", generation, key), func() (*appmessage.GetBlockTemplateResponseMessage, string, error) {
+		template, node, err := py.clientTemplate(client)
+		if err == nil {
+			py.templateCache.put(key, generation, template, node)
+		}
+		return template, node, err
+	})
+}
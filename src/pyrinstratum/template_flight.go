@@ -0,0 +1,44 @@
+package pyrinstratum
+
+import (
+	"fmt"
+
+	"github.com/pyrin-network/pyipad/app/appmessage"
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+	"golang.org/x/sync/singleflight"
+)
+
+// templateFlight collapses concurrent template fetches for the same key into
+// one rpc, callers overlapping one in flight (e.g. a job push racing a new
+// block broadcast) get its result instead of fetching again. A fetch that
+// panics panics in every caller sharing it. The zero value is ready to use
+type templateFlight struct {
+	group singleflight.Group
+}
+
+// templateFlightKey identifies a client's fetches, the wallet being part of
+// it since a client's template is built for the address it authorized with
+func templateFlightKey(client *gostratum.StratumContext) string {
+	return fmt.Sprintf("%d/%s", client.Id, client.WalletAddr)
+}
+
+type flightResult struct {
+	template *appmessage.GetBlockTemplateResponseMessage
+	node     string
+}
+
+// do runs fetch unless a fetch for key is already in flight, in which case
+// it waits for and returns that fetch's result
+func (f *templateFlight) do(key string, fetch func() (*appmessage.GetBlockTemplateResponseMessage, string, error)) (*appmessage.GetBlockTemplateResponseMessage, string, error) {
+	fetched := false
+	result, err, shared := f.group.Do(key, func() (interface{}, error) {
+		fetched = true
+		template, node, err := fetch()
+		return flightResult{template: template, node: node}, err
+	})
+	if shared && !fetched {
+		RecordSharedTemplateFetch()
+	}
+	flight := result.(flightResult)
+	return flight.template, flight.node, err
+}
@@ -0,0 +1,41 @@
+package pyrinstratum
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/pyrin-network/pyipad/app/appmessage"
+)
+
+// LoadBlockTemplate reads a captured GetBlockTemplate response, the json
+// encoding of the appmessage response (e.g. dumped with json.Marshal when
+// reproducing a bug), for replaying it against the job push and share
+// validation. The template must convert to a domain block like a node's
+// would, so a broken capture fails here rather than halfway through a replay
+func LoadBlockTemplate(path string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed reading block template")
+	}
+	// captures from other node versions may carry a full target instead of
+	// compact bits
+	raw, _, err = normalizeTemplateTarget(raw)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed decoding block template %s", path)
+	}
+	template := &appmessage.GetBlockTemplateResponseMessage{}
+	if err := json.Unmarshal(raw, template); err != nil {
+		return nil, errors.Wrapf(err, "failed decoding block template %s", path)
+	}
+	if template.Error != nil {
+		return nil, errors.Errorf("captured block template %s is an error response: %s", path, template.Error.Message)
+	}
+	if template.Block == nil || template.Block.Header == nil {
+		return nil, errors.Errorf("captured block template %s has no block header", path)
+	}
+	if _, err := appmessage.RPCBlockToDomainBlock(template.Block); err != nil {
+		return nil, errors.Wrapf(err, "captured block template %s isn't a valid block", path)
+	}
+	return template, nil
+}
@@ -0,0 +1,203 @@
+package pyrinstratum
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pyrin-network/pyipad/app/appmessage"
+	"github.com/pyrin-network/pyipad/util/difficulty"
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+	"go.uber.org/zap"
+)
+
+// templateReplay drives a captured template through the bridge the way a
+// new block notification would, for reproducing share handling against it
+type templateReplay struct {
+	template *appmessage.GetBlockTemplateResponseMessage
+	node     *mockRpcClient
+	api      *PyrinApi
+	shares   *shareHandler
+	listener *clientListener
+	client   *gostratum.StratumContext
+	writes   chan string
+	mc       *gostratum.MockConnection
+	// the last job as sent
+	job string
+}
+
+// replayTemplate loads the captured template and connects a single miner,
+// subscribed and authorized, to a bridge whose node serves only it
+func replayTemplate(t *testing.T, path string) *templateReplay {
+	template, err := LoadBlockTemplate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &templateReplay{template: template, writes: make(chan string, 8)}
+	r.node = &mockRpcClient{templates: []*appmessage.GetBlockTemplateResponseMessage{template}}
+	r.api = testApi(r.node, 0)
+	r.shares = newShareHandler(r.api, 1, 0, nil, 0, invalidSharePolicy{}, 0)
+	r.listener = newClientListener(zap.NewNop().Sugar(), r.shares, 1, 0, 0, 0, 0, 0, nil, nil)
+	// balances aren't part of a replay
+	r.listener.lastBalanceCheck = time.Now()
+	r.client, r.mc = gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	// past the subscribe grace, the client is sent jobs like a subscribed one
+	GetMiningState(r.client).connectTime = time.Now().Add(-subscribeGrace)
+	r.listener.clients[1] = r.client
+	return r
+}
+
+// read returns the next message the bridge sent the miner
+func (r *templateReplay) read(t *testing.T) string {
+	r.mc.AsyncReadTestDataFromBuffer(func(b []byte) { r.writes <- string(b) })
+	select {
+	case msg := <-r.writes:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the bridge to write to the miner")
+		return ""
+	}
+}
+
+// pushJob signals a new block and returns the job the miner was sent, with
+// the difficulty first on the first push
+func (r *templateReplay) pushJob(t *testing.T) gostratum.JsonRpcEvent {
+	r.listener.NewBlockAvailable(r.api)
+	for {
+		var event gostratum.JsonRpcEvent
+		msg := r.read(t)
+		if err := json.Unmarshal([]byte(msg), &event); err != nil {
+			t.Fatalf("failed decoding %s: %s", msg, err)
+		}
+		if event.Method == "mining.notify" {
+			r.job = msg
+			return event
+		}
+	}
+}
+
+// submit sends a share for the job and returns the bridge's reply, or the
+// error for shares the bridge doesn't reply to itself
+func (r *templateReplay) submit(job gostratum.JsonRpcEvent, nonce uint64) (string, error) {
+	event := gostratum.JsonRpcEvent{
+		Id:     job.Id,
+		Method: gostratum.StratumMethodSubmit,
+		Params: []any{r.client.WalletAddr + "." + r.client.WorkerName, job.Params[0], strconv.FormatUint(nonce, 16)},
+	}
+	r.mc.AsyncReadTestDataFromBuffer(func(b []byte) { r.writes <- string(b) })
+	if err := r.shares.HandleSubmit(r.client, event); err != nil {
+		return "", err
+	}
+	return <-r.writes, nil
+}
+
+func TestReplayTemplate(t *testing.T) {
+	r := replayTemplate(t, "example_template.json")
+	job := r.pushJob(t)
+	if r.node.templateCalls != 1 {
+		t.Fatalf("expected the captured template fetched once, got %d", r.node.templateCalls)
+	}
+	header, err := SerializeBlockHeader(r.template.Block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := mustJson(t, GenerateJobHeader(header)); !strings.Contains(r.job, expected) {
+		t.Fatalf("expected the job built from the captured header %s, got %s", expected, r.job)
+	}
+	if ts := job.Params[2].(float64); int64(ts) != r.template.Block.Header.Timestamp {
+		t.Fatalf("expected the captured template timestamp, got %f", ts)
+	}
+
+	// down to a share in a few hundred hashes so one can be mined here
+	diff := GetMiningState(r.client).stratumDiff
+	diff.setDiffValue(1.0 / (1 << 24))
+	if reply, err := r.submit(job, testShareNonce(t, r.template.Block, diff.targetValue, true)); err != nil || !strings.Contains(reply, `"result":true`) {
+		t.Fatalf("expected the share accepted, got %s (%v)", reply, err)
+	}
+	if reply, err := r.submit(gostratum.JsonRpcEvent{Id: 2, Params: []any{"999"}}, 1); err != nil || !strings.Contains(reply, "Unknown job") {
+		t.Fatalf("expected a share for a job the miner wasn't sent rejected, got %s (%v)", reply, err)
+	}
+	if found := r.shares.overall.SharesFound.Load(); found != 1 {
+		t.Fatalf("expected one share credited, got %d", found)
+	}
+}
+
+func mustJson(t *testing.T, value any) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(encoded)
+}
+
+func TestLoadBlockTemplateErrors(t *testing.T) {
+	if _, err := LoadBlockTemplate("missing.json"); err == nil {
+		t.Fatalf("expected a missing capture to fail")
+	}
+	if _, err := LoadBlockTemplate("example_header.json"); err == nil || !strings.Contains(err.Error(), "no block header") {
+		t.Fatalf("expected a bare header rejected as a template, got %v", err)
+	}
+}
+
+func TestTemplateTargetForms(t *testing.T) {
+	const bits = 453325233 // 0x1b0531b1
+	target := fmt.Sprintf("%064x", difficulty.CompactToBig(bits))
+	for _, test := range []struct {
+		name, bits, target string
+		form               targetForm
+		err                string
+	}{
+		{name: "compact number", bits: "453325233", form: targetCompact},
+		{name: "compact hex", bits: `"0x1b0531b1"`, form: targetCompact},
+		{name: "full target", target: target, form: targetFull},
+		{name: "full target with 0x", target: "0x" + target, form: targetFull},
+		{name: "both agreeing", bits: "453325233", target: target, form: targetFull},
+		{name: "both disagreeing", bits: "453325234", target: target, err: "don't match its target"},
+		{name: "neither", err: "neither bits nor a target"},
+		{name: "inexact target", target: "1234567", err: "no exact compact form"},
+		{name: "invalid target", target: "xyz", err: "invalid template target"},
+		{name: "invalid bits", bits: `"xyz"`, err: "invalid template bits"},
+		{name: "zero bits", bits: "0", err: "no positive target"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			parsed, form, err := templateBits(json.RawMessage(test.bits), test.target)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing '%s', got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil || parsed != bits || form != test.form {
+				t.Fatalf("expected bits %d as %s, got %d as %s (%v)", bits, test.form, parsed, form, err)
+			}
+		})
+	}
+
+	// a capture carrying only the full target loads like the compact one
+	captured, err := os.ReadFile("example_template.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := strings.Replace(string(captured), `"Bits": 453325233,`, fmt.Sprintf(`"Target": "%s",`, target), 1)
+	if full == string(captured) {
+		t.Fatalf("expected the capture's bits replaced")
+	}
+	path := filepath.Join(t.TempDir(), "template.json")
+	if err := os.WriteFile(path, []byte(full), 0644); err != nil {
+		t.Fatal(err)
+	}
+	template, err := LoadBlockTemplate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := LoadBlockTemplate("example_template.json")
+	if template.Block.Header.Bits != bits || template.Block.Header.Nonce != expected.Block.Header.Nonce {
+		t.Fatalf("expected the full target capture decoded to the same header, got %+v", template.Block.Header)
+	}
+}
@@ -0,0 +1,46 @@
+package pyrinstratum
+
+import (
+	"time"
+
+	"github.com/pyrin-network/pyipad/app/appmessage"
+	"go.uber.org/zap"
+)
+
+const defaultTemplateRetries = 3
+const defaultTemplateRetryDelay = 500 * time.Millisecond
+
+// freshConnection is how long after the bridge (re)connected to a node an
+// unsynced template from it is taken for the node still starting up
+const freshConnection = 30 * time.Second
+
+// templateRetry is how often a just (re)connected node handing out unsynced
+// templates is asked again before its template is used, -1 (or 0) attempts
+// for none
+type templateRetry struct {
+	attempts int
+	delay    time.Duration
+}
+
+// getSyncedBlockTemplate fetches a template from the node, asking again a
+// few times while a node the bridge only just (re)connected to reports it
+// isn't synced. A restarted node does that for a second or two while it's
+// still loading, rather than refusing the request. A node that's been up for
+// longer and isn't synced is left to the sync monitor. The last template is
+// returned either way, synced or not
+func (py *PyrinApi) getSyncedBlockTemplate(node *pyrinNode, address, extraData string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+	template, err := py.getBlockTemplate(node, address, extraData)
+	for attempt := 0; err == nil && !template.IsSynced && attempt < py.templateRetry.attempts &&
+		node.connectionAge(time.Now()) < freshConnection; attempt++ {
+		RecordTemplateUnsynced(node.address)
+		py.logger.Info("just connected pyrin node not synced yet, asking for a template again",
+			zap.String("node", node.address))
+		select {
+		case <-py.ctx.Done():
+			return template, nil
+		case <-time.After(py.templateRetry.delay):
+		}
+		template, err = py.getBlockTemplate(node, address, extraData)
+	}
+	return template, err
+}
@@ -0,0 +1,134 @@
+package pyrinstratum
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/pyrin-network/pyipad/util/difficulty"
+)
+
+// targetForm is how a template header expresses its target
+type targetForm string
+
+const (
+	// the compact "Bits", as a number or a hex string
+	targetCompact targetForm = "bits"
+	// a full 256 bit "Target", as a hex string
+	targetFull targetForm = "target"
+)
+
+// templateBits returns the compact target of a template header given its
+// raw "Bits" and "Target" values, either of which may be missing depending
+// on the node version the template came from. When both are present they
+// have to agree
+func templateBits(rawBits json.RawMessage, rawTarget string) (uint32, targetForm, error) {
+	var bits uint32
+	var hasBits bool
+	if len(rawBits) > 0 && !bytes.Equal(rawBits, []byte("null")) {
+		parsed, err := parseCompactBits(rawBits)
+		if err != nil {
+			return 0, "", err
+		}
+		bits, hasBits = parsed, true
+	}
+	if rawTarget == "" {
+		if !hasBits {
+			return 0, "", errors.New("template header has neither bits nor a target")
+		}
+		return bits, targetCompact, checkCompactBits(bits)
+	}
+
+	target, ok := new(big.Int).SetString(strings.TrimPrefix(rawTarget, "0x"), 16)
+	if !ok || target.Sign() <= 0 || target.BitLen() > 256 {
+		return 0, "", errors.Errorf("invalid template target '%s'", rawTarget)
+	}
+	compact := difficulty.BigToCompact(target)
+	// every node target is derived from compact bits, one that isn't exactly
+	// representable means the template is corrupt
+	if difficulty.CompactToBig(compact).Cmp(target) != 0 {
+		return 0, "", errors.Errorf("template target %s has no exact compact form", rawTarget)
+	}
+	if hasBits && bits != compact {
+		return 0, "", errors.Errorf("template bits %08x don't match its target %s", bits, rawTarget)
+	}
+	return compact, targetFull, nil
+}
+
+// checkCompactBits returns an error if the compact bits don't encode a
+// positive target, which no node sends. Shares and blocks would otherwise be
+// judged against a target of 0. Templates fetched over rpc carry compact bits
+// only (a uint32 in pyipad's protobuf), so this is all their target needs
+func checkCompactBits(bits uint32) error {
+	if difficulty.CompactToBig(bits).Sign() <= 0 {
+		return errors.Errorf("template bits %08x encode no positive target", bits)
+	}
+	return nil
+}
+
+// parseCompactBits reads compact bits sent as a json number or as a hex
+// string, with or without 0x
+func parseCompactBits(raw json.RawMessage) (uint32, error) {
+	var number json.Number
+	if err := json.Unmarshal(raw, &number); err == nil {
+		bits, err := strconv.ParseUint(number.String(), 10, 32)
+		return uint32(bits), errors.Wrapf(err, "invalid template bits %s", raw)
+	}
+	var hex string
+	if err := json.Unmarshal(raw, &hex); err != nil {
+		return 0, errors.Errorf("invalid template bits %s", raw)
+	}
+	bits, err := strconv.ParseUint(strings.TrimPrefix(hex, "0x"), 16, 32)
+	return uint32(bits), errors.Wrapf(err, "invalid template bits '%s'", hex)
+}
+
+// normalizeTemplateTarget rewrites the header of a captured GetBlockTemplate
+// response to the numeric compact bits appmessage decodes, whichever form
+// the target was captured in
+func normalizeTemplateTarget(raw []byte) ([]byte, targetForm, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	// keeps numbers like the nonce exact through the rewrite
+	decoder.UseNumber()
+	var response map[string]any
+	if err := decoder.Decode(&response); err != nil {
+		return nil, "", err
+	}
+	block, _ := response["Block"].(map[string]any)
+	header, _ := block["Header"].(map[string]any)
+	if header == nil {
+		// left for the decoded template's checks
+		return raw, "", nil
+	}
+	var rawBits json.RawMessage
+	if value, exists := takeField(header, "Bits"); exists {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, "", err
+		}
+		rawBits = encoded
+	}
+	target, _ := takeField(header, "Target")
+	rawTarget, _ := target.(string)
+	bits, form, err := templateBits(rawBits, rawTarget)
+	if err != nil {
+		return nil, "", err
+	}
+	header["Bits"] = bits
+	normalized, err := json.Marshal(response)
+	return normalized, form, err
+}
+
+// takeField removes and returns the field, matched case insensitively like
+// encoding/json matches struct fields
+func takeField(fields map[string]any, name string) (any, bool) {
+	for key, value := range fields {
+		if strings.EqualFold(key, name) {
+			delete(fields, key)
+			return value, true
+		}
+	}
+	return nil, false
+}
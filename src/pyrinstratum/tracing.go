@@ -0,0 +1,280 @@
+package pyrinstratum
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+	"go.uber.org/zap"
+)
+
+// spans are exported in batches of up to traceBatchSize, at least every
+// traceFlushInterval. Spans ended while traceQueueSize are waiting to be
+// exported are dropped
+const traceBatchSize = 512
+const traceFlushInterval = 5 * time.Second
+const traceQueueSize = 4096
+const traceExportTimeout = 10 * time.Second
+
+const traceServiceName = "pyrin-stratum-bridge"
+
+// tracer exports share and template lifecycle spans to an OpenTelemetry
+// collector over OTLP/HTTP (json encoded). A nil tracer is a valid disabled
+// one, it starts nil spans whose methods do nothing, so tracing costs nothing
+// when no endpoint is configured
+type tracer struct {
+	endpoint   string
+	sampleRate float64
+	client     *http.Client
+	spans      chan *span
+	logger     *zap.SugaredLogger
+}
+
+// newTracer returns a tracer exporting to the collector at endpoint, e.g.
+// http://localhost:4318, the /v1/traces path is added unless given. Only
+// sampleRate of the root spans (and their children) are recorded
+func newTracer(endpoint string, sampleRate float64, logger *zap.SugaredLogger) *tracer {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint += "/v1/traces"
+	}
+	return &tracer{
+		endpoint:   endpoint,
+		sampleRate: sampleRate,
+		client:     &http.Client{Timeout: traceExportTimeout},
+		spans:      make(chan *span, traceQueueSize),
+		logger:     logger,
+	}
+}
+
+// spanAttr is a span attribute, values are strings, ints or bools
+type spanAttr struct {
+	key   string
+	value any
+}
+
+// span is a timed operation within a trace. Spans aren't safe for concurrent
+// use, start a child per goroutine instead
+type span struct {
+	tracer  *tracer
+	name    string
+	traceID [16]byte
+	id      [8]byte
+	parent  [8]byte
+	start   time.Time
+	end     time.Time
+	attrs   []spanAttr
+	err     string
+}
+
+// start begins a new trace, or nothing if this one isn't sampled
+func (t *tracer) start(name string, attrs ...spanAttr) *span {
+	if t == nil || (t.sampleRate < 1 && mrand.Float64() >= t.sampleRate) {
+		return nil
+	}
+	s := &span{tracer: t, name: name, start: time.Now(), attrs: attrs}
+	rand.Read(s.traceID[:])
+	rand.Read(s.id[:])
+	return s
+}
+
+// child begins a span nested in s
+func (s *span) child(name string, attrs ...spanAttr) *span {
+	if s == nil {
+		return nil
+	}
+	c := &span{tracer: s.tracer, name: name, traceID: s.traceID, parent: s.id, start: time.Now(), attrs: attrs}
+	rand.Read(c.id[:])
+	return c
+}
+
+func (s *span) setAttr(key string, value any) {
+	if s != nil {
+		s.attrs = append(s.attrs, spanAttr{key: key, value: value})
+	}
+}
+
+// fail marks the span as failed with err, a nil err leaves it as is
+func (s *span) fail(err error) {
+	if s != nil && err != nil {
+		s.err = err.Error()
+	}
+}
+
+// finish ends the span and queues it for export
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	select {
+	case s.tracer.spans <- s:
+	default:
+		RecordTraceDrop()
+	}
+}
+
+// run exports queued spans until ctx is cancelled, exporting what's left
+// on the way out
+func (t *tracer) run(ctx context.Context) {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	batch := make([]*span, 0, traceBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(batch); err != nil {
+			t.logger.Warn("failed exporting traces: ", err)
+			for range batch {
+				RecordTraceDrop()
+			}
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		case s := <-t.spans:
+			if batch = append(batch, s); len(batch) >= traceBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (t *tracer) export(spans []*span) error {
+	data, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	res, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("collector %s responded %s", t.endpoint, res.Status)
+	}
+	return nil
+}
+
+// the OTLP/HTTP json encoding of an export request, limited to the fields
+// the bridge sets
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpSpan struct {
+	TraceID      string         `json:"traceId"`
+	SpanID       string         `json:"spanId"`
+	ParentSpanID string         `json:"parentSpanId,omitempty"`
+	Name         string         `json:"name"`
+	Kind         int            `json:"kind"`
+	Start        string         `json:"startTimeUnixNano"`
+	End          string         `json:"endTimeUnixNano"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	Status       *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+// span kind internal and status error, as numbered in the OTLP protos
+const otlpKindInternal = 1
+const otlpStatusError = 2
+
+func otlpValue(value any) map[string]any {
+	switch v := value.(type) {
+	case string:
+		return map[string]any{"stringValue": v}
+	case int:
+		return map[string]any{"intValue": strconv.Itoa(v)}
+	case bool:
+		return map[string]any{"boolValue": v}
+	default:
+		return map[string]any{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+func otlpRequest(spans []*span) otlpTraces {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		es := otlpSpan{
+			TraceID: hex.EncodeToString(s.traceID[:]),
+			SpanID:  hex.EncodeToString(s.id[:]),
+			Name:    s.name,
+			Kind:    otlpKindInternal,
+			Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+			End:     strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parent != [8]byte{} {
+			es.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		for _, a := range s.attrs {
+			es.Attributes = append(es.Attributes, otlpKeyValue{Key: a.key, Value: otlpValue(a.value)})
+		}
+		if s.err != "" {
+			es.Status = &otlpStatus{Code: otlpStatusError, Message: s.err}
+		}
+		encoded = append(encoded, es)
+	}
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			{Key: "service.name", Value: otlpValue(traceServiceName)},
+			{Key: "service.version", Value: otlpValue(version)},
+		}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "pyrinstratum", Version: version}, Spans: encoded}},
+	}}}
+}
+
+// workerAttrs identifies the client a span is for
+func workerAttrs(ctx *gostratum.StratumContext) []spanAttr {
+	return []spanAttr{{key: "worker", value: ctx.WorkerName}, {key: "wallet", value: ctx.WalletAddr}}
+}
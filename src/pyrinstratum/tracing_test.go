@@ -0,0 +1,83 @@
+package pyrinstratum
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestTracing(t *testing.T) {
+	var disabled *tracer
+	span := disabled.start("share")
+	span.child("share.validate").finish()
+	span.setAttr("job_id", 1)
+	span.fail(fmt.Errorf("nope"))
+	span.finish()
+	if span != nil {
+		t.Fatalf("expected a disabled tracer to start no spans")
+	}
+
+	exports := make(chan otlpTraces, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("unexpected export path %s", r.URL.Path)
+		}
+		var traces otlpTraces
+		if err := json.NewDecoder(r.Body).Decode(&traces); err != nil {
+			t.Error(err)
+		}
+		exports <- traces
+	}))
+	defer collector.Close()
+
+	traces := newTracer(collector.URL, 1, zap.NewNop().Sugar())
+	if never := newTracer(collector.URL, 0, zap.NewNop().Sugar()); never.start("share") != nil {
+		t.Fatalf("expected nothing sampled at a rate of 0")
+	}
+	root := traces.start("share", spanAttr{key: "worker", value: "rig1"})
+	root.setAttr("job_id", 7)
+	child := root.child("share.submit")
+	child.fail(fmt.Errorf("block rejected"))
+	child.finish()
+	root.finish()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		traces.run(ctx)
+		close(done)
+	}()
+	cancel()
+	<-done
+
+	exported := <-exports
+	if len(exported.ResourceSpans) != 1 || len(exported.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected export %+v", exported)
+	}
+	spans := exported.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans exported, got %d", len(spans))
+	}
+	submit, share := spans[0], spans[1]
+	if submit.TraceID != share.TraceID || submit.ParentSpanID != share.SpanID || share.ParentSpanID != "" {
+		t.Fatalf("expected share.submit nested in share, got %+v and %+v", submit, share)
+	}
+	if submit.Status == nil || submit.Status.Code != otlpStatusError || submit.Status.Message != "block rejected" {
+		t.Fatalf("expected share.submit failed, got %+v", submit.Status)
+	}
+	if share.Status != nil {
+		t.Fatalf("expected share ok, got %+v", share.Status)
+	}
+	attrs := map[string]map[string]any{}
+	for _, a := range share.Attributes {
+		attrs[a.Key] = a.Value
+	}
+	if attrs["worker"]["stringValue"] != "rig1" || attrs["job_id"]["intValue"] != "7" {
+		t.Fatalf("unexpected share attributes %+v", attrs)
+	}
+}
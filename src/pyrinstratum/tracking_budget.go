@@ -0,0 +1,35 @@
+package pyrinstratum
+
+import "time"
+
+// what an evicted worker was tracked by, the labels of
+// py_tracking_evicted_counter. With max_tracked_workers set each of these
+// keeps at most that many workers, so the memory they take is bounded no
+// matter how many workers come and go
+const (
+	trackedWorkerStats = "worker_stats"
+	trackedDiffMemory  = "diff_memory"
+	trackedFlaps       = "flaps"
+)
+
+// evictStats drops the stats of the worker that shared least recently to
+// make room for a new one. Its counts start over if it's still around and
+// shares again. Must be called with the stats lock held
+func (sh *shareHandler) evictStats() {
+	oldest := sh.statsOrder.Back()
+	if oldest == nil {
+		return
+	}
+	delete(sh.stats, sh.statsOrder.Remove(oldest).(string))
+	RecordTrackingEvicted(trackedWorkerStats)
+}
+
+// touchStats records an accepted share for the worker, moving it to the
+// front of the eviction order. Stats already evicted aren't in it anymore
+// and stay out
+func (sh *shareHandler) touchStats(stats *WorkStats) {
+	sh.statsLock.Lock()
+	defer sh.statsLock.Unlock()
+	stats.LastShare = time.Now()
+	sh.statsOrder.MoveToFront(stats.order)
+}
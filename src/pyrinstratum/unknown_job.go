@@ -0,0 +1,49 @@
+package pyrinstratum
+
+import (
+	"fmt"
+
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+	"go.uber.org/zap"
+)
+
+// UnknownJobPolicy controls how a submit for a job id the connection was
+// never sent is answered. Unlike a stale share (a job that was sent but is
+// no longer retained, or built on old parents) no honest miner produces
+// these, it's a confused client reusing job ids across connections or
+// someone probing the bridge
+type UnknownJobPolicy string
+
+const (
+	// UnknownJobReject replies with an "Unknown job" error, the default
+	UnknownJobReject UnknownJobPolicy = "reject"
+	// UnknownJobDisconnect drops the connection
+	UnknownJobDisconnect UnknownJobPolicy = "disconnect"
+)
+
+func (p UnknownJobPolicy) Valid() bool {
+	switch p {
+	case "", UnknownJobReject, UnknownJobDisconnect:
+		return true
+	}
+	return false
+}
+
+var (
+	ErrUnknownJobId = fmt.Errorf("unknown job")
+	ErrExpiredJobId = fmt.Errorf("job no longer retained")
+)
+
+// handleUnknownJob answers a submit for a job id the client was never sent
+// per the policy, returning an error (which drops the connection) only when
+// disconnecting
+func (sh *shareHandler) handleUnknownJob(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent, err error) error {
+	RecordUnknownJob()
+	sh.checkInvalidShares(ctx, true)
+	if sh.unknownJobs == UnknownJobDisconnect {
+		ctx.Logger.Warn("disconnecting worker submitting for a job it was never sent", zap.Error(err))
+		return err
+	}
+	ctx.Logger.Info(err.Error())
+	return ctx.ReplyUnknownJob(event.Id)
+}
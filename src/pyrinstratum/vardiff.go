@@ -0,0 +1,251 @@
+package pyrinstratum
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// VardiffMode selects how the vardiff controller retargets a worker's
+// difficulty
+type VardiffMode string
+
+const (
+	// VardiffSimple retargets straight to the difficulty matching the target
+	// share rate (bounded per step)
+	VardiffSimple VardiffMode = ""
+	// VardiffVariance derives the target share rate from the desired
+	// coefficient of variation of the shares per window, keeping payout
+	// variance predictable regardless of hashrate
+	VardiffVariance VardiffMode = "variance"
+	// VardiffPID steers towards the target share rate with a PID controller,
+	// converging more smoothly than the simple mode
+	VardiffPID VardiffMode = "pid"
+)
+
+func (m VardiffMode) Valid() bool {
+	switch m {
+	case VardiffSimple, VardiffVariance, VardiffPID:
+		return true
+	}
+	return false
+}
+
+const (
+	defaultSharesPerMin = 15
+	// shares older than this no longer count towards the estimated rate
+	vardiffWindow = 5 * time.Minute
+	// how often a worker's difficulty is evaluated, also the time needed
+	// after connecting before the first retarget
+	vardiffRetargetInterval = 30 * time.Second
+	// share rates off by less than this (relative) aren't worth a retarget
+	vardiffChangeThreshold = 0.25
+	// max factor the simple mode moves difficulty by in one retarget
+	vardiffMaxStep = 4
+	// bounds the per-worker share history
+	vardiffMaxShares = 1024
+	// consecutive retargets held back by the hard cap before warning, and
+	// how often to repeat the warning while it persists
+	vardiffCapWarnHits  = 3
+	vardiffCapWarnEvery = 20
+
+	// pid gains, the error is in log space so they're unit-less. The
+	// controller runs in velocity form (it outputs the change in difficulty)
+	// so the integral gain does most of the work and can't wind up
+	vardiffKp = 0.2
+	vardiffKi = 0.5
+	vardiffKd = 0.05
+)
+
+type vardiffConfig struct {
+	mode         VardiffMode
+	sharesPerMin float64
+	targetCV     float64
+	minDiff      float64
+	// 0 for no upper bound
+	maxDiff float64
+	// safety cap above any other bound, 0 for none
+	hardCap float64
+	// coalescing of difficulty changes, changes within minChangeInterval of
+	// the previous one or smaller than minChangeRatio (relative) are held
+	// back. 0 disables either
+	minChangeInterval time.Duration
+	minChangeRatio    float64
+	// minDiff and maxDiff overridden relative to the network difficulty
+	relative relativeDiff
+}
+
+// targetSharesPerMin returns the share rate the controller aims for. Share
+// counts per window are roughly poisson, so a coefficient of variation of cv
+// needs 1/cv^2 shares per window
+func (cfg vardiffConfig) targetSharesPerMin() float64 {
+	if cfg.mode == VardiffVariance && cfg.targetCV > 0 {
+		return 1 / (cfg.targetCV * cfg.targetCV) / vardiffWindow.Minutes()
+	}
+	return cfg.sharesPerMin
+}
+
+func (cfg vardiffConfig) clamp(diff float64) float64 {
+	minDiff, maxDiff := cfg.relative.bounds(cfg.minDiff, cfg.maxDiff)
+	if maxDiff > 0 && diff > maxDiff {
+		diff = maxDiff
+	}
+	if cfg.hardCap > 0 && diff > cfg.hardCap {
+		diff = cfg.hardCap
+	}
+	return math.Max(diff, minDiff)
+}
+
+type vardiffShare struct {
+	at   time.Time
+	diff float64
+}
+
+// vardiffDecision describes a retarget evaluation, logged for tuning
+type vardiffDecision struct {
+	evaluated   bool
+	changed     bool
+	observedSPM float64
+	targetSPM   float64
+	oldDiff     float64
+	newDiff     float64
+	// consecutive evaluations that wanted to go above the hard cap
+	capHits int
+	// a change was wanted but held back by the coalescing settings
+	suppressed bool
+	// shares were accepted within the window, observedSPM is measured
+	// rather than assumed
+	measured bool
+}
+
+// drift returns the ratio of the difficulty the worker's share rate implies,
+// the difficulty that would have it submit at the target rate, to the
+// difficulty it was at. 1 is on target, above 1 the worker is submitting
+// faster than targeted. False unless a measured rate was evaluated
+func (d vardiffDecision) drift() (float64, bool) {
+	if !d.evaluated || !d.measured {
+		return 0, false
+	}
+	return d.observedSPM / d.targetSPM, true
+}
+
+// capAnomaly returns true if the worker keeps asking for more difficulty than
+// the hard cap allows, likely a hashrate measurement glitch or a broken miner
+func (d vardiffDecision) capAnomaly() bool {
+	return d.capHits == vardiffCapWarnHits || (d.capHits > vardiffCapWarnHits && d.capHits%vardiffCapWarnEvery == 0)
+}
+
+// vardiff retargets a single worker's difficulty based on its accepted
+// shares. Shares are weighted by the difficulty they were found at, so the
+// estimated share rate stays correct across difficulty changes
+type vardiff struct {
+	lock           sync.Mutex
+	cfg            vardiffConfig
+	start          time.Time
+	lastEvaluation time.Time
+	shares         []vardiffShare
+	// errors of the previous two evaluations, for the pid mode
+	lastError float64
+	prevError float64
+	capHits   int
+	// when difficulty was last changed, zero until the first change
+	lastChange time.Time
+}
+
+func newVardiff(cfg vardiffConfig, now time.Time) *vardiff {
+	return &vardiff{
+		cfg:            cfg,
+		start:          now,
+		lastEvaluation: now,
+	}
+}
+
+func (vd *vardiff) addShare(at time.Time, diff float64) {
+	vd.lock.Lock()
+	defer vd.lock.Unlock()
+	if len(vd.shares) >= vardiffMaxShares {
+		vd.shares = vd.shares[1:]
+	}
+	vd.shares = append(vd.shares, vardiffShare{at: at, diff: diff})
+}
+
+// retarget evaluates the worker's share rate against the target and returns
+// the difficulty it should be at
+func (vd *vardiff) retarget(now time.Time, current float64) vardiffDecision {
+	vd.lock.Lock()
+	defer vd.lock.Unlock()
+	decision := vardiffDecision{
+		targetSPM: vd.cfg.targetSharesPerMin(),
+		oldDiff:   current,
+		newDiff:   current,
+	}
+	if now.Sub(vd.lastEvaluation) < vardiffRetargetInterval || current <= 0 || decision.targetSPM <= 0 {
+		return decision
+	}
+	decision.evaluated = true
+	vd.lastEvaluation = now
+
+	cutoff := now.Add(-vardiffWindow)
+	for len(vd.shares) > 0 && vd.shares[0].at.Before(cutoff) {
+		vd.shares = vd.shares[1:]
+	}
+	elapsed := now.Sub(vd.start)
+	if elapsed > vardiffWindow {
+		elapsed = vardiffWindow
+	}
+	work := 0.0
+	for _, share := range vd.shares {
+		work += share.diff
+	}
+	if len(vd.shares) == 0 {
+		// nothing found yet, assume a share was about to land so the rate
+		// is an upper bound and difficulty ramps down
+		work = current
+	}
+	decision.measured = len(vd.shares) > 0
+	decision.observedSPM = work / current / elapsed.Minutes()
+
+	ratio := decision.observedSPM / decision.targetSPM
+	var factor float64
+	switch vd.cfg.mode {
+	case VardiffPID:
+		err := math.Log(ratio)
+		step := vardiffKi*err + vardiffKp*(err-vd.lastError) + vardiffKd*(err-2*vd.lastError+vd.prevError)
+		vd.prevError, vd.lastError = vd.lastError, err
+		factor = math.Exp(step)
+	default:
+		factor = math.Max(1.0/vardiffMaxStep, math.Min(vardiffMaxStep, ratio))
+	}
+
+	next := vd.cfg.clamp(current * factor)
+	if vd.cfg.hardCap > 0 && current*factor > vd.cfg.hardCap && ratio-1 >= vardiffChangeThreshold {
+		vd.capHits++
+	} else {
+		vd.capHits = 0
+	}
+	decision.capHits = vd.capHits
+	outOfBounds := vd.cfg.clamp(current) != current
+	if !outOfBounds && (math.Abs(ratio-1) < vardiffChangeThreshold || next == current) {
+		return decision
+	}
+	if !outOfBounds && vd.coalesce(now, current, next) {
+		decision.suppressed = true
+		return decision
+	}
+	decision.newDiff = next
+	decision.changed = next != current
+	if decision.changed {
+		vd.lastChange = now
+	}
+	return decision
+}
+
+// coalesce returns true if a change from current to next should be held
+// back, too soon after the previous change or too small to be worth the
+// miner resetting its work. Changes forced by the bounds are never held back
+func (vd *vardiff) coalesce(now time.Time, current, next float64) bool {
+	if vd.cfg.minChangeInterval > 0 && !vd.lastChange.IsZero() && now.Sub(vd.lastChange) < vd.cfg.minChangeInterval {
+		return true
+	}
+	return vd.cfg.minChangeRatio > 0 && math.Abs(next/current-1) < vd.cfg.minChangeRatio
+}
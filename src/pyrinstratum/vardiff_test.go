@@ -0,0 +1,229 @@
+package pyrinstratum
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+	"go.uber.org/zap"
+)
+
+// simulateVardiff feeds the controller shares from a worker that finds
+// `hashrate` diff-1 shares per minute, returning the difficulty after
+// `duration`
+func simulateVardiff(cfg vardiffConfig, hashrate, diff float64, duration time.Duration) float64 {
+	start := time.Now()
+	vd := newVardiff(cfg, start)
+	pending := 0.0
+	for elapsed := time.Duration(0); elapsed < duration; elapsed += time.Second {
+		now := start.Add(elapsed)
+		pending += hashrate / 60 / diff
+		for ; pending >= 1; pending-- {
+			vd.addShare(now, diff)
+		}
+		if decision := vd.retarget(now, diff); decision.changed {
+			diff = decision.newDiff
+		}
+	}
+	return diff
+}
+
+func TestVardiffRetarget(t *testing.T) {
+	cfg := vardiffConfig{sharesPerMin: 15, minDiff: 1, maxDiff: 4096}
+
+	for _, mode := range []VardiffMode{VardiffSimple, VardiffPID} {
+		cfg.mode = mode
+		// 15 shares/min at diff 1000 needs 15000 diff-1 shares/min
+		if diff := simulateVardiff(cfg, 15000, 1, 10*time.Minute); math.Abs(diff/1000-1) > vardiffChangeThreshold {
+			t.Errorf("%s: expected ramp up to ~1000, got %f", mode, diff)
+		}
+		if diff := simulateVardiff(cfg, 15000, 100000, 10*time.Minute); math.Abs(diff/1000-1) > vardiffChangeThreshold {
+			t.Errorf("%s: expected ramp down to ~1000, got %f", mode, diff)
+		}
+		if diff := simulateVardiff(cfg, 1.5e6, 1, 10*time.Minute); diff != cfg.maxDiff {
+			t.Errorf("%s: expected clamp at max diff, got %f", mode, diff)
+		}
+		if diff := simulateVardiff(cfg, 0, 64, 10*time.Minute); diff != cfg.minDiff {
+			t.Errorf("%s: expected clamp at min diff, got %f", mode, diff)
+		}
+	}
+
+	t.Run("small changes are ignored", func(t *testing.T) {
+		start := time.Now()
+		vd := newVardiff(vardiffConfig{sharesPerMin: 15, minDiff: 1}, start)
+		for i := 0; i < 9; i++ {
+			vd.addShare(start.Add(time.Duration(i)*3*time.Second), 100)
+		}
+		// 9 shares in 30s is 18/min, within 25% of the target
+		decision := vd.retarget(start.Add(vardiffRetargetInterval), 100)
+		if !decision.evaluated || decision.changed {
+			t.Fatalf("expected evaluated without change, got %+v", decision)
+		}
+		if decision := vd.retarget(start.Add(vardiffRetargetInterval+time.Second), 100); decision.evaluated {
+			t.Fatalf("expected no evaluation before the retarget interval passed")
+		}
+	})
+
+	t.Run("hard cap", func(t *testing.T) {
+		cfg := vardiffConfig{sharesPerMin: 15, minDiff: 1, maxDiff: 1 << 20, hardCap: 512}
+		if diff := simulateVardiff(cfg, 1.5e6, 1, 10*time.Minute); diff != cfg.hardCap {
+			t.Fatalf("expected vardiff held at the hard cap, got %f", diff)
+		}
+
+		start := time.Now()
+		vd := newVardiff(cfg, start)
+		anomalies := 0
+		for i := 1; i <= 2*vardiffCapWarnEvery; i++ {
+			now := start.Add(time.Duration(i) * vardiffRetargetInterval)
+			for j := 0; j < 100; j++ {
+				vd.addShare(now, 512)
+			}
+			decision := vd.retarget(now, 512)
+			if decision.newDiff != 512 {
+				t.Fatalf("expected diff to stay at the cap, got %f", decision.newDiff)
+			}
+			if decision.capAnomaly() {
+				anomalies++
+			}
+		}
+		if anomalies != 3 {
+			t.Fatalf("expected the anomaly reported after %d hits and every %d after, got %d reports",
+				vardiffCapWarnHits, vardiffCapWarnEvery, anomalies)
+		}
+	})
+
+	t.Run("coalescing", func(t *testing.T) {
+		cfg := vardiffConfig{sharesPerMin: 15, minDiff: 1, minChangeInterval: 2 * time.Minute, minChangeRatio: 0.5}
+		start := time.Now()
+		vd := newVardiff(cfg, start)
+		retargetAt := func(i int, shares int, diff float64) vardiffDecision {
+			now := start.Add(time.Duration(i) * vardiffRetargetInterval)
+			for j := 0; j < shares; j++ {
+				vd.addShare(now, diff)
+			}
+			return vd.retarget(now, diff)
+		}
+		// 15 shares in 30s is twice the target rate
+		if decision := retargetAt(1, 15, 100); !decision.changed || decision.newDiff != 200 {
+			t.Fatalf("expected the first change to go through, got %+v", decision)
+		}
+		if decision := retargetAt(2, 60, 200); decision.changed || !decision.suppressed {
+			t.Fatalf("expected a change right after the previous one to be held back, got %+v", decision)
+		}
+		// 100 shares over the 5m window is a third above the target rate
+		vd.shares = nil
+		if decision := retargetAt(11, 100, 200); decision.changed || !decision.suppressed {
+			t.Fatalf("expected a change under the min change ratio to be held back, got %+v", decision)
+		}
+	})
+
+	t.Run("drift", func(t *testing.T) {
+		start := time.Now()
+		vd := newVardiff(vardiffConfig{sharesPerMin: 15, minDiff: 1, minChangeRatio: 0.5}, start)
+		if _, ok := vd.retarget(start.Add(vardiffRetargetInterval), 100).drift(); ok {
+			t.Fatalf("expected no drift before the worker's first share")
+		}
+		// 20 shares/min against 15, held back by the min change ratio
+		for i := 0; i < 100; i++ {
+			vd.addShare(start.Add(vardiffWindow), 100)
+		}
+		decision := vd.retarget(start.Add(vardiffWindow), 100)
+		if drift, ok := decision.drift(); !ok || !decision.suppressed || math.Abs(drift-4.0/3) > 1e-9 {
+			t.Fatalf("expected the worker a third above its difficulty, got %f (%t) %+v", drift, ok, decision)
+		}
+		if _, ok := vd.retarget(start.Add(vardiffWindow+time.Second), 100).drift(); ok {
+			t.Fatalf("expected no drift without an evaluation")
+		}
+	})
+
+	t.Run("variance target", func(t *testing.T) {
+		cfg := vardiffConfig{mode: VardiffVariance, sharesPerMin: 15, targetCV: 0.1}
+		// cv 0.1 needs 100 shares per 5m window
+		if spm := cfg.targetSharesPerMin(); math.Abs(spm-20) > 1e-9 {
+			t.Fatalf("expected 20 shares/min for cv 0.1, got %f", spm)
+		}
+	})
+}
+
+func TestRelativeDiff(t *testing.T) {
+	defer currentNetworkDiff.Store(0)
+	currentNetworkDiff.Store(0)
+	relative := relativeDiff{minFraction: 0.001, maxFraction: 0.01}
+	if minDiff, maxDiff := relative.bounds(4, 0); minDiff != 4 || maxDiff != 0 {
+		t.Fatalf("expected the absolute bounds until the network difficulty is known, got %f %f", minDiff, maxDiff)
+	}
+
+	setNetworkDifficulty(1e15)
+	// a share at the network share difficulty is worth a block
+	if blocks := shareExpectedBlocks(DiffToHash(networkShareDiff(1e15)), 1e15); math.Abs(blocks-1) > 1e-9 {
+		t.Fatalf("expected a network difficulty share to be worth a block, got %f", blocks)
+	}
+	minDiff, maxDiff := relative.bounds(4, 0)
+	if math.Abs(minDiff/networkShareDiff(1e15)-0.001) > 1e-12 || math.Abs(maxDiff/minDiff-10) > 1e-9 {
+		t.Fatalf("expected bounds at 1/1000 and 1/100 of the network, got %f %f", minDiff, maxDiff)
+	}
+	cfg := vardiffConfig{minDiff: 4, relative: relative}
+	if clamped := cfg.clamp(1); clamped != minDiff {
+		t.Fatalf("expected vardiff clamped to the relative min, got %f", clamped)
+	}
+	if clamped := cfg.clamp(math.MaxFloat64); clamped != maxDiff {
+		t.Fatalf("expected vardiff clamped to the relative max, got %f", clamped)
+	}
+
+	// clients at the min difficulty follow the network
+	listener := newClientListener(zap.NewNop().Sugar(), nil, 4, 0, 0, 0, 0, 0, nil, nil)
+	listener.relativeDiff = relativeDiff{minFraction: 0.001}
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	state := GetMiningState(ctx)
+	state.stratumDiff = newPyrinDiff()
+	state.setDiff(listener.startingDiff(state), listener.startingDiffSource(state))
+	sent := make(chan string, 1)
+	setNetworkDifficulty(1.02e15)
+	if err := listener.followNetworkDiff(ctx, state); err != nil || state.stratumDiff.diffValue != minDiff {
+		t.Fatalf("expected a small network move ignored, got %f (%v)", state.stratumDiff.diffValue, err)
+	}
+	setNetworkDifficulty(2e15)
+	mc.AsyncReadTestDataFromBuffer(func(b []byte) { sent <- string(b) })
+	if err := listener.followNetworkDiff(ctx, state); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-sent; !strings.Contains(msg, "mining.set_difficulty") || math.Abs(state.stratumDiff.diffValue/minDiff-2) > 1e-9 {
+		t.Fatalf("expected the client sent twice the difficulty, got %f (%s)", state.stratumDiff.diffValue, msg)
+	}
+}
+
+func TestNetworkDiffNotice(t *testing.T) {
+	listener := newClientListener(zap.NewNop().Sugar(), nil, 4, 0, 0, 0, 0, 0, nil, nil)
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	state := GetMiningState(ctx)
+	messages := readAll(mc)
+	none := func(when string) {
+		select {
+		case msg := <-messages:
+			t.Fatalf("expected no message %s, got %s", when, msg)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	setNetworkDifficulty(1e15)
+	listener.noticeNetworkDiff(ctx, state)
+	none("unless enabled")
+
+	listener.networkDiffNotice = true
+	listener.noticeNetworkDiff(ctx, state)
+	if msg := <-messages; !strings.Contains(msg, "client.show_message") || !strings.Contains(msg, "network difficulty 1e+15") {
+		t.Fatalf("expected the network difficulty sent, got %s", msg)
+	}
+	setNetworkDifficulty(1.02e15)
+	listener.noticeNetworkDiff(ctx, state)
+	none("for a small network move")
+
+	setNetworkDifficulty(2e15)
+	listener.noticeNetworkDiff(ctx, state)
+	if msg := <-messages; !strings.Contains(msg, "network difficulty 2e+15") {
+		t.Fatalf("expected the new network difficulty sent, got %s", msg)
+	}
+}
@@ -0,0 +1,58 @@
+package pyrinstratum
+
+import (
+	"fmt"
+
+	"github.com/pyrin-network/pyipad/util"
+	"github.com/pkg/errors"
+)
+
+var ErrWalletNotAllowed = fmt.Errorf("wallet not allowed on this bridge")
+
+// walletAccess restricts which payout addresses may authorize, for private
+// and solo bridges with an exposed port. Denied addresses are always turned
+// away, and when allowed is non-empty so is every address not in it. The
+// zero value lets everyone in
+type walletAccess struct {
+	allowed map[string]struct{}
+	denied  map[string]struct{}
+}
+
+func newWalletAccess(allowed, denied []string) walletAccess {
+	toSet := func(addresses []string) map[string]struct{} {
+		if len(addresses) == 0 {
+			return nil
+		}
+		set := make(map[string]struct{}, len(addresses))
+		for _, address := range addresses {
+			set[address] = struct{}{}
+		}
+		return set
+	}
+	return walletAccess{allowed: toSet(allowed), denied: toSet(denied)}
+}
+
+// rejects returns which list turned the wallet away, "" if it's let in
+func (w walletAccess) rejects(wallet string) string {
+	if _, denied := w.denied[wallet]; denied {
+		return "denylist"
+	}
+	if _, allowed := w.allowed[wallet]; w.allowed != nil && !allowed {
+		return "allowlist"
+	}
+	return ""
+}
+
+func (w walletAccess) enabled() bool {
+	return w.allowed != nil || w.denied != nil
+}
+
+// validateListedWallet checks an allowed/denied address in the config the
+// same way as payout addresses, miners authorize with the cleaned up form so
+// a listed address has to be complete to ever match
+func validateListedWallet(setting, address string) error {
+	if _, err := util.DecodeAddress(address, util.Bech32PrefixUnknown); err != nil {
+		return errors.Wrapf(err, "invalid %s address %s", setting, address)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package pyrinstratum
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/pyrin-network/pyrin-stratum-bridge/src/gostratum"
+)
+
+// how often workers past the ttl are looked for
+const workerMetricSweepInterval = time.Minute
+
+// workerMetricPolicy bounds the cardinality of the per worker series on big
+// pools. Workers are only published once they've had minShares shares
+// accepted (keeping out scanners and connections that never mine), the
+// shares before that are added when they are. Workers that haven't been
+// seen (sent a job or submitted) for the ttl have their series dropped.
+// Both 0 publish every worker for as long as the process runs
+type workerMetricPolicy struct {
+	lock      sync.Mutex
+	minShares int64
+	ttl       time.Duration
+	workers   map[string]*workerSeries
+}
+
+// workerSeries is a worker's accounting while the policy is enabled
+type workerSeries struct {
+	labels    prometheus.Labels
+	published bool
+	lastSeen  time.Time
+	// accepted before publishing
+	shares    int64
+	shareDiff float64
+	// found a block, its block series outlive the ttl
+	foundBlock bool
+}
+
+var workerMetrics = &workerMetricPolicy{workers: map[string]*workerSeries{}}
+
+func setWorkerMetricPolicy(minShares int64, ttl time.Duration) {
+	workerMetrics.lock.Lock()
+	defer workerMetrics.lock.Unlock()
+	workerMetrics.minShares, workerMetrics.ttl = minShares, ttl
+}
+
+func (p *workerMetricPolicy) enabledLocked() bool {
+	return p.minShares > 0 || p.ttl > 0
+}
+
+// seriesLocked returns the worker's accounting, creating it if it's new
+func (p *workerMetricPolicy) seriesLocked(labels prometheus.Labels, now time.Time) *workerSeries {
+	key := strings.Join([]string{labels["worker"], labels["miner"], labels["wallet"], labels["ip"]}, "\x00")
+	series, exists := p.workers[key]
+	if !exists {
+		// a copy, callers extend theirs for the series with more labels
+		series = &workerSeries{labels: copyLabels(labels), published: p.minShares <= 0}
+		p.workers[key] = series
+	}
+	series.lastSeen = now
+	return series
+}
+
+// workerSeriesLabels returns the worker's labels, false if its series
+// aren't published (yet)
+func workerSeriesLabels(worker *gostratum.StratumContext) (prometheus.Labels, bool) {
+	labels := commonLabels(worker)
+	p := workerMetrics
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.enabledLocked() {
+		return labels, true
+	}
+	return labels, p.seriesLocked(labels, time.Now()).published
+}
+
+// workerShare counts an accepted share, returning the shares and difficulty
+// to add to the worker's series: the share itself, or every share so far on
+// the one that gets the worker published. False while it isn't published
+func workerShare(worker *gostratum.StratumContext, shareDiff float64) (prometheus.Labels, int64, float64, bool) {
+	labels := commonLabels(worker)
+	p := workerMetrics
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.enabledLocked() {
+		return labels, 1, shareDiff, true
+	}
+	series := p.seriesLocked(labels, time.Now())
+	if series.published {
+		return labels, 1, shareDiff, true
+	}
+	series.shares++
+	series.shareDiff += shareDiff
+	if series.shares < p.minShares {
+		return labels, 0, 0, false
+	}
+	shares, diff := series.shares, series.shareDiff
+	series.published, series.shares, series.shareDiff = true, 0, 0
+	initWorkerSeries(labels)
+	return labels, shares, diff, true
+}
+
+// publishWorker publishes the worker whatever its share count, e.g. for a
+// block it found (foundBlock)
+func publishWorker(worker *gostratum.StratumContext, foundBlock bool) prometheus.Labels {
+	labels := commonLabels(worker)
+	p := workerMetrics
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.enabledLocked() {
+		return labels
+	}
+	series := p.seriesLocked(labels, time.Now())
+	series.foundBlock = series.foundBlock || foundBlock
+	if !series.published {
+		series.published = true
+		initWorkerSeries(labels)
+		shareCounter.With(labels).Add(float64(series.shares))
+		shareDiffCounter.With(labels).Add(series.shareDiff)
+		series.shares, series.shareDiff = 0, 0
+	}
+	return labels
+}
+
+// sweep drops the series of workers not seen for the ttl. Without a ttl
+// only the accounting of workers that never got published is dropped, after
+// the usual retention
+func (p *workerMetricPolicy) sweep(now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for key, series := range p.workers {
+		expiry := p.ttl
+		if expiry <= 0 {
+			if series.published {
+				continue
+			}
+			expiry = workerMetricRetention
+		}
+		if now.Sub(series.lastSeen) < expiry {
+			continue
+		}
+		if series.published {
+			deleteWorkerSeries(series.labels, series.foundBlock)
+		}
+		delete(p.workers, key)
+	}
+}
+
+// startWorkerMetricSweeper sweeps until ctx is cancelled, if the policy is
+// enabled
+func startWorkerMetricSweeper(ctx context.Context) {
+	workerMetrics.lock.Lock()
+	enabled := workerMetrics.enabledLocked()
+	workerMetrics.lock.Unlock()
+	if !enabled {
+		return
+	}
+	ticker := time.NewTicker(workerMetricSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			workerMetrics.sweep(now)
+		}
+	}
+}